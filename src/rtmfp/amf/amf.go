@@ -0,0 +1,191 @@
+//Package amf encode and decode AMF0, the serialization format of Flash NetConnection
+//and NetStream messages, with AMF3 values after the avmplus marker, see package amf3.
+//
+//Decoded AMF0 values are:
+//
+//	number                float64
+//	boolean               bool
+//	string, long string   string
+//	null                  nil
+//	undefined             Undefined{}
+//	unsupported           Unsupported{}
+//	XML document          XMLDocument
+//	date                  time.Time in UTC
+//	object                map[string]interface{}
+//	typed object          *TypedObject
+//	ECMA array            ECMAArray
+//	strict array          []interface{}
+//	avmplus               the AMF3 value, see package amf3
+//
+//Marshal and Unmarshal convert Go values to and from them, as encoding/json does, and
+//the Decoder and Encoder do so on a stream of values, e.g. the arguments of a command.
+package amf
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"rtmfp/amf3"
+)
+
+//AMF0 type markers
+const (
+	amf0_number       = 0x00
+	amf0_boolean      = 0x01
+	amf0_string       = 0x02
+	amf0_object       = 0x03
+	amf0_movieclip    = 0x04 //reserved
+	amf0_null         = 0x05
+	amf0_undefined    = 0x06
+	amf0_reference    = 0x07
+	amf0_ecma_array   = 0x08
+	amf0_object_end   = 0x09
+	amf0_strict_array = 0x0a
+	amf0_date         = 0x0b
+	amf0_long_string  = 0x0c
+	amf0_unsupported  = 0x0d
+	amf0_recordset    = 0x0e //reserved
+	amf0_xml_document = 0x0f
+	amf0_typed_object = 0x10
+	amf0_avmplus      = 0x11 //switch to AMF3
+)
+
+//nested objects and arrays deeper than it are rejected.
+var MaxDepth = 64
+
+var ErrUnexpectedEOF = errors.New("amf: unexpected end of data.")
+var ErrTooDeep = errors.New("amf: nested too deep.")
+
+//values without a Go counterpart.
+type Undefined struct{}
+type Unsupported struct{}
+type XMLDocument string
+
+//NetConnection.objectEncoding, the format of the values.
+type ObjectEncoding uint8
+
+const (
+	AMF0 ObjectEncoding = 0
+	AMF3 ObjectEncoding = 3
+)
+
+//one property of an object, in the order it is encoded.
+type Property struct {
+	Key   string
+	Value interface{}
+}
+
+//anonymous object keeping the order of its properties, a map[string]interface{} is
+//encoded in the sorted order of its keys.
+type Object []Property
+
+func (self Object) Get(key string) (interface{}, bool) {
+	for _, p := range self {
+		if p.Key == key {
+			return p.Value, true
+		}
+	}
+	return nil, false
+}
+
+//associative array, e.g. onMetaData, in the order of its properties.
+type ECMAArray Object
+
+//object of a registered class.
+type TypedObject struct {
+	ClassName  string
+	Properties Object
+}
+
+//AMF0 encoding of v.
+//
+//Structs are encoded as objects of their exported fields, in the order of the fields,
+//or as typed objects if registered with RegisterClass(). The `amf:"name,omitempty"`
+//tag of a field give its name, and omit it if it is empty. a field tagged "-" is
+//ignored, and the fields of an embedded struct are promoted as in encoding/json.
+//
+//Maps with string keys are encoded as objects, slices and arrays as strict arrays,
+//except []byte which is an AMF3 ByteArray, and time.Time as a date. the values of
+//package amf and amf3 are encoded as they are. maps, slices and pointers encoded
+//again are encoded as references.
+func Marshal(v interface{}) ([]byte, error) {
+	w := bytes.NewBuffer(nil)
+	if err := NewEncoder(w).Encode(v); err != nil {
+		return nil, err
+	}
+	return w.Bytes(), nil
+}
+
+//AMF3 encoding of v, as Marshal() does. structs of registered classes have their
+//fields as sealed members, other structs are anonymous dynamic objects.
+func MarshalAMF3(v interface{}) ([]byte, error) {
+
+	val, err := (&marshaler{amf3: true}).marshal(reflect.ValueOf(v))
+	if err != nil {
+		return nil, err
+	}
+
+	w := bytes.NewBuffer(nil)
+	if err := amf3.NewEncoder(w).Encode(val); err != nil {
+		return nil, err
+	}
+	return w.Bytes(), nil
+}
+
+//decode one AMF0 value into the value pointed to by v.
+//
+//Objects are decoded into structs, matching the field names of Marshal(), or case
+//insensitively, and into maps with string keys. numbers are decoded into any numeric
+//type they fit in. an object of a class registered with RegisterClass() is decoded
+//into a pointer to its struct if v point to an interface{}, and null or undefined set
+//the zero value.
+func Unmarshal(data []byte, v interface{}) error {
+
+	r := bytes.NewReader(data)
+	if err := NewDecoder(r).Decode(v); err != nil {
+		if err == io.EOF {
+			return ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	if r.Len() > 0 {
+		return errors.New("amf: data after the value.")
+	}
+
+	return nil
+}
+
+//decode one AMF3 value into the value pointed to by v, as Unmarshal() does.
+func UnmarshalAMF3(data []byte, v interface{}) error {
+
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errors.New("amf: Unmarshal need a non-nil pointer.")
+	}
+
+	r := bytes.NewReader(data)
+	val, err := amf3.NewDecoder(r).Decode()
+	if err != nil {
+		return err
+	}
+
+	if r.Len() > 0 {
+		return errors.New("amf: data after the value.")
+	}
+
+	return (&unmarshaler{}).unmarshal(rv.Elem(), val)
+}
+
+//store a decoded value, e.g. an element of an []interface{} decoded before, in the
+//value pointed to by v, as Unmarshal() does.
+func Convert(val interface{}, v interface{}) error {
+
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errors.New("amf: Convert need a non-nil pointer.")
+	}
+
+	return (&unmarshaler{}).unmarshal(rv.Elem(), val)
+}
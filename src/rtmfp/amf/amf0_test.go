@@ -0,0 +1,352 @@
+package amf
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+//hex bytes, "#" comments to the end of the line.
+func load_hex_golden(t *testing.T, path string) []byte {
+
+	text, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var digits []string
+	for _, line := range strings.Split(string(text), "\n") {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		digits = append(digits, strings.Fields(line)...)
+	}
+
+	data, err := hex.DecodeString(strings.Join(digits, ""))
+	if err != nil {
+		t.Fatal(path, err)
+	}
+
+	return data
+}
+
+//connect.hex is captured from Flash Player, the others are written by hand.
+func TestGolden(t *testing.T) {
+
+	status := Object{{"level", "status"}, {"code", "NetStream.Play.Start"}}
+
+	cases := []struct {
+		file    string
+		values  []interface{} //encoded to the golden bytes
+		decoded []interface{} //decoded from the golden bytes
+	}{
+		{
+			file: "connect.hex",
+			values: []interface{}{"connect", 1.0, Object{
+				{"app", ""},
+				{"flashVer", "WIN 11,7,700,202"},
+				{"swfUrl", Undefined{}},
+				{"tcUrl", "rtmfp://192.168.137.183/"},
+				{"fpad", false},
+				{"capabilities", 235.0},
+				{"audioCodecs", 3575.0},
+				{"videoCodecs", 252.0},
+				{"videoFunction", 1.0},
+				{"pageUrl", Undefined{}},
+				{"objectEncoding", 3.0},
+			}},
+			decoded: []interface{}{"connect", 1.0, map[string]interface{}{
+				"app":            "",
+				"flashVer":       "WIN 11,7,700,202",
+				"swfUrl":         Undefined{},
+				"tcUrl":          "rtmfp://192.168.137.183/",
+				"fpad":           false,
+				"capabilities":   235.0,
+				"audioCodecs":    3575.0,
+				"videoCodecs":    252.0,
+				"videoFunction":  1.0,
+				"pageUrl":        Undefined{},
+				"objectEncoding": 3.0,
+			}},
+		},
+		{
+			file: "onmetadata.hex",
+			values: []interface{}{"onMetaData", ECMAArray{
+				{"duration", 60.04},
+				{"width", 640.0},
+				{"height", 360.0},
+				{"videodatarate", 700.0},
+				{"framerate", 25.0},
+				{"videocodecid", 7.0},
+				{"audiodatarate", 128.0},
+				{"audiosamplerate", 44100.0},
+				{"audiosamplesize", 16.0},
+				{"stereo", true},
+				{"audiocodecid", 10.0},
+				{"encoder", "Lavf58.29.100"},
+				{"filesize", 5432100.0},
+			}},
+		},
+		{
+			file:   "result.hex",
+			values: []interface{}{"_result", 2.0, nil, []interface{}{status, status}},
+			decoded: []interface{}{"_result", 2.0, nil, []interface{}{
+				map[string]interface{}{"level": "status", "code": "NetStream.Play.Start"},
+				map[string]interface{}{"level": "status", "code": "NetStream.Play.Start"},
+			}},
+		},
+		{
+			file: "types.hex",
+			values: []interface{}{
+				Undefined{},
+				Unsupported{},
+				time.Date(2009, 2, 13, 23, 31, 30, 500*int(time.Millisecond), time.UTC),
+				XMLDocument(`<root><item id="1"/></root>`),
+				&TypedObject{ClassName: "flash.geom.Point", Properties: Object{{"x", 1.5}, {"y", -2.0}}},
+				[]interface{}{},
+			},
+		},
+	}
+
+	for _, c := range cases {
+
+		golden := load_hex_golden(t, "testdata/amf0/"+c.file)
+
+		buf := bytes.NewBuffer(nil)
+		e := NewEncoder(buf)
+		for _, v := range c.values {
+			if err := e.Encode(v); err != nil {
+				t.Fatal(c.file, err)
+			}
+		}
+
+		if !bytes.Equal(buf.Bytes(), golden) {
+			t.Fatalf("%s: encoding not match.\n%s\n%s", c.file, hex.Dump(buf.Bytes()), hex.Dump(golden))
+		}
+
+		decoded := c.decoded
+		if decoded == nil {
+			decoded = c.values
+		}
+
+		r := bytes.NewBuffer(golden)
+		d := NewDecoder(r)
+		for i, expect := range decoded {
+			var v interface{}
+			if err := d.Decode(&v); err != nil {
+				t.Fatal(c.file, i, err)
+			}
+			if !reflect.DeepEqual(v, expect) {
+				t.Fatalf("%s: value %d not match.\n%#v\n%#v", c.file, i, v, expect)
+			}
+		}
+
+		if r.Len() != 0 {
+			t.Fatal(c.file, "bytes left.", r.Len())
+		}
+
+		if err := d.Decode(new(interface{})); err != io.EOF {
+			t.Fatal(c.file, "no EOF after the values.", err)
+		}
+
+		//every truncation inside a value is an error, never a panic.
+		boundaries := map[int]bool{0: true}
+		r = bytes.NewBuffer(golden)
+		d = NewDecoder(r)
+		for range decoded {
+			d.Decode(new(interface{}))
+			boundaries[len(golden)-r.Len()] = true
+		}
+
+		for n := 1; n < len(golden); n++ {
+			var err error
+			for d := NewDecoder(bytes.NewReader(golden[:n])); err == nil; {
+				err = d.Decode(new(interface{}))
+			}
+			if err == io.EOF && !boundaries[n] {
+				t.Fatal(c.file, "truncated at", n, "decoded.")
+			}
+		}
+	}
+}
+
+func TestReferences(t *testing.T) {
+
+	//the same map and array twice.
+	obj := map[string]interface{}{"a": 1.0}
+	inner := []interface{}{obj}
+	v := []interface{}{obj, inner, obj, inner}
+
+	buf := bytes.NewBuffer(nil)
+	if err := NewEncoder(buf).Encode(v); err != nil {
+		t.Fatal(err)
+	}
+
+	//array 0, obj 1, inner 2
+	if !bytes.Contains(buf.Bytes(), []byte{0x07, 0x00, 0x01, 0x07, 0x00, 0x02}) {
+		t.Fatal("references not written.", hex.Dump(buf.Bytes()))
+	}
+
+	var decoded []interface{}
+	if err := Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, v) {
+		t.Fatalf("not match.\n%#v\n%#v", decoded, v)
+	}
+
+	//the reference table last across the values of a stream, until Reset().
+	buf.Reset()
+	e := NewEncoder(buf)
+	e.Encode(obj)
+	e.Encode(obj)
+	e.Reset()
+	e.Encode(obj)
+	one := []byte{0x03, 0x00, 0x01, 'a', 0x00, 0x3f, 0xf0, 0, 0, 0, 0, 0, 0, 0x00, 0x00, 0x09}
+	expect := append(append(append([]byte{}, one...), 0x07, 0x00, 0x00), one...)
+	if !bytes.Equal(buf.Bytes(), expect) {
+		t.Fatal("unexpected encoding.", hex.Dump(buf.Bytes()))
+	}
+
+	d := NewDecoder(buf)
+	var a, b interface{}
+	var c map[string]interface{}
+	if err := d.Decode(&a); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Decode(&b); err != nil {
+		t.Fatal(err)
+	}
+	b.(map[string]interface{})["b"] = 2.0
+	if len(a.(map[string]interface{})) != 2 {
+		t.Fatal("reference decoded as a copy.")
+	}
+	d.Reset()
+	if err := d.Decode(&c); err != nil || !reflect.DeepEqual(c, obj) {
+		t.Fatal("not match.", c, err)
+	}
+
+	//out of range
+	if err := Unmarshal([]byte{0x0a, 0, 0, 0, 1, 0x07, 0x00, 0x01}, new(interface{})); err == nil {
+		t.Fatal("invalid reference decoded.")
+	}
+
+	//a cycle is kept.
+	cycle := []byte{0x03, 0x00, 0x04, 's', 'e', 'l', 'f', 0x07, 0x00, 0x00, 0x00, 0x00, 0x09}
+	var m interface{}
+	if err := Unmarshal(cycle, &m); err != nil {
+		t.Fatal(err)
+	}
+	if reflect.ValueOf(m.(map[string]interface{})["self"]).Pointer() != reflect.ValueOf(m).Pointer() {
+		t.Fatal("cycle not kept.")
+	}
+}
+
+func TestErrors(t *testing.T) {
+
+	invalid := [][]byte{
+		{},
+		{0x04},                         //movieclip
+		{0x0e},                         //recordset
+		{0x12},                         //unknown
+		{0x02, 0x00, 0x05, 'a'},        //short string
+		{0x03, 0x00, 0x01, 'a', 0x05},  //object without end
+		{0x03, 0x00, 0x00, 0x05},       //wrong end marker
+		{0x0a, 0xff, 0xff, 0xff, 0xff}, //huge strict array
+		{0x0c, 0xff, 0xff, 0xff, 0xff}, //huge long string
+		{0x11, 0x0c, 0x15, 0x01},       //short amf3 byte array
+	}
+
+	for _, data := range invalid {
+		if err := Unmarshal(data, new(interface{})); err == nil {
+			t.Fatal("decoded invalid data.", data)
+		}
+	}
+
+	//too deep
+	deep := bytes.NewBuffer(nil)
+	for i := 0; i < MaxDepth+1; i++ {
+		deep.Write([]byte{0x0a, 0, 0, 0, 1})
+	}
+	deep.WriteByte(0x05)
+
+	if err := Unmarshal(deep.Bytes(), new(interface{})); err != ErrTooDeep {
+		t.Fatal("nested too deep decoded.", err)
+	}
+
+	//unsupported Go type
+	if _, err := Marshal(make(chan int)); err == nil {
+		t.Fatal("unsupported type encoded.")
+	}
+
+	if _, err := Marshal(map[string]interface{}{"": 1.0}); err == nil {
+		t.Fatal("empty key encoded.")
+	}
+}
+
+func TestLongString(t *testing.T) {
+
+	long := strings.Repeat("x", 70000)
+
+	data, _ := Marshal(map[string]interface{}{"b": long, "a": "short"})
+
+	//keys sorted, the long string use the long string marker.
+	if !bytes.HasPrefix(data, []byte{0x03, 0x00, 0x01, 'a', 0x02, 0x00, 0x05}) ||
+		!bytes.Contains(data, []byte{0x00, 0x01, 'b', 0x0c, 0x00, 0x01, 0x11, 0x70}) {
+		t.Fatal("unexpected encoding.")
+	}
+
+	var v map[string]string
+	if err := Unmarshal(data, &v); err != nil || v["b"] != long {
+		t.Fatal("long string not match.", err)
+	}
+}
+
+func TestStream(t *testing.T) {
+
+	obj := map[string]interface{}{"level": "status", "code": "NetConnection.Connect.Success"}
+
+	buf := bytes.NewBuffer(nil)
+	e := NewEncoder(buf)
+	e.Encode("_result")
+	e.Encode(1)
+	e.Encode(nil)
+	e.SetObjectEncoding(AMF3)
+	e.Encode(obj)
+	e.Encode([]int{1, 2})
+
+	if !bytes.Contains(buf.Bytes(), []byte{0x05, 0x11, 0x0a, 0x0b, 0x01}) {
+		t.Fatal("not an AMF3 object after an avmplus marker.", hex.Dump(buf.Bytes()))
+	}
+
+	//a reader which is not an io.ByteReader, the decoder read no more than it need.
+	d := NewDecoder(iotest.OneByteReader(bytes.NewReader(buf.Bytes())))
+
+	var cmd string
+	var id int
+	var null, info, arr interface{}
+	for _, v := range []interface{}{&cmd, &id, &null, &info, &arr} {
+		if err := d.Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if cmd != "_result" || id != 1 || null != nil || !reflect.DeepEqual(info, obj) ||
+		!reflect.DeepEqual(arr, []interface{}{1, 2}) {
+		t.Fatal("not match.", cmd, id, null, info, arr)
+	}
+
+	if err := d.Decode(&null); err != io.EOF {
+		t.Fatal("no EOF at the end.", err)
+	}
+
+	if err := d.Decode(nil); err == nil {
+		t.Fatal("decoded into nil.")
+	}
+}
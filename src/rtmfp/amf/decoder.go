@@ -0,0 +1,314 @@
+package amf
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"rtmfp/amf3"
+	"time"
+)
+
+//Decoder read AMF0 values from a stream, and the AMF3 values of avmplus markers. the
+//reference table last across values until Reset(), as in one message.
+type Decoder struct {
+	r      io.Reader
+	byte_r io.ByteReader
+
+	refs  []interface{} //objects, typed objects, ecma and strict arrays in the order read
+	depth int
+}
+
+//the decoder read no more than the values from r if it is an io.ByteReader,
+//e.g. a *bytes.Buffer, so that other data may follow them.
+func NewDecoder(r io.Reader) *Decoder {
+	d := &Decoder{r: r}
+	d.byte_r, _ = r.(io.ByteReader)
+	return d
+}
+
+//clear the reference table.
+func (self *Decoder) Reset() {
+	self.refs = nil
+}
+
+//read one value into the value pointed to by v, as Unmarshal() does. return io.EOF
+//if the stream end before the value.
+func (self *Decoder) Decode(v interface{}) error {
+
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errors.New("amf: Decode need a non-nil pointer.")
+	}
+
+	marker, err := self.read_u8()
+	if err == ErrUnexpectedEOF {
+		return io.EOF
+	}
+	if err != nil {
+		return err
+	}
+
+	val, err := self.read_value_of(marker)
+	if err != nil {
+		return err
+	}
+
+	return (&unmarshaler{}).unmarshal(rv.Elem(), val)
+}
+
+func (self *Decoder) read_full(n int) ([]byte, error) {
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(self.r, buf); err != nil {
+		return nil, eof(err)
+	}
+	return buf, nil
+}
+
+func eof(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (self *Decoder) read_u8() (uint8, error) {
+	if self.byte_r != nil {
+		v, err := self.byte_r.ReadByte()
+		return v, eof(err)
+	}
+
+	buf, err := self.read_full(1)
+	if err != nil {
+		return 0, err
+	}
+	return buf[0], nil
+}
+
+func (self *Decoder) read_u16() (uint16, error) {
+	buf, err := self.read_full(2)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint16(buf), nil
+}
+
+func (self *Decoder) read_u32() (uint32, error) {
+	buf, err := self.read_full(4)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(buf), nil
+}
+
+func (self *Decoder) read_number() (float64, error) {
+	buf, err := self.read_full(8)
+	if err != nil {
+		return 0, err
+	}
+	return math.Float64frombits(binary.BigEndian.Uint64(buf)), nil
+}
+
+//read n bytes, in chunks so that a forged length fail at the end of data.
+func (self *Decoder) read_bytes(n uint32) ([]byte, error) {
+	buf := make([]byte, 0, alloc_len(n))
+	for uint32(len(buf)) < n {
+		chunk := n - uint32(len(buf))
+		if chunk > 64*1024 {
+			chunk = 64 * 1024
+		}
+		data, err := self.read_full(int(chunk))
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, data...)
+	}
+	return buf, nil
+}
+
+//a length read from the data, bounded so that a forged one can not allocate more
+//than the data may hold.
+func alloc_len(n uint32) int {
+	if n > 1024 {
+		return 1024
+	}
+	return int(n)
+}
+
+func (self *Decoder) read_string() (string, error) {
+	n, err := self.read_u16()
+	if err != nil {
+		return "", err
+	}
+	data, err := self.read_bytes(uint32(n))
+	return string(data), err
+}
+
+func (self *Decoder) read_long_string() (string, error) {
+	n, err := self.read_u32()
+	if err != nil {
+		return "", err
+	}
+	data, err := self.read_bytes(n)
+	return string(data), err
+}
+
+//reserve a slot in the reference table, filled once the value is complete.
+func (self *Decoder) add_ref(v interface{}) int {
+	self.refs = append(self.refs, v)
+	return len(self.refs) - 1
+}
+
+func (self *Decoder) read_value() (interface{}, error) {
+
+	marker, err := self.read_u8()
+	if err != nil {
+		return nil, err
+	}
+
+	return self.read_value_of(marker)
+}
+
+func (self *Decoder) read_value_of(marker uint8) (interface{}, error) {
+
+	switch marker {
+	case amf0_number:
+		return self.read_number()
+	case amf0_boolean:
+		v, err := self.read_u8()
+		return v != 0, err
+	case amf0_string:
+		return self.read_string()
+	case amf0_long_string:
+		return self.read_long_string()
+	case amf0_null:
+		return nil, nil
+	case amf0_undefined:
+		return Undefined{}, nil
+	case amf0_unsupported:
+		return Unsupported{}, nil
+	case amf0_xml_document:
+		v, err := self.read_long_string()
+		return XMLDocument(v), err
+	case amf0_date:
+		return self.read_date()
+	case amf0_reference:
+		index, err := self.read_u16()
+		if err != nil {
+			return nil, err
+		}
+		if int(index) >= len(self.refs) {
+			return nil, fmt.Errorf("amf: reference %d out of range.", index)
+		}
+		return self.refs[index], nil
+	case amf0_avmplus:
+		//the AMF3 value, with its own reference tables.
+		return amf3.NewDecoder(self.r).Decode()
+	}
+
+	//complex values
+	if self.depth >= MaxDepth {
+		return nil, ErrTooDeep
+	}
+	self.depth++
+	defer func() { self.depth-- }()
+
+	switch marker {
+	case amf0_object:
+		obj := make(map[string]interface{})
+		self.add_ref(obj)
+		err := self.read_properties(func(key string, value interface{}) { obj[key] = value })
+		return obj, err
+
+	case amf0_typed_object:
+		class_name, err := self.read_string()
+		if err != nil {
+			return nil, err
+		}
+		obj := &TypedObject{ClassName: class_name}
+		self.add_ref(obj)
+		err = self.read_properties(func(key string, value interface{}) {
+			obj.Properties = append(obj.Properties, Property{key, value})
+		})
+		return obj, err
+
+	case amf0_ecma_array:
+		//the count is a hint only, the array end with the object end marker.
+		if _, err := self.read_u32(); err != nil {
+			return nil, err
+		}
+		index := self.add_ref(nil)
+		var arr ECMAArray
+		err := self.read_properties(func(key string, value interface{}) {
+			arr = append(arr, Property{key, value})
+		})
+		self.refs[index] = arr
+		return arr, err
+
+	case amf0_strict_array:
+		n, err := self.read_u32()
+		if err != nil {
+			return nil, err
+		}
+		index := self.add_ref(nil)
+		arr := make([]interface{}, 0, alloc_len(n))
+		for i := uint32(0); i < n; i++ {
+			value, err := self.read_value()
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, value)
+		}
+		self.refs[index] = arr
+		return arr, nil
+	}
+
+	return nil, fmt.Errorf("amf: unknown type 0x%02x.", marker)
+}
+
+//properties until the empty key and the object end marker.
+func (self *Decoder) read_properties(set func(key string, value interface{})) error {
+	for {
+		key, err := self.read_string()
+		if err != nil {
+			return err
+		}
+
+		if key == "" {
+			marker, err := self.read_u8()
+			if err != nil {
+				return err
+			}
+			if marker != amf0_object_end {
+				return fmt.Errorf("amf: expect object end, got 0x%02x.", marker)
+			}
+			return nil
+		}
+
+		value, err := self.read_value()
+		if err != nil {
+			return err
+		}
+
+		set(key, value)
+	}
+}
+
+//milliseconds since the epoch in UTC, the time zone is reserved and ignored.
+func (self *Decoder) read_date() (time.Time, error) {
+	ms, err := self.read_number()
+	if err != nil {
+		return time.Time{}, err
+	}
+	if _, err := self.read_u16(); err != nil {
+		return time.Time{}, err
+	}
+	if math.IsNaN(ms) || math.IsInf(ms, 0) {
+		return time.Time{}, errors.New("amf: invalid date.")
+	}
+
+	sec := math.Floor(ms / 1000)
+	return time.Unix(int64(sec), int64((ms-sec*1000)*1e6)).UTC(), nil
+}
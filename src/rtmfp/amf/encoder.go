@@ -0,0 +1,325 @@
+package amf
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"rtmfp/amf3"
+	"sort"
+	"time"
+)
+
+//Encoder write AMF0 values to a stream, or AMF3 values after avmplus markers. maps,
+//slices and pointers written again are written as references, until Reset().
+type Encoder struct {
+	w   io.Writer
+	err error //first write error
+
+	encoding  ObjectEncoding
+	marshaler *marshaler
+
+	refs  map[ref_key]int
+	count int //complex values written, their index in the reference table.
+	depth int
+}
+
+//identity of a map, slice or pointer, slices of the same array differ by length.
+type ref_key struct {
+	ptr uintptr
+	len int
+	typ reflect.Type
+}
+
+//the identity of v, the zero key if it has none. empty slices may share their
+//pointer, they have none.
+func ref_key_of(v reflect.Value) ref_key {
+	switch v.Kind() {
+	case reflect.Map, reflect.Ptr:
+		return ref_key{ptr: v.Pointer(), typ: v.Type()}
+	case reflect.Slice:
+		if v.Len() > 0 {
+			return ref_key{ptr: v.Pointer(), len: v.Len(), typ: v.Type()}
+		}
+	}
+	return ref_key{}
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	e := &Encoder{w: w}
+	e.Reset()
+	return e
+}
+
+//AMF0 by default. with AMF3, every value is written as an AMF3 value after an
+//avmplus marker, as Flash do with NetConnection.objectEncoding set to 3.
+func (self *Encoder) SetObjectEncoding(encoding ObjectEncoding) {
+	self.encoding = encoding
+	self.marshaler = &marshaler{amf3: encoding == AMF3}
+}
+
+//clear the reference table.
+func (self *Encoder) Reset() {
+	self.refs = nil
+	self.count = 0
+	self.marshaler = &marshaler{amf3: self.encoding == AMF3}
+}
+
+//write one value, converted as Marshal() does.
+func (self *Encoder) Encode(v interface{}) error {
+
+	val, err := self.marshaler.marshal(reflect.ValueOf(v))
+	if err != nil {
+		return err
+	}
+
+	if self.encoding == AMF3 {
+		self.write_u8(amf0_avmplus)
+		err = self.write_amf3(val)
+	} else {
+		err = self.write_value(val)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return self.err
+}
+
+func (self *Encoder) write(p []byte) {
+	if self.err != nil {
+		return
+	}
+	_, self.err = self.w.Write(p)
+}
+
+func (self *Encoder) write_u8(v uint8) {
+	self.write([]byte{v})
+}
+
+func (self *Encoder) write_u16(v uint16) {
+	var buf [2]byte
+	binary.BigEndian.PutUint16(buf[:], v)
+	self.write(buf[:])
+}
+
+func (self *Encoder) write_u32(v uint32) {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], v)
+	self.write(buf[:])
+}
+
+func (self *Encoder) write_number(v float64) {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], math.Float64bits(v))
+	self.write(buf[:])
+}
+
+//the AMF3 value after an avmplus marker, with its own reference tables.
+func (self *Encoder) write_amf3(v interface{}) error {
+	if self.err != nil {
+		return self.err
+	}
+	return amf3.NewEncoder(self.w).Encode(v)
+}
+
+func (self *Encoder) write_string(v string) error {
+	if len(v) > math.MaxUint16 {
+		return errors.New("amf: key longer than 65535 bytes.")
+	}
+	self.write_u16(uint16(len(v)))
+	self.write([]byte(v))
+	return nil
+}
+
+func (self *Encoder) write_long_string(v string) error {
+	if int64(len(v)) > math.MaxUint32 {
+		return errors.New("amf: string longer than 4GB.")
+	}
+	self.write_u32(uint32(len(v)))
+	self.write([]byte(v))
+	return nil
+}
+
+//write a reference if the value was written before, otherwise count it.
+func (self *Encoder) write_ref(v interface{}) bool {
+
+	key := ref_key_of(reflect.ValueOf(v))
+
+	if key.ptr != 0 && self.refs != nil {
+		if index, ok := self.refs[key]; ok && index <= math.MaxUint16 {
+			self.write_u8(amf0_reference)
+			self.write_u16(uint16(index))
+			return true
+		}
+	}
+
+	if key.ptr != 0 {
+		if self.refs == nil {
+			self.refs = make(map[ref_key]int)
+		}
+		self.refs[key] = self.count
+	}
+	self.count++
+
+	return false
+}
+
+func (self *Encoder) write_value(val interface{}) error {
+
+	switch v := val.(type) {
+	case nil:
+		self.write_u8(amf0_null)
+	case Undefined:
+		self.write_u8(amf0_undefined)
+	case Unsupported:
+		self.write_u8(amf0_unsupported)
+	case float64:
+		self.write_u8(amf0_number)
+		self.write_number(v)
+	case float32:
+		return self.write_value(float64(v))
+	case int:
+		return self.write_value(float64(v))
+	case int8:
+		return self.write_value(float64(v))
+	case int16:
+		return self.write_value(float64(v))
+	case int32:
+		return self.write_value(float64(v))
+	case int64:
+		return self.write_value(float64(v))
+	case uint:
+		return self.write_value(float64(v))
+	case uint8:
+		return self.write_value(float64(v))
+	case uint16:
+		return self.write_value(float64(v))
+	case uint32:
+		return self.write_value(float64(v))
+	case uint64:
+		return self.write_value(float64(v))
+	case bool:
+		self.write_u8(amf0_boolean)
+		if v {
+			self.write_u8(1)
+		} else {
+			self.write_u8(0)
+		}
+	case string:
+		if len(v) > math.MaxUint16 {
+			self.write_u8(amf0_long_string)
+			return self.write_long_string(v)
+		}
+		self.write_u8(amf0_string)
+		return self.write_string(v)
+	case XMLDocument:
+		self.write_u8(amf0_xml_document)
+		return self.write_long_string(string(v))
+	case time.Time:
+		self.write_u8(amf0_date)
+		self.write_number(float64(v.Unix())*1000 + float64(v.Nanosecond())/1e6) //UnixNano() overflow out of 1678-2262
+		self.write_u16(0)
+	case []byte, amf3.Undefined, amf3.XML, amf3.XMLDocument, []int32, []uint32, []float64,
+		*amf3.Object, *amf3.Array, *amf3.ObjectVector, *amf3.Dictionary:
+		//values of AMF3 only
+		self.write_u8(amf0_avmplus)
+		return self.write_amf3(v)
+	default:
+		return self.write_complex(val)
+	}
+
+	return nil
+}
+
+func (self *Encoder) write_complex(val interface{}) error {
+
+	if self.depth >= MaxDepth {
+		return ErrTooDeep
+	}
+	self.depth++
+	defer func() { self.depth-- }()
+
+	switch v := val.(type) {
+	case map[string]interface{}:
+		if self.write_ref(v) {
+			return nil
+		}
+		self.write_u8(amf0_object)
+		return self.write_properties(sorted_properties(v))
+
+	case Object:
+		if self.write_ref(v) {
+			return nil
+		}
+		self.write_u8(amf0_object)
+		return self.write_properties(v)
+
+	case *TypedObject:
+		if self.write_ref(v) {
+			return nil
+		}
+		self.write_u8(amf0_typed_object)
+		if err := self.write_string(v.ClassName); err != nil {
+			return err
+		}
+		return self.write_properties(v.Properties)
+
+	case ECMAArray:
+		if self.write_ref(v) {
+			return nil
+		}
+		self.write_u8(amf0_ecma_array)
+		self.write_u32(uint32(len(v)))
+		return self.write_properties(Object(v))
+
+	case []interface{}:
+		if self.write_ref(v) {
+			return nil
+		}
+		self.write_u8(amf0_strict_array)
+		self.write_u32(uint32(len(v)))
+		for _, e := range v {
+			if err := self.write_value(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return fmt.Errorf("amf: unsupported type %T.", val)
+}
+
+func (self *Encoder) write_properties(props Object) error {
+	for _, p := range props {
+		if p.Key == "" {
+			return errors.New("amf: empty property name.")
+		}
+		if err := self.write_string(p.Key); err != nil {
+			return err
+		}
+		if err := self.write_value(p.Value); err != nil {
+			return err
+		}
+	}
+	self.write_u16(0)
+	self.write_u8(amf0_object_end)
+	return nil
+}
+
+func sorted_properties(obj map[string]interface{}) Object {
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	props := make(Object, len(keys))
+	for i, k := range keys {
+		props[i] = Property{k, obj[k]}
+	}
+	return props
+}
@@ -0,0 +1,660 @@
+package amf
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"rtmfp/amf3"
+	"strings"
+	"time"
+)
+
+var class_types = map[string]reflect.Type{}
+var class_names = map[reflect.Type]string{}
+
+//register the struct type of v as the class className, so that it is marshaled as a
+//typed object and a typed object of the class is unmarshaled into it. should be
+//called before use, e.g. in init().
+func RegisterClass(className string, v interface{}) {
+
+	t := reflect.TypeOf(v)
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if t == nil || t.Kind() != reflect.Struct || className == "" {
+		panic(fmt.Sprintf("amf: can not register %T as class %q.", v, className))
+	}
+
+	class_types[className] = t
+	class_names[t] = className
+}
+
+var time_type = reflect.TypeOf(time.Time{})
+
+//a struct field and its encoded name.
+type field struct {
+	name      string
+	index     []int
+	omitempty bool
+}
+
+//exported fields in order, the fields of embedded structs are promoted unless a
+//field of the same name is less deep.
+func fields_of(t reflect.Type) []field {
+
+	var fields []field
+	var embedded []field
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+
+		tag := f.Tag.Get("amf")
+		if tag == "-" {
+			continue
+		}
+
+		name := tag
+		omitempty := false
+		if i := strings.Index(tag, ","); i >= 0 {
+			name = tag[:i]
+			omitempty = strings.Contains(tag[i:], ",omitempty")
+		}
+
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			for _, sub := range fields_of(f.Type) {
+				sub.index = append([]int{i}, sub.index...)
+				embedded = append(embedded, sub)
+			}
+			continue
+		}
+
+		if f.PkgPath != "" {
+			continue //unexported
+		}
+
+		if name == "" {
+			name = f.Name
+		}
+
+		fields = append(fields, field{name, []int{i}, omitempty})
+	}
+
+	for _, sub := range embedded {
+		dup := false
+		for _, f := range fields {
+			if f.name == sub.name {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			fields = append(fields, sub)
+		}
+	}
+
+	return fields
+}
+
+func is_empty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
+
+//convert Go values to the values of the AMF0 or the AMF3 encoder.
+type marshaler struct {
+	amf3  bool
+	seen  map[ref_key]interface{} //converted maps, slices and pointers, so that they are written as references
+	depth int
+}
+
+func (self *marshaler) marshal(v reflect.Value) (interface{}, error) {
+
+	for v.Kind() == reflect.Interface && !v.IsNil() {
+		v = v.Elem()
+	}
+
+	key := ref_key_of(v)
+	if key.ptr != 0 {
+		if val, ok := self.seen[key]; ok {
+			return val, nil
+		}
+	}
+
+	val, err := self.marshal_value(v)
+
+	if err == nil && key.ptr != 0 {
+		if self.seen == nil {
+			self.seen = make(map[ref_key]interface{})
+		}
+		self.seen[key] = val
+	}
+
+	return val, err
+}
+
+func (self *marshaler) marshal_value(v reflect.Value) (interface{}, error) {
+
+	if !v.IsValid() {
+		return nil, nil
+	}
+
+	if self.depth >= MaxDepth {
+		return nil, ErrTooDeep
+	}
+	self.depth++
+	defer func() { self.depth-- }()
+
+	switch x := v.Interface().(type) {
+	case []byte:
+		if x == nil {
+			return nil, nil
+		}
+		return x, nil
+	case time.Time,
+		amf3.Undefined, amf3.XML, amf3.XMLDocument,
+		*amf3.Object, *amf3.Array, *amf3.ObjectVector, *amf3.Dictionary:
+		return x, nil
+	case Undefined, Unsupported:
+		if self.amf3 {
+			return amf3.Undefined{}, nil
+		}
+		return x, nil
+	case XMLDocument:
+		if self.amf3 {
+			return amf3.XMLDocument(x), nil
+		}
+		return x, nil
+	case Object:
+		return self.marshal_object("", x, false)
+	case ECMAArray:
+		props, err := self.marshal_properties(Object(x))
+		if err != nil || !self.amf3 {
+			return ECMAArray(props), err
+		}
+		arr := &amf3.Array{}
+		for _, p := range props {
+			arr.Associative = append(arr.Associative, amf3.Property{Name: p.Key, Value: p.Value})
+		}
+		return arr, nil
+	case *TypedObject:
+		if x == nil {
+			return nil, nil
+		}
+		return self.marshal_object(x.ClassName, x.Properties, true)
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		return v.Bool(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint(), nil
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), nil
+	case reflect.String:
+		return v.String(), nil
+
+	case reflect.Interface, reflect.Ptr:
+		if v.IsNil() {
+			return nil, nil
+		}
+		return self.marshal(v.Elem())
+
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return nil, nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			buf := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(buf), v)
+			return buf, nil
+		}
+		arr := make([]interface{}, v.Len())
+		for i := range arr {
+			var err error
+			if arr[i], err = self.marshal(v.Index(i)); err != nil {
+				return nil, err
+			}
+		}
+		return arr, nil
+
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return nil, fmt.Errorf("amf: unsupported map key type %v.", v.Type().Key())
+		}
+		if v.IsNil() {
+			return nil, nil
+		}
+		obj := make(map[string]interface{}, v.Len())
+		for _, key := range v.MapKeys() {
+			value, err := self.marshal(v.MapIndex(key))
+			if err != nil {
+				return nil, err
+			}
+			obj[key.String()] = value
+		}
+		return obj, nil
+
+	case reflect.Struct:
+		var props Object
+		for _, f := range fields_of(v.Type()) {
+			fv := v.FieldByIndex(f.index)
+			if f.omitempty && is_empty(fv) {
+				continue
+			}
+			props = append(props, Property{f.name, fv.Interface()})
+		}
+		class_name, typed := class_names[v.Type()]
+		return self.marshal_object(class_name, props, typed)
+	}
+
+	return nil, fmt.Errorf("amf: unsupported type %v.", v.Type())
+}
+
+func (self *marshaler) marshal_properties(props Object) (Object, error) {
+	res := make(Object, len(props))
+	for i, p := range props {
+		value, err := self.marshal(reflect.ValueOf(p.Value))
+		if err != nil {
+			return nil, err
+		}
+		res[i] = Property{p.Key, value}
+	}
+	return res, nil
+}
+
+//an anonymous or a typed object of the properties.
+func (self *marshaler) marshal_object(class_name string, props Object, typed bool) (interface{}, error) {
+
+	props, err := self.marshal_properties(props)
+	if err != nil {
+		return nil, err
+	}
+
+	if !self.amf3 {
+		if typed {
+			return &TypedObject{ClassName: class_name, Properties: props}, nil
+		}
+		return props, nil
+	}
+
+	if !typed {
+		obj := &amf3.Object{Traits: &amf3.Traits{Dynamic: true}}
+		for _, p := range props {
+			obj.Dynamic = append(obj.Dynamic, amf3.Property{Name: p.Key, Value: p.Value})
+		}
+		return obj, nil
+	}
+
+	obj := &amf3.Object{Traits: &amf3.Traits{ClassName: class_name}}
+	for _, p := range props {
+		obj.Traits.Members = append(obj.Traits.Members, p.Key)
+		obj.Sealed = append(obj.Sealed, p.Value)
+	}
+	return obj, nil
+}
+
+//class name of a decoded object, "" if anonymous.
+func class_of(val interface{}) string {
+	switch v := val.(type) {
+	case *TypedObject:
+		return v.ClassName
+	case *amf3.Object:
+		if !v.Traits.Externalizable {
+			return v.Traits.ClassName
+		}
+	}
+	return ""
+}
+
+//properties of a decoded object or associative array.
+func properties_of(val interface{}) (Object, bool) {
+	switch v := val.(type) {
+	case map[string]interface{}:
+		return sorted_properties(v), true
+	case Object:
+		return v, true
+	case ECMAArray:
+		return Object(v), true
+	case *TypedObject:
+		return v.Properties, true
+	case *amf3.Object:
+		var props Object
+		for i, name := range v.Traits.Members {
+			if i < len(v.Sealed) {
+				props = append(props, Property{name, v.Sealed[i]})
+			}
+		}
+		for _, p := range v.Dynamic {
+			props = append(props, Property{p.Name, p.Value})
+		}
+		return props, true
+	case *amf3.Array:
+		var props Object
+		for _, p := range v.Associative {
+			props = append(props, Property{p.Name, p.Value})
+		}
+		return props, true
+	}
+	return nil, false
+}
+
+//elements of a decoded array or vector.
+func elements_of(val interface{}) ([]interface{}, bool) {
+	switch v := val.(type) {
+	case []interface{}:
+		return v, true
+	case *amf3.Array:
+		return v.Dense, true
+	case *amf3.ObjectVector:
+		return v.Items, true
+	case []int32, []uint32, []float64:
+		rv := reflect.ValueOf(v)
+		items := make([]interface{}, rv.Len())
+		for i := range items {
+			items[i] = rv.Index(i).Interface()
+		}
+		return items, true
+	}
+	return nil, false
+}
+
+func number_of(val interface{}) (float64, bool) {
+	switch v := val.(type) {
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+//assign decoded values to Go values.
+type unmarshaler struct {
+	visited map[ref_key]bool //decoded values converted in place by generic()
+	depth   int
+}
+
+func (self *unmarshaler) unmarshal(dst reflect.Value, val interface{}) error {
+
+	if self.depth >= MaxDepth {
+		return ErrTooDeep
+	}
+	self.depth++
+	defer func() { self.depth-- }()
+
+	if dst.Kind() == reflect.Interface && dst.NumMethod() == 0 {
+		v, err := self.generic(val)
+		if err != nil {
+			return err
+		}
+		if v == nil {
+			dst.Set(reflect.Zero(dst.Type()))
+		} else {
+			dst.Set(reflect.ValueOf(v))
+		}
+		return nil
+	}
+
+	switch val.(type) {
+	case nil, Undefined, Unsupported, amf3.Undefined:
+		dst.Set(reflect.Zero(dst.Type()))
+		return nil
+	}
+
+	//a Go value already, e.g. the struct of a registered class.
+	if rv := reflect.ValueOf(val); rv.Type().AssignableTo(dst.Type()) {
+		dst.Set(rv)
+		return nil
+	} else if rv.Kind() == reflect.Ptr && rv.Type().Elem().AssignableTo(dst.Type()) && rv.Type().Elem().Kind() == reflect.Struct {
+		dst.Set(rv.Elem())
+		return nil
+	}
+
+	if dst.Kind() == reflect.Ptr {
+		if dst.IsNil() {
+			dst.Set(reflect.New(dst.Type().Elem()))
+		}
+		return self.unmarshal(dst.Elem(), val)
+	}
+
+	if dst.Type() == time_type {
+		t, ok := val.(time.Time)
+		if !ok {
+			return mismatch(val, dst)
+		}
+		dst.Set(reflect.ValueOf(t))
+		return nil
+	}
+
+	switch dst.Kind() {
+	case reflect.Bool:
+		b, ok := val.(bool)
+		if !ok {
+			return mismatch(val, dst)
+		}
+		dst.SetBool(b)
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, ok := number_of(val)
+		if !ok || n != math.Trunc(n) || n < math.MinInt64 || n >= math.MaxInt64 || dst.OverflowInt(int64(n)) {
+			return mismatch(val, dst)
+		}
+		dst.SetInt(int64(n))
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, ok := number_of(val)
+		if !ok || n != math.Trunc(n) || n < 0 || n >= math.MaxUint64 || dst.OverflowUint(uint64(n)) {
+			return mismatch(val, dst)
+		}
+		dst.SetUint(uint64(n))
+
+	case reflect.Float32, reflect.Float64:
+		n, ok := number_of(val)
+		if !ok || dst.OverflowFloat(n) {
+			return mismatch(val, dst)
+		}
+		dst.SetFloat(n)
+
+	case reflect.String:
+		switch s := val.(type) {
+		case string:
+			dst.SetString(s)
+		case XMLDocument:
+			dst.SetString(string(s))
+		case amf3.XMLDocument:
+			dst.SetString(string(s))
+		case amf3.XML:
+			dst.SetString(string(s))
+		default:
+			return mismatch(val, dst)
+		}
+
+	case reflect.Slice:
+		if buf, ok := val.([]byte); ok && dst.Type().Elem().Kind() == reflect.Uint8 {
+			dst.SetBytes(append([]byte(nil), buf...))
+			return nil
+		}
+		items, ok := elements_of(val)
+		if !ok {
+			return mismatch(val, dst)
+		}
+		s := reflect.MakeSlice(dst.Type(), len(items), len(items))
+		for i, item := range items {
+			if err := self.unmarshal(s.Index(i), item); err != nil {
+				return err
+			}
+		}
+		dst.Set(s)
+
+	case reflect.Array:
+		items, ok := elements_of(val)
+		if !ok {
+			return mismatch(val, dst)
+		}
+		for i := 0; i < dst.Len(); i++ {
+			if i >= len(items) {
+				dst.Index(i).Set(reflect.Zero(dst.Type().Elem()))
+				continue
+			}
+			if err := self.unmarshal(dst.Index(i), items[i]); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Map:
+		props, ok := properties_of(val)
+		if !ok || dst.Type().Key().Kind() != reflect.String {
+			return mismatch(val, dst)
+		}
+		m := reflect.MakeMap(dst.Type())
+		for _, p := range props {
+			elem := reflect.New(dst.Type().Elem()).Elem()
+			if err := self.unmarshal(elem, p.Value); err != nil {
+				return err
+			}
+			m.SetMapIndex(reflect.ValueOf(p.Key).Convert(dst.Type().Key()), elem)
+		}
+		dst.Set(m)
+
+	case reflect.Struct:
+		props, ok := properties_of(val)
+		if !ok {
+			return mismatch(val, dst)
+		}
+		fields := fields_of(dst.Type())
+		for _, p := range props {
+			f, ok := find_field(fields, p.Key)
+			if !ok {
+				continue
+			}
+			if err := self.unmarshal(dst.FieldByIndex(f.index), p.Value); err != nil {
+				return err
+			}
+		}
+
+	default:
+		return mismatch(val, dst)
+	}
+
+	return nil
+}
+
+//the field of the exact name, or case insensitively.
+func find_field(fields []field, name string) (field, bool) {
+	for _, f := range fields {
+		if f.name == name {
+			return f, true
+		}
+	}
+	for _, f := range fields {
+		if strings.EqualFold(f.name, name) {
+			return f, true
+		}
+	}
+	return field{}, false
+}
+
+//the value for an interface{}, with objects of registered classes as their structs.
+//the decoded values holding them are changed in place, so that references to them
+//and cycles are kept.
+func (self *unmarshaler) generic(val interface{}) (interface{}, error) {
+
+	if t, ok := class_types[class_of(val)]; ok {
+		p := reflect.New(t)
+		if err := self.unmarshal(p.Elem(), val); err != nil {
+			return nil, err
+		}
+		return p.Interface(), nil
+	}
+
+	key := ref_key_of(reflect.ValueOf(val))
+	if key.ptr == 0 || self.visited[key] {
+		return val, nil
+	}
+	if self.visited == nil {
+		self.visited = make(map[ref_key]bool)
+	}
+	self.visited[key] = true
+
+	var err error
+
+	switch v := val.(type) {
+	case []interface{}:
+		err = self.generic_values(v)
+	case map[string]interface{}:
+		for key, item := range v {
+			if v[key], err = self.generic(item); err != nil {
+				break
+			}
+		}
+	case ECMAArray:
+		err = self.generic_properties(Object(v))
+	case Object:
+		err = self.generic_properties(v)
+	case *TypedObject:
+		err = self.generic_properties(v.Properties)
+	case *amf3.Object:
+		if err = self.generic_values(v.Sealed); err == nil {
+			for i := range v.Dynamic {
+				if v.Dynamic[i].Value, err = self.generic(v.Dynamic[i].Value); err != nil {
+					break
+				}
+			}
+		}
+	case *amf3.Array:
+		if err = self.generic_values(v.Dense); err == nil {
+			for i := range v.Associative {
+				if v.Associative[i].Value, err = self.generic(v.Associative[i].Value); err != nil {
+					break
+				}
+			}
+		}
+	case *amf3.ObjectVector:
+		err = self.generic_values(v.Items)
+	}
+
+	return val, err
+}
+
+func (self *unmarshaler) generic_values(values []interface{}) (err error) {
+	for i := range values {
+		if values[i], err = self.generic(values[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *unmarshaler) generic_properties(props Object) (err error) {
+	for i := range props {
+		if props[i].Value, err = self.generic(props[i].Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func mismatch(val interface{}, dst reflect.Value) error {
+	return fmt.Errorf("amf: can not unmarshal %T into %v.", val, dst.Type())
+}
+
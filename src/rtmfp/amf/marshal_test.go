@@ -0,0 +1,222 @@
+package amf
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type test_base struct {
+	ID      int64  `amf:"id"`
+	Comment string `amf:"comment,omitempty"`
+}
+
+type test_status struct {
+	test_base
+	Level       string            `amf:"level"`
+	Code        string            `amf:"code"`
+	Description string            `amf:"description,omitempty"`
+	Time        time.Time         `amf:"time"`
+	Tags        []string          `amf:"tags"`
+	Counts      map[string]uint16 `amf:"counts"`
+	Data        []byte            `amf:"data"`
+	Next        *test_status      `amf:"next"`
+	Any         interface{}       `amf:"any"`
+	Ratio       float32
+	Ignored     int `amf:"-"`
+	unexported  int
+}
+
+type test_point struct {
+	X, Y float64
+}
+
+func init() {
+	RegisterClass("com.example.Point", test_point{})
+}
+
+func test_status_value() *test_status {
+	return &test_status{
+		test_base: test_base{ID: 7},
+		Level:     "status",
+		Code:      "NetStream.Play.Start",
+		Time:      time.Date(2009, 2, 13, 23, 31, 30, 0, time.UTC),
+		Tags:      []string{"a", "b"},
+		Counts:    map[string]uint16{"x": 1, "y": 65535},
+		Data:      []byte{1, 2, 3},
+		Next:      &test_status{Level: "error", Tags: []string{}},
+		Any:       []interface{}{"c", 1.5, nil},
+		Ratio:     0.5,
+	}
+}
+
+func TestMarshal(t *testing.T) {
+
+	v := test_status_value()
+	v.Ignored = 1
+	v.unexported = 2
+
+	for _, amf3 := range []bool{false, true} {
+
+		marshal, unmarshal := Marshal, Unmarshal
+		if amf3 {
+			marshal, unmarshal = MarshalAMF3, UnmarshalAMF3
+		}
+
+		data, err := marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var decoded test_status
+		if err := unmarshal(data, &decoded); err != nil {
+			t.Fatal(amf3, err)
+		}
+
+		expect := test_status_value()
+		if !reflect.DeepEqual(&decoded, expect) {
+			t.Fatalf("AMF3 %v not match.\n%#v\n%#v", amf3, &decoded, expect)
+		}
+	}
+
+	//field order, promoted fields after the others, omitted fields.
+	data, err := Marshal(&test_status{Level: "status", Tags: []string{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var obj map[string]interface{}
+	if err := Unmarshal(data, &obj); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(obj) != 10 || obj["level"] != "status" || obj["id"] != 0.0 || obj["counts"] != nil {
+		t.Fatalf("unexpected object.\n%#v", obj)
+	}
+	if _, ok := obj["description"]; ok {
+		t.Fatal("empty field not omitted.")
+	}
+
+	if !bytes.HasPrefix(data, []byte{0x03, 0x00, 0x05, 'l', 'e', 'v', 'e', 'l'}) {
+		t.Fatal("fields not in order.", data)
+	}
+}
+
+func TestMarshalClass(t *testing.T) {
+
+	p := &test_point{1.5, -2}
+	v := map[string]interface{}{"point": p, "points": []*test_point{p, nil}}
+
+	data, err := Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//a typed object, the second one a reference to it.
+	typed := append([]byte{0x10, 0x00, 0x11}, "com.example.Point"...)
+	if !bytes.Contains(data, typed) || bytes.Count(data, typed) != 1 {
+		t.Fatal("not a typed object.", data)
+	}
+
+	data3, err := MarshalAMF3(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data3, []byte{0x0a, 0x23, 0x23}) {
+		t.Fatal("not sealed members of the class.", data3)
+	}
+
+	//a registered class into an interface{} is its struct.
+	for _, c := range []struct {
+		data      []byte
+		unmarshal func([]byte, interface{}) error
+	}{{data, Unmarshal}, {data3, UnmarshalAMF3}} {
+
+		var decoded interface{}
+		if err := c.unmarshal(c.data, &decoded); err != nil {
+			t.Fatal(err)
+		}
+
+		if m, ok := decoded.(map[string]interface{}); ok {
+			decoded = m["point"]
+			if items := m["points"].([]interface{}); !reflect.DeepEqual(items, []interface{}{p, nil}) {
+				t.Fatalf("not match.\n%#v", items)
+			}
+		}
+
+		if !reflect.DeepEqual(decoded, p) {
+			t.Fatalf("not match.\n%#v", decoded)
+		}
+	}
+}
+
+func TestUnmarshal(t *testing.T) {
+
+	var v struct {
+		Level string
+		Small uint8
+		Neg   int
+		Pos   *int
+		Arr   [2]int32
+		Xml   string
+	}
+
+	//case insensitive names, null for the zero value, unknown keys ignored.
+	data, _ := Marshal(Object{
+		{"level", "status"},
+		{"small", 255},
+		{"neg", -3},
+		{"pos", nil},
+		{"arr", []interface{}{1, 2, 3}},
+		{"xml", XMLDocument("<a/>")},
+		{"unknown", true},
+	})
+
+	if err := Unmarshal(data, &v); err != nil {
+		t.Fatal(err)
+	}
+
+	if v.Level != "status" || v.Small != 255 || v.Neg != -3 || v.Pos != nil || v.Arr != [2]int32{1, 2} || v.Xml != "<a/>" {
+		t.Fatalf("not match.\n%#v", v)
+	}
+
+	invalid := []interface{}{
+		Object{{"small", 256}},
+		Object{{"small", -1}},
+		Object{{"neg", 1.5}},
+		Object{{"level", 1}},
+		Object{{"arr", "abc"}},
+		"abc",
+	}
+
+	for _, val := range invalid {
+		data, _ := Marshal(val)
+		if err := Unmarshal(data, &v); err == nil {
+			t.Fatalf("%#v unmarshaled.", val)
+		}
+	}
+
+	data, _ = Marshal("abc")
+	var s string
+	if err := Unmarshal(data, s); err == nil {
+		t.Fatal("unmarshaled into a non-pointer.")
+	}
+	if err := Unmarshal(append(data, 0x05), &s); err == nil {
+		t.Fatal("data after the value ignored.")
+	}
+
+	if _, err := Marshal(map[int]string{1: "a"}); err == nil {
+		t.Fatal("map of int keys marshaled.")
+	}
+	if _, err := Marshal(make(chan int)); err == nil {
+		t.Fatal("chan marshaled.")
+	}
+
+	//a cycle is too deep.
+	cycle := &test_status{}
+	cycle.Next = cycle
+	if _, err := Marshal(cycle); err != ErrTooDeep {
+		t.Fatal("cycle marshaled.", err)
+	}
+}
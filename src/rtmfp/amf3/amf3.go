@@ -0,0 +1,170 @@
+//Package amf3 encode and decode AMF3, the ActionScript 3 serialization format, with
+//the string, object and traits reference tables of the specification.
+//
+//Decoded values are:
+//
+//	undefined             Undefined{}
+//	null                  nil
+//	false, true           bool
+//	integer               int
+//	double                float64
+//	string                string
+//	XMLDocument, XML      XMLDocument, XML
+//	date                  time.Time in UTC
+//	array                 []interface{}, or *Array if it has associative members
+//	anonymous object      map[string]interface{}, if no sealed members
+//	other objects         *Object
+//	ByteArray             []byte
+//	Vector.<int>          []int32
+//	Vector.<uint>         []uint32
+//	Vector.<Number>       []float64
+//	Vector.<Object>       *ObjectVector
+//	Dictionary            *Dictionary
+//
+//the encoder accept the same values, Go integers and float32 as well.
+package amf3
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+//type markers
+const (
+	undefined_marker     = 0x00
+	null_marker          = 0x01
+	false_marker         = 0x02
+	true_marker          = 0x03
+	integer_marker       = 0x04
+	double_marker        = 0x05
+	string_marker        = 0x06
+	xml_document_marker  = 0x07
+	date_marker          = 0x08
+	array_marker         = 0x09
+	object_marker        = 0x0a
+	xml_marker           = 0x0b
+	byte_array_marker    = 0x0c
+	vector_int_marker    = 0x0d
+	vector_uint_marker   = 0x0e
+	vector_double_marker = 0x0f
+	vector_object_marker = 0x10
+	dictionary_marker    = 0x11
+)
+
+const max_u29 = 1<<29 - 1
+const min_int = -1 << 28
+const max_int = 1<<28 - 1
+
+//nested values deeper than it are rejected.
+var MaxDepth = 64
+
+var ErrUnexpectedEOF = errors.New("amf3: unexpected end of data.")
+var ErrTooDeep = errors.New("amf3: nested too deep.")
+
+type Undefined struct{}
+
+type XMLDocument string //flash.xml.XMLDocument
+type XML string         //E4X XML
+
+//one member of an object or an associative array, in the order it is encoded.
+type Property struct {
+	Name  string
+	Value interface{}
+}
+
+//array with associative members, Flash write them before the dense ones.
+type Array struct {
+	Associative []Property
+	Dense       []interface{}
+}
+
+//class of an object. Members are the sealed members, their values follow in the order.
+type Traits struct {
+	ClassName      string
+	Members        []string
+	Dynamic        bool
+	Externalizable bool
+}
+
+func (self *Traits) key() string {
+	return fmt.Sprintf("%q %q %v %v", self.ClassName, self.Members, self.Dynamic, self.Externalizable)
+}
+
+type Object struct {
+	Traits   *Traits
+	Sealed   []interface{} //values of Traits.Members
+	Dynamic  []Property
+	External interface{} //data of an externalizable object, see RegisterExternalizable()
+}
+
+//value of a member, sealed or dynamic.
+func (self *Object) Get(name string) (interface{}, bool) {
+	for i, member := range self.Traits.Members {
+		if member == name && i < len(self.Sealed) {
+			return self.Sealed[i], true
+		}
+	}
+	for _, p := range self.Dynamic {
+		if p.Name == name {
+			return p.Value, true
+		}
+	}
+	return nil, false
+}
+
+//Vector.<T> of objects, TypeName is the class of T, "" for Object.
+type ObjectVector struct {
+	TypeName string
+	Fixed    bool
+	Items    []interface{}
+}
+
+type DictionaryEntry struct {
+	Key, Value interface{}
+}
+
+type Dictionary struct {
+	WeakKeys bool
+	Entries  []DictionaryEntry
+}
+
+//read and write the data of an externalizable class, which only the class know.
+type ExternalReader func(d *Decoder) (interface{}, error)
+type ExternalWriter func(e *Encoder, data interface{}) error
+
+type externalizable struct {
+	read  ExternalReader
+	write ExternalWriter
+}
+
+var externalizables = map[string]externalizable{}
+
+//register an externalizable class, should be called before use, e.g. in init().
+func RegisterExternalizable(className string, read ExternalReader, write ExternalWriter) {
+	externalizables[className] = externalizable{read, write}
+}
+
+//classes of Flex which wrap one value.
+func read_wrapped(d *Decoder) (interface{}, error)     { return d.Decode() }
+func write_wrapped(e *Encoder, data interface{}) error { return e.Encode(data) }
+
+func init() {
+	for _, class_name := range []string{
+		"flex.messaging.io.ArrayCollection",
+		"flex.messaging.io.ArrayList",
+		"flex.messaging.io.ObjectProxy",
+	} {
+		RegisterExternalizable(class_name, read_wrapped, write_wrapped)
+	}
+}
+
+//milliseconds since the epoch.
+func to_time(ms float64) time.Time {
+	sec := int64(ms / 1000)
+	return time.Unix(sec, int64((ms-float64(sec)*1000)*1e6)).UTC()
+}
+
+func from_time(t time.Time) float64 {
+	return float64(t.Unix())*1000 + float64(t.Nanosecond())/1e6
+}
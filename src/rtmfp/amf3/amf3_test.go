@@ -0,0 +1,308 @@
+package amf3
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func test_u29(v uint32, t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	if err := NewEncoder(buf).write_u29(v); err != nil {
+		t.Fatal(err)
+	}
+	if r, err := NewDecoder(buf).read_u29(); err != nil || r != v {
+		t.Fatal("not match.", v, r, err)
+	}
+	if buf.Len() != 0 {
+		t.Fatal("bytes left.", v)
+	}
+}
+
+func TestU29(t *testing.T) {
+	test_u29(0xF, t)
+	test_u29(0x7F, t)
+	test_u29(0x80, t)
+	test_u29(0xFFFF, t)
+	test_u29(0xFFFFF, t)
+	test_u29(0xFFFFFF, t)
+	test_u29(0xFFFFFFF, t)
+	test_u29(0x1FFFFFFF, t)
+
+	test_u29(0x12345678, t)
+
+	if err := NewEncoder(bytes.NewBuffer(nil)).write_u29(0x20000000); err == nil {
+		t.Fatal("30 bits encoded.")
+	}
+}
+
+func TestIntegers(t *testing.T) {
+
+	//integers out of 29 bits are written as doubles.
+	values := []interface{}{int(1 << 28), int64(-1<<28 - 1), uint32(1 << 31), uint64(1 << 40), int8(-5), uint16(60000)}
+	expect := []interface{}{float64(1 << 28), float64(-1<<28 - 1), float64(1 << 31), float64(1 << 40), -5, 60000}
+
+	for i, v := range values {
+		buf := bytes.NewBuffer(nil)
+		if err := NewEncoder(buf).Encode(v); err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := NewDecoder(buf).Decode()
+		if err != nil || decoded != expect[i] {
+			t.Fatalf("%T %v decoded as %T %v.", v, v, decoded, decoded)
+		}
+	}
+}
+
+//hex bytes, "#" comments to the end of the line.
+func load_hex_golden(t *testing.T, path string) []byte {
+
+	text, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var digits []string
+	for _, line := range strings.Split(string(text), "\n") {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		digits = append(digits, strings.Fields(line)...)
+	}
+
+	data, err := hex.DecodeString(strings.Join(digits, ""))
+	if err != nil {
+		t.Fatal(path, err)
+	}
+
+	return data
+}
+
+func TestGolden(t *testing.T) {
+
+	point := &Traits{ClassName: "com.example.Point", Members: []string{"x", "y"}}
+	p1 := &Object{Traits: point, Sealed: []interface{}{1, 2.5}}
+	p2 := &Object{Traits: point, Sealed: []interface{}{-3, "x"}}
+	anonymous := map[string]interface{}{"b": "name", "a": 1}
+
+	cases := []struct {
+		file    string
+		values  []interface{} //encoded to the golden bytes
+		decoded []interface{} //decoded from the golden bytes
+	}{
+		{
+			file: "types.hex",
+			values: []interface{}{
+				Undefined{}, nil, false, true,
+				0, 127, 128, 16383, 16384, 2097151, 2097152, 1<<28 - 1, -1, -1 << 28,
+				float64(1 << 28),
+				1.5,
+				"", "héllo", "héllo",
+				XMLDocument(`<root><item id="1"/></root>`),
+				XML(`<a>b</a>`),
+				time.Date(2009, 2, 13, 23, 31, 30, 500*int(time.Millisecond), time.UTC),
+				[]byte{0xde, 0xad, 0xbe, 0xef},
+				[]int32{1, -2, 2147483647},
+				[]uint32{0, 4294967295},
+				[]float64{0.5, -1e300},
+				&ObjectVector{TypeName: "String", Fixed: true, Items: []interface{}{"héllo", nil}},
+				&Dictionary{WeakKeys: true, Entries: []DictionaryEntry{{"key", 1}, {2, false}}},
+			},
+		},
+		{
+			file: "objects.hex",
+			values: []interface{}{
+				[]interface{}{p1, p2, p1},
+				"com.example.Point",
+				&Array{Associative: []Property{{"name", "value"}}, Dense: []interface{}{true}},
+				anonymous,
+				&Object{
+					Traits:   &Traits{ClassName: "flex.messaging.io.ArrayCollection", Externalizable: true},
+					External: []interface{}{1, anonymous},
+				},
+				&Object{
+					Traits:  &Traits{ClassName: "com.example.Tagged", Members: []string{"id"}, Dynamic: true},
+					Sealed:  []interface{}{7},
+					Dynamic: []Property{{"extra", false}},
+				},
+			},
+		},
+	}
+
+	for _, c := range cases {
+
+		golden := load_hex_golden(t, "testdata/"+c.file)
+
+		buf := bytes.NewBuffer(nil)
+		e := NewEncoder(buf)
+		for _, v := range c.values {
+			if err := e.Encode(v); err != nil {
+				t.Fatal(c.file, err)
+			}
+		}
+
+		if !bytes.Equal(buf.Bytes(), golden) {
+			t.Fatalf("%s: encoding not match.\n%s\n%s", c.file, hex.Dump(buf.Bytes()), hex.Dump(golden))
+		}
+
+		decoded := c.decoded
+		if decoded == nil {
+			decoded = c.values
+		}
+
+		r := bytes.NewBuffer(golden)
+		d := NewDecoder(r)
+		for i, expect := range decoded {
+			v, err := d.Decode()
+			if err != nil {
+				t.Fatal(c.file, i, err)
+			}
+			if !reflect.DeepEqual(v, expect) {
+				t.Fatalf("%s: value %d not match.\n%#v\n%#v", c.file, i, v, expect)
+			}
+		}
+
+		if r.Len() != 0 {
+			t.Fatal(c.file, "bytes left.", r.Len())
+		}
+
+		//every truncation is an error, never a panic.
+		for n := 0; n < len(golden); n++ {
+			d := NewDecoder(bytes.NewBuffer(golden[:n]))
+			var err error
+			for range decoded {
+				if _, err = d.Decode(); err != nil {
+					break
+				}
+			}
+			if err == nil {
+				t.Fatal(c.file, "truncated at", n, "decoded.")
+			}
+		}
+	}
+}
+
+func TestReferences(t *testing.T) {
+
+	//the decoded graph keep the identity of referenced values.
+	m := map[string]interface{}{"a": 1}
+	v := []interface{}{m, m}
+
+	buf := bytes.NewBuffer(nil)
+	if err := NewEncoder(buf).Encode(v); err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := NewDecoder(buf).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	arr := decoded.([]interface{})
+	arr[0].(map[string]interface{})["b"] = 2
+	if len(arr[1].(map[string]interface{})) != 2 {
+		t.Fatal("reference decoded as a copy.")
+	}
+
+	//Reset() clear the tables, the same string is written inline again.
+	buf.Reset()
+	e := NewEncoder(buf)
+	e.Encode("abc")
+	e.Encode("abc")
+	e.Reset()
+	e.Encode("abc")
+	if !bytes.Equal(buf.Bytes(), []byte{0x06, 0x07, 'a', 'b', 'c', 0x06, 0x00, 0x06, 0x07, 'a', 'b', 'c'}) {
+		t.Fatal("unexpected encoding.", hex.Dump(buf.Bytes()))
+	}
+}
+
+func TestErrors(t *testing.T) {
+
+	invalid := [][]byte{
+		{},
+		{0x12},                               //unknown
+		{0x06, 0x02},                         //string reference out of range
+		{0x09, 0x02},                         //object reference out of range
+		{0x0a, 0x05},                         //traits reference out of range
+		{0x06, 0xff, 0xff, 0xff, 0xff},       //huge string
+		{0x0c, 0xff, 0xff, 0xff, 0xff},       //huge byte array
+		{0x09, 0xff, 0xff, 0xff, 0xff, 0x01}, //huge array
+		{0x08, 0x01, 0x7f, 0xf8, 0, 0, 0, 0, 0, 0}, //NaN date
+		{0x0a, 0x17, 0x01, 0x03, 0x78},             //externalizable with members
+		{0x0a, 0x07, 0x07, 'a', 'b', 'c'},          //unknown externalizable
+	}
+
+	for _, data := range invalid {
+		if _, err := NewDecoder(bytes.NewBuffer(data)).Decode(); err == nil {
+			t.Fatal("decoded invalid data.", data)
+		}
+	}
+
+	//too deep
+	deep := bytes.NewBuffer(nil)
+	for i := 0; i < MaxDepth+1; i++ {
+		deep.Write([]byte{0x09, 0x03, 0x01})
+	}
+	deep.WriteByte(0x01)
+
+	if _, err := NewDecoder(deep).Decode(); err != ErrTooDeep {
+		t.Fatal("nested too deep decoded.", err)
+	}
+
+	var nested interface{}
+	for i := 0; i < MaxDepth+1; i++ {
+		nested = []interface{}{nested}
+	}
+	if err := NewEncoder(bytes.NewBuffer(nil)).Encode(nested); err != ErrTooDeep {
+		t.Fatal("nested too deep encoded.", err)
+	}
+
+	unsupported := []interface{}{
+		struct{}{},
+		map[string]interface{}{"": 1},
+		&Object{Traits: &Traits{ClassName: "unknown", Externalizable: true}},
+		&Object{Traits: &Traits{Members: []string{"x"}}},
+	}
+
+	for _, v := range unsupported {
+		if err := NewEncoder(bytes.NewBuffer(nil)).Encode(v); err == nil {
+			t.Fatalf("%#v encoded.", v)
+		}
+	}
+}
+
+func TestExternalizable(t *testing.T) {
+
+	//a class writing a 4 bytes counter.
+	RegisterExternalizable("com.example.Counter",
+		func(d *Decoder) (interface{}, error) {
+			return d.read_u32()
+		},
+		func(e *Encoder, data interface{}) error {
+			e.write_u32(data.(uint32))
+			return nil
+		})
+
+	v := &Object{
+		Traits:   &Traits{ClassName: "com.example.Counter", Externalizable: true},
+		External: uint32(42),
+	}
+
+	buf := bytes.NewBuffer(nil)
+	if err := NewEncoder(buf).Encode([]interface{}{v, "after"}); err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := NewDecoder(buf).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(decoded, []interface{}{v, "after"}) {
+		t.Fatalf("not match.\n%#v", decoded)
+	}
+}
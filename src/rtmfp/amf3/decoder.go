@@ -0,0 +1,518 @@
+package amf3
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+//Decoder read AMF3 values from a stream. the reference tables last across values
+//until Reset(), as in one AMF3 message.
+type Decoder struct {
+	r      io.Reader
+	byte_r io.ByteReader
+
+	strings []string
+	objects []interface{}
+	traits  []*Traits
+
+	depth int
+}
+
+//the decoder read no more than the values from r if it is an io.ByteReader,
+//e.g. a *bytes.Buffer, so that other data may follow them.
+func NewDecoder(r io.Reader) *Decoder {
+	d := &Decoder{r: r}
+	d.byte_r, _ = r.(io.ByteReader)
+	return d
+}
+
+//clear the reference tables.
+func (self *Decoder) Reset() {
+	self.strings = nil
+	self.objects = nil
+	self.traits = nil
+}
+
+//raw bytes, for externalizable classes.
+func (self *Decoder) Read(p []byte) (int, error) {
+	return self.r.Read(p)
+}
+
+func (self *Decoder) read_full(n int) ([]byte, error) {
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(self.r, buf); err != nil {
+		return nil, eof(err)
+	}
+	return buf, nil
+}
+
+func eof(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (self *Decoder) read_u8() (uint8, error) {
+	if self.byte_r != nil {
+		v, err := self.byte_r.ReadByte()
+		return v, eof(err)
+	}
+
+	buf, err := self.read_full(1)
+	if err != nil {
+		return 0, err
+	}
+	return buf[0], nil
+}
+
+func (self *Decoder) read_u32() (uint32, error) {
+	buf, err := self.read_full(4)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(buf), nil
+}
+
+func (self *Decoder) read_double() (float64, error) {
+	buf, err := self.read_full(8)
+	if err != nil {
+		return 0, err
+	}
+	return math.Float64frombits(binary.BigEndian.Uint64(buf)), nil
+}
+
+//variable length unsigned 29-bit integer.
+func (self *Decoder) read_u29() (uint32, error) {
+
+	v := uint32(0)
+
+	for i := 0; i < 4; i++ {
+		b, err := self.read_u8()
+		if err != nil {
+			return 0, err
+		}
+
+		if i == 3 {
+			return v<<8 | uint32(b), nil
+		}
+
+		v = v<<7 | uint32(b&0x7f)
+
+		if b&0x80 == 0 {
+			break
+		}
+	}
+
+	return v, nil
+}
+
+//U29 of a reference or an inline value, the inline value is the rest bits.
+func (self *Decoder) read_ref_u29() (value uint32, inline bool, err error) {
+	v, err := self.read_u29()
+	return v >> 1, v&1 == 1, err
+}
+
+//a length read from the data, checked so that a forged one can not allocate
+//more than the data may hold.
+func (self *Decoder) alloc_len(n uint32) int {
+	if n > 1024 {
+		return 1024
+	}
+	return int(n)
+}
+
+func (self *Decoder) read_string() (string, error) {
+
+	v, inline, err := self.read_ref_u29()
+	if err != nil {
+		return "", err
+	}
+
+	if !inline {
+		if int(v) >= len(self.strings) {
+			return "", fmt.Errorf("amf3: string reference %d out of range.", v)
+		}
+		return self.strings[v], nil
+	}
+
+	if v == 0 {
+		return "", nil //empty strings are never referenced
+	}
+
+	buf, err := self.read_full_checked(v)
+	if err != nil {
+		return "", err
+	}
+
+	s := string(buf)
+	self.strings = append(self.strings, s)
+
+	return s, nil
+}
+
+//read n bytes, in chunks so that a forged length fail at the end of data.
+func (self *Decoder) read_full_checked(n uint32) ([]byte, error) {
+	buf := make([]byte, 0, self.alloc_len(n))
+	for uint32(len(buf)) < n {
+		chunk := n - uint32(len(buf))
+		if chunk > 64*1024 {
+			chunk = 64 * 1024
+		}
+		data, err := self.read_full(int(chunk))
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, data...)
+	}
+	return buf, nil
+}
+
+//an object reference, or the inline value's U29 bits.
+func (self *Decoder) read_object_ref() (ref interface{}, v uint32, inline bool, err error) {
+
+	v, inline, err = self.read_ref_u29()
+	if err != nil || inline {
+		return
+	}
+
+	if int(v) >= len(self.objects) {
+		err = fmt.Errorf("amf3: object reference %d out of range.", v)
+		return
+	}
+
+	return self.objects[v], v, false, nil
+}
+
+//reserve a slot in the object table, filled once the value is complete.
+func (self *Decoder) add_object(v interface{}) int {
+	self.objects = append(self.objects, v)
+	return len(self.objects) - 1
+}
+
+//read one value.
+func (self *Decoder) Decode() (interface{}, error) {
+
+	marker, err := self.read_u8()
+	if err != nil {
+		return nil, err
+	}
+
+	switch marker {
+	case undefined_marker:
+		return Undefined{}, nil
+	case null_marker:
+		return nil, nil
+	case false_marker:
+		return false, nil
+	case true_marker:
+		return true, nil
+	case integer_marker:
+		v, err := self.read_u29()
+		if v&(1<<28) != 0 {
+			return int(v) - 1<<29, err //sign extend
+		}
+		return int(v), err
+	case double_marker:
+		return self.read_double()
+	case string_marker:
+		return self.read_string()
+	}
+
+	if self.depth >= MaxDepth {
+		return nil, ErrTooDeep
+	}
+	self.depth++
+	defer func() { self.depth-- }()
+
+	ref, v, inline, err := self.read_object_ref()
+	if err != nil || !inline {
+		return ref, err
+	}
+
+	switch marker {
+	case xml_document_marker, xml_marker:
+		buf, err := self.read_full_checked(v)
+		if err != nil {
+			return nil, err
+		}
+		if marker == xml_marker {
+			self.add_object(XML(buf))
+			return XML(buf), nil
+		}
+		self.add_object(XMLDocument(buf))
+		return XMLDocument(buf), nil
+
+	case date_marker:
+		ms, err := self.read_double()
+		if err != nil {
+			return nil, err
+		}
+		if math.IsNaN(ms) || math.IsInf(ms, 0) {
+			return nil, fmt.Errorf("amf3: invalid date.")
+		}
+		t := to_time(ms)
+		self.add_object(t)
+		return t, nil
+
+	case byte_array_marker:
+		buf, err := self.read_full_checked(v)
+		if err != nil {
+			return nil, err
+		}
+		self.add_object(buf)
+		return buf, nil
+
+	case array_marker:
+		return self.read_array(v)
+
+	case object_marker:
+		return self.read_object(v)
+
+	case vector_int_marker, vector_uint_marker, vector_double_marker, vector_object_marker:
+		return self.read_vector(marker, v)
+
+	case dictionary_marker:
+		return self.read_dictionary(v)
+	}
+
+	return nil, fmt.Errorf("amf3: unknown type 0x%02x.", marker)
+}
+
+func (self *Decoder) read_array(dense_len uint32) (interface{}, error) {
+
+	index := self.add_object(nil)
+
+	var assoc []Property
+	for {
+		name, err := self.read_string()
+		if err != nil {
+			return nil, err
+		}
+		if name == "" {
+			break
+		}
+
+		value, err := self.Decode()
+		if err != nil {
+			return nil, err
+		}
+
+		assoc = append(assoc, Property{name, value})
+	}
+
+	dense := make([]interface{}, 0, self.alloc_len(dense_len))
+
+	for i := uint32(0); i < dense_len; i++ {
+		value, err := self.Decode()
+		if err != nil {
+			return nil, err
+		}
+		dense = append(dense, value)
+	}
+
+	if len(assoc) == 0 {
+		self.objects[index] = dense
+		return dense, nil
+	}
+
+	arr := &Array{Associative: assoc, Dense: dense}
+	self.objects[index] = arr
+
+	return arr, nil
+}
+
+func (self *Decoder) read_traits(v uint32) (*Traits, error) {
+
+	//U29O-traits-ref
+	if v&1 == 0 {
+		if int(v>>1) >= len(self.traits) {
+			return nil, fmt.Errorf("amf3: traits reference %d out of range.", v>>1)
+		}
+		return self.traits[v>>1], nil
+	}
+
+	traits := &Traits{
+		Externalizable: v&2 != 0,
+		Dynamic:        v&4 != 0,
+	}
+
+	class_name, err := self.read_string()
+	if err != nil {
+		return nil, err
+	}
+	traits.ClassName = class_name
+
+	count := v >> 3
+	if traits.Externalizable && count != 0 {
+		return nil, fmt.Errorf("amf3: externalizable traits with sealed members.")
+	}
+
+	for i := uint32(0); i < count; i++ {
+		name, err := self.read_string()
+		if err != nil {
+			return nil, err
+		}
+		traits.Members = append(traits.Members, name)
+	}
+
+	self.traits = append(self.traits, traits)
+
+	return traits, nil
+}
+
+func (self *Decoder) read_object(v uint32) (interface{}, error) {
+
+	traits, err := self.read_traits(v)
+	if err != nil {
+		return nil, err
+	}
+
+	obj := &Object{Traits: traits}
+	index := self.add_object(obj)
+
+	if traits.Externalizable {
+		ext, ok := externalizables[traits.ClassName]
+		if !ok {
+			return nil, fmt.Errorf("amf3: unknown externalizable class %q.", traits.ClassName)
+		}
+		obj.External, err = ext.read(self)
+		return obj, err
+	}
+
+	for range traits.Members {
+		value, err := self.Decode()
+		if err != nil {
+			return nil, err
+		}
+		obj.Sealed = append(obj.Sealed, value)
+	}
+
+	if traits.Dynamic {
+		for {
+			name, err := self.read_string()
+			if err != nil {
+				return nil, err
+			}
+			if name == "" {
+				break
+			}
+
+			value, err := self.Decode()
+			if err != nil {
+				return nil, err
+			}
+
+			obj.Dynamic = append(obj.Dynamic, Property{name, value})
+		}
+	}
+
+	//anonymous object
+	if traits.ClassName == "" && traits.Dynamic && len(traits.Members) == 0 {
+		m := make(map[string]interface{}, len(obj.Dynamic))
+		for _, p := range obj.Dynamic {
+			m[p.Name] = p.Value
+		}
+		self.objects[index] = m
+		return m, nil
+	}
+
+	return obj, nil
+}
+
+func (self *Decoder) read_vector(marker uint8, count uint32) (interface{}, error) {
+
+	index := self.add_object(nil)
+
+	fixed, err := self.read_u8()
+	if err != nil {
+		return nil, err
+	}
+
+	var vec interface{}
+
+	switch marker {
+	case vector_int_marker:
+		items := make([]int32, 0, self.alloc_len(count))
+		for i := uint32(0); i < count; i++ {
+			v, err := self.read_u32()
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, int32(v))
+		}
+		vec = items
+
+	case vector_uint_marker:
+		items := make([]uint32, 0, self.alloc_len(count))
+		for i := uint32(0); i < count; i++ {
+			v, err := self.read_u32()
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, v)
+		}
+		vec = items
+
+	case vector_double_marker:
+		items := make([]float64, 0, self.alloc_len(count))
+		for i := uint32(0); i < count; i++ {
+			v, err := self.read_double()
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, v)
+		}
+		vec = items
+
+	default:
+		type_name, err := self.read_string()
+		if err != nil {
+			return nil, err
+		}
+		ov := &ObjectVector{TypeName: type_name, Fixed: fixed != 0}
+		self.objects[index] = ov
+
+		ov.Items = make([]interface{}, 0, self.alloc_len(count))
+		for i := uint32(0); i < count; i++ {
+			v, err := self.Decode()
+			if err != nil {
+				return nil, err
+			}
+			ov.Items = append(ov.Items, v)
+		}
+		vec = ov
+	}
+
+	self.objects[index] = vec
+
+	return vec, nil
+}
+
+func (self *Decoder) read_dictionary(count uint32) (interface{}, error) {
+
+	weak, err := self.read_u8()
+	if err != nil {
+		return nil, err
+	}
+
+	dict := &Dictionary{WeakKeys: weak != 0}
+	self.add_object(dict)
+
+	dict.Entries = make([]DictionaryEntry, 0, self.alloc_len(count))
+	for i := uint32(0); i < count; i++ {
+		key, err := self.Decode()
+		if err != nil {
+			return nil, err
+		}
+		value, err := self.Decode()
+		if err != nil {
+			return nil, err
+		}
+		dict.Entries = append(dict.Entries, DictionaryEntry{key, value})
+	}
+
+	return dict, nil
+}
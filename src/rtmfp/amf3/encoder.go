@@ -0,0 +1,489 @@
+package amf3
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"sort"
+	"time"
+)
+
+//Encoder write AMF3 values to a stream. maps, slices and pointers written again are
+//written as references, strings and traits too, until Reset().
+type Encoder struct {
+	w   io.Writer
+	err error //first write error
+
+	strings map[string]int
+	objects map[object_key]int
+	traits  map[string]int
+
+	object_count int
+	depth        int
+}
+
+//identity of a map, slice or pointer, slices of the same array differ by length.
+type object_key struct {
+	ptr uintptr
+	len int
+	typ reflect.Type
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	e := &Encoder{w: w}
+	e.Reset()
+	return e
+}
+
+//clear the reference tables.
+func (self *Encoder) Reset() {
+	self.strings = make(map[string]int)
+	self.objects = make(map[object_key]int)
+	self.traits = make(map[string]int)
+	self.object_count = 0
+}
+
+//raw bytes, for externalizable classes.
+func (self *Encoder) Write(p []byte) (int, error) {
+	if self.err != nil {
+		return 0, self.err
+	}
+	n, err := self.w.Write(p)
+	self.err = err
+	return n, err
+}
+
+func (self *Encoder) write_u8(v uint8) {
+	self.Write([]byte{v})
+}
+
+func (self *Encoder) write_u32(v uint32) {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], v)
+	self.Write(buf[:])
+}
+
+func (self *Encoder) write_double(v float64) {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], math.Float64bits(v))
+	self.Write(buf[:])
+}
+
+func (self *Encoder) write_u29(v uint32) error {
+
+	switch {
+	case v < 0x80:
+		self.Write([]byte{byte(v)})
+	case v < 0x4000:
+		self.Write([]byte{byte(v>>7 | 0x80), byte(v & 0x7f)})
+	case v < 0x200000:
+		self.Write([]byte{byte(v>>14 | 0x80), byte(v>>7 | 0x80), byte(v & 0x7f)})
+	case v <= max_u29:
+		self.Write([]byte{byte(v>>22 | 0x80), byte(v>>15 | 0x80), byte(v>>8 | 0x80), byte(v)})
+	default:
+		return fmt.Errorf("amf3: %d exceed 29 bits.", v)
+	}
+
+	return nil
+}
+
+//an inline value with its length or flags.
+func (self *Encoder) write_inline(v int) error {
+	if v < 0 || v > max_u29>>1 {
+		return errors.New("amf3: too long.")
+	}
+	return self.write_u29(uint32(v)<<1 | 1)
+}
+
+func (self *Encoder) write_ref(index int) error {
+	return self.write_u29(uint32(index) << 1)
+}
+
+func (self *Encoder) write_string(v string) error {
+
+	if v == "" {
+		return self.write_u29(1)
+	}
+
+	if index, ok := self.strings[v]; ok {
+		return self.write_ref(index)
+	}
+
+	if err := self.write_inline(len(v)); err != nil {
+		return err
+	}
+	self.strings[v] = len(self.strings)
+	self.Write([]byte(v))
+
+	return nil
+}
+
+//write a reference if the value was written before, otherwise count it.
+func (self *Encoder) write_object_ref(v interface{}) (bool, error) {
+
+	rv := reflect.ValueOf(v)
+
+	var key object_key
+	switch rv.Kind() {
+	case reflect.Map, reflect.Ptr:
+		key = object_key{ptr: rv.Pointer(), typ: rv.Type()}
+	case reflect.Slice:
+		key = object_key{ptr: rv.Pointer(), len: rv.Len(), typ: rv.Type()}
+	}
+
+	if key.ptr != 0 {
+		if index, ok := self.objects[key]; ok {
+			return true, self.write_ref(index)
+		}
+		self.objects[key] = self.object_count
+	}
+	self.object_count++
+
+	return false, nil
+}
+
+//write one value.
+func (self *Encoder) Encode(val interface{}) error {
+
+	if err := self.encode(val); err != nil {
+		return err
+	}
+
+	return self.err
+}
+
+func (self *Encoder) encode(val interface{}) error {
+
+	switch v := val.(type) {
+	case nil:
+		self.write_u8(null_marker)
+	case Undefined:
+		self.write_u8(undefined_marker)
+	case bool:
+		if v {
+			self.write_u8(true_marker)
+		} else {
+			self.write_u8(false_marker)
+		}
+	case int:
+		return self.write_int(int64(v))
+	case int8:
+		return self.write_int(int64(v))
+	case int16:
+		return self.write_int(int64(v))
+	case int32:
+		return self.write_int(int64(v))
+	case int64:
+		return self.write_int(v)
+	case uint:
+		return self.write_uint(uint64(v))
+	case uint8:
+		return self.write_int(int64(v))
+	case uint16:
+		return self.write_int(int64(v))
+	case uint32:
+		return self.write_uint(uint64(v))
+	case uint64:
+		return self.write_uint(v)
+	case float32:
+		self.write_u8(double_marker)
+		self.write_double(float64(v))
+	case float64:
+		self.write_u8(double_marker)
+		self.write_double(v)
+	case string:
+		self.write_u8(string_marker)
+		return self.write_string(v)
+	default:
+		return self.encode_complex(val)
+	}
+
+	return nil
+}
+
+func (self *Encoder) write_int(v int64) error {
+	if v < min_int || v > max_int {
+		self.write_u8(double_marker)
+		self.write_double(float64(v))
+		return nil
+	}
+
+	self.write_u8(integer_marker)
+	return self.write_u29(uint32(v) & max_u29)
+}
+
+func (self *Encoder) write_uint(v uint64) error {
+	if v > max_int {
+		self.write_u8(double_marker)
+		self.write_double(float64(v))
+		return nil
+	}
+	return self.write_int(int64(v))
+}
+
+//values in the object reference table.
+func (self *Encoder) encode_complex(val interface{}) error {
+
+	if self.depth >= MaxDepth {
+		return ErrTooDeep
+	}
+	self.depth++
+	defer func() { self.depth-- }()
+
+	marker, ok := complex_marker(val)
+	if !ok {
+		return fmt.Errorf("amf3: unsupported type %T.", val)
+	}
+
+	self.write_u8(marker)
+
+	if done, err := self.write_object_ref(val); done || err != nil {
+		return err
+	}
+
+	switch v := val.(type) {
+	case XMLDocument:
+		return self.write_bytes(string(v))
+	case XML:
+		return self.write_bytes(string(v))
+	case []byte:
+		return self.write_bytes(string(v))
+
+	case time.Time:
+		self.write_u29(1)
+		self.write_double(from_time(v))
+		return nil
+
+	case []interface{}:
+		return self.write_array(nil, v)
+	case *Array:
+		return self.write_array(v.Associative, v.Dense)
+
+	case map[string]interface{}:
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		obj := &Object{Traits: &Traits{Dynamic: true}}
+		for _, name := range names {
+			obj.Dynamic = append(obj.Dynamic, Property{name, v[name]})
+		}
+		return self.write_object(obj)
+	case *Object:
+		return self.write_object(v)
+
+	case []int32:
+		if err := self.write_inline(len(v)); err != nil {
+			return err
+		}
+		self.write_u8(0)
+		for _, item := range v {
+			self.write_u32(uint32(item))
+		}
+		return nil
+	case []uint32:
+		if err := self.write_inline(len(v)); err != nil {
+			return err
+		}
+		self.write_u8(0)
+		for _, item := range v {
+			self.write_u32(item)
+		}
+		return nil
+	case []float64:
+		if err := self.write_inline(len(v)); err != nil {
+			return err
+		}
+		self.write_u8(0)
+		for _, item := range v {
+			self.write_double(item)
+		}
+		return nil
+	case *ObjectVector:
+		if err := self.write_inline(len(v.Items)); err != nil {
+			return err
+		}
+		self.write_bool(v.Fixed)
+		if err := self.write_string(v.TypeName); err != nil {
+			return err
+		}
+		return self.write_values(v.Items)
+
+	case *Dictionary:
+		if err := self.write_inline(len(v.Entries)); err != nil {
+			return err
+		}
+		self.write_bool(v.WeakKeys)
+		for _, entry := range v.Entries {
+			if err := self.encode(entry.Key); err != nil {
+				return err
+			}
+			if err := self.encode(entry.Value); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return nil
+}
+
+func complex_marker(val interface{}) (uint8, bool) {
+	switch val.(type) {
+	case XMLDocument:
+		return xml_document_marker, true
+	case XML:
+		return xml_marker, true
+	case []byte:
+		return byte_array_marker, true
+	case time.Time:
+		return date_marker, true
+	case []interface{}, *Array:
+		return array_marker, true
+	case map[string]interface{}, *Object:
+		return object_marker, true
+	case []int32:
+		return vector_int_marker, true
+	case []uint32:
+		return vector_uint_marker, true
+	case []float64:
+		return vector_double_marker, true
+	case *ObjectVector:
+		return vector_object_marker, true
+	case *Dictionary:
+		return dictionary_marker, true
+	}
+	return 0, false
+}
+
+func (self *Encoder) write_bool(v bool) {
+	if v {
+		self.write_u8(1)
+	} else {
+		self.write_u8(0)
+	}
+}
+
+func (self *Encoder) write_bytes(v string) error {
+	if err := self.write_inline(len(v)); err != nil {
+		return err
+	}
+	self.Write([]byte(v))
+	return nil
+}
+
+func (self *Encoder) write_values(values []interface{}) error {
+	for _, v := range values {
+		if err := self.encode(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//members and the empty name which end them.
+func (self *Encoder) write_properties(props []Property) error {
+	for _, p := range props {
+		if p.Name == "" {
+			return errors.New("amf3: empty member name.")
+		}
+		if err := self.write_string(p.Name); err != nil {
+			return err
+		}
+		if err := self.encode(p.Value); err != nil {
+			return err
+		}
+	}
+	return self.write_string("")
+}
+
+func (self *Encoder) write_array(assoc []Property, dense []interface{}) error {
+	if err := self.write_inline(len(dense)); err != nil {
+		return err
+	}
+	if err := self.write_properties(assoc); err != nil {
+		return err
+	}
+	return self.write_values(dense)
+}
+
+func (self *Encoder) write_object(obj *Object) error {
+
+	traits := obj.Traits
+	if traits == nil {
+		traits = &Traits{Dynamic: true}
+	}
+
+	if err := self.write_traits(traits); err != nil {
+		return err
+	}
+
+	if traits.Externalizable {
+		ext, ok := externalizables[traits.ClassName]
+		if !ok {
+			return fmt.Errorf("amf3: unknown externalizable class %q.", traits.ClassName)
+		}
+		return ext.write(self, obj.External)
+	}
+
+	if len(obj.Sealed) != len(traits.Members) {
+		return fmt.Errorf("amf3: %d sealed values for %d members.", len(obj.Sealed), len(traits.Members))
+	}
+
+	if err := self.write_values(obj.Sealed); err != nil {
+		return err
+	}
+
+	if traits.Dynamic {
+		return self.write_properties(obj.Dynamic)
+	}
+
+	return nil
+}
+
+func (self *Encoder) write_traits(traits *Traits) error {
+
+	key := traits.key()
+	if index, ok := self.traits[key]; ok {
+		//U29O-traits-ref
+		return self.write_u29(uint32(index)<<2 | 1)
+	}
+	self.traits[key] = len(self.traits)
+
+	if traits.Externalizable && len(traits.Members) > 0 {
+		return errors.New("amf3: externalizable traits with sealed members.")
+	}
+
+	if len(traits.Members) > max_u29>>4 {
+		return errors.New("amf3: too many members.")
+	}
+
+	flags := uint32(0x03)
+	if traits.Externalizable {
+		flags |= 0x04
+	}
+	if traits.Dynamic {
+		flags |= 0x08
+	}
+
+	if err := self.write_u29(uint32(len(traits.Members))<<4 | flags); err != nil {
+		return err
+	}
+
+	if err := self.write_string(traits.ClassName); err != nil {
+		return err
+	}
+
+	for _, member := range traits.Members {
+		if err := self.write_string(member); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -30,8 +30,8 @@ func gen_peerid_from_cert(cert []byte) []byte {
 }
 
 //unit is 4 milliseconds
-func timestamp() uint16 {
-	return uint16(time.Now().UnixNano() / (4 * 1000000))
+func timestamp(now time.Time) uint16 {
+	return uint16(now.UnixNano() / (4 * 1000000))
 }
 
 func HmacSha256(a, b []byte) []byte {
@@ -150,6 +150,10 @@ func read_option(buf []byte, opt_type uint8) []byte {
 		var this_opt_type uint8
 		binary.Read(r, binary.BigEndian, &this_opt_type)
 
+		if data_len < 0 || data_len > r.Len() {
+			break
+		}
+
 		if opt_type == this_opt_type {
 			return r.Bytes()[:data_len]
 		}
@@ -160,6 +164,78 @@ func read_option(buf []byte, opt_type uint8) []byte {
 	return nil
 }
 
+func read_all_options(buf []byte, opt_type uint8) (opts [][]byte) {
+
+	r := bytes.NewBuffer(buf)
+
+	for r.Len() > 0 {
+
+		len := decode_vlu(r)
+		data_len := int(len - 1)
+
+		var this_opt_type uint8
+		binary.Read(r, binary.BigEndian, &this_opt_type)
+
+		if data_len < 0 || data_len > r.Len() {
+			break
+		}
+
+		if opt_type == this_opt_type {
+			opts = append(opts, r.Bytes()[:data_len])
+		}
+
+		r.Next(data_len)
+	}
+
+	return opts
+}
+
+//copy buf without options of opt_type.
+func strip_option(buf []byte, opt_type uint8) []byte {
+
+	stripped := bytes.NewBuffer(nil)
+
+	r := bytes.NewBuffer(buf)
+
+	for r.Len() > 0 {
+
+		opt := r.Bytes()
+
+		opt_len := decode_vlu(r)
+		data_len := int(opt_len - 1)
+
+		var this_opt_type uint8
+		binary.Read(r, binary.BigEndian, &this_opt_type)
+
+		if data_len < 0 || data_len > r.Len() {
+			break
+		}
+
+		//vlu + type + data
+		opt = opt[:len(opt)-r.Len()+data_len]
+		if this_opt_type != opt_type {
+			stripped.Write(opt)
+		}
+
+		r.Next(data_len)
+	}
+
+	return stripped.Bytes()
+}
+
+//initiator certificate carry the certificate of the initiator endpoint plus its dh public option(0x1D),
+//peerid of the initiator is calculated without the dh option.
+//flash player only send the dh option, its peerid is the hash of the whole certificate.
+func gen_peerid_from_init_cert(initCert []byte) []byte {
+
+	cert := strip_option(initCert, 0x1D)
+	if len(cert) == 0 {
+		cert = initCert
+	}
+
+	return gen_peerid_from_cert(cert)
+}
+
 func read_vlu_option(buf []byte, opt_type uint8, default_value uint) uint {
 
 	r := bytes.NewBuffer(buf)
@@ -167,15 +243,20 @@ func read_vlu_option(buf []byte, opt_type uint8, default_value uint) uint {
 	for r.Len() > 0 {
 
 		len := decode_vlu(r)
+		data_len := int(len - 1)
 
 		var this_opt_type uint8
 		binary.Read(r, binary.BigEndian, &this_opt_type)
 
+		//the end of the options.
+		if data_len < 0 || data_len > r.Len() {
+			break
+		}
+
 		if opt_type == this_opt_type {
 			return decode_vlu(r)
 		}
 
-		data_len := int(len - 1)
 		r.Next(data_len)
 	}
 
@@ -203,29 +284,80 @@ func decode_endpoint_discriminator(r *bytes.Buffer) (edpType uint8, edpData []by
 	return
 }
 
+func encode_endpoint_discriminator(w io.Writer, edpType uint8, edpData []byte) {
+
+	edp_len := uint(len(edpData))
+
+	encode_vlu(w, get_vlu_size(1+edp_len)+1+edp_len)
+	encode_vlu(w, 1+edp_len)
+	binary.Write(w, binary.BigEndian, edpType)
+	w.Write(edpData)
+}
+
 func decode_address(r *bytes.Buffer) string {
+	addr, _, _ := decode_address_origin(r)
+	return addr
+}
 
-	var flag uint8
-	binary.Read(r, binary.BigEndian, &flag)
+//address and its origin flag, ok is false if the buffer is too short.
+func decode_address_origin(r *bytes.Buffer) (addr string, origin uint8, ok bool) {
 
-	var ipAddress net.IP
-	if flag&0x80 == 0 {
-		ipAddress = r.Bytes()[0:4] //ipv4
-		r.Next(4)
-	} else {
-		ipAddress = r.Bytes()[0:16] //ipv6
-		r.Next(16)
+	if r.Len() < 1 {
+		return
+	}
+
+	flag, _ := r.ReadByte()
+
+	ip_len := 4 //ipv4
+	if flag&0x80 != 0 {
+		ip_len = 16 //ipv6
 	}
 
+	if r.Len() < ip_len+2 {
+		r.Next(r.Len())
+		return
+	}
+
+	ipAddress := make(net.IP, ip_len)
+	copy(ipAddress, r.Next(ip_len))
+
 	var port uint16
 	binary.Read(r, binary.BigEndian, &port)
 
-	addr := &net.UDPAddr{
+	udp_addr := &net.UDPAddr{
 		IP:   ipAddress,
 		Port: int(port),
 	}
 
-	return addr.String()
+	return udp_addr.String(), flag & 0x03, true
+}
+
+//origin of the address, low 2 bits of the address flags.
+var address_origin_unknown = uint8(0)
+var address_origin_local = uint8(1)
+var address_origin_observed = uint8(2)
+var address_origin_relay = uint8(3)
+
+func encode_address(w io.Writer, addr string, origin uint8) error {
+
+	udp_addr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+
+	flag := origin & 0x03
+
+	ip := udp_addr.IP.To4()
+	if ip == nil {
+		flag |= 0x80 //ipv6
+		ip = udp_addr.IP.To16()
+	}
+
+	binary.Write(w, binary.BigEndian, flag)
+	w.Write(ip)
+	binary.Write(w, binary.BigEndian, uint16(udp_addr.Port))
+
+	return nil
 }
 
 func min_duration(a, b time.Duration) time.Duration {
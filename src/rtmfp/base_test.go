@@ -45,3 +45,67 @@ func TestVlu(t *testing.T) {
 		t.Fatal()
 	}
 }
+
+func TestAddress(t *testing.T) {
+
+	for _, addr := range []string{"127.0.0.1:1935", "[::1]:1935", "[2001:db8::1]:65535"} {
+
+		buf := bytes.NewBuffer(nil)
+		if err := encode_address(buf, addr, address_origin_observed); err != nil {
+			t.Fatal(err)
+		}
+
+		if decoded := decode_address(buf); decoded != addr {
+			t.Fatal("address not match.", addr, decoded)
+		}
+	}
+
+	for _, origin := range []uint8{address_origin_unknown, address_origin_local, address_origin_observed, address_origin_relay} {
+
+		buf := bytes.NewBuffer(nil)
+		encode_address(buf, "[2001:db8::1]:1935", origin)
+
+		data := buf.Bytes()
+		if data[0] != 0x80|origin || len(data) != 1+16+2 {
+			t.Fatal("unexpected encoding.", data)
+		}
+
+		if addr, decoded, ok := decode_address_origin(buf); !ok || decoded != origin || addr != "[2001:db8::1]:1935" {
+			t.Fatal("origin not match.", origin, decoded)
+		}
+	}
+
+	//truncated
+	buf := bytes.NewBuffer(nil)
+	encode_address(buf, "[::1]:1935", address_origin_local)
+
+	if _, _, ok := decode_address_origin(bytes.NewBuffer(buf.Bytes()[:10])); ok {
+		t.Fatal("truncated address decoded.")
+	}
+}
+
+func TestInitCertPeerid(t *testing.T) {
+
+	h := &handshake{profile: default_crypto_profile}
+	h.gen_certificate()
+
+	//certificate + OPTION(x1D, group + DH)
+	dh := bytes.Repeat([]byte{0xab}, 128)
+
+	cert := bytes.NewBuffer(nil)
+	cert.Write(h.certificate)
+	encode_vlu(cert, uint(2+len(dh)))
+	cert.WriteByte(0x1D)
+	cert.WriteByte(dh_group_modp1024)
+	cert.Write(dh)
+
+	if !bytes.Equal(gen_peerid_from_init_cert(cert.Bytes()), h.peerid()) {
+		t.Fatal("peerid of initiator not match.")
+	}
+
+	//flash player
+	flash_cert := cert.Bytes()[len(h.certificate):]
+	if !bytes.Equal(gen_peerid_from_init_cert(flash_cert), gen_peerid_from_cert(flash_cert)) {
+		t.Fatal("peerid of flash player not match.")
+	}
+}
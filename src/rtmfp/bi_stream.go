@@ -32,8 +32,9 @@ import (
 var bi_stream_handler = "__data"
 
 type bi_stream struct {
-	name string
-	ns   *net_stream
+	name    string
+	session *session
+	ns      *net_stream
 
 	received_msgs chan []byte
 	closed        bool
@@ -82,6 +83,8 @@ func (self *bi_stream) passive_open_dispatch(play_event chan bool) {
 			self.close()
 		} else if cmd == bi_stream_handler {
 			self.received_msgs <- param.([]byte)
+		} else if is_stream_control(cmd) {
+			//answered by recv(), e.g. pause and seek.
 		} else {
 			fmt.Printf("unknown cmd:%s\n", cmd)
 		}
@@ -94,6 +97,8 @@ func (self *bi_stream) active_open(session *session, dstStream string) (err erro
 		panic("session not empty!")
 	}
 
+	self.session = session
+
 	self.ns = &net_stream{
 		session: session,
 	}
@@ -108,6 +113,9 @@ func (self *bi_stream) active_open(session *session, dstStream string) (err erro
 
 	play_start_event := make(chan bool, 1)
 
+	//the session may be opened by the far end, after a glare.
+	passive_recv_flow := session.create_recv_flow
+
 	session.create_recv_flow = func(options []byte, flowid uint) (*recv_flow, error) {
 
 		rel_flowid := read_vlu_option(options, 0xa, 0)
@@ -118,6 +126,8 @@ func (self *bi_stream) active_open(session *session, dstStream string) (err erro
 
 			return self.ns.recvFlow, nil
 
+		} else if passive_recv_flow != nil {
+			return passive_recv_flow(options, flowid)
 		} else {
 			fmt.Println("not expect this flow!")
 			//panic("not expect this flow!")
@@ -130,7 +140,7 @@ func (self *bi_stream) active_open(session *session, dstStream string) (err erro
 	//received play.start?
 	select {
 	case <-play_start_event:
-	case <-time.After(3 * time.Second):
+	case <-session.clock.After(3 * time.Second):
 		return errors.New("not recv play.start in 3s.")
 	}
 
@@ -145,6 +155,8 @@ func (self *bi_stream) passive_open(session *session, dstStream string) error {
 		panic("session empty!")
 	}
 
+	self.session = session
+
 	self.received_msgs = make(chan []byte, 1000)
 
 	play_event := make(chan bool, 1)
@@ -195,7 +207,7 @@ func (self *bi_stream) close() {
 		close(self.received_msgs)
 
 		//close the session because it is the only user.
-		self.ns.session.close()
+		self.session.close()
 	}
 }
 
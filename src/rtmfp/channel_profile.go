@@ -0,0 +1,100 @@
+package rtmfp
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+type JitterDistribution int
+
+const (
+	JitterUniform JitterDistribution = iota //extra delay in [0, Jitter)
+	JitterNormal                            //Delay +/- normal with stddev Jitter, never below zero.
+	JitterPareto                            //heavy tailed, Pareto II with shape 3 and scale Jitter, mean Jitter/2.
+)
+
+//ChannelProfile describe impairments of one direction of a simulated link,
+//zero value is a perfect link.
+type ChannelProfile struct {
+	Delay              time.Duration
+	Jitter             time.Duration
+	JitterDistribution JitterDistribution
+	KeepOrder          bool //jitter only delay packets, never reorder them.
+	Disorder           bool //50% chance to swap a packet with the one queued before it.
+
+	LoseRate  int             //0-100, uniform loss.
+	BurstLoss *GilbertElliott //bursty loss, replace LoseRate when set.
+
+	DuplicateRate int //0-100, a duplicated packet get its own delay.
+	CorruptRate   int //0-100, flip one random bit of the packet.
+
+	Capacity      int //queued packets, packets exceed it are dropped. 0 unlimited.
+	MaxPacketSize int //0 unlimited.
+
+	Speed     int         //bytes/s, 0 unlimited.
+	RateTrace []RatePoint //scripted speed changes, override Speed from their time on.
+
+	DeliveryTrace *DeliveryTrace //recorded link capacity, replace Speed and RateTrace when set.
+	DelayTrace    *DelayTrace    //recorded delay and loss, replace Delay, Jitter and loss when set.
+
+	Seed int64 //seed of all random impairments, 0 for a random seed.
+}
+
+//two state Markov loss model. P and R are transition probabilities per packet,
+//LossGood and LossBad the loss probability in each state, all in [0, 1].
+//mean burst length is 1/R packets.
+type GilbertElliott struct {
+	P, R              float64
+	LossGood, LossBad float64
+}
+
+//from At after the channel opened, the speed is Speed bytes/s, 0 unlimited.
+//points should be sorted by At.
+type RatePoint struct {
+	At    time.Duration
+	Speed int
+}
+
+//speed at the elapsed time since the channel opened.
+func (self *ChannelProfile) speed_at(elapsed time.Duration) int {
+	speed := self.Speed
+	for _, point := range self.RateTrace {
+		if point.At > elapsed {
+			break
+		}
+		speed = point.Speed
+	}
+	return speed
+}
+
+//delay of a packet entering the channel at elapsed since it opened, without the serialization delay.
+func (self *ChannelProfile) packet_delay(r *rand.Rand, elapsed time.Duration) time.Duration {
+
+	if self.DelayTrace != nil {
+		return self.DelayTrace.record_at(elapsed).Delay
+	}
+
+	if self.Jitter <= 0 {
+		return self.Delay
+	}
+
+	var delay time.Duration
+
+	switch self.JitterDistribution {
+	case JitterNormal:
+		delay = self.Delay + time.Duration(r.NormFloat64()*float64(self.Jitter))
+	case JitterPareto:
+		//inverse transform of Pareto II: scale * (u^(-1/shape) - 1)
+		u := 1 - r.Float64() //(0, 1]
+		delay = self.Delay + time.Duration(float64(self.Jitter)*(math.Pow(u, -1.0/3)-1))
+	default:
+		delay = self.Delay + time.Duration(r.Int63n(int64(self.Jitter)))
+	}
+
+	if delay < 0 {
+		delay = 0
+	}
+
+	return delay
+}
@@ -0,0 +1,209 @@
+package rtmfp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var mahimahi_mtu = 1500
+
+//DeliveryTrace replay a Mahimahi link trace: each opportunity deliver up to MTU bytes
+//of the packets waiting at that time, unused opportunities are lost. the trace loops.
+type DeliveryTrace struct {
+	Opportunities []time.Duration //sorted, from the start of the period
+	Period        time.Duration
+	MTU           int
+}
+
+//Mahimahi format: one line per 1500-byte delivery opportunity, the millisecond it
+//happen at. lines with the same millisecond are several opportunities, the trace loops
+//after the last millisecond.
+func LoadDeliveryTrace(r io.Reader) (*DeliveryTrace, error) {
+
+	trace := &DeliveryTrace{MTU: mahimahi_mtu}
+
+	err := scan_trace_lines(r, func(line int, fields []string) error {
+
+		if len(fields) != 1 {
+			return fmt.Errorf("line %d: expect one timestamp.", line)
+		}
+
+		ms, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil || ms < 0 {
+			return fmt.Errorf("line %d: invalid timestamp %q.", line, fields[0])
+		}
+
+		at := time.Duration(ms) * time.Millisecond
+		if n := len(trace.Opportunities); n > 0 && at < trace.Opportunities[n-1] {
+			return fmt.Errorf("line %d: timestamp goes backwards.", line)
+		}
+
+		trace.Opportunities = append(trace.Opportunities, at)
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(trace.Opportunities) == 0 {
+		return nil, errors.New("empty delivery trace.")
+	}
+
+	trace.Period = trace.Opportunities[len(trace.Opportunities)-1]
+	if trace.Period == 0 {
+		return nil, errors.New("delivery trace last less than 1ms.")
+	}
+
+	return trace, nil
+}
+
+func LoadDeliveryTraceFile(path string) (*DeliveryTrace, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return LoadDeliveryTrace(f)
+}
+
+//time of the i-th opportunity since the trace start, counting all loops.
+func (self *DeliveryTrace) opportunity(i int64) time.Duration {
+	n := int64(len(self.Opportunities))
+	return time.Duration(i/n)*self.Period + self.Opportunities[i%n]
+}
+
+//index of the first opportunity at or after t.
+func (self *DeliveryTrace) first_at_or_after(t time.Duration) int64 {
+	n := int64(len(self.Opportunities))
+
+	//the last opportunity is at the end of its period.
+	loops := int64(0)
+	if t > 0 {
+		loops = int64((t - 1) / self.Period)
+	}
+	offset := t - time.Duration(loops)*self.Period
+
+	i := sort.Search(len(self.Opportunities), func(k int) bool { return self.Opportunities[k] >= offset })
+
+	return loops*n + int64(i)
+}
+
+//DelayTrace replay one way delay and loss recorded by probes on a real network,
+//each packet get the delay or loss of the last probe sent before it. the trace loops.
+type DelayTrace struct {
+	Records []DelayRecord //sorted by At
+	Period  time.Duration
+}
+
+type DelayRecord struct {
+	At    time.Duration //probe sent time, from the start of the trace
+	Delay time.Duration
+	Lost  bool
+}
+
+//one line per probe: "<sent ms> <delay ms>", delay -1 for a lost probe. the trace
+//loops after the last probe, with the interval between the last two probes.
+func LoadDelayTrace(r io.Reader) (*DelayTrace, error) {
+
+	trace := &DelayTrace{}
+
+	err := scan_trace_lines(r, func(line int, fields []string) error {
+
+		if len(fields) != 2 {
+			return fmt.Errorf("line %d: expect sent time and delay.", line)
+		}
+
+		at, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil || at < 0 {
+			return fmt.Errorf("line %d: invalid sent time %q.", line, fields[0])
+		}
+
+		delay, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil || (delay < 0 && delay != -1) {
+			return fmt.Errorf("line %d: invalid delay %q.", line, fields[1])
+		}
+
+		record := DelayRecord{
+			At:    time.Duration(at * float64(time.Millisecond)),
+			Delay: time.Duration(delay * float64(time.Millisecond)),
+			Lost:  delay == -1,
+		}
+
+		if record.Lost {
+			record.Delay = 0
+		}
+
+		if n := len(trace.Records); n > 0 && record.At <= trace.Records[n-1].At {
+			return fmt.Errorf("line %d: sent time not increasing.", line)
+		}
+
+		trace.Records = append(trace.Records, record)
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	n := len(trace.Records)
+	if n == 0 {
+		return nil, errors.New("empty delay trace.")
+	}
+
+	interval := time.Millisecond
+	if n > 1 {
+		interval = trace.Records[n-1].At - trace.Records[n-2].At
+	}
+	trace.Period = trace.Records[n-1].At + interval
+
+	return trace, nil
+}
+
+func LoadDelayTraceFile(path string) (*DelayTrace, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return LoadDelayTrace(f)
+}
+
+//the record of the last probe sent at or before t since the trace start.
+func (self *DelayTrace) record_at(t time.Duration) DelayRecord {
+	offset := t % self.Period
+
+	i := sort.Search(len(self.Records), func(k int) bool { return self.Records[k].At > offset })
+	if i == 0 {
+		return self.Records[0]
+	}
+	return self.Records[i-1]
+}
+
+//call fn with fields of each line, skip blank lines and "#" comments.
+func scan_trace_lines(r io.Reader, fn func(line int, fields []string) error) error {
+
+	scanner := bufio.NewScanner(r)
+
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		if err := fn(line, strings.Fields(text)); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
@@ -0,0 +1,180 @@
+package rtmfp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadDeliveryTrace(t *testing.T) {
+
+	trace, err := LoadDeliveryTrace(strings.NewReader("1\n1\n5\n\n10\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if trace.Period != 10*time.Millisecond || trace.MTU != 1500 {
+		t.Fatal("trace not match.", trace.Period, trace.MTU)
+	}
+
+	expect := []time.Duration{1, 1, 5, 10, 11, 11, 15, 20}
+	for i, at := range expect {
+		if trace.opportunity(int64(i)) != at*time.Millisecond {
+			t.Fatal("opportunity not match.", i, trace.opportunity(int64(i)))
+		}
+	}
+
+	if i := trace.first_at_or_after(12 * time.Millisecond); i != 6 {
+		t.Fatal("first opportunity not match.", i)
+	}
+
+	if i := trace.first_at_or_after(10 * time.Millisecond); i != 3 {
+		t.Fatal("first opportunity not match.", i)
+	}
+
+	for _, bad := range []string{"", "0\n", "5\n3\n", "1 2\n", "x\n", "-1\n"} {
+		if _, err := LoadDeliveryTrace(strings.NewReader(bad)); err == nil {
+			t.Fatalf("%q should be rejected.", bad)
+		}
+	}
+}
+
+func TestLoadDelayTrace(t *testing.T) {
+
+	trace, err := LoadDelayTrace(strings.NewReader("# comment\n0 40\n20 42.5\n40 -1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if trace.Period != 60*time.Millisecond {
+		t.Fatal("period not match.", trace.Period)
+	}
+
+	if r := trace.record_at(25 * time.Millisecond); r.Delay != 42500*time.Microsecond || r.Lost {
+		t.Fatal("record not match.", r)
+	}
+
+	if r := trace.record_at(45 * time.Millisecond); !r.Lost {
+		t.Fatal("record should be lost.", r)
+	}
+
+	//loop
+	if r := trace.record_at(65 * time.Millisecond); r.Delay != 40*time.Millisecond {
+		t.Fatal("record not match.", r)
+	}
+
+	for _, bad := range []string{"", "0\n", "0 -2\n", "10 1\n10 2\n", "a 1\n"} {
+		if _, err := LoadDelayTrace(strings.NewReader(bad)); err == nil {
+			t.Fatalf("%q should be rejected.", bad)
+		}
+	}
+}
+
+func TestNoisyChanDeliveryTrace(t *testing.T) {
+
+	trace, err := LoadDeliveryTraceFile("testdata/synthetic_cellular.mahi")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//packets waiting at the start use the opportunities one by one, across the loop.
+	count := len(trace.Opportunities) + 100
+
+	arrivals := run_noisy_chan(ChannelProfile{DeliveryTrace: trace}, count, 1500, 0, 30*time.Second)
+	if len(arrivals) != count {
+		t.Fatal("packets lost.", len(arrivals))
+	}
+
+	for i, a := range arrivals {
+		if a.seq != i || a.at != trace.opportunity(int64(i)) {
+			t.Fatal("packet not delivered at its opportunity.", i, a.seq, a.at, trace.opportunity(int64(i)))
+		}
+	}
+
+	//small packets share an opportunity.
+	arrivals = run_noisy_chan(ChannelProfile{DeliveryTrace: trace}, 300, 500, 0, 30*time.Second)
+	for i, a := range arrivals {
+		if a.at != trace.opportunity(int64(i/3)) {
+			t.Fatal("packet not delivered at its opportunity.", i, a.at, trace.opportunity(int64(i/3)))
+		}
+	}
+
+	//opportunities while the link is idle are lost, one packet per 100ms take the first one
+	//after it, unless it queue behind others in the outage.
+	interval := 100 * time.Millisecond
+	arrivals = run_noisy_chan(ChannelProfile{DeliveryTrace: trace}, 150, 1500, interval, 30*time.Second)
+
+	next := int64(0)
+	for _, a := range arrivals {
+		sent := time.Duration(a.seq) * interval
+
+		i := trace.first_at_or_after(sent)
+		if i < next {
+			i = next
+		}
+		next = i + 1
+
+		if at := trace.opportunity(i) - sent; a.at != at {
+			t.Fatal("packet not delivered at the next opportunity.", a.seq, a.at, at)
+		}
+	}
+}
+
+func TestNoisyChanDelayTrace(t *testing.T) {
+
+	trace, err := LoadDelayTraceFile("testdata/synthetic_cellular.delay")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//one packet per probe, each get the recorded delay or loss.
+	count := len(trace.Records)
+
+	arrivals := run_noisy_chan(ChannelProfile{DelayTrace: trace, KeepOrder: true}, count, 100, 20*time.Millisecond, time.Second)
+
+	lost := 0
+	for _, r := range trace.Records {
+		if r.Lost {
+			lost++
+		}
+	}
+
+	if len(arrivals) != count-lost {
+		t.Fatal("loss not match.", len(arrivals), count-lost)
+	}
+
+	for _, a := range arrivals {
+		r := trace.Records[a.seq]
+		if r.Lost {
+			t.Fatal("lost packet delivered.", a.seq)
+		}
+		if a.at < r.Delay {
+			t.Fatal("delay not match.", a.seq, a.at, r.Delay)
+		}
+	}
+}
+
+//regression: the same cellular like conditions, the transfer and its duration should not change.
+//the traces in testdata are synthetic, not recorded on a real network. recorded Mahimahi traces
+//and probe logs in the same formats can replace them.
+func TestFlowCellularTrace(t *testing.T) {
+
+	delivery, err := LoadDeliveryTraceFile("testdata/synthetic_cellular.mahi")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	delay, err := LoadDelayTraceFile("testdata/synthetic_cellular.delay")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	forward := ChannelProfile{DeliveryTrace: delivery, DelayTrace: delay, KeepOrder: true, Capacity: 100}
+	backward := ChannelProfile{DelayTrace: delay, KeepOrder: true}
+
+	elapsed := sim_flow_transfer(t, forward, backward)
+
+	if again := sim_flow_transfer(t, forward, backward); again != elapsed {
+		t.Fatal("same trace should replay the same transfer.", elapsed, again)
+	}
+}
@@ -40,7 +40,10 @@ func decode_fihello_chunk(srcAddr *string, r *bytes.Buffer, handler chunk_handle
 	//fmt.Println("[FIHello Chunk]")
 
 	edpType, edpData := decode_endpoint_discriminator(r)
-	replyAddress := decode_address(r)
+	replyAddress, _, ok := decode_address_origin(r)
+	if !ok {
+		return
+	}
 	tag := r.Bytes()
 
 	if handler != nil {
@@ -74,7 +77,7 @@ func decode_rhello_chunk(srcAddr *string, r *bytes.Buffer, handler chunk_handler
 }
 
 func decode_rhello_cookie_change_chunk(srcAddr *string, r *bytes.Buffer, handler chunk_handler) {
-	fmt.Println("[RHello Cookie Change Chunk]")
+	//fmt.Println("[RHello Cookie Change Chunk]")
 
 	oldCookieLength := decode_vlu(r)
 	oldCookie := r.Bytes()[:oldCookieLength]
@@ -97,7 +100,11 @@ func decode_redirect_chunk(srcAddr *string, r *bytes.Buffer, handler chunk_handl
 	redirectDestination := make([]string, 0)
 
 	for r.Len() > 0 {
-		redirectDestination = append(redirectDestination, decode_address(r))
+		addr, _, ok := decode_address_origin(r)
+		if !ok {
+			break
+		}
+		redirectDestination = append(redirectDestination, addr)
 	}
 
 	fmt.Printf("redirectDestination:%v\n", redirectDestination)
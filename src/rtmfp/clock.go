@@ -0,0 +1,336 @@
+package rtmfp
+
+import (
+	"container/heap"
+	"runtime"
+	"sync"
+	"time"
+)
+
+//clock is the source of time for sessions, flows, handshakes and test channels,
+//so tests can run them on a simulated clock.
+type clock interface {
+	Now() time.Time
+	Since(t time.Time) time.Duration
+	Sleep(d time.Duration)
+	After(d time.Duration) <-chan time.Time
+	AfterFunc(d time.Duration, f func()) clock_timer
+	NewTicker(d time.Duration) clock_ticker
+}
+
+type clock_timer interface {
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+type clock_ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+var default_clock clock = &real_clock{}
+
+type real_clock struct{}
+
+func (self *real_clock) Now() time.Time                         { return time.Now() }
+func (self *real_clock) Since(t time.Time) time.Duration        { return time.Since(t) }
+func (self *real_clock) Sleep(d time.Duration)                  { time.Sleep(d) }
+func (self *real_clock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+func (self *real_clock) AfterFunc(d time.Duration, f func()) clock_timer {
+	return time.AfterFunc(d, f)
+}
+
+func (self *real_clock) NewTicker(d time.Duration) clock_ticker {
+	return &real_ticker{time.NewTicker(d)}
+}
+
+type real_ticker struct {
+	ticker *time.Ticker
+}
+
+func (self *real_ticker) C() <-chan time.Time { return self.ticker.C }
+func (self *real_ticker) Stop()               { self.ticker.Stop() }
+
+//sim_clock is a virtual clock for tests. time stands still while goroutines are working
+//and jumps to the next timer once every goroutine using the clock has been idle for a
+//while, so long timeouts and link delays cost almost no real time.
+//without timers it sleeps until one is added, and it waits on a real timer while the
+//goroutines are busy, so a clock only use the cpu to move the simulation on.
+//
+//determinism is best effort: the clock does not know which goroutines have work pending,
+//it only see that none has used it for sim_clock_idle_count checks. a goroutine busy
+//without calling the clock for longer, e.g. a slow crypto or a loaded machine, may see
+//time jump before it is done, and goroutines woken at the same instant run in the order
+//of the scheduler. timeouts and delays are exact in virtual time, the interleaving of the
+//work between them is not, so tests should not depend on it.
+var sim_clock_idle_check = 50 * time.Microsecond
+var sim_clock_idle_count = 3 //consecutive idle checks before time jumps
+var sim_clock_busy_count = 8 //consecutive busy checks before waiting on a real timer
+
+type sim_clock struct {
+	mutex  sync.Mutex
+	now    time.Time
+	seq    int
+	timers sim_timer_heap
+	active bool //clock used since the last idle check
+	wake   chan bool
+	done   chan bool
+}
+
+func new_sim_clock(start time.Time) *sim_clock {
+	c := &sim_clock{
+		now:  start,
+		wake: make(chan bool, 1),
+		done: make(chan bool),
+	}
+
+	go c.run()
+
+	return c
+}
+
+func (self *sim_clock) stop() {
+	close(self.done)
+}
+
+func (self *sim_clock) run() {
+
+	idle, busy := 0, 0
+
+	check := time.NewTimer(time.Hour)
+	check.Stop()
+
+	for {
+		self.mutex.Lock()
+		empty := self.timers.Len() == 0
+		self.mutex.Unlock()
+
+		if empty {
+			idle, busy = 0, 0
+			select {
+			case <-self.done:
+				return
+			case <-self.wake:
+			}
+		}
+
+		if busy < sim_clock_busy_count {
+			//real timers are too coarse to confirm the goroutines are idle, yield to them instead.
+			for start := time.Now(); time.Since(start) < sim_clock_idle_check; {
+				runtime.Gosched()
+			}
+
+			select {
+			case <-self.done:
+				return
+			default:
+			}
+		} else {
+			check.Reset(sim_clock_idle_check)
+			select {
+			case <-self.done:
+				check.Stop()
+				return
+			case <-check.C:
+			}
+		}
+
+		self.mutex.Lock()
+
+		if self.active || self.timers.Len() == 0 {
+			if self.active {
+				busy++
+			}
+			self.active = false
+			idle = 0
+			self.mutex.Unlock()
+			continue
+		}
+
+		busy = 0
+
+		idle++
+		if idle < sim_clock_idle_count {
+			self.mutex.Unlock()
+			continue
+		}
+
+		//fire all timers due at the next instant.
+		at := self.timers[0].at
+		if at.After(self.now) {
+			self.now = at
+		}
+
+		var due []*sim_timer
+		for self.timers.Len() > 0 && !self.timers[0].at.After(self.now) {
+			t := heap.Pop(&self.timers).(*sim_timer)
+			due = append(due, t)
+			if t.period > 0 {
+				self.add_timer(t, t.period)
+			}
+		}
+
+		now := self.now
+		self.active = true
+		idle = 0
+		self.mutex.Unlock()
+
+		for _, t := range due {
+			t.fire(now)
+		}
+	}
+}
+
+//should be called with mutex held.
+func (self *sim_clock) add_timer(t *sim_timer, d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	self.seq++
+	t.at = self.now.Add(d)
+	t.seq = self.seq
+	heap.Push(&self.timers, t)
+	self.notify()
+}
+
+func (self *sim_clock) new_timer(d, period time.Duration, fire func(now time.Time)) *sim_timer {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.active = true
+
+	t := &sim_timer{clock: self, period: period, fire: fire, index: -1}
+	self.add_timer(t, d)
+
+	return t
+}
+
+//wake the idle clock, should be called with mutex held.
+func (self *sim_clock) notify() {
+	select {
+	case self.wake <- true:
+	default:
+	}
+}
+
+func (self *sim_clock) Now() time.Time {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.active = true
+	return self.now
+}
+
+func (self *sim_clock) Since(t time.Time) time.Duration {
+	return self.Now().Sub(t)
+}
+
+func (self *sim_clock) Sleep(d time.Duration) {
+	<-self.After(d)
+}
+
+func (self *sim_clock) After(d time.Duration) <-chan time.Time {
+	c := make(chan time.Time, 1)
+	self.new_timer(d, 0, func(now time.Time) { c <- now })
+	return c
+}
+
+func (self *sim_clock) AfterFunc(d time.Duration, f func()) clock_timer {
+	return self.new_timer(d, 0, func(now time.Time) { go f() })
+}
+
+func (self *sim_clock) NewTicker(d time.Duration) clock_ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+
+	c := make(chan time.Time, 1)
+	t := self.new_timer(d, d, func(now time.Time) {
+		//drop ticks for a slow receiver, as time.Ticker does.
+		select {
+		case c <- now:
+		default:
+		}
+	})
+
+	return &sim_ticker{timer: t, c: c}
+}
+
+type sim_timer struct {
+	clock  *sim_clock
+	at     time.Time
+	seq    int
+	index  int //in the heap, -1 when not pending
+	period time.Duration
+	fire   func(now time.Time)
+}
+
+func (self *sim_timer) Stop() bool {
+	self.clock.mutex.Lock()
+	defer self.clock.mutex.Unlock()
+
+	self.clock.active = true
+
+	if self.index < 0 {
+		return false
+	}
+
+	heap.Remove(&self.clock.timers, self.index)
+	return true
+}
+
+func (self *sim_timer) Reset(d time.Duration) bool {
+	self.clock.mutex.Lock()
+	defer self.clock.mutex.Unlock()
+
+	self.clock.active = true
+
+	pending := self.index >= 0
+	if pending {
+		heap.Remove(&self.clock.timers, self.index)
+	}
+
+	self.clock.add_timer(self, d)
+
+	return pending
+}
+
+type sim_ticker struct {
+	timer *sim_timer
+	c     chan time.Time
+}
+
+func (self *sim_ticker) C() <-chan time.Time { return self.c }
+func (self *sim_ticker) Stop()               { self.timer.Stop() }
+
+//timers ordered by fire time, then by creation.
+type sim_timer_heap []*sim_timer
+
+func (self sim_timer_heap) Len() int { return len(self) }
+func (self sim_timer_heap) Less(i, j int) bool {
+	if self[i].at.Equal(self[j].at) {
+		return self[i].seq < self[j].seq
+	}
+	return self[i].at.Before(self[j].at)
+}
+func (self sim_timer_heap) Swap(i, j int) {
+	self[i], self[j] = self[j], self[i]
+	self[i].index = i
+	self[j].index = j
+}
+
+func (self *sim_timer_heap) Push(x interface{}) {
+	t := x.(*sim_timer)
+	t.index = len(*self)
+	*self = append(*self, t)
+}
+
+func (self *sim_timer_heap) Pop() interface{} {
+	old := *self
+	n := len(old)
+	t := old[n-1]
+	t.index = -1
+	*self = old[:n-1]
+	return t
+}
@@ -0,0 +1,55 @@
+package rtmfp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSimClock(t *testing.T) {
+
+	start := time.Unix(1000000000, 0)
+
+	clock := new_sim_clock(start)
+	defer clock.stop()
+
+	real_start := time.Now()
+
+	fired := make(chan int, 10)
+
+	clock.AfterFunc(2*time.Second, func() { fired <- 2 })
+	clock.AfterFunc(1*time.Second, func() { fired <- 1 })
+
+	stopped := clock.AfterFunc(500*time.Millisecond, func() { fired <- 0 })
+	if !stopped.Stop() {
+		t.Fatal("pending timer should be stopped.")
+	}
+
+	reset := clock.AfterFunc(500*time.Millisecond, func() { fired <- 3 })
+	reset.Reset(3 * time.Second)
+
+	for i := 1; i <= 3; i++ {
+		if n := <-fired; n != i {
+			t.Fatal("timers fired out of order.", n, i)
+		}
+	}
+
+	if now := clock.Now(); !now.Equal(start.Add(3 * time.Second)) {
+		t.Fatal("time not match.", now.Sub(start))
+	}
+
+	ticker := clock.NewTicker(time.Hour)
+	for i := 0; i < 3; i++ {
+		<-ticker.C()
+	}
+	ticker.Stop()
+
+	clock.Sleep(time.Hour)
+
+	if elapsed := clock.Since(start); elapsed != 3*time.Second+4*time.Hour {
+		t.Fatal("time not match.", elapsed)
+	}
+
+	if real_elapsed := time.Since(real_start); real_elapsed > time.Second {
+		t.Fatal("sim clock too slow.", real_elapsed)
+	}
+}
@@ -0,0 +1,101 @@
+package rtmfp
+
+import (
+	"bytes"
+	"encoding/binary"
+	//	"fmt"
+	"io"
+	"rtmfp/amf"
+)
+
+//a command of a NetConnection or a NetStream: "cmd|transaction id|command object|args...".
+//the transaction id of a call is echoed by its _result or _error, 0 when no response
+//is expected.
+type command struct {
+	name   string
+	tid    float64
+	object interface{} //null but for connect and the _result of connect.
+	args   []interface{}
+}
+
+func decode_command(buf []byte) (c *command, err error) {
+
+	r := bytes.NewBuffer(buf)
+
+	var msg_type uint8
+	binary.Read(r, binary.BigEndian, &msg_type)
+
+	//fmt.Printf("msg type:%d\n", msg_type)
+
+	d := amf.NewDecoder(r)
+	c = &command{}
+
+	switch msg_type {
+	case 0x11, 0x14: //AMF?, AMF_WITH_HANDLER
+		if msg_type == 0x11 {
+			r.Next(5)
+		} else {
+			r.Next(4)
+		}
+		if err = d.Decode(&c.name); err != nil {
+			return nil, err
+		}
+		if err = d.Decode(&c.tid); err != nil {
+			return nil, err
+		}
+		if err = d.Decode(&c.object); err == io.EOF {
+			return c, nil
+		}
+	case 0x0F: //AMF
+		r.Next(5)
+		if err = d.Decode(&c.name); err != nil {
+			return nil, err
+		}
+	default:
+		//fmt.Printf("unknown msg type:%d\n", msg_type)
+		//panic("unknown msg type")
+		return c, nil
+	}
+
+	for err == nil {
+		var arg interface{}
+		if err = d.Decode(&arg); err == nil {
+			c.args = append(c.args, arg)
+		}
+	}
+
+	if err != io.EOF {
+		return nil, err
+	}
+
+	//fmt.Printf("#cmd:%s\n", c.name)
+
+	return c, nil
+}
+
+//the values may be any value amf.Marshal() accept, e.g. a struct with amf tags.
+func encode_command(c *command) ([]byte, error) {
+
+	w := bytes.NewBuffer(nil)
+
+	//AMF_WITH_HANDLER
+
+	binary.Write(w, binary.BigEndian, uint8(0x14))
+	binary.Write(w, binary.BigEndian, uint32(0))
+
+	e := amf.NewEncoder(w)
+	e.Encode(c.name)
+	e.Encode(c.tid)
+
+	if err := e.Encode(c.object); err != nil {
+		return nil, err
+	}
+
+	for _, arg := range c.args {
+		if err := e.Encode(arg); err != nil {
+			return nil, err
+		}
+	}
+
+	return w.Bytes(), nil
+}
@@ -0,0 +1,362 @@
+package rtmfp
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"math/big"
+	"sync"
+)
+
+var default_crypto_key = []byte("Adobe Systems 02")
+
+//CryptoProfile decide how packets are protected on the wire, how session keys are derived
+//from the key agreement, and what the certificate look like.
+//
+//packet passed to EncryptPacket/DecryptPacket exclude the scrambled session id, it start from the flags byte.
+//nil key stand for the default key used by startup packets.
+type CryptoProfile interface {
+	EncryptPacket(key, packet []byte) ([]byte, error)
+	DecryptPacket(key, packet []byte) ([]byte, error)
+	DeriveSessionKeys(shareSecret, myNonce, otherNonce []byte) (dkey, ekey []byte)
+	BuildCertificate(pseudoId []byte) []byte
+}
+
+//a CryptoProfile keeping state for each session key may implement it, it is told when
+//a session is closed and its keys are no longer used.
+type SessionKeyReleaser interface {
+	ReleaseSessionKeys(dkey, ekey []byte)
+}
+
+var default_crypto_profile CryptoProfile = &FlashCryptoProfile{}
+
+//FlashCryptoProfile is compatible with flash player.
+//AES-128-CBC with zero iv, 16-bit checksum, 0xff padding.
+type FlashCryptoProfile struct{}
+
+func (self *FlashCryptoProfile) EncryptPacket(key, packet []byte) ([]byte, error) {
+
+	if key == nil {
+		key = default_crypto_key
+	}
+
+	c, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := bytes.NewBuffer(nil)
+	binary.Write(buf, binary.BigEndian, uint16(0)) //checksum
+	buf.Write(packet)
+
+	padding_len := ((buf.Len()-1)/16+1)*16 - buf.Len()
+	for i := 0; i < padding_len; i++ {
+		buf.WriteByte(0xff)
+	}
+
+	raw_data := buf.Bytes()
+
+	check_sum := calc_check_sum(raw_data[2:])
+	binary.BigEndian.PutUint16(raw_data, check_sum)
+
+	iv := make([]byte, 16)
+	encrypt := cipher.NewCBCEncrypter(c, iv)
+	encrypt.CryptBlocks(raw_data, raw_data)
+
+	return raw_data, nil
+}
+
+func (self *FlashCryptoProfile) DecryptPacket(key, packet []byte) ([]byte, error) {
+
+	if key == nil {
+		key = default_crypto_key
+	}
+
+	if len(packet) < 16 || len(packet)%16 != 0 {
+		return nil, errors.New("invalid packet length.")
+	}
+
+	c, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	iv := make([]byte, 16)
+	decrypt := cipher.NewCBCDecrypter(c, iv)
+	decrypt.CryptBlocks(packet, packet)
+
+	check_sum := binary.BigEndian.Uint16(packet)
+	if check_sum != calc_check_sum(packet[2:]) {
+		return nil, errors.New("check sum don't match!")
+	}
+
+	return packet[2:], nil
+}
+
+func (self *FlashCryptoProfile) DeriveSessionKeys(shareSecret, myNonce, otherNonce []byte) (dkey, ekey []byte) {
+	return GenCryptoKeys(new(big.Int).SetBytes(shareSecret), myNonce, otherNonce)
+}
+
+func (self *FlashCryptoProfile) BuildCertificate(pseudoId []byte) []byte {
+
+	buf := bytes.NewBuffer(nil)
+	buf.Write([]byte("\x01\x0A\x41\x0E"))
+
+	pseudo_id := make([]byte, 64)
+	copy(pseudo_id, pseudoId)
+	buf.Write(pseudo_id)
+
+	//supported dh groups, OPTION(x15, group)
+	for _, id := range []uint8{dh_group_modp1024, dh_group_modp2048, dh_group_x25519} {
+		if find_dh_group(id) != nil {
+			encode_vlu(buf, 1+get_vlu_size(uint(id)))
+			buf.WriteByte(0x15)
+			encode_vlu(buf, uint(id))
+		}
+	}
+
+	return buf.Bytes()
+}
+
+var aead_seq_size = 8
+var aead_replay_window_size = 64 //0 disable replay protection
+
+//AEADCryptoProfile protect packets with AES-128-GCM, only for peers running this library.
+//each packet carry a 64-bit sequence number in clear, which form the nonce and is
+//checked against a replay window for established sessions.
+type AEADCryptoProfile struct {
+	FlashCryptoProfile //same certificate
+
+	mutex  sync.Mutex
+	states map[string]*aead_key_state
+}
+
+type aead_key_state struct {
+	aead     cipher.AEAD
+	send_seq uint64
+	replay   *replay_window //nil if replay protection is disabled
+	refs     int            //sessions using the key, both ends of a session in the same process share it.
+}
+
+func new_aead_key_state(key []byte) (*aead_key_state, error) {
+
+	c, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(c)
+	if err != nil {
+		return nil, err
+	}
+
+	state := &aead_key_state{aead: aead}
+	if aead_replay_window_size > 0 {
+		state.replay = new_replay_window(uint64(aead_replay_window_size))
+	}
+
+	return state, nil
+}
+
+//the state of an established key exists from DeriveSessionKeys() to ReleaseSessionKeys(), packets
+//of unknown or released keys are rejected, so that the sequence numbers never restart.
+func (self *AEADCryptoProfile) key_state(key []byte, established bool) (*aead_key_state, error) {
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.states == nil {
+		self.states = make(map[string]*aead_key_state)
+	}
+
+	state, ok := self.states[string(key)]
+	if ok {
+		return state, nil
+	}
+
+	if established {
+		return nil, errors.New("unknown session key.")
+	}
+
+	state, err := new_aead_key_state(key)
+	if err != nil {
+		return nil, err
+	}
+	self.states[string(key)] = state
+
+	return state, nil
+}
+
+func (self *AEADCryptoProfile) add_key(key []byte) {
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.states == nil {
+		self.states = make(map[string]*aead_key_state)
+	}
+
+	state, ok := self.states[string(key)]
+	if !ok {
+		var err error
+		if state, err = new_aead_key_state(key); err != nil {
+			return //16 bytes key never fail.
+		}
+		self.states[string(key)] = state
+	}
+	state.refs++
+}
+
+func (self *AEADCryptoProfile) EncryptPacket(key, packet []byte) ([]byte, error) {
+
+	established := key != nil
+	if !established {
+		key = default_crypto_key
+	}
+
+	state, err := self.key_state(key, established)
+	if err != nil {
+		return nil, err
+	}
+
+	seq := make([]byte, aead_seq_size)
+	if established {
+		self.mutex.Lock()
+		state.send_seq++
+		binary.BigEndian.PutUint64(seq, state.send_seq)
+		self.mutex.Unlock()
+	} else {
+		//default key is shared by every one, nothing to protect but integrity.
+		rand.Read(seq)
+	}
+
+	nonce := make([]byte, state.aead.NonceSize())
+	copy(nonce[len(nonce)-aead_seq_size:], seq)
+
+	return state.aead.Seal(seq, nonce, packet, seq), nil
+}
+
+func (self *AEADCryptoProfile) DecryptPacket(key, packet []byte) ([]byte, error) {
+
+	established := key != nil
+	if !established {
+		key = default_crypto_key
+	}
+
+	state, err := self.key_state(key, established)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(packet) < aead_seq_size+state.aead.Overhead() {
+		return nil, errors.New("invalid packet length.")
+	}
+
+	seq := packet[:aead_seq_size]
+
+	nonce := make([]byte, state.aead.NonceSize())
+	copy(nonce[len(nonce)-aead_seq_size:], seq)
+
+	plain, err := state.aead.Open(nil, nonce, packet[aead_seq_size:], seq)
+	if err != nil {
+		return nil, err
+	}
+
+	if established && state.replay != nil {
+		self.mutex.Lock()
+		fresh := state.replay.check_and_update(binary.BigEndian.Uint64(seq))
+		self.mutex.Unlock()
+
+		if !fresh {
+			return nil, errors.New("replayed packet.")
+		}
+	}
+
+	return plain, nil
+}
+
+//forget the cipher and the replay window of the keys of a closed session, once no
+//session use them.
+func (self *AEADCryptoProfile) ReleaseSessionKeys(dkey, ekey []byte) {
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	for _, key := range [][]byte{dkey, ekey} {
+		if state, ok := self.states[string(key)]; ok {
+			state.refs--
+			if state.refs <= 0 {
+				delete(self.states, string(key))
+			}
+		}
+	}
+}
+
+func (self *AEADCryptoProfile) DeriveSessionKeys(shareSecret, myNonce, otherNonce []byte) (dkey, ekey []byte) {
+
+	label := []byte("rtmfp aead")
+
+	dkey = HmacSha256(shareSecret, append(HmacSha256(myNonce, otherNonce), label...))[:16]
+	ekey = HmacSha256(shareSecret, append(HmacSha256(otherNonce, myNonce), label...))[:16]
+
+	self.add_key(dkey)
+	self.add_key(ekey)
+
+	return
+}
+
+//sliding window over received sequence numbers, see RFC 4303 section 3.4.3.
+//bitmap is a ring of 64-bit blocks as RFC 6479 so that the window never shift bits.
+type replay_window struct {
+	size   uint64   //sequence numbers older than max-size are rejected
+	max    uint64   //highest sequence number received
+	bitmap []uint64 //bit (seq%64) of block (seq/64)%len set means seq has been received
+}
+
+func new_replay_window(size uint64) *replay_window {
+	return &replay_window{
+		size:   size,
+		bitmap: make([]uint64, (size+63)/64+1),
+	}
+}
+
+func (self *replay_window) check_and_update(seq uint64) bool {
+
+	if seq == 0 {
+		return false
+	}
+
+	blocks := uint64(len(self.bitmap))
+	block := seq / 64
+
+	if seq > self.max {
+		//clear blocks slid into the window
+		cur := self.max / 64
+		diff := block - cur
+		if diff > blocks {
+			diff = blocks
+		}
+		for i := uint64(1); i <= diff; i++ {
+			self.bitmap[(cur+i)%blocks] = 0
+		}
+
+		self.max = seq
+
+	} else if self.max-seq >= self.size {
+		//too old
+		return false
+	}
+
+	mask := uint64(1) << (seq % 64)
+	if self.bitmap[block%blocks]&mask != 0 {
+		//duplicated
+		return false
+	}
+
+	self.bitmap[block%blocks] |= mask
+
+	return true
+}
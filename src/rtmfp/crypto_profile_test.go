@@ -0,0 +1,212 @@
+package rtmfp
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func test_crypto_profile(t *testing.T, profile CryptoProfile, key []byte) {
+
+	plain := []byte("\x0b\x12\x34\x01\x00\x05hello")
+
+	encrypted, err := profile.EncryptPacket(key, plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decrypted, err := profile.DecryptPacket(key, append([]byte(nil), encrypted...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.HasPrefix(decrypted, plain) {
+		t.Fatal("decrypted packet not match.")
+	}
+
+	tampered := append([]byte(nil), encrypted...)
+	tampered[len(tampered)-1] ^= 0x1
+	if _, err := profile.DecryptPacket(key, tampered); err == nil {
+		t.Fatal("tampered packet accepted.")
+	}
+}
+
+func TestFlashCryptoProfile(t *testing.T) {
+	test_crypto_profile(t, &FlashCryptoProfile{}, nil)
+	test_crypto_profile(t, &FlashCryptoProfile{}, []byte("0123456789abcdef"))
+}
+
+func TestAEADCryptoProfile(t *testing.T) {
+	test_crypto_profile(t, &AEADCryptoProfile{}, nil)
+
+	profile := &AEADCryptoProfile{}
+	key, _ := profile.DeriveSessionKeys([]byte("secret"), []byte("my nonce"), []byte("other nonce"))
+	test_crypto_profile(t, profile, key)
+
+	profile = &AEADCryptoProfile{}
+	key, _ = profile.DeriveSessionKeys([]byte("secret"), []byte("my nonce"), []byte("other nonce"))
+
+	encrypted, _ := profile.EncryptPacket(key, []byte("hello"))
+
+	if _, err := profile.DecryptPacket(key, encrypted); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := profile.DecryptPacket(key, encrypted); err == nil {
+		t.Fatal("replayed packet accepted.")
+	}
+}
+
+func TestAEADReleasedKeys(t *testing.T) {
+
+	profile := &AEADCryptoProfile{}
+
+	if _, err := profile.EncryptPacket([]byte("0123456789abcdef"), []byte("hello")); err == nil {
+		t.Fatal("unknown key accepted.")
+	}
+
+	//both ends of a session in the same process.
+	dkey, ekey := profile.DeriveSessionKeys([]byte("secret"), []byte("a"), []byte("b"))
+	profile.DeriveSessionKeys([]byte("secret"), []byte("b"), []byte("a"))
+
+	encrypted, _ := profile.EncryptPacket(ekey, []byte("hello"))
+
+	profile.ReleaseSessionKeys(dkey, ekey)
+	if _, err := profile.EncryptPacket(ekey, []byte("hello")); err != nil {
+		t.Fatal("key released while used by the other end.", err)
+	}
+
+	profile.ReleaseSessionKeys(ekey, dkey)
+
+	//a replay after the session is closed neither restart the window nor the sequence numbers.
+	if _, err := profile.DecryptPacket(ekey, encrypted); err == nil {
+		t.Fatal("packet of a released key accepted.")
+	}
+	if _, err := profile.EncryptPacket(ekey, []byte("hello")); err == nil {
+		t.Fatal("released key reused.")
+	}
+}
+
+func TestReplayWindow(t *testing.T) {
+
+	w := new_replay_window(64)
+
+	for _, seq := range []uint64{1, 3, 2, 10} {
+		if !w.check_and_update(seq) {
+			t.Fatal("fresh seq rejected.", seq)
+		}
+	}
+
+	for _, seq := range []uint64{0, 1, 3, 10} {
+		if w.check_and_update(seq) {
+			t.Fatal("duplicated seq accepted.", seq)
+		}
+	}
+
+	if !w.check_and_update(200) || w.check_and_update(200-64) {
+		t.Fatal("seq out of window accepted.")
+	}
+
+	if !w.check_and_update(200-63) || !w.check_and_update(1000) || w.check_and_update(1000) {
+		t.Fatal("window not slide.")
+	}
+
+	//larger window than one block
+	w = new_replay_window(1024)
+
+	for seq := uint64(1); seq <= 2000; seq += 3 {
+		if !w.check_and_update(seq) {
+			t.Fatal("fresh seq rejected.", seq)
+		}
+	}
+
+	if w.check_and_update(1999) || !w.check_and_update(1998) || w.check_and_update(1999-1024) {
+		t.Fatal("unexpected window state.")
+	}
+}
+
+func TestAEADReplayDisabled(t *testing.T) {
+
+	saved := aead_replay_window_size
+	defer func() { aead_replay_window_size = saved }()
+
+	aead_replay_window_size = 0
+
+	profile := &AEADCryptoProfile{}
+	key, _ := profile.DeriveSessionKeys([]byte("secret"), []byte("my nonce"), []byte("other nonce"))
+
+	encrypted, _ := profile.EncryptPacket(key, []byte("hello"))
+
+	for i := 0; i < 2; i++ {
+		if _, err := profile.DecryptPacket(key, append([]byte(nil), encrypted...)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAEADSession(t *testing.T) {
+
+	chan_a := make(chan *network_packet, network_packet_chan_default_buffer_size)
+	chan_b := make(chan *network_packet, network_packet_chan_default_buffer_size)
+
+	profile := &AEADCryptoProfile{}
+
+	initiator := &session{
+		in:        chan_a,
+		out:       chan_b,
+		sessionid: 1,
+		profile:   profile,
+	}
+
+	responder := &session{
+		in:        chan_b,
+		out:       chan_a,
+		sessionid: 2,
+		profile:   profile,
+	}
+
+	responder.passive_open()
+	err := initiator.active_open("", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan bool, 1)
+
+	responder.create_recv_flow = func(options []byte, flowid uint) (*recv_flow, error) {
+		flow, err := responder.new_recv_flow(flowid)
+
+		go func() {
+			buf, _ := flow.recv()
+			done <- string(buf) == "hello"
+		}()
+
+		return flow, err
+	}
+
+	flow, _ := initiator.new_send_flow(0, nil)
+	flow.send([]byte("hello"))
+
+	select {
+	case ok := <-done:
+		if !ok {
+			t.Fatal("msg not match.")
+		}
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("timeout")
+	}
+
+	saved := session_key_release_delay
+	defer func() { session_key_release_delay = saved }()
+	session_key_release_delay = 10 * time.Millisecond
+
+	//the state of the default key is left.
+	initiator.close()
+	time.Sleep(100 * time.Millisecond)
+
+	profile.mutex.Lock()
+	defer profile.mutex.Unlock()
+	if len(profile.states) != 1 {
+		t.Fatal("keys not released.", len(profile.states))
+	}
+}
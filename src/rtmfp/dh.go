@@ -0,0 +1,185 @@
+package rtmfp
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"errors"
+	"math/big"
+)
+
+var dh1024p = "FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7EDEE386BFB5A899FA5AE9F24117C4B1FE649286651ECE65381FFFFFFFFFFFFFFFF"
+
+//RFC 3526 2048-bit MODP group
+var dh2048p = "FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7EDEE386BFB5A899FA5AE9F24117C4B1FE649286651ECE45B3DC2007CB8A163BF0598DA48361C55D39A69163FA8FD24CF5F83655D23DCA3AD961C62F356208552BB9ED529077096966D670C354E4ABC9804F1746C08CA18217C32905E462E36CE3BE39E772C180E86039B2783A2EC07A28FB5C55DF06F4C52C9DE2BCBF6955817183995497CEA956AE515D2261898FA051015728E5A8AACAA68FFFFFFFFFFFFFFFF"
+
+//group id is the IKE group number, carried in certificate option 0x15(supported groups),
+//0x1D(initiator dh public) and nonce option 0x0D(responder dh public).
+var dh_group_modp1024 = uint8(2)
+var dh_group_modp2048 = uint8(14)
+var dh_group_x25519 = uint8(31)
+
+//in preference order. 1024-bit group is the only one flash player knows, keep it for interop.
+var supported_dh_groups = []uint8{dh_group_x25519, dh_group_modp2048, dh_group_modp1024}
+
+type dh_group interface {
+	id() uint8
+	generate_key() (private, public []byte)
+	check_public(public []byte) error
+	compute_secret(private, other_public []byte) ([]byte, error)
+}
+
+type modp_group struct {
+	group_id uint8
+	p        *big.Int
+	size     int //bytes of p
+}
+
+func new_modp_group(group_id uint8, p_hex string) *modp_group {
+	p := new(big.Int)
+	p.SetString(p_hex, 16)
+
+	return &modp_group{
+		group_id: group_id,
+		p:        p,
+		size:     len(p.Bytes()),
+	}
+}
+
+func (self *modp_group) id() uint8 {
+	return self.group_id
+}
+
+func (self *modp_group) generate_key() (private, public []byte) {
+
+	//x
+	private = make([]byte, self.size)
+	rand.Read(private)
+
+	//y = g^x mod p
+	y := new(big.Int).Exp(big.NewInt(2), new(big.Int).SetBytes(private), self.p)
+
+	//public number is padded to the size of p
+	public = make([]byte, self.size)
+	copy(public[self.size-len(y.Bytes()):], y.Bytes())
+
+	return
+}
+
+//valid public number should be in range [2, p-2]
+func (self *modp_group) check_public(public []byte) error {
+
+	if len(public) != self.size {
+		return errors.New("invalid dh public number length.")
+	}
+
+	y := new(big.Int).SetBytes(public)
+	max := new(big.Int).Sub(self.p, big.NewInt(2))
+
+	if y.Cmp(big.NewInt(2)) < 0 || y.Cmp(max) > 0 {
+		return errors.New("dh public number out of range.")
+	}
+
+	return nil
+}
+
+func (self *modp_group) compute_secret(private, other_public []byte) ([]byte, error) {
+
+	if err := self.check_public(other_public); err != nil {
+		return nil, err
+	}
+
+	//share_secret = y^x mode p
+	y := new(big.Int).SetBytes(other_public)
+	share_secret := y.Exp(y, new(big.Int).SetBytes(private), self.p)
+
+	return share_secret.Bytes(), nil
+}
+
+type x25519_group struct{}
+
+func (self *x25519_group) id() uint8 {
+	return dh_group_x25519
+}
+
+func (self *x25519_group) generate_key() (private, public []byte) {
+
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+
+	return key.Bytes(), key.PublicKey().Bytes()
+}
+
+func (self *x25519_group) check_public(public []byte) error {
+
+	if len(public) != 32 {
+		return errors.New("invalid x25519 public key length.")
+	}
+
+	//low order points are rejected by ecdh when computing the secret.
+	if bytes.Equal(public, make([]byte, 32)) {
+		return errors.New("invalid x25519 public key.")
+	}
+
+	return nil
+}
+
+func (self *x25519_group) compute_secret(private, other_public []byte) ([]byte, error) {
+
+	if err := self.check_public(other_public); err != nil {
+		return nil, err
+	}
+
+	key, err := ecdh.X25519().NewPrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+
+	pub, err := ecdh.X25519().NewPublicKey(other_public)
+	if err != nil {
+		return nil, err
+	}
+
+	return key.ECDH(pub)
+}
+
+var dh_groups = map[uint8]dh_group{
+	dh_group_modp1024: new_modp_group(dh_group_modp1024, dh1024p),
+	dh_group_modp2048: new_modp_group(dh_group_modp2048, dh2048p),
+	dh_group_x25519:   &x25519_group{},
+}
+
+//return nil if the group is unknown or disabled. 1024-bit group is always available.
+func find_dh_group(id uint8) dh_group {
+
+	if id == dh_group_modp1024 {
+		return dh_groups[id]
+	}
+
+	for _, supported := range supported_dh_groups {
+		if supported == id {
+			return dh_groups[id]
+		}
+	}
+
+	return nil
+}
+
+//choose our most preferred group which the responder certificate claim to support,
+//fallback to 1024-bit group if the certificate don't tell.
+func select_dh_group(cert []byte) uint8 {
+
+	offered := read_all_options(cert, 0x15)
+
+	for _, id := range supported_dh_groups {
+		for _, opt := range offered {
+			if decode_vlu(bytes.NewBuffer(opt)) == uint(id) {
+				return id
+			}
+		}
+	}
+
+	return dh_group_modp1024
+}
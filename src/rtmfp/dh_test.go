@@ -0,0 +1,150 @@
+package rtmfp
+
+import (
+	"bytes"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestDHGroups(t *testing.T) {
+
+	for id, group := range dh_groups {
+
+		a_private, a_public := group.generate_key()
+		b_private, b_public := group.generate_key()
+
+		a_secret, err := group.compute_secret(a_private, b_public)
+		if err != nil {
+			t.Fatal(id, err)
+		}
+
+		b_secret, err := group.compute_secret(b_private, a_public)
+		if err != nil {
+			t.Fatal(id, err)
+		}
+
+		if !bytes.Equal(a_secret, b_secret) {
+			t.Fatal("share secret not match.", id)
+		}
+	}
+}
+
+func TestDHCheckPublic(t *testing.T) {
+
+	group := dh_groups[dh_group_modp1024].(*modp_group)
+
+	number := func(v *big.Int) []byte {
+		buf := make([]byte, group.size)
+		copy(buf[group.size-len(v.Bytes()):], v.Bytes())
+		return buf
+	}
+
+	p_minus := func(n int64) *big.Int {
+		return new(big.Int).Sub(group.p, big.NewInt(n))
+	}
+
+	for _, v := range []*big.Int{big.NewInt(0), big.NewInt(1), p_minus(1), group.p} {
+		if group.check_public(number(v)) == nil {
+			t.Fatal("invalid public number accepted.", v)
+		}
+	}
+
+	for _, v := range []*big.Int{big.NewInt(2), p_minus(2)} {
+		if group.check_public(number(v)) != nil {
+			t.Fatal("valid public number rejected.", v)
+		}
+	}
+
+	if group.check_public([]byte{2}) == nil {
+		t.Fatal("short public number accepted.")
+	}
+
+	x25519 := dh_groups[dh_group_x25519]
+	private, _ := x25519.generate_key()
+
+	//order 1 point
+	low_order := make([]byte, 32)
+	low_order[0] = 1
+	if _, err := x25519.compute_secret(private, low_order); err == nil {
+		t.Fatal("low order point accepted.")
+	}
+}
+
+func TestSelectDHGroup(t *testing.T) {
+
+	if select_dh_group(nil) != dh_group_modp1024 {
+		t.Fatal("should fallback to 1024-bit group.")
+	}
+
+	//flash certificate
+	if select_dh_group([]byte("\x02\x15\x02\x02\x15\x05\x02\x15\x0E")) != dh_group_modp2048 {
+		t.Fatal("should select 2048-bit group.")
+	}
+
+	if select_dh_group([]byte("\x02\x15\x02\x02\x15\x1F")) != dh_group_x25519 {
+		t.Fatal("should select x25519.")
+	}
+}
+
+func test_handshake_dh_group(t *testing.T, expect uint8) {
+
+	chan1 := make(chan *network_packet, network_packet_chan_default_buffer_size)
+	chan2 := make(chan *network_packet, network_packet_chan_default_buffer_size)
+
+	a := &handshake{
+		in:  chan1,
+		out: chan2,
+	}
+
+	b := &handshake{
+		in:  chan2,
+		out: chan1,
+	}
+
+	a.open()
+	b.open()
+
+	responder_event := make(chan *session, 1)
+
+	b.create_passive_session = func(addr string, peerid []byte) (*session, error) {
+		s := b.new_session()
+		s.passive_open()
+		responder_event <- s
+		return s, nil
+	}
+
+	initiator, err := a.create_session("", b.peerid())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var responder *session
+	select {
+	case responder = <-responder_event:
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("timeout")
+	}
+
+	if initiator.dh_group.id() != expect || responder.dh_group.id() != expect {
+		t.Fatal("unexpected dh group.", initiator.dh_group.id(), responder.dh_group.id())
+	}
+
+	if !bytes.Equal(initiator.ekey, responder.dkey) || !bytes.Equal(initiator.dkey, responder.ekey) {
+		t.Fatal("keys not match.")
+	}
+}
+
+func TestHandshakeDHGroup(t *testing.T) {
+
+	saved := supported_dh_groups
+	defer func() { supported_dh_groups = saved }()
+
+	test_handshake_dh_group(t, dh_group_x25519)
+
+	supported_dh_groups = []uint8{dh_group_modp2048, dh_group_modp1024}
+	test_handshake_dh_group(t, dh_group_modp2048)
+
+	supported_dh_groups = []uint8{dh_group_modp1024}
+	test_handshake_dh_group(t, dh_group_modp1024)
+}
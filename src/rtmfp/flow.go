@@ -46,8 +46,8 @@ type send_flow struct {
 	ack_ranges         RangeQueue
 	data_packets_count int //user data sent since last received ack.
 
-	bufprob_ticker *time.Ticker
-	rtx_alarm      *time.Timer
+	bufprob_ticker clock_ticker
+	rtx_alarm      clock_timer
 
 	current_tsn int
 
@@ -56,6 +56,10 @@ type send_flow struct {
 	closed bool
 
 	c_loss int
+
+	//the queue and the windows, sent by the owner of the flow, acked on the session
+	//goroutine and retransmitted by the alarm.
+	mutex sync.Mutex
 }
 
 type recv_flow struct {
@@ -75,7 +79,7 @@ type recv_flow struct {
 	recv_buf_mutex sync.Mutex
 	recv_cond      *sync.Cond
 
-	delack_alarm *time.Timer
+	delack_alarm clock_timer
 
 	closed bool
 }
@@ -88,6 +92,12 @@ func (self *send_flow) open() {
 }
 
 func (self *send_flow) close() {
+	self.mutex.Lock()
+	self.stop()
+	self.mutex.Unlock()
+}
+
+func (self *send_flow) stop() {
 	self.closed = true
 
 	if self.rtx_alarm != nil {
@@ -109,6 +119,9 @@ func (self *send_flow) next_seqnumber() uint {
 //data parameter is view as a message, which will delieve to the receiver as a whole.
 func (self *send_flow) send(data []byte) (uint, error) {
 
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
 	if self.closed {
 		return 0, errors.New("flow closed!")
 	}
@@ -152,6 +165,14 @@ func (self *send_flow) send(data []byte) (uint, error) {
 	return uint(len(data)), nil
 }
 
+//the chunks not yet acked.
+func (self *send_flow) queued() int {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return self.send_queue.Len()
+}
+
 func (self *send_flow) send_buget() bool {
 	return self.inflight_bytes < min_uint(self.recv_wnd, self.cong_wnd)
 }
@@ -175,6 +196,13 @@ func (self *send_flow) try_send() {
 
 func (self *send_flow) on_rtx_alarm() {
 
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.closed {
+		return
+	}
+
 	any_loss := false
 
 	for i := self.send_queue.Front(); i != nil; i = i.Next() {
@@ -191,7 +219,7 @@ func (self *send_flow) on_rtx_alarm() {
 			fmt.Printf("seq_num(%d) resend(%d) exceed max resend count(%d)! close the flow.\n",
 				chunk.seqNum, chunk.send_count, max_data_chunk_resend_count)
 
-			self.close()
+			self.stop()
 			return
 		}
 
@@ -203,9 +231,14 @@ func (self *send_flow) on_rtx_alarm() {
 		self.cong_wnd = timeout_cong_wnd
 
 		//erto backoff?
+		self.session.tx_mutex.Lock()
 		erto_backoff := time.Duration(int64(float64(self.session.erto) * 1.4142))
 		erto_capped := min_duration(erto_backoff, 10*time.Second)
 		self.session.erto = max_duration(erto_capped, self.session.mrto)
+		self.session.tx_mutex.Unlock()
+
+		//the path may be broken, fail over to another address of the far end.
+		self.session.path_timeout()
 	} else {
 		self.cong_wnd = init_cong_wnd
 	}
@@ -269,14 +302,21 @@ func (self *send_flow) send_userdata(chunk *data_chunk) {
 		false)
 
 	if self.rtx_alarm == nil {
-		self.rtx_alarm = time.AfterFunc(self.session.erto, func() { self.on_rtx_alarm() })
+		self.rtx_alarm = self.session.clock.AfterFunc(self.session.rto(), func() { self.on_rtx_alarm() })
 	} else {
-		self.rtx_alarm.Reset(self.session.erto)
+		self.rtx_alarm.Reset(self.session.rto())
 	}
 }
 
 func (self *send_flow) on_range_ack(bufAvail, cumAck uint, recvRanges []Range) {
 
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.closed {
+		return
+	}
+
 	self.data_packets_count = 0
 
 	pre_ack_outstanding := self.inflight_bytes
@@ -326,6 +366,8 @@ func (self *send_flow) on_range_ack(bufAvail, cumAck uint, recvRanges []Range) {
 		return
 	}
 
+	self.session.path_acked()
+
 	//calc negative ack
 	any_nak := false
 	any_loss := false
@@ -344,11 +386,12 @@ func (self *send_flow) on_range_ack(bufAvail, cumAck uint, recvRanges []Range) {
 	//perpare buffer probe
 	if bufAvail == 0 && self.bufprob_ticker == nil {
 
-		self.bufprob_ticker = time.NewTicker(bufprob_ticker_duration)
+		ticker := self.session.clock.NewTicker(bufprob_ticker_duration)
+		self.bufprob_ticker = ticker
 		go func() {
 
 			for {
-				_, ok := <-self.bufprob_ticker.C
+				_, ok := <-ticker.C()
 				if !ok {
 					break
 				}
@@ -362,7 +405,7 @@ func (self *send_flow) on_range_ack(bufAvail, cumAck uint, recvRanges []Range) {
 	self.update_congestion_wnd(any_loss, true, any_nak, acked_bytes, pre_ack_outstanding)
 
 	if self.rtx_alarm != nil {
-		self.rtx_alarm.Reset(self.session.erto)
+		self.rtx_alarm.Reset(self.session.rto())
 	}
 
 	self.try_send()
@@ -451,7 +494,9 @@ func (self *recv_flow) open() {
 }
 
 func (self *recv_flow) close() {
+	self.recv_cond.L.Lock()
 	self.closed = true
+	self.recv_cond.L.Unlock()
 
 	self.recv_cond.Signal()
 }
@@ -472,20 +517,20 @@ func (self *recv_flow) available_buffers() uint {
 func (self *recv_flow) recv() ([]byte, error) {
 
 	var msg []byte
-	for !self.closed {
 
-		self.recv_cond.L.Lock()
+	self.recv_cond.L.Lock()
+	for !self.closed {
 		msg = self.read_message()
 		if msg == nil {
 			self.recv_cond.Wait() //wait for more data available.
-			self.recv_cond.L.Unlock()
 		} else {
-			self.recv_cond.L.Unlock()
 			break
 		}
 	}
+	closed := self.closed
+	self.recv_cond.L.Unlock()
 
-	if self.closed {
+	if closed {
 		return nil, errors.New("connection closed!")
 	} else {
 		return msg, nil
@@ -534,16 +579,21 @@ func (self *recv_flow) read_message() []byte {
 	return nil
 }
 
+//return false if the chunk has been received before.
 func (self *recv_flow) on_userdata(fragmentControl uint8, sequenceNumber,
-	fsnOffset uint, data, options []byte, abandon, final bool) {
+	fsnOffset uint, data, options []byte, abandon, final bool) bool {
+
+	//the buffers are read by recv, and the ack state by the delay ack alarm.
+	self.recv_cond.L.Lock()
 
 	self.rx_data_packets++
 
 	//fmt.Printf("recv_flow::on_userdata(%d-%d) last_ordered_seq#:%d\n", sequenceNumber, fsnOffset, self.last_ordered_seqnum)
 
 	if self.recv_ranges.Contain(sequenceNumber) { //duplicate ack
+		self.recv_cond.L.Unlock()
 		self.send_ack()
-		return
+		return false
 	}
 
 	ack_now := false
@@ -588,19 +638,25 @@ func (self *recv_flow) on_userdata(fragmentControl uint8, sequenceNumber,
 	self.recv_cond.Signal()
 
 	if ack_now {
+		self.recv_cond.L.Unlock()
 		self.send_ack()
 	} else {
 		//delay send ack
 		if self.delack_alarm == nil {
-			self.delack_alarm = time.AfterFunc(200*time.Millisecond, func() {
+			self.delack_alarm = self.session.clock.AfterFunc(200*time.Millisecond, func() {
 				self.send_ack()
 			})
 		}
+		self.recv_cond.L.Unlock()
 	}
+
+	return true
 }
 
 func (self *recv_flow) send_ack() {
 
+	self.recv_cond.L.Lock()
+
 	self.rx_data_packets = 0
 	self.prev_rwnd = int(self.available_buffers() / 1024)
 
@@ -618,9 +674,12 @@ func (self *recv_flow) send_ack() {
 	//fmt.Printf("send_ack(flowid:%d bufAvail:%d cumAck:%d recvRanges:%s)\n",
 	//self.flowid, self.available_buffers(), self.last_ordered_seqnum, recvRanges.String())
 
+	buf_avail, cum_ack := self.available_buffers(), self.last_ordered_seqnum
+	self.recv_cond.L.Unlock()
+
 	self.session.send_range_ack(self.flowid,
-		self.available_buffers(), //bufAvail
-		self.last_ordered_seqnum, //cumAck
+		buf_avail, //bufAvail
+		cum_ack,   //cumAck
 		recvRanges.ToArray())
 }
 
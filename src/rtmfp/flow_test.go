@@ -3,36 +3,48 @@ package rtmfp
 import (
 	"bytes"
 	"crypto/rand"
-	//	"fmt"
+	"fmt"
 	"testing"
 	"time"
 )
 
-func create_sessions() (init, resp *session, err error) {
+//the lossy link of TestFlow.
+func lossy_profile(seed int64) ChannelProfile {
+	return ChannelProfile{
+		LoseRate:      50,
+		Delay:         10 * time.Millisecond,
+		Capacity:      10,
+		Disorder:      true,
+		MaxPacketSize: 1500,
+		Seed:          seed,
+	}
+}
+
+//sessions over a link with a profile each direction, forward is from the initiator.
+//a nil clock is the real clock.
+func create_sessions(c clock, forward, backward ChannelProfile) (init, resp *session, err error) {
 
 	chan_a := make(chan *network_packet, network_packet_chan_default_buffer_size)
 	chan_b := make(chan *network_packet, network_packet_chan_default_buffer_size)
 
-	chan_a_x := &noisy_chan{
-		in:              chan_a,
-		lose_rate:       50,
-		delay:           10 * time.Millisecond,
-		capacity:        10,
-		disorder:        true,
-		max_packet_size: 1500,
-	}
+	chan_a_x := &noisy_chan{in: chan_a, clock: c, profile: backward}
 	chan_a_x.open()
 
+	chan_b_x := &noisy_chan{in: chan_b, clock: c, profile: forward}
+	chan_b_x.open()
+
 	initiator := session{
 		in:        chan_a_x.out,
-		out:       chan_b,
+		out:       chan_b_x.in,
 		sessionid: 1,
+		clock:     c,
 	}
 
 	responder := session{
-		in:        chan_b,
+		in:        chan_b_x.out,
 		out:       chan_a_x.in,
 		sessionid: 2,
+		clock:     c,
 	}
 
 	responder.passive_open()
@@ -54,37 +66,39 @@ func create_random_msgs() (msgs [][]byte) {
 	return
 }
 
-func TestFlow(t *testing.T) {
+//transfer msgs on a sim_clock, drops are fixed by the seeds and retransmission
+//timeouts cost no real time. return the simulated duration.
+func sim_flow_transfer(t *testing.T, forward, backward ChannelProfile) time.Duration {
 
-	initiator, responder, err := create_sessions()
+	clock := new_sim_clock(time.Unix(1000000000, 0))
+	defer clock.stop()
 
+	start, real_start := clock.Now(), time.Now()
+
+	initiator, responder, err := create_sessions(clock, forward, backward)
 	if err != nil {
-		t.Fatalf(err.Error())
+		t.Fatal(err)
 	}
 
 	msgs := create_random_msgs()
 
-	done := make(chan bool)
+	done := make(chan bool, 1)
+	fail := make(chan string, 1)
 
 	responder.create_recv_flow = func(signature []byte, flowid uint) (*recv_flow, error) {
 
 		flow, err := responder.new_recv_flow(flowid)
 		if err == nil {
-
 			go func() {
-
 				for i := 0; i < len(msgs); i++ {
-
 					buf, _ := flow.recv()
 					if !bytes.Equal(buf, msgs[i]) {
-						t.Fatalf("msg %d not match!(%d  %d)\n", i, len(buf), len(msgs[i]))
+						fail <- fmt.Sprintf("msg %d not match!(%d  %d)", i, len(buf), len(msgs[i]))
+						return
 					}
 				}
-
 				done <- true
-
 			}()
-
 		}
 
 		return flow, err
@@ -98,10 +112,26 @@ func TestFlow(t *testing.T) {
 
 	select {
 	case <-done:
-	case <-time.After(5 * time.Second):
+	case msg := <-fail:
+		t.Fatal(msg)
+	case <-clock.After(60 * time.Second):
 		t.Fatal("timeout!")
 	}
 
+	elapsed, real_elapsed := clock.Since(start), time.Since(real_start)
+	t.Logf("simulated %v in %v", elapsed, real_elapsed)
+
 	initiator.close()
 	responder.close()
+
+	return elapsed
+}
+
+func TestFlow(t *testing.T) {
+
+	elapsed := sim_flow_transfer(t, ChannelProfile{}, lossy_profile(1))
+
+	if again := sim_flow_transfer(t, ChannelProfile{}, lossy_profile(1)); again != elapsed {
+		t.Fatal("same seed should replay the same transfer.", elapsed, again)
+	}
 }
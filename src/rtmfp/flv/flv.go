@@ -0,0 +1,46 @@
+//Package flv read and write FLV files, the tags of which are the audio, video and data
+//messages of Flash NetStreams, e.g. to record a published stream and play it back.
+package flv
+
+import (
+	"errors"
+)
+
+//tag types
+const (
+	TagAudio = 0x08
+	TagVideo = 0x09
+	TagData  = 0x12
+)
+
+//flags of the header
+const (
+	HasVideo = 0x01
+	HasAudio = 0x04
+)
+
+const header_size = 9
+const tag_header_size = 11
+
+//tags larger than it are rejected, the size has 24 bits.
+const max_tag_size = 1<<24 - 1
+
+var ErrInvalidHeader = errors.New("flv: invalid header.")
+var ErrInvalidTag = errors.New("flv: invalid tag.")
+
+//one tag, the timestamp is in milliseconds from the start of the file.
+type Tag struct {
+	Type      uint8
+	Timestamp uint32
+	Data      []byte
+}
+
+//a position to seek to, the video keyframes or the tags of an audio only file.
+type IndexEntry struct {
+	Timestamp uint32
+	Offset    int64
+}
+
+func IsKeyframe(data []byte) bool {
+	return len(data) > 0 && data[0]>>4 == 1
+}
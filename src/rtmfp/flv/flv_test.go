@@ -0,0 +1,164 @@
+package flv
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func test_tags() []*Tag {
+	return []*Tag{
+		{TagData, 0, []byte{0x02, 0x00, 0x01, 'a'}},
+		{TagVideo, 0, []byte{0x17, 0x00}}, //AVC config, a keyframe
+		{TagAudio, 10, []byte{0xaf, 0x01}},
+		{TagVideo, 40, []byte{0x27, 0x01}},
+		{TagVideo, 1000, []byte{0x17, 0x01}},
+		{TagVideo, 0x01020304, []byte{0x17, 0x01, 0xff}}, //extended timestamp
+	}
+}
+
+func write_test_file(t *testing.T, tags []*Tag) []byte {
+	buf := bytes.NewBuffer(nil)
+	w := NewWriter(buf, HasAudio|HasVideo)
+	for _, tag := range tags {
+		if err := w.WriteTag(tag); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestWriter(t *testing.T) {
+
+	data := write_test_file(t, []*Tag{{TagVideo, 0x01020304, []byte{0x17, 0x01}}})
+
+	expect, _ := hex.DecodeString("464c5601050000000900000000" + "0900000202030401000000" + "1701" + "0000000d")
+	if !bytes.Equal(data, expect) {
+		t.Fatalf("unexpected encoding.\n%s\n%s", hex.Dump(data), hex.Dump(expect))
+	}
+
+	w := NewWriter(bytes.NewBuffer(nil), HasAudio)
+	if w.WriteTag(&Tag{Type: 0x07}) == nil || w.WriteTag(&Tag{Type: TagAudio, Data: make([]byte, 1<<24)}) == nil {
+		t.Fatal("invalid tag written.")
+	}
+}
+
+func TestReader(t *testing.T) {
+
+	tags := test_tags()
+	data := write_test_file(t, tags)
+
+	r, err := NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Flags() != HasAudio|HasVideo || r.Offset() != 13 {
+		t.Fatal("unexpected header.", r.Flags(), r.Offset())
+	}
+
+	var offsets []int64
+	for _, expect := range tags {
+		offsets = append(offsets, r.Offset())
+		tag, err := r.ReadTag()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(tag, expect) {
+			t.Fatalf("not match.\n%#v\n%#v", tag, expect)
+		}
+	}
+
+	if _, err := r.ReadTag(); err != io.EOF {
+		t.Fatal("not EOF after the last tag.", err)
+	}
+
+	//every truncation is an error, or less tags, the last PreviousTagSize may be missing.
+	for n := 0; n < len(data); n++ {
+		r, err := NewReader(bytes.NewReader(data[:n]))
+		count := 0
+		for err == nil {
+			if _, err = r.ReadTag(); err == nil {
+				count++
+			}
+		}
+		if count == len(tags) && n != len(data)-4 {
+			t.Fatal("truncated at", n, "read.")
+		}
+	}
+
+	for _, header := range []string{"464c5601050000000800000000", "464c5602050000000900000000", "4d5034"} {
+		h, _ := hex.DecodeString(header)
+		if _, err := NewReader(bytes.NewReader(h)); err != ErrInvalidHeader {
+			t.Fatal("invalid header read.", header)
+		}
+	}
+}
+
+func TestIndex(t *testing.T) {
+
+	tags := test_tags()
+	data := write_test_file(t, tags)
+
+	r, _ := NewReader(bytes.NewReader(data))
+	r.ReadTag()
+	start := r.Offset()
+
+	//the offsets of the keyframes, from the next tag.
+	index, err := r.Index()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(index) != 3 || index[0].Timestamp != 0 || index[1].Timestamp != 1000 || index[2].Timestamp != 0x01020304 {
+		t.Fatalf("unexpected index.\n%#v", index)
+	}
+	if r.Offset() != start {
+		t.Fatal("not back to the next tag.")
+	}
+
+	if err := r.SeekTag(index[1].Offset); err != nil {
+		t.Fatal(err)
+	}
+	tag, err := r.ReadTag()
+	if err != nil || !reflect.DeepEqual(tag, tags[4]) {
+		t.Fatalf("unexpected tag after seek.\n%#v %v", tag, err)
+	}
+
+	//audio only.
+	data = write_test_file(t, []*Tag{tags[0], tags[2], {TagAudio, 30, []byte{0xaf, 0x01}}})
+	r, _ = NewReader(bytes.NewReader(data))
+	if index, err := r.Index(); err != nil || len(index) != 2 || index[1].Timestamp != 30 {
+		t.Fatalf("unexpected index.\n%#v %v", index, err)
+	}
+
+	r, _ = NewReader(bytes.NewBuffer(data))
+	if _, err := r.Index(); err == nil {
+		t.Fatal("index without io.Seeker.")
+	}
+
+	//the error of the frame type of a video tag, the last one truncated is not indexed.
+	data = write_test_file(t, tags)
+	r, _ = NewReader(&failing_reader{bytes.NewReader(data), int64(len(data) - 4 - 3)})
+	if _, err := r.Index(); err == nil {
+		t.Fatal("read error ignored.")
+	}
+	r, _ = NewReader(bytes.NewReader(data[:len(data)-4-3]))
+	if index, err := r.Index(); err != nil || len(index) != 2 {
+		t.Fatalf("unexpected index.\n%#v %v", index, err)
+	}
+}
+
+//fail to read at the offset at, e.g. a bad sector.
+type failing_reader struct {
+	*bytes.Reader
+	at int64
+}
+
+func (self *failing_reader) Read(p []byte) (int, error) {
+	if pos, _ := self.Seek(0, io.SeekCurrent); pos == self.at {
+		return 0, errors.New("read failed.")
+	}
+	return self.Reader.Read(p)
+}
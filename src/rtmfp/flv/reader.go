@@ -0,0 +1,174 @@
+package flv
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+//Reader read the tags of an FLV file.
+type Reader struct {
+	r      io.Reader
+	flags  uint8
+	offset int64 //of the next tag
+}
+
+func NewReader(r io.Reader) (*Reader, error) {
+
+	var h [header_size]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return nil, ErrInvalidHeader
+	}
+
+	if h[0] != 'F' || h[1] != 'L' || h[2] != 'V' || h[3] != 1 {
+		return nil, ErrInvalidHeader
+	}
+
+	data_offset := binary.BigEndian.Uint32(h[5:9])
+	if data_offset < header_size || data_offset > 1024 {
+		return nil, ErrInvalidHeader
+	}
+
+	//extra header bytes, and the PreviousTagSize0.
+	if _, err := io.CopyN(io.Discard, r, int64(data_offset-header_size)+4); err != nil {
+		return nil, ErrInvalidHeader
+	}
+
+	return &Reader{r: r, flags: h[4], offset: int64(data_offset) + 4}, nil
+}
+
+//HasAudio and HasVideo of the header.
+func (self *Reader) Flags() uint8 {
+	return self.flags
+}
+
+//the position of the next tag.
+func (self *Reader) Offset() int64 {
+	return self.offset
+}
+
+func unexpected_eof(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (self *Reader) read_tag_header() (tag_type uint8, size uint32, timestamp uint32, err error) {
+
+	var h [tag_header_size]byte
+	if _, err = io.ReadFull(self.r, h[:]); err != nil {
+		return
+	}
+
+	tag_type = h[0]
+	size = uint32(h[1])<<16 | uint32(h[2])<<8 | uint32(h[3])
+	timestamp = uint32(h[7])<<24 | uint32(h[4])<<16 | uint32(h[5])<<8 | uint32(h[6])
+
+	if tag_type != TagAudio && tag_type != TagVideo && tag_type != TagData {
+		err = ErrInvalidTag
+	}
+
+	return
+}
+
+//the next tag, io.EOF after the last one.
+func (self *Reader) ReadTag() (*Tag, error) {
+
+	tag_type, size, timestamp, err := self.read_tag_header()
+	if err != nil {
+		return nil, err
+	}
+
+	t := &Tag{Type: tag_type, Timestamp: timestamp, Data: make([]byte, size)}
+	if _, err := io.ReadFull(self.r, t.Data); err != nil {
+		return nil, unexpected_eof(err)
+	}
+
+	//PreviousTagSize, missing after the last tag of some files.
+	var prev [4]byte
+	if n, err := io.ReadFull(self.r, prev[:]); err != nil && !(err == io.EOF && n == 0) {
+		return nil, unexpected_eof(err)
+	}
+
+	self.offset += int64(tag_header_size + size + 4)
+
+	return t, nil
+}
+
+//read the next tag from offset, e.g. of an IndexEntry. the reader of NewReader() must
+//be an io.Seeker.
+func (self *Reader) SeekTag(offset int64) error {
+
+	s, ok := self.r.(io.Seeker)
+	if !ok {
+		return errors.New("flv: not an io.Seeker.")
+	}
+
+	if _, err := s.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	self.offset = offset
+
+	return nil
+}
+
+//the positions to seek to, from the next tag to the end of the file: the video keyframes,
+//or every audio tag of a file without video. the reader is back to the next tag after.
+func (self *Reader) Index() ([]IndexEntry, error) {
+
+	s, ok := self.r.(io.Seeker)
+	if !ok {
+		return nil, errors.New("flv: not an io.Seeker.")
+	}
+
+	start := self.offset
+	var keyframes, audio []IndexEntry
+
+tags:
+	for {
+		tag_type, size, timestamp, err := self.read_tag_header()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		entry := IndexEntry{timestamp, self.offset}
+		skip := int64(size) + 4
+
+		switch tag_type {
+		case TagAudio:
+			audio = append(audio, entry)
+		case TagVideo:
+			if size > 0 {
+				var b [1]byte
+				if _, err := io.ReadFull(self.r, b[:]); err == io.EOF {
+					//truncated at the end.
+					break tags
+				} else if err != nil {
+					return nil, err
+				}
+				skip--
+				if IsKeyframe(b[:]) {
+					keyframes = append(keyframes, entry)
+				}
+			}
+		}
+
+		if _, err := s.Seek(skip, io.SeekCurrent); err != nil {
+			return nil, err
+		}
+		self.offset += tag_header_size + int64(size) + 4
+	}
+
+	if err := self.SeekTag(start); err != nil {
+		return nil, err
+	}
+
+	if len(keyframes) > 0 {
+		return keyframes, nil
+	}
+	return audio, nil
+}
@@ -0,0 +1,55 @@
+package flv
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+//Writer write tags to an FLV file, the header is written before the first tag.
+type Writer struct {
+	w      io.Writer
+	flags  uint8
+	header bool
+}
+
+//flags is HasAudio, HasVideo or both.
+func NewWriter(w io.Writer, flags uint8) *Writer {
+	return &Writer{w: w, flags: flags}
+}
+
+func (self *Writer) write_header() error {
+
+	h := []byte{'F', 'L', 'V', 1, self.flags, 0, 0, 0, header_size, 0, 0, 0, 0}
+	if _, err := self.w.Write(h); err != nil {
+		return err
+	}
+
+	self.header = true
+	return nil
+}
+
+func (self *Writer) WriteTag(t *Tag) error {
+
+	if len(t.Data) > max_tag_size || (t.Type != TagAudio && t.Type != TagVideo && t.Type != TagData) {
+		return ErrInvalidTag
+	}
+
+	if !self.header {
+		if err := self.write_header(); err != nil {
+			return err
+		}
+	}
+
+	size := uint32(len(t.Data))
+
+	buf := make([]byte, tag_header_size+size+4)
+	buf[0] = t.Type
+	buf[1], buf[2], buf[3] = byte(size>>16), byte(size>>8), byte(size)
+	buf[4], buf[5], buf[6], buf[7] = byte(t.Timestamp>>16), byte(t.Timestamp>>8), byte(t.Timestamp), byte(t.Timestamp>>24)
+	//stream id is always 0.
+	copy(buf[tag_header_size:], t.Data)
+	binary.BigEndian.PutUint32(buf[tag_header_size+size:], tag_header_size+size)
+
+	_, err := self.w.Write(buf)
+	return err
+}
@@ -2,59 +2,110 @@ package rtmfp
 
 import (
 	"bytes"
+	"crypto/hmac"
 	"crypto/rand"
 	"encoding/binary"
 	//"encoding/hex"
 	"errors"
 	//"fmt"
+	"net"
 	"strings"
+	"sync"
 	"time"
 )
 
 var ihello_retry = 5 //not exceed 64
 var ihello_timeout = 1 * time.Second
 
+//cookie secret is replaced periodically, cookies made by the previous secret are still recognized
+//and answered with a RHello Cookie Change.
+var cookie_rotate_duration = 60 * time.Second
+var cookie_max_age = 5 * time.Minute
+var cookie_mac_size = 16
+
+//IHello responses allowed per source ip, token bucket.
+var ihello_rate_limit = 10 //per second
+var ihello_rate_burst = 20
+
+const (
+	cookie_invalid = iota
+	cookie_valid
+	cookie_stale
+)
+
 var last_sessionid uint32
+var sessionid_mutex sync.Mutex
 
 func new_sessionid() uint32 {
+	sessionid_mutex.Lock()
+	defer sessionid_mutex.Unlock()
+
 	last_sessionid++
 	return last_sessionid
 }
 
-type rhello_cb func(srcAddr string, cookie, dh_public []byte)
+//reject responders whose certificate don't match the requested peerid.
+var strict_peerid_check = true
+
+type rhello_cb func(srcAddr string, cookie, dh_public, far_peerid []byte, dh_group_id uint8)
 
 type create_session_request struct {
 	target []byte
+	strict bool
 	cb     rhello_cb
+
+	//addresses learned from redirect, ihellos are sent to all of them.
+	candidates []string
+
+	//glare handling, see handshake.check_glare()
+	session  *session //set once we send iikeying
+	yielded  bool
+	yield    chan bool
+	survivor chan *session //the session opened by the peer we yield to, nil if it fail.
+}
+
+//0x0a serverurl, 0x0f peerid
+func get_edp_type(edp []byte) uint8 {
+	if strings.Contains(string(edp), "rtmfp://") {
+		return 0x0a
+	} else {
+		return 0x0f
+	}
 }
 
 type handshake struct {
 	in  chan *network_packet
 	out chan *network_packet
 
-	cookie    []byte
 	pseudo_id [64]byte
 
+	mutex             sync.Mutex
+	cookie_secret     []byte
+	old_cookie_secret []byte
+	rotate_ticker     clock_ticker
+	done              chan bool //closed by close(), stop the rotation.
+
+	ihello_buckets map[string]*ihello_bucket
+
 	certificate []byte
+	profile     CryptoProfile
+	clock       clock //nil for the real clock, shared by sessions.
 
 	requests map[string]*create_session_request
 	sessions map[uint32]*session
 
+	//pending create_session requests by target peerid.
+	dialing map[string]*create_session_request
+
+	//rendezvous mode, introduce peers connected to us by their peerid.
+	rendezvous bool
+	peers      map[string]*session
+
 	create_passive_session func(addr string, peerid []byte) (*session, error)
 }
 
 func (self *handshake) gen_certificate() {
-
-	buf := bytes.NewBuffer(nil)
-	buf.Write([]byte("\x01\x0A\x41\x0E"))
-
-	for i := 0; i < len(self.pseudo_id); i++ {
-		buf.WriteByte(self.pseudo_id[i])
-	}
-
-	buf.Write([]byte("\x02\x15\x02\x02\x15\x05\x02\x15\x0E"))
-
-	self.certificate = buf.Bytes()
+	self.certificate = self.profile.BuildCertificate(self.pseudo_id[:])
 }
 
 func (self *handshake) peerid() []byte {
@@ -71,47 +122,203 @@ func (self *handshake) create_session(addr string, target []byte) (s *session, e
 	continue_chan := make(chan bool, 1)
 
 	var other_addr string
-	var cookie_echo, other_dh_public []byte
+	var cookie_echo, other_dh_public, far_peerid []byte
+	var dh_group_id uint8
 
-	self.requests[string(tag)] = &create_session_request{
+	req := &create_session_request{
 		target: target,
-		cb: func(srcAddr string, cookie, dh_public []byte) {
+		strict: strict_peerid_check && get_edp_type(target) == 0x0f && len(target) > 0,
+		cb: func(srcAddr string, cookie, dh_public, farId []byte, group_id uint8) {
 			other_addr = srcAddr
 			cookie_echo = cookie
 			other_dh_public = dh_public
+			far_peerid = farId
+			dh_group_id = group_id
 			continue_chan <- true
 		},
+		yield:    make(chan bool, 1),
+		survivor: make(chan *session, 1),
+	}
+
+	self.mutex.Lock()
+	self.requests[string(tag)] = req
+	self.mutex.Unlock()
+
+	if get_edp_type(target) == 0x0f && len(target) > 0 {
+		self.mutex.Lock()
+		self.dialing[string(target)] = req
+		self.mutex.Unlock()
+
+		defer func() {
+			self.mutex.Lock()
+			if self.dialing[string(target)] == req {
+				delete(self.dialing, string(target))
+			}
+			self.mutex.Unlock()
+		}()
 	}
 
 	//send ihello with retry.
 forloop:
 	for i := 0; i < ihello_retry; i++ {
-		self.send_ihello(addr, target, tag)
+		self.send_ihellos(addr, tag, req)
 		select {
 		case recv_rhello = <-continue_chan:
 			break forloop
-		case <-time.After((1 << uint(i)) * ihello_timeout):
+		case <-req.yield:
+			self.remove_request(tag)
+			return self.wait_survivor(req)
+		case <-self.clock.After((1 << uint(i)) * ihello_timeout):
 		}
 	}
 
 	if recv_rhello == false {
+		self.remove_request(tag)
 		return nil, errors.New("create session fail!(no valid rhello recved.)")
 	}
 
 	s = self.new_session()
+	s.far_peerid = far_peerid
+	s.dh_group = find_dh_group(dh_group_id)
+
+	self.mutex.Lock()
+	yielded := req.yielded
+	req.session = s
+	self.mutex.Unlock()
+
+	if yielded {
+		self.remove_session(s)
+		return self.wait_survivor(req)
+	}
+
 	err = s.active_open(other_addr, cookie_echo, other_dh_public)
 
+	self.mutex.Lock()
+	yielded = req.yielded
+	self.mutex.Unlock()
+
+	if yielded {
+		self.remove_session(s)
+		return self.wait_survivor(req)
+	}
+
+	//other addresses of the far end told by the redirect, to fail over to.
+	if err == nil {
+		self.mutex.Lock()
+		candidates := req.candidates
+		self.mutex.Unlock()
+
+		for _, candidate := range candidates {
+			if s.add_path(candidate, false) {
+				s.probe_path(candidate)
+			}
+		}
+	}
+
 	return s, err
 }
 
+//the session opened by the peer we yield to, instead of ours.
+func (self *handshake) wait_survivor(req *create_session_request) (*session, error) {
+	select {
+	case s := <-req.survivor:
+		if s != nil {
+			return s, nil
+		}
+	case <-self.clock.After(iikeying_timeout):
+	}
+	return nil, errors.New("create session fail!(yield to the session opened by peer, which fail.)")
+}
+
+//forget a pending request, answers to its tag are dropped.
+func (self *handshake) remove_request(tag []byte) {
+	self.mutex.Lock()
+	delete(self.requests, string(tag))
+	self.mutex.Unlock()
+}
+
+//forget a session closed or aborted by glare, packets to it are dropped.
+func (self *handshake) remove_session(s *session) {
+	self.mutex.Lock()
+	delete(self.sessions, s.sessionid)
+	self.mutex.Unlock()
+}
+
+//send ihello to the address we are told and all candidates learned from redirect at the same time,
+//whichever path get through the NATs first wins.
+func (self *handshake) send_ihellos(addr string, tag []byte, req *create_session_request) {
+
+	self.mutex.Lock()
+	candidates := req.candidates
+	self.mutex.Unlock()
+
+	self.send_ihello(addr, req.target, tag)
+
+	for _, dstAddr := range candidates {
+		if dstAddr != addr {
+			self.send_ihello(dstAddr, req.target, tag)
+		}
+	}
+}
+
+//glare: both ends send iikeying to each other. keep only one session, the end with
+//the greater peerid keeps the session it initiated, the other end yields.
+//return true if the incoming iikeying should be dropped, and the request yielding to it,
+//which wait for the session opened by it.
+func (self *handshake) check_glare(peerid []byte) (bool, *create_session_request) {
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	req, ok := self.dialing[string(peerid)]
+	if !ok || req.yielded {
+		return false, nil
+	}
+
+	//our iikeying is on the way, the far end will yield to it.
+	if req.session != nil && bytes.Compare(self.peerid(), peerid) > 0 {
+		return true, nil
+	}
+
+	req.yielded = true
+	req.yield <- true
+
+	if req.session != nil {
+		req.session.abort_open()
+	}
+
+	return false, req
+}
+
 func (self *handshake) new_session() *session {
 	s := &session{
-		sessionid: new_sessionid(),
-		in:        make(chan *network_packet, network_packet_chan_default_buffer_size),
-		out:       self.out,
+		sessionid:   new_sessionid(),
+		in:          make(chan *network_packet, network_packet_chan_default_buffer_size),
+		out:         self.out,
+		profile:     self.profile,
+		certificate: self.certificate,
+		open_abort:  make(chan bool, 1),
+		clock:       self.clock,
+	}
+
+	//a closed session is no longer introduced to other peers, and its packets are dropped
+	//before the profile forget its keys.
+	s.on_close = func() {
+		self.unregister_peer(s)
+		self.remove_session(s)
+	}
+
+	//the initiator is sending ihellos to us at the same time, our rhello open our NAT
+	//mapping for it, and the initiator's ihello open its mapping for our rhello.
+	s.recv_forwarded_ihello = func(edpData []byte, replyAddress string, tag []byte) {
+		if bytes.Equal(edpData, self.peerid()) {
+			self.send_rhello(replyAddress, tag)
+		}
 	}
 
+	self.mutex.Lock()
 	self.sessions[s.sessionid] = s
+	self.mutex.Unlock()
 
 	return s
 }
@@ -120,9 +327,33 @@ func (self *handshake) open() error {
 
 	self.requests = make(map[string]*create_session_request)
 	self.sessions = make(map[uint32]*session)
+	self.peers = make(map[string]*session)
+	self.dialing = make(map[string]*create_session_request)
+
+	self.ihello_buckets = make(map[string]*ihello_bucket)
+
+	if self.profile == nil {
+		self.profile = default_crypto_profile
+	}
 
-	self.cookie = make([]byte, 4)
-	rand.Read(self.cookie)
+	if self.clock == nil {
+		self.clock = default_clock
+	}
+
+	self.rotate_cookie_secret()
+	self.rotate_ticker = self.clock.NewTicker(cookie_rotate_duration)
+	self.done = make(chan bool)
+	go func(ticker clock_ticker, done chan bool) {
+		for {
+			select {
+			case <-ticker.C():
+				self.rotate_cookie_secret()
+				self.expire_ihello_buckets()
+			case <-done:
+				return
+			}
+		}
+	}(self.rotate_ticker, self.done)
 
 	self.gen_certificate()
 
@@ -133,6 +364,130 @@ func (self *handshake) open() error {
 
 func (self *handshake) close() {
 	//FIXME: clean up.
+
+	if self.rotate_ticker != nil {
+		self.rotate_ticker.Stop()
+	}
+
+	self.mutex.Lock()
+	if self.done != nil {
+		close(self.done)
+		self.done = nil
+	}
+	self.mutex.Unlock()
+}
+
+func (self *handshake) rotate_cookie_secret() {
+
+	secret := make([]byte, 32)
+	rand.Read(secret)
+
+	self.mutex.Lock()
+	self.old_cookie_secret = self.cookie_secret
+	self.cookie_secret = secret
+	self.mutex.Unlock()
+}
+
+//cookie = timestamp(4 bytes, unix seconds) + HMAC-SHA256(secret, timestamp + initiator address)
+//the responder keeps no state for each IHello, cookie is verified by recompute it.
+func make_cookie(secret []byte, ts uint32, addr string) []byte {
+
+	buf := bytes.NewBuffer(nil)
+	binary.Write(buf, binary.BigEndian, ts)
+
+	mac := HmacSha256(secret, append(buf.Bytes(), []byte(addr)...))
+	buf.Write(mac[:cookie_mac_size])
+
+	return buf.Bytes()
+}
+
+func (self *handshake) new_cookie(addr string) []byte {
+
+	self.mutex.Lock()
+	secret := self.cookie_secret
+	self.mutex.Unlock()
+
+	return make_cookie(secret, uint32(self.clock.Now().Unix()), addr)
+}
+
+func (self *handshake) check_cookie(addr string, cookie []byte) int {
+
+	if len(cookie) != 4+cookie_mac_size {
+		return cookie_invalid
+	}
+
+	ts := binary.BigEndian.Uint32(cookie)
+
+	age := self.clock.Since(time.Unix(int64(ts), 0))
+	if age > cookie_max_age || age < -cookie_rotate_duration {
+		return cookie_invalid
+	}
+
+	self.mutex.Lock()
+	secret, old_secret := self.cookie_secret, self.old_cookie_secret
+	self.mutex.Unlock()
+
+	if hmac.Equal(cookie, make_cookie(secret, ts, addr)) {
+		return cookie_valid
+	}
+
+	if old_secret != nil && hmac.Equal(cookie, make_cookie(old_secret, ts, addr)) {
+		return cookie_stale
+	}
+
+	return cookie_invalid
+}
+
+type ihello_bucket struct {
+	tokens      float64
+	update_time time.Time
+}
+
+//limit IHello responses by source ip, so we can't be used to amplify traffic to a spoofed address.
+func (self *handshake) allow_ihello(addr string) bool {
+
+	ip, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		ip = addr
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	now := self.clock.Now()
+
+	bucket, ok := self.ihello_buckets[ip]
+	if !ok {
+		bucket = &ihello_bucket{tokens: float64(ihello_rate_burst), update_time: now}
+		self.ihello_buckets[ip] = bucket
+	}
+
+	bucket.tokens += now.Sub(bucket.update_time).Seconds() * float64(ihello_rate_limit)
+	if bucket.tokens > float64(ihello_rate_burst) {
+		bucket.tokens = float64(ihello_rate_burst)
+	}
+	bucket.update_time = now
+
+	if bucket.tokens < 1 {
+		return false
+	}
+
+	bucket.tokens--
+
+	return true
+}
+
+func (self *handshake) expire_ihello_buckets() {
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	for ip, bucket := range self.ihello_buckets {
+		//the bucket is full again, forget it.
+		if self.clock.Since(bucket.update_time).Seconds()*float64(ihello_rate_limit) >= float64(ihello_rate_burst) {
+			delete(self.ihello_buckets, ip)
+		}
+	}
 }
 
 func (self *handshake) dispatch() {
@@ -162,7 +517,9 @@ func (self *handshake) recv_packet(p *network_packet) {
 
 	if sessionId > 0 {
 		//dispatch the established session.
+		self.mutex.Lock()
 		s, ok := self.sessions[sessionId]
+		self.mutex.Unlock()
 		if ok {
 			s.in <- p
 		} else {
@@ -170,7 +527,7 @@ func (self *handshake) recv_packet(p *network_packet) {
 		}
 
 	} else {
-		decode_packet(&p.addr, p.data, default_crypto_key, nil, self)
+		decode_packet(&p.addr, p.data, nil, self.profile, nil, self)
 	}
 }
 
@@ -184,42 +541,113 @@ func (self *handshake) send_ihello(addr string, edp, tag []byte) {
 
 	chunk_buf := bytes.NewBuffer(nil)
 
-	//0x0a serverurl, 0x0f peerid
-	var edp_type uint8
-	if strings.Contains(string(edp), "rtmfp://") {
-		edp_type = 0x0a
-	} else {
-		edp_type = 0x0f
-	}
-
-	edp_len := uint(len(edp))
-
 	//EndPointDiscriminator
-	encode_vlu(chunk_buf, get_vlu_size(1+edp_len)+1+edp_len)
-	encode_vlu(chunk_buf, 1+edp_len)
-	binary.Write(chunk_buf, binary.BigEndian, edp_type)
-	chunk_buf.Write(edp)
+	encode_endpoint_discriminator(chunk_buf, get_edp_type(edp), edp)
 
 	//Tag
 	chunk_buf.Write(tag)
 
 	p := &packet{
-		time_stamp: timestamp(),
+		time_stamp: timestamp(self.clock.Now()),
 		mode:       mode_startup,
 	}
 
 	p.init()
 	p.add_chunk(0x30, chunk_buf.Bytes())
 
-	go self.send_packet(addr, p.pack(0, default_crypto_key))
+	go self.send_packet(addr, p.pack(0, nil, self.profile))
 }
 
 func (self *handshake) recv_ihello(srcAddr *string, edpType uint8, edpData, tag []byte) {
 	//fmt.Printf("recv_ihello(edpType:%d edpData:%v tag:%v)\n", edpType, edpData, tag)
 
+	if !self.allow_ihello(*srcAddr) {
+		//fmt.Printf("too many ihello from %s, drop it.\n", *srcAddr)
+		return
+	}
+
+	if self.rendezvous && edpType == 0x0f && !bytes.Equal(edpData, self.peerid()) {
+		self.introduce(*srcAddr, edpData, tag)
+		return
+	}
+
 	self.send_rhello(*srcAddr, tag)
 }
 
+func (self *handshake) register_peer(peerid []byte, s *session) {
+	self.mutex.Lock()
+	if !s.unregistered {
+		self.peers[string(peerid)] = s
+	}
+	self.mutex.Unlock()
+}
+
+func (self *handshake) unregister_peer(s *session) {
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	s.unregistered = true
+
+	for peerid, p := range self.peers {
+		if p == s {
+			delete(self.peers, peerid)
+		}
+	}
+}
+
+func (self *handshake) find_peer(peerid []byte) *session {
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	s, ok := self.peers[string(peerid)]
+	if !ok {
+		return nil
+	}
+
+	if !s.handshaked() {
+		return nil
+	}
+
+	return s
+}
+
+//tell the initiator where the target is, and tell the target who is looking for it.
+//both sides then send hellos to each other directly.
+func (self *handshake) introduce(initiatorAddr string, target, tag []byte) {
+
+	s := self.find_peer(target)
+	if s == nil {
+		//fmt.Printf("peer %s not registered.\n", hex.EncodeToString(target))
+		return
+	}
+
+	self.send_redirect(initiatorAddr, tag, s.reachable_addrs())
+	s.send_fihello(target, initiatorAddr, tag)
+}
+
+func (self *handshake) send_redirect(dstAddr string, tagEcho []byte, redirectDestination []string) {
+
+	chunk_buf := bytes.NewBuffer(nil)
+
+	encode_vlu_prefix_bytes(chunk_buf, tagEcho)
+
+	for _, addr := range redirectDestination {
+		encode_address(chunk_buf, addr, address_origin_observed)
+	}
+
+	p := &packet{
+		time_stamp: timestamp(self.clock.Now()),
+		mode:       mode_startup,
+	}
+
+	p.init()
+	p.add_chunk(0x71, chunk_buf.Bytes())
+
+	go self.send_packet(dstAddr, p.pack(0, nil, self.profile))
+}
+
 func (self *handshake) recv_fihello(srcAddr *string, edpType uint8, edpData []byte, replyAddress string, tag []byte) {
 	//fmt.Printf("recv_fihello(edpType:%d edpData:%v tag:%v)\n", edpType, edpData, tag)
 
@@ -233,21 +661,21 @@ func (self *handshake) send_rhello(dstAddr string, tag []byte) {
 	//tag echo
 	encode_vlu_prefix_bytes(chunk_buf, tag)
 
-	//cookie
-	encode_vlu_prefix_bytes(chunk_buf, self.cookie)
+	//cookie, bind to the address which will send iikeying.
+	encode_vlu_prefix_bytes(chunk_buf, self.new_cookie(dstAddr))
 
 	//responder certificate
 	chunk_buf.Write(self.certificate)
 
 	p := &packet{
-		time_stamp: timestamp(),
+		time_stamp: timestamp(self.clock.Now()),
 		mode:       mode_startup,
 	}
 
 	p.init()
 	p.add_chunk(0x70, chunk_buf.Bytes())
 
-	go self.send_packet(dstAddr, p.pack(0, default_crypto_key))
+	go self.send_packet(dstAddr, p.pack(0, nil, self.profile))
 }
 
 func (self *handshake) recv_rhello(srcAddr *string, tagEcho, cookie, respCert []byte) {
@@ -255,17 +683,20 @@ func (self *handshake) recv_rhello(srcAddr *string, tagEcho, cookie, respCert []
 	//fmt.Printf("recv_rhello(tagEho:%v cookie:%v respCert:%v\n", tagEcho, cookie, respCert)
 
 	//check pending tag.
+	self.mutex.Lock()
 	req, ok := self.requests[string(tagEcho)]
+	self.mutex.Unlock()
 	if !ok {
 		//fmt.Println("invalid tagEcho!")
 		return
 	}
-	delete(self.requests, string(tagEcho))
 
 	var dh_public_number []byte
+	dh_group_id := select_dh_group(respCert)
 
 	//flash client will return dh public number in rhello
 	if read_vlu_option(respCert, 0x1D, 0) == 0x02 && len(respCert) > 128 {
+		dh_group_id = dh_group_modp1024
 		dh_public_number = respCert[len(respCert)-128:]
 		//fmt.Println("respCert contain dh public number")
 
@@ -277,24 +708,56 @@ func (self *handshake) recv_rhello(srcAddr *string, tagEcho, cookie, respCert []
 	farId := gen_peerid_from_cert(respCert)
 	if !bytes.Equal(farId, req.target) {
 		//fmt.Println("WARNING: respCert is not match to the request peerid!")
+
+		if req.strict {
+			//someone else answer for the peerid, keep waiting for the right one.
+			return
+		}
+	}
+
+	//only the first answer continue the request.
+	self.mutex.Lock()
+	pending := self.requests[string(tagEcho)] == req
+	delete(self.requests, string(tagEcho))
+	self.mutex.Unlock()
+	if !pending {
+		return
 	}
 
 	//TODO: check established session by peerid?
 	//this happen when peer have multi-ip or we get peer from multi place, and we don't know peerid in advance.
 
-	req.cb(*srcAddr, cookie, dh_public_number)
+	req.cb(*srcAddr, cookie, dh_public_number, farId, dh_group_id)
 }
 
 func (self *handshake) recv_redirect(srcAddr *string, tagEcho []byte, redirectDestination []string) {
 	//fmt.Printf("recv_redirect(tag:%v %v)\n", tagEcho, redirectDestination)
 
 	//check pending tag.
+	self.mutex.Lock()
 	req, ok := self.requests[string(tagEcho)]
 	if !ok {
+		self.mutex.Unlock()
 		//fmt.Println("invalid tagEcho!")
 		return
 	}
 
+	for _, dstAddr := range redirectDestination {
+		known := false
+		for _, candidate := range req.candidates {
+			if candidate == dstAddr {
+				known = true
+				break
+			}
+		}
+
+		if !known {
+			req.candidates = append(req.candidates, dstAddr)
+		}
+	}
+	self.mutex.Unlock()
+
+	//the target is told to answer us at the same time, punch our NAT for it now.
 	for _, dstAddr := range redirectDestination {
 		self.send_ihello(dstAddr, req.target, tagEcho)
 	}
@@ -303,15 +766,38 @@ func (self *handshake) recv_redirect(srcAddr *string, tagEcho []byte, redirectDe
 func (self *handshake) recv_iikeying(srcAddr *string, initSid uint32, cookieEcho, initCert, initNonce []byte) {
 
 	//check cookieEcho
-	if !bytes.Equal(self.cookie, cookieEcho) {
+	switch self.check_cookie(*srcAddr, cookieEcho) {
+	case cookie_valid:
+	case cookie_stale:
+		//made by the previous secret, tell the initiator to use a fresh one.
+		self.send_rhello_cookie_change(*srcAddr, initSid, cookieEcho)
+		return
+	default:
 		//fmt.Println("cookie not match!")
 		return
 	}
 
+	//CERT = OPTION(x1D, group + DH), check it before any session is created.
+	option_1d := read_option(initCert, 0x1D)
+	if len(option_1d) < 2 {
+		return
+	}
+
+	group := find_dh_group(option_1d[0])
+	if group == nil || group.check_public(option_1d[1:]) != nil {
+		//fmt.Println("unsupported dh group or invalid dh public number!")
+		return
+	}
+
 	//TODO: find established session by peerid. this will happen when the rikeying response is lost.
 
-	//NOTE: peerid calc from initCert and respCert is different! so we should call this nearid, only identify this session.
-	nearId := gen_peerid_from_cert(initCert)
+	peerid := gen_peerid_from_init_cert(initCert)
+
+	drop, yielding := self.check_glare(peerid)
+	if drop {
+		//fmt.Println("glare, drop the iikeying from the peer with less peerid.")
+		return
+	}
 
 	if self.create_passive_session == nil {
 		//fmt.Println("create_passive_session function not set.")
@@ -319,17 +805,52 @@ func (self *handshake) recv_iikeying(srcAddr *string, initSid uint32, cookieEcho
 		return
 	}
 
-	s, err := self.create_passive_session(*srcAddr, nearId)
+	s, err := self.create_passive_session(*srcAddr, peerid)
 	if err != nil {
 		//fmt.Println(err)
+		if yielding != nil {
+			yielding.survivor <- nil
+		}
 		return
 	}
 
+	if self.rendezvous {
+		self.register_peer(peerid, s)
+	}
+
 	s.recv_iikeying(srcAddr, initSid, cookieEcho, initCert, initNonce)
+
+	//the create_session yielding to us use the session too.
+	if yielding != nil {
+		s.far_peerid = peerid
+		yielding.survivor <- s
+	}
+}
+
+func (self *handshake) send_rhello_cookie_change(dstAddr string, initSid uint32, oldCookie []byte) {
+
+	chunk_buf := bytes.NewBuffer(nil)
+
+	//old cookie
+	encode_vlu_prefix_bytes(chunk_buf, oldCookie)
+
+	//new cookie
+	chunk_buf.Write(self.new_cookie(dstAddr))
+
+	p := &packet{
+		time_stamp: timestamp(self.clock.Now()),
+		mode:       mode_startup,
+	}
+
+	p.init()
+	p.add_chunk(0x79, chunk_buf.Bytes())
+
+	//initiator session is in startup state, use its sessionid with default key, like RIKeying.
+	go self.send_packet(dstAddr, p.pack(initSid, nil, self.profile))
 }
 
 func (self *handshake) recv_rhello_cookie_change(srcAddr *string, oldCookie, newCookie []byte) {
-	panic("should not called!")
+	//cookie change is sent to the initiator session, not to sessionid 0. ignore it.
 }
 
 func (self *handshake) recv_rikeying(srcAddr *string, respSid uint32, respNonce []byte) {
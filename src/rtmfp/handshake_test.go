@@ -1,7 +1,9 @@
 package rtmfp
 
 import (
+	"bytes"
 	"testing"
+	"time"
 )
 
 func TestHandshake(t *testing.T) {
@@ -30,9 +32,186 @@ func TestHandshake(t *testing.T) {
 		return s, nil
 	}
 
-	_, err := a.create_session("", []byte("xyz"))
+	s, err := a.create_session("", b.peerid())
 
 	if err != nil {
 		t.Fatal()
 	}
+
+	if !bytes.Equal(s.far_peerid, b.peerid()) {
+		t.Fatal("far peerid not verified.")
+	}
+}
+
+func TestStrictPeeridCheck(t *testing.T) {
+
+	chan1 := make(chan *network_packet, network_packet_chan_default_buffer_size)
+	chan2 := make(chan *network_packet, network_packet_chan_default_buffer_size)
+
+	a := &handshake{
+		in:  chan1,
+		out: chan2,
+	}
+
+	b := &handshake{
+		in:  chan2,
+		out: chan1,
+	}
+
+	a.open()
+	b.open()
+
+	b.create_passive_session = func(addr string, peerid []byte) (*session, error) {
+		s := b.new_session()
+		s.passive_open()
+		return s, nil
+	}
+
+	saved_retry, saved_timeout := ihello_retry, ihello_timeout
+	ihello_retry, ihello_timeout = 2, 50*time.Millisecond
+	defer func() {
+		ihello_retry, ihello_timeout = saved_retry, saved_timeout
+		strict_peerid_check = true
+	}()
+
+	//b is not the peer we want.
+	_, err := a.create_session("", []byte("xyz"))
+	if err == nil {
+		t.Fatal("responder with wrong peerid should be rejected.")
+	}
+
+	strict_peerid_check = false
+
+	s, err := a.create_session("", []byte("xyz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(s.far_peerid, b.peerid()) {
+		t.Fatal("far peerid not match.")
+	}
+}
+
+func TestCookie(t *testing.T) {
+
+	hs := &handshake{
+		in:  make(chan *network_packet, 1),
+		out: make(chan *network_packet, 1),
+	}
+	hs.open()
+	defer hs.close()
+
+	addr := "10.0.0.1:1000"
+
+	cookie := hs.new_cookie(addr)
+	if hs.check_cookie(addr, cookie) != cookie_valid {
+		t.Fatal("fresh cookie not valid.")
+	}
+
+	if hs.check_cookie("10.0.0.2:1000", cookie) != cookie_invalid {
+		t.Fatal("cookie should bind to address.")
+	}
+
+	hs.rotate_cookie_secret()
+	if hs.check_cookie(addr, cookie) != cookie_stale {
+		t.Fatal("cookie of previous secret should be stale.")
+	}
+
+	hs.rotate_cookie_secret()
+	if hs.check_cookie(addr, cookie) != cookie_invalid {
+		t.Fatal("cookie of expired secret should be invalid.")
+	}
+}
+
+func TestCookieChange(t *testing.T) {
+
+	chan1 := make(chan *network_packet, network_packet_chan_default_buffer_size)
+	chan2 := make(chan *network_packet, network_packet_chan_default_buffer_size)
+
+	a := &handshake{
+		in:  chan1,
+		out: chan2,
+	}
+
+	b := &handshake{
+		in:  chan2,
+		out: chan1,
+	}
+
+	a.open()
+	b.open()
+
+	b.create_passive_session = func(addr string, peerid []byte) (*session, error) {
+		s := b.new_session()
+		s.passive_open()
+		return s, nil
+	}
+
+	//the cookie is made before the responder rotate its secret.
+	old_cookie := b.new_cookie("")
+	b.rotate_cookie_secret()
+
+	s := a.new_session()
+	err := s.active_open("", old_cookie, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Equal(s.get_cookie_echo(), old_cookie) {
+		t.Fatal("cookie not changed.")
+	}
+}
+
+func TestIHelloRateLimit(t *testing.T) {
+
+	hs := &handshake{
+		in:  make(chan *network_packet, 1),
+		out: make(chan *network_packet, 1),
+	}
+	hs.open()
+	defer hs.close()
+
+	for i := 0; i < ihello_rate_burst; i++ {
+		if !hs.allow_ihello("10.0.0.1:1000") {
+			t.Fatal("ihello should be allowed.")
+		}
+	}
+
+	if hs.allow_ihello("10.0.0.1:2000") {
+		t.Fatal("ihello should be limited by ip.")
+	}
+
+	if !hs.allow_ihello("10.0.0.2:1000") {
+		t.Fatal("other ip should not be limited.")
+	}
+}
+
+func TestPeerRegistry(t *testing.T) {
+
+	hs := &handshake{
+		in:  make(chan *network_packet, 1),
+		out: make(chan *network_packet, 16),
+	}
+	hs.open()
+	defer hs.close()
+
+	s := hs.new_session()
+	s.passive_open()
+	s.ekey = []byte("0123456789abcdef")
+
+	hs.register_peer([]byte("peer"), s)
+	if hs.find_peer([]byte("peer")) != s {
+		t.Fatal("peer not found.")
+	}
+
+	s.close()
+	if hs.find_peer([]byte("peer")) != nil {
+		t.Fatal("closed peer found.")
+	}
+
+	//closed before registered.
+	hs.register_peer([]byte("peer"), s)
+	if hs.find_peer([]byte("peer")) != nil {
+		t.Fatal("closed peer registered.")
+	}
 }
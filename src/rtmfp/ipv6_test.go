@@ -0,0 +1,215 @@
+package rtmfp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func skip_without_ipv6(t *testing.T) {
+	conn, err := net.ListenPacket("udp6", "[::1]:0")
+	if err != nil {
+		t.Skip("ipv6 loopback not available.", err)
+	}
+	conn.Close()
+}
+
+//a transport echo every stream message.
+func new_echo_transport() *Transport {
+	tr := &Transport{}
+	tr.SetStreamHandler(func(stream *BiStream, addr string) bool {
+		go func() {
+			for {
+				data, err := stream.Recv()
+				if err != nil {
+					return
+				}
+				stream.Send(data)
+			}
+		}()
+		return true
+	})
+	return tr
+}
+
+func new_client_transport(t *testing.T, localAddr, pseudoId string) *Transport {
+	tr := &Transport{}
+	tr.SetStreamHandler(func(*BiStream, string) bool { return false })
+	if err := tr.Open(localAddr, []byte(pseudoId)); err != nil {
+		t.Fatal(err)
+	}
+	return tr
+}
+
+func is_ipv6(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.To4() == nil
+}
+
+func TestIPv6Transport(t *testing.T) {
+
+	skip_without_ipv6(t)
+
+	server := new_echo_transport()
+	if err := server.Open("[::1]:0", []byte("server")); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	client := new_client_transport(t, "[::1]:0", "client")
+	defer client.Close()
+
+	stream, err := client.CreateBiStream(server.LocalAddr(), server.Peerid())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := echo(stream, "hello", time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	if addr := stream.Session().RemoteAddr(); addr != server.LocalAddr() {
+		t.Fatal("unexpected remote address.", addr)
+	}
+
+	//bigger than a packet.
+	if err := echo(stream, string(make([]byte, 10*1024)), time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIPv6Rendezvous(t *testing.T) {
+
+	skip_without_ipv6(t)
+
+	server := &Transport{}
+	server.SetRendezvous(true)
+	server.SetStreamHandler(func(*BiStream, string) bool { return true })
+	if err := server.Open("[::1]:0", []byte("server")); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	target := new_echo_transport()
+	if err := target.Open("[::1]:0", []byte("target")); err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+
+	//register to the rendezvous service.
+	if _, err := target.CreateBiStream(server.LocalAddr(), server.Peerid()); err != nil {
+		t.Fatal(err)
+	}
+
+	initiator := new_client_transport(t, "[::1]:0", "initiator")
+	defer initiator.Close()
+
+	//the redirect carry the target's ipv6 address.
+	stream, err := initiator.CreateBiStream(server.LocalAddr(), target.Peerid())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if addr := stream.Session().RemoteAddr(); addr != target.LocalAddr() {
+		t.Fatal("not connected to the target directly.", addr)
+	}
+
+	if err := echo(stream, "hello", time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDualStack(t *testing.T) {
+
+	skip_without_ipv6(t)
+
+	server := new_echo_transport()
+	if err := server.OpenDualStack("127.0.0.1:0", "[::1]:0", []byte("server")); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	addrs := server.LocalAddrs()
+	if len(addrs) != 2 || is_ipv6(addrs[0]) || !is_ipv6(addrs[1]) {
+		t.Fatal("unexpected local addresses.", addrs)
+	}
+
+	for i, local := range []string{"127.0.0.1:0", "[::1]:0"} {
+
+		client := new_client_transport(t, local, "client")
+		defer client.Close()
+
+		stream, err := client.CreateBiStream(addrs[i], server.Peerid())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := echo(stream, "hello "+local, time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDualStackRendezvous(t *testing.T) {
+
+	skip_without_ipv6(t)
+
+	server := &Transport{}
+	server.SetRendezvous(true)
+	server.SetStreamHandler(func(*BiStream, string) bool { return true })
+	if err := server.OpenDualStack("127.0.0.1:0", "[::1]:0", []byte("server")); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	server_addrs := server.LocalAddrs()
+
+	target := new_echo_transport()
+	if err := target.OpenDualStack("127.0.0.1:0", "[::1]:0", []byte("target")); err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+
+	//register over ipv4, then let the server learn our ipv6 address by probing its one.
+	register, err := target.CreateBiStream(server_addrs[0], server.Peerid())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := register.Session().AddPath(server_addrs[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		paths := register.Session().Paths()
+		if len(paths) == 2 && paths[0].Validated && paths[1].Validated {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("ipv6 path not validated.", paths)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	//an ipv6 only initiator is redirected to the target's ipv6 address.
+	initiator := new_client_transport(t, "[::1]:0", "initiator")
+	defer initiator.Close()
+
+	stream, err := initiator.CreateBiStream(server_addrs[1], target.Peerid())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if addr := stream.Session().RemoteAddr(); addr != target.LocalAddrs()[1] {
+		t.Fatal("not connected to the target's ipv6 address.", addr)
+	}
+
+	if err := echo(stream, "hello", time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
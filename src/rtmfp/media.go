@@ -0,0 +1,411 @@
+//media messages of NetStreams, and the publications relaying the media of a publisher
+//to the players of its stream name.
+
+package rtmfp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"sync"
+)
+
+//types of MediaMessage, the same as the types of FLV tags.
+const (
+	MediaAudio = 0x08
+	MediaVideo = 0x09
+	MediaData  = 0x12 //AMF0 values, e.g. onMetaData.
+)
+
+//a timestamped message of a NetStream. Data is an FLV tag body, e.g. the codec header
+//and the frame for audio and video.
+type MediaMessage struct {
+	Type      uint8
+	Timestamp uint32 //in milliseconds
+	Data      []byte
+}
+
+func is_media(msg_type uint8) bool {
+	return msg_type == MediaAudio || msg_type == MediaVideo || msg_type == MediaData
+}
+
+func decode_media(buf []byte) (*MediaMessage, error) {
+
+	if len(buf) < 5 || !is_media(buf[0]) {
+		return nil, errors.New("invalid media message.")
+	}
+
+	return &MediaMessage{
+		Type:      buf[0],
+		Timestamp: binary.BigEndian.Uint32(buf[1:5]),
+		Data:      buf[5:],
+	}, nil
+}
+
+func encode_media(m *MediaMessage) []byte {
+
+	buf := make([]byte, 5+len(m.Data))
+	buf[0] = m.Type
+	binary.BigEndian.PutUint32(buf[1:5], m.Timestamp)
+	copy(buf[5:], m.Data)
+
+	return buf
+}
+
+func is_video_keyframe(data []byte) bool {
+	return len(data) > 0 && data[0]>>4 == 1
+}
+
+//the AVCDecoderConfigurationRecord of H.264.
+func is_video_config(data []byte) bool {
+	return len(data) > 1 && data[0]&0x0f == 7 && data[1] == 0
+}
+
+//the AudioSpecificConfig of AAC.
+func is_audio_config(data []byte) bool {
+	return len(data) > 1 && data[0]>>4 == 10 && data[1] == 0
+}
+
+//"@setDataFrame" in AMF0, the publisher set the data frame kept for the players with it.
+var set_data_frame = append([]byte{0x02, 0x00, 0x0d}, "@setDataFrame"...)
+
+type player struct {
+	wait_keyframe bool //video is sent from a keyframe.
+	paused        bool
+}
+
+//the stream name published, and the players of it.
+type publication struct {
+	name      string
+	publisher *net_stream //nil until published.
+	players   map[*net_stream]*player
+
+	//sent to the players joining the stream.
+	metadata     *MediaMessage
+	audio_config *MediaMessage
+	video_config *MediaMessage
+
+	recorder *recorder //nil if not recorded.
+
+	//the messages are sent to the players out of the lock of the publications, in the
+	//order relayed. taken before the lock is released.
+	send_mutex sync.Mutex
+}
+
+//the publications of a Transport, by stream name.
+type publications struct {
+	mutex     sync.Mutex
+	streams   map[string]*publication
+	playbacks map[*net_stream]*playback //the players of recordings.
+}
+
+func new_publications() *publications {
+	return &publications{streams: make(map[string]*publication), playbacks: make(map[*net_stream]*playback)}
+}
+
+func (self *publications) get(name string) *publication {
+	p, ok := self.streams[name]
+	if !ok {
+		p = &publication{name: name, players: make(map[*net_stream]*player)}
+		self.streams[name] = p
+	}
+	return p
+}
+
+func (self *publications) publish(name string, ns *net_stream) error {
+
+	self.mutex.Lock()
+
+	p := self.get(name)
+	if p.publisher != nil {
+		self.mutex.Unlock()
+		return errors.New(name + " is already published.")
+	}
+	p.publisher = ns
+
+	var players []*net_stream
+	for s, pl := range p.players {
+		pl.wait_keyframe = true
+		players = append(players, s)
+	}
+
+	self.mutex.Unlock()
+
+	for _, s := range players {
+		s.send("onStatus", &net_status{"status", "NetStream.Play.PublishNotify", name + " is now published."})
+	}
+
+	return nil
+}
+
+//play the live stream name or its recording, see net_stream.recv_play() for start.
+//the live stream is received from now on, or when it is published.
+func (self *publications) play(name string, ns *net_stream, start float64) error {
+
+	//the recording is opened and indexed out of the lock.
+	var pb *playback
+	var err error
+	if start != -1 {
+		pb, err = open_playback(name, ns)
+	}
+
+	self.mutex.Lock()
+
+	//play again.
+	self.stop(ns)
+
+	p, ok := self.streams[name]
+	published := ok && p.publisher != nil
+
+	if start == -1 || (start == -2 && published) {
+		if pb != nil {
+			pb.file.Close()
+		}
+		self.play_live(name, ns)
+		return nil
+	}
+
+	if err != nil {
+		if start == -2 {
+			//wait for the publisher.
+			self.play_live(name, ns)
+			return nil
+		}
+		self.mutex.Unlock()
+		return err
+	}
+
+	self.playbacks[ns] = pb
+	self.mutex.Unlock()
+
+	ns.send_play_start(name)
+	go pb.run(uint32(math.Max(start, 0)))
+
+	return nil
+}
+
+//called with the lock, which is released.
+func (self *publications) play_live(name string, ns *net_stream) {
+
+	p := self.get(name)
+	p.players[ns] = &player{wait_keyframe: true}
+
+	headers := []*MediaMessage{p.metadata, p.audio_config, p.video_config}
+
+	//before the media relayed from now on.
+	p.send_mutex.Lock()
+	self.mutex.Unlock()
+	defer p.send_mutex.Unlock()
+
+	ns.send_play_start(name)
+
+	for _, m := range headers {
+		if m != nil {
+			ns.send_media(m)
+		}
+	}
+}
+
+//record the stream name published by ns, from now on.
+func (self *publications) record(name string, ns *net_stream) error {
+
+	r, err := new_recorder(name)
+	if err != nil {
+		return err
+	}
+
+	self.mutex.Lock()
+
+	p, ok := self.streams[name]
+	if !ok || p.publisher != ns {
+		self.mutex.Unlock()
+		r.discard()
+		return errors.New(name + " is not published.")
+	}
+
+	old := p.recorder
+	p.recorder = r
+	self.mutex.Unlock()
+
+	//the last write of the publisher may not be done.
+	if old != nil {
+		old.close()
+	}
+
+	return nil
+}
+
+//seek the recording played by ns.
+func (self *publications) seek(ns *net_stream, ms float64) error {
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	pb, ok := self.playbacks[ns]
+	if !ok {
+		return errors.New("not playing a recording.")
+	}
+	pb.seek(uint32(math.Max(ms, 0)))
+
+	return nil
+}
+
+//pause or resume the live stream or the recording played by ns.
+func (self *publications) pause(ns *net_stream, paused bool) error {
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if pb, ok := self.playbacks[ns]; ok {
+		pb.pause(paused)
+		return nil
+	}
+
+	for _, p := range self.streams {
+		if pl, ok := p.players[ns]; ok {
+			if pl.paused && !paused {
+				pl.wait_keyframe = true
+			}
+			pl.paused = paused
+			return nil
+		}
+	}
+
+	return errors.New("not playing.")
+}
+
+//stop playing, the live streams and the recording.
+func (self *publications) stop(ns *net_stream) (played bool) {
+
+	if pb, ok := self.playbacks[ns]; ok {
+		pb.close()
+		delete(self.playbacks, ns)
+		played = true
+	}
+
+	for name, p := range self.streams {
+		if _, ok := p.players[ns]; ok {
+			delete(p.players, ns)
+			played = true
+		}
+
+		if p.publisher == nil && len(p.players) == 0 {
+			delete(self.streams, name)
+		}
+	}
+
+	return played
+}
+
+//stop publishing or playing.
+func (self *publications) remove(ns *net_stream) (published, played bool) {
+
+	self.mutex.Lock()
+
+	var players []*net_stream
+	var names []string
+	var recorders []*recorder
+	for name, p := range self.streams {
+		if p.publisher == ns {
+			p.publisher = nil
+			p.metadata, p.audio_config, p.video_config = nil, nil, nil
+			published = true
+
+			if p.recorder != nil {
+				recorders = append(recorders, p.recorder)
+				p.recorder = nil
+			}
+
+			for s := range p.players {
+				players = append(players, s)
+				names = append(names, name)
+			}
+		}
+	}
+
+	played = self.stop(ns)
+	self.mutex.Unlock()
+
+	for _, r := range recorders {
+		r.close()
+	}
+
+	for i, s := range players {
+		s.send("onStatus", &net_status{"status", "NetStream.Play.UnpublishNotify", names[i] + " is now unpublished."})
+	}
+
+	return published, played
+}
+
+//send a message of the publisher ns to the players.
+func (self *publications) relay(ns *net_stream, m *MediaMessage) {
+
+	self.mutex.Lock()
+
+	var p *publication
+	for _, s := range self.streams {
+		if s.publisher == ns {
+			p = s
+			break
+		}
+	}
+
+	if p == nil {
+		//not published.
+		self.mutex.Unlock()
+		return
+	}
+
+	switch m.Type {
+	case MediaData:
+		if bytes.HasPrefix(m.Data, set_data_frame) {
+			m = &MediaMessage{Type: m.Type, Timestamp: m.Timestamp, Data: m.Data[len(set_data_frame):]}
+			p.metadata = m
+		}
+	case MediaAudio:
+		if is_audio_config(m.Data) {
+			p.audio_config = m
+		}
+	case MediaVideo:
+		if is_video_config(m.Data) {
+			p.video_config = m
+		}
+	}
+
+	r := p.recorder
+
+	var players []*net_stream
+	for s, pl := range p.players {
+		if pl.paused {
+			continue
+		}
+
+		//the codec config is always sent, it is needed by the keyframe.
+		if m.Type == MediaVideo && pl.wait_keyframe && !is_video_config(m.Data) {
+			if !is_video_keyframe(m.Data) {
+				continue
+			}
+			pl.wait_keyframe = false
+		}
+		players = append(players, s)
+	}
+
+	p.send_mutex.Lock()
+	self.mutex.Unlock()
+
+	for _, s := range players {
+		s.send_media(m)
+	}
+
+	p.send_mutex.Unlock()
+
+	//out of the locks, a recorder is only written by the publisher.
+	if r != nil {
+		if err := r.write(m); err != nil {
+			//published live from now on.
+			r.close()
+			ns.send("onStatus", &net_status{"error", "NetStream.Record.Failed", err.Error()})
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package rtmfp
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"rtmfp/amf"
+	"rtmfp/remoting"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMediaMessage(t *testing.T) {
+
+	m := &MediaMessage{Type: MediaVideo, Timestamp: 0x01020304, Data: []byte{0x17, 0x01, 0xff}}
+
+	buf := encode_media(m)
+	if !bytes.Equal(buf, []byte{0x09, 0x01, 0x02, 0x03, 0x04, 0x17, 0x01, 0xff}) {
+		t.Fatal("unexpected encoding.", buf)
+	}
+
+	decoded, err := decode_media(buf)
+	if err != nil || !reflect.DeepEqual(decoded, m) {
+		t.Fatalf("not match.\n%#v %v", decoded, err)
+	}
+
+	if _, err := decode_media(buf[:4]); err == nil {
+		t.Fatal("truncated message decoded.")
+	}
+	if _, err := decode_media([]byte{0x14, 0, 0, 0, 0}); err == nil {
+		t.Fatal("command decoded as media.")
+	}
+
+	if !is_video_keyframe(m.Data) || is_video_config(m.Data) || !is_video_config([]byte{0x17, 0x00}) || is_video_keyframe([]byte{0x27, 0x01}) {
+		t.Fatal("unexpected video frame type.")
+	}
+	if !is_audio_config([]byte{0xaf, 0x00}) || is_audio_config([]byte{0xaf, 0x01}) {
+		t.Fatal("unexpected audio frame type.")
+	}
+}
+
+func connect_test_client(t *testing.T, server *Transport, name string) *NetConnection {
+
+	c := &Transport{}
+	c.SetStreamHandler(func(*BiStream, string) bool { return false })
+	c.Open("127.0.0.1:0", []byte(name))
+
+	nc, err := c.CreateNetConnection(server.LocalAddr(), server.Peerid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := nc.Connect("live"); err != nil {
+		t.Fatal(err)
+	}
+
+	return nc
+}
+
+func recv_media(t *testing.T, s *NetStream, expect ...*MediaMessage) {
+
+	for _, m := range expect {
+
+		done := make(chan *MediaMessage, 1)
+		go func() {
+			m, _ := s.Recv()
+			done <- m
+		}()
+
+		select {
+		case recv := <-done:
+			if !reflect.DeepEqual(recv, m) {
+				t.Fatalf("unexpected media.\n%#v\n%#v", recv, m)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timeout")
+		}
+	}
+}
+
+func TestRelay(t *testing.T) {
+
+	server := &Transport{}
+	server.SetConnectHandler(func(*NetConnection, *ConnectInfo) error { return nil })
+	server.Open("127.0.0.1:0", []byte("server"))
+	defer server.Close()
+
+	publisher := connect_test_client(t, server, "publisher")
+	defer publisher.Close()
+	early := connect_test_client(t, server, "early")
+	defer early.Close()
+	late := connect_test_client(t, server, "late")
+	defer late.Close()
+
+	//played before published.
+	s1, err := early.CreateNetStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s1.Play("cam"); err != nil {
+		t.Fatal(err)
+	}
+
+	pub, err := publisher.CreateNetStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pub.Publish("cam"); err != nil {
+		t.Fatal(err)
+	}
+
+	//a name is published once.
+	pub2, _ := late.CreateNetStream()
+	if err := pub2.Publish("cam"); err == nil || err.(*remoting.Fault).Code != "NetStream.Publish.BadName" {
+		t.Fatal("published twice.", err)
+	}
+
+	onmetadata, _ := amf.Marshal("onMetaData")
+	props, _ := amf.Marshal(map[string]interface{}{"width": 320})
+	metadata := append(onmetadata, props...)
+
+	set_metadata := &MediaMessage{MediaData, 0, append(append([]byte{}, set_data_frame...), metadata...)}
+	video_config := &MediaMessage{MediaVideo, 0, []byte{0x17, 0x00, 0x01}}
+	inter := &MediaMessage{MediaVideo, 10, []byte{0x27, 0x01, 0x02}}
+	audio_config := &MediaMessage{MediaAudio, 10, []byte{0xaf, 0x00, 0x12}}
+	keyframe := &MediaMessage{MediaVideo, 20, []byte{0x17, 0x01, 0x03}}
+	audio := &MediaMessage{MediaAudio, 30, []byte{0xaf, 0x01, 0x04}}
+
+	for _, m := range []*MediaMessage{set_metadata, video_config, inter, audio_config, keyframe, audio} {
+		pub.Send(m)
+	}
+
+	//the data frame without @setDataFrame, the video from the keyframe.
+	recv_media(t, s1, &MediaMessage{MediaData, 0, metadata}, video_config, audio_config, keyframe, audio)
+
+	//joining the stream, the data frame and the codec configs first.
+	s2, _ := late.CreateNetStream()
+	if err := s2.Play("cam"); err != nil {
+		t.Fatal(err)
+	}
+
+	inter2 := &MediaMessage{MediaVideo, 40, []byte{0x27, 0x01, 0x05}}
+	keyframe2 := &MediaMessage{MediaVideo, 50, []byte{0x17, 0x01, 0x06}}
+	pub.Send(inter2)
+	pub.Send(keyframe2)
+
+	recv_media(t, s1, inter2, keyframe2)
+	recv_media(t, s2, &MediaMessage{MediaData, 0, metadata}, audio_config, video_config, keyframe2)
+
+	//published again after closed.
+	pub.Close()
+
+	pub3, _ := late.CreateNetStream()
+	if err := pub3.Publish("cam"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStreamControl(t *testing.T) {
+
+	var mutex sync.Mutex
+	var commands []string
+	server := &Transport{}
+	server.SetConnectHandler(func(*NetConnection, *ConnectInfo) error { return nil })
+	server.SetStreamCommandHandler(func(nc *NetConnection, id float64, cmd string, args []interface{}) error {
+		if name, _ := command_arg(args, 0).(string); name == "secret" {
+			return errors.New("denied.")
+		}
+		mutex.Lock()
+		commands = append(commands, cmd)
+		mutex.Unlock()
+		return nil
+	})
+	server.Open("127.0.0.1:0", []byte("server"))
+	defer server.Close()
+
+	publisher := connect_test_client(t, server, "publisher")
+	defer publisher.Close()
+	client := connect_test_client(t, server, "player")
+	defer client.Close()
+
+	pub, _ := publisher.CreateNetStream()
+	if err := pub.Publish("secret"); err == nil || err.(*remoting.Fault).Code != "NetStream.Publish.Denied" {
+		t.Fatal("not denied.", err)
+	}
+	if err := pub.Publish("cam"); err != nil {
+		t.Fatal(err)
+	}
+
+	s, _ := client.CreateNetStream()
+	if err := s.Play("secret"); err == nil || err.(*remoting.Fault).Code != "NetStream.Play.Failed" {
+		t.Fatal("not denied.", err)
+	}
+	if err := s.Play("cam"); err != nil {
+		t.Fatal(err)
+	}
+
+	audio := &MediaMessage{MediaAudio, 0, []byte{0xaf, 0x01, 0x01}}
+	inter := &MediaMessage{MediaVideo, 0, []byte{0x27, 0x01, 0x02}}
+	keyframe := &MediaMessage{MediaVideo, 0, []byte{0x17, 0x01, 0x03}}
+
+	//nothing while paused, the video from a keyframe after.
+	s.ReceiveAudio(false)
+	if err := s.Pause(); err != nil {
+		t.Fatal(err)
+	}
+	pub.Send(keyframe)
+	//relayed before the answer, which is received in the order of the flow.
+	if err := pub.Seek(0); err == nil {
+		t.Fatal("published stream sought.")
+	}
+	if err := s.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range []*MediaMessage{audio, inter, keyframe} {
+		pub.Send(m)
+	}
+	recv_media(t, s, keyframe)
+
+	//the answer of seek is received after receiveVideo.
+	s.ReceiveAudio(true)
+	s.ReceiveVideo(false)
+	if err := s.Seek(0); err == nil || err.(*remoting.Fault).Code != "NetStream.Seek.Failed" {
+		t.Fatal("live stream sought.", err)
+	}
+	pub.Send(keyframe)
+	pub.Send(audio)
+	recv_media(t, s, audio)
+
+	s.ReceiveVideo(true)
+	s.Seek(0)
+	pub.Send(inter)
+	pub.Send(keyframe)
+	recv_media(t, s, keyframe)
+
+	//stopped, the far end is notified.
+	pub.stream.send("closeStream", nil)
+	if err := pub.wait_status("NetStream.Unpublish.Success"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.wait_status("NetStream.Play.UnpublishNotify"); err != nil {
+		t.Fatal(err)
+	}
+	s.stream.send("closeStream", nil)
+	if err := s.wait_status("NetStream.Play.Stop"); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []string{"publish", "play", "receiveAudio", "pause", "seek", "pause", "receiveAudio", "receiveVideo", "seek", "receiveVideo", "seek", "closeStream", "closeStream"}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if !reflect.DeepEqual(commands, expect) {
+		t.Fatal("unexpected commands.", commands)
+	}
+}
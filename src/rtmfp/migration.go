@@ -0,0 +1,97 @@
+package rtmfp
+
+import (
+	"errors"
+	"net"
+)
+
+//how a session follow the far end when its packets come from a new address,
+//e.g. it roam to another network or its NAT binding change.
+type AddressValidation int
+
+const (
+	AddressValidationPing     AddressValidation = iota //move after the new address echo a random ping challenge, the default.
+	AddressValidationNone                              //move on the first authenticated packet from the new address.
+	AddressValidationDisabled                          //never move, packets from other addresses are still accepted.
+)
+
+//Session is the connection to a far end carrying a BiStream.
+type Session struct {
+	session   *session
+	transport *Transport
+}
+
+func (self *Session) RemoteAddr() string {
+	return self.session.remote_addr()
+}
+
+func (self *Session) LocalAddr() string {
+	self.session.out_mutex.Lock()
+	socket := self.session.socket
+	self.session.out_mutex.Unlock()
+
+	if socket != nil {
+		return socket.local_addr().String()
+	}
+	return self.transport.LocalAddr()
+}
+
+//called when the session move to a new address of the far end, on the session's
+//goroutine, should not block.
+func (self *Session) SetAddressChangeHandler(h func(oldAddr, newAddr string)) {
+	self.session.address_changed = h
+}
+
+//move the local end of the session to a new socket, e.g. after the host roam to
+//another interface. the far end follow by its AddressValidation policy. other
+//sessions stay on the transport socket.
+func (self *Session) Migrate(newLocalAddr string) error {
+
+	conn, err := self.transport.listen(newLocalAddr)
+	if err != nil {
+		return err
+	}
+
+	return self.MigrateConn(conn)
+}
+
+//same as Migrate(), on the given connection, the session take the ownership of it.
+func (self *Session) MigrateConn(conn net.PacketConn) error {
+
+	//received packets go to the handshake as the transport socket's do.
+	socket := &socket_bin{out: self.transport.socket.out}
+
+	err := socket.open_conn(conn)
+	if err != nil {
+		return err
+	}
+
+	if err := self.session.migrate(socket); err != nil {
+		socket.close()
+		return err
+	}
+
+	return nil
+}
+
+//addresses of the far end known by the session, sorted.
+func (self *Session) Paths() []PathInfo {
+	return self.session.path_infos()
+}
+
+//another address the far end may be reached at, e.g. its address of the other IP
+//family. it is probed and the session fail over to it when the path in use break.
+func (self *Session) AddPath(addr string) error {
+
+	if _, err := net.ResolveUDPAddr("udp", addr); err != nil {
+		return err
+	}
+
+	if self.session.add_path(addr, false) {
+		self.session.probe_path(addr)
+	} else if !self.session.has_path(addr) {
+		return errors.New("too many paths.")
+	}
+
+	return nil
+}
@@ -0,0 +1,232 @@
+package rtmfp
+
+import (
+	"errors"
+	"net"
+	"rtmfp/vnet"
+	"testing"
+	"time"
+)
+
+func vnet_listen_func(sw *vnet.Switch) func(string) (net.PacketConn, error) {
+	return func(addr string) (net.PacketConn, error) {
+		conn, err := sw.Listen(addr)
+		if err != nil {
+			return nil, err
+		}
+		return conn, nil
+	}
+}
+
+//links of the switch impaired by profile.
+func vnet_link_func(profile ChannelProfile) vnet.LinkFunc {
+	return func(src_ip, dst_ip string, deliver func(src, dst string, data []byte)) vnet.Link {
+		return NewChannelLink(profile, deliver)
+	}
+}
+
+//echo server on the switch, server side sessions are sent to sessions.
+func open_echo_server(t *testing.T, sw *vnet.Switch, addr string, sessions chan *Session) *Transport {
+
+	server := &Transport{}
+	server.SetListenFunc(vnet_listen_func(sw))
+	server.SetStreamHandler(func(stream *BiStream, addr string) bool {
+		sessions <- stream.Session()
+		go func() {
+			for {
+				data, err := stream.Recv()
+				if err != nil {
+					return
+				}
+				stream.Send(data)
+			}
+		}()
+		return true
+	})
+
+	if err := server.Open(addr, []byte("server")); err != nil {
+		t.Fatal(err)
+	}
+
+	return server
+}
+
+func echo(stream *BiStream, msg string, timeout time.Duration) error {
+
+	done := make(chan error, 1)
+
+	go func() {
+		stream.Send([]byte(msg))
+		data, err := stream.Recv()
+		if err == nil && string(data) != msg {
+			err = errors.New("echo msg not match!")
+		}
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return errors.New("echo timeout: " + msg)
+	}
+}
+
+func wait_address_change(changed chan [2]string, timeout time.Duration) ([2]string, error) {
+	select {
+	case c := <-changed:
+		return c, nil
+	case <-time.After(timeout):
+		return [2]string{}, errors.New("address not changed.")
+	}
+}
+
+func TestSessionMigrate(t *testing.T) {
+
+	sw := vnet.NewSwitch()
+	defer sw.Close()
+
+	sw.SetLinkFunc(vnet_link_func(ChannelProfile{Delay: 5 * time.Millisecond}))
+
+	sessions := make(chan *Session, 1)
+	server := open_echo_server(t, sw, "10.0.0.1:1935", sessions)
+	defer server.Close()
+
+	client := &Transport{}
+	client.SetListenFunc(vnet_listen_func(sw))
+	client.SetStreamHandler(func(*BiStream, string) bool { return false })
+	if err := client.Open("10.0.1.1:1935", []byte("client")); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	stream, err := client.CreateBiStream("10.0.0.1:1935", server.Peerid())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := echo(stream, "before", time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	server_session := <-sessions
+
+	changed := make(chan [2]string, 1)
+	server_session.SetAddressChangeHandler(func(oldAddr, newAddr string) {
+		changed <- [2]string{oldAddr, newAddr}
+	})
+
+	//roam to wifi, the old network is gone.
+	if err := stream.Session().Migrate("10.0.2.1:1935"); err != nil {
+		t.Fatal(err)
+	}
+
+	sw.SetRewriteFunc(func(src, dst string) (string, string, bool) {
+		return src, dst, src != "10.0.1.1:1935" && dst != "10.0.1.1:1935"
+	})
+
+	if addr := stream.Session().LocalAddr(); addr != "10.0.2.1:1935" {
+		t.Fatal("local address not changed.", addr)
+	}
+
+	c, err := wait_address_change(changed, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c[0] != "10.0.1.1:1935" || c[1] != "10.0.2.1:1935" || server_session.RemoteAddr() != "10.0.2.1:1935" {
+		t.Fatal("server not follow the client.", c, server_session.RemoteAddr())
+	}
+
+	if err := echo(stream, "after", 3*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	//in use
+	if err := stream.Session().Migrate("10.0.0.1:1935"); err == nil {
+		t.Fatal("migrate to a used address.")
+	}
+
+	//closed, the new address is released.
+	stream.Close()
+	if err := stream.Session().Migrate("10.0.3.1:1935"); err == nil {
+		t.Fatal("closed session migrated.")
+	}
+
+	conn, err := vnet_listen_func(sw)("10.0.3.1:1935")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestNATRebinding(t *testing.T) {
+
+	sw := vnet.NewSwitch()
+	defer sw.Close()
+
+	sw.SetLinkFunc(vnet_link_func(ChannelProfile{Delay: 5 * time.Millisecond}))
+
+	//the client is behind a port restricted cone NAT.
+	router := new_nat(nat_endpoint_independent, nat_address_port_dependent, "1.1.1.1")
+
+	sw.SetRewriteFunc(func(src, dst string) (string, string, bool) {
+		if ip, _, _ := net.SplitHostPort(src); ip == "192.168.0.2" {
+			src = router.outbound(src, dst)
+		}
+		if ip, _, _ := net.SplitHostPort(dst); ip == router.public_ip {
+			private, ok := router.inbound(src, dst)
+			return src, private, ok
+		}
+		return src, dst, true
+	})
+
+	sessions := make(chan *Session, 1)
+	server := open_echo_server(t, sw, "10.0.0.1:1935", sessions)
+	defer server.Close()
+
+	client := &Transport{}
+	client.SetListenFunc(vnet_listen_func(sw))
+	client.SetStreamHandler(func(*BiStream, string) bool { return false })
+	if err := client.Open("192.168.0.2:1935", []byte("client")); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	stream, err := client.CreateBiStream("10.0.0.1:1935", server.Peerid())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := echo(stream, "before", time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	server_session := <-sessions
+	old_addr := server_session.RemoteAddr()
+
+	changed := make(chan [2]string, 1)
+	server_session.SetAddressChangeHandler(func(oldAddr, newAddr string) {
+		changed <- [2]string{oldAddr, newAddr}
+	})
+
+	//the router reboot, the client get a new public port without knowing it.
+	router.reset()
+
+	if err := echo(stream, "after", 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := wait_address_change(changed, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c[0] != old_addr || c[1] == old_addr || server_session.RemoteAddr() != c[1] {
+		t.Fatal("server not follow the new binding.", old_addr, c)
+	}
+
+	if ip, _, _ := net.SplitHostPort(c[1]); ip != "1.1.1.1" {
+		t.Fatal("unexpected address.", c[1])
+	}
+}
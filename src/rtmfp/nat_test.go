@@ -0,0 +1,390 @@
+package rtmfp
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+//mapping and filtering behaviors, RFC 4787.
+//full cone NAT is endpoint independent mapping and filtering,
+//(port) restricted cone NAT is endpoint independent mapping with address (and port) dependent filtering,
+//symmetric NAT is address and port dependent mapping and filtering.
+var nat_endpoint_independent = 0
+var nat_address_dependent = 1
+var nat_address_port_dependent = 2
+
+//nat rewrite source address of outbound packets and filter inbound packets, to put
+//endpoints behind simulated routers.
+type nat struct {
+	public_ip string
+	mapping   int
+	filtering int
+
+	timeout         time.Duration //binding expire without outbound traffic, 0 never expire.
+	inbound_refresh bool          //inbound traffic keep the binding alive too.
+	clock           clock
+
+	mutex     sync.Mutex
+	last_port int
+	bindings  map[string]*nat_binding //private address + remote endpoint -> binding
+	ports     map[int]*nat_binding    //public port -> binding
+}
+
+type nat_binding struct {
+	key         string
+	private     string
+	public_port int
+	last_active time.Time
+	permits     map[string]time.Time //remote endpoints we have sent to, by filtering behavior
+}
+
+func new_nat(mapping, filtering int, public_ip string) *nat {
+	return &nat{
+		public_ip: public_ip,
+		mapping:   mapping,
+		filtering: filtering,
+		last_port: 10000,
+		clock:     default_clock,
+		bindings:  make(map[string]*nat_binding),
+		ports:     make(map[int]*nat_binding),
+	}
+}
+
+func (self *nat) public_address() string {
+	return self.public_ip
+}
+
+//the part of the remote endpoint which matter to the behavior.
+func nat_endpoint_key(behavior int, remote string) string {
+	switch behavior {
+	case nat_address_dependent:
+		ip, _, err := net.SplitHostPort(remote)
+		if err != nil {
+			return remote
+		}
+		return ip
+	case nat_address_port_dependent:
+		return remote
+	default:
+		return ""
+	}
+}
+
+func (self *nat) expired(t, now time.Time) bool {
+	return self.timeout > 0 && now.Sub(t) >= self.timeout
+}
+
+func (self *nat) remove_binding(b *nat_binding) {
+	delete(self.bindings, b.key)
+	delete(self.ports, b.public_port)
+}
+
+//return the public source address of the packet from src to dst.
+func (self *nat) outbound(src, dst string) string {
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	now := self.clock.Now()
+
+	key := src + "|" + nat_endpoint_key(self.mapping, dst)
+
+	b, ok := self.bindings[key]
+	if ok && self.expired(b.last_active, now) {
+		self.remove_binding(b)
+		ok = false
+	}
+
+	if !ok {
+		//new binding always get a new port, so a rebinding is visible to the far end.
+		self.last_port++
+
+		b = &nat_binding{
+			key:         key,
+			private:     src,
+			public_port: self.last_port,
+			permits:     make(map[string]time.Time),
+		}
+
+		self.bindings[key] = b
+		self.ports[b.public_port] = b
+	}
+
+	b.last_active = now
+	b.permits[nat_endpoint_key(self.filtering, dst)] = now
+
+	return net.JoinHostPort(self.public_ip, strconv.Itoa(b.public_port))
+}
+
+//return the private destination address of the packet from src to dst, false if filtered.
+func (self *nat) inbound(src, dst string) (string, bool) {
+
+	_, port_str, err := net.SplitHostPort(dst)
+	if err != nil {
+		return "", false
+	}
+
+	port, _ := strconv.Atoi(port_str)
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	now := self.clock.Now()
+
+	b, ok := self.ports[port]
+	if !ok {
+		return "", false
+	}
+
+	if self.expired(b.last_active, now) {
+		self.remove_binding(b)
+		return "", false
+	}
+
+	permit_key := nat_endpoint_key(self.filtering, src)
+
+	permit_time, ok := b.permits[permit_key]
+	if !ok || self.expired(permit_time, now) {
+		return "", false
+	}
+
+	if self.inbound_refresh {
+		b.last_active = now
+		b.permits[permit_key] = now
+	}
+
+	return b.private, true
+}
+
+//drop all bindings, as the router reboot.
+func (self *nat) reset() {
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.bindings = make(map[string]*nat_binding)
+	self.ports = make(map[int]*nat_binding)
+}
+
+//a router the hosts of sim_network stay behind.
+type nat_device interface {
+	public_address() string
+	outbound(src, dst string) string
+	inbound(src, dst string) (string, bool)
+}
+
+//route packets between handshakes by address, hosts may stay behind a NAT.
+type sim_network struct {
+	mutex sync.Mutex
+	hosts map[string]chan *network_packet //address -> in chan of the host
+	nats  map[string]nat_device           //public ip -> nat
+	delay time.Duration                   //one way delay of the packets
+}
+
+func new_sim_network() *sim_network {
+	return &sim_network{
+		hosts: make(map[string]chan *network_packet),
+		nats:  make(map[string]nat_device),
+	}
+}
+
+func (self *sim_network) attach(h *handshake, addr string, device nat_device) {
+
+	//different certificate for each host.
+	copy(h.pseudo_id[:], addr)
+
+	h.in = make(chan *network_packet, network_packet_chan_default_buffer_size)
+	h.out = make(chan *network_packet, network_packet_chan_default_buffer_size)
+
+	self.mutex.Lock()
+	self.hosts[addr] = h.in
+	if device != nil {
+		self.nats[device.public_address()] = device
+	}
+	self.mutex.Unlock()
+
+	go func() {
+		for p := range h.out {
+			self.route(addr, device, p)
+		}
+	}()
+}
+
+func (self *sim_network) route(src string, device nat_device, p *network_packet) {
+
+	self.mutex.Lock()
+
+	if device != nil {
+		src = device.outbound(src, p.addr)
+	}
+
+	dst := p.addr
+
+	ip, _, _ := net.SplitHostPort(dst)
+	if dst_nat, ok := self.nats[ip]; ok {
+		private, ok := dst_nat.inbound(src, dst)
+		if !ok {
+			self.mutex.Unlock()
+			return
+		}
+		dst = private
+	}
+
+	in, ok := self.hosts[dst]
+
+	self.mutex.Unlock()
+
+	if !ok {
+		return
+	}
+
+	if self.delay > 0 {
+		time.AfterFunc(self.delay, func() {
+			in <- &network_packet{addr: src, data: p.data}
+		})
+		return
+	}
+
+	in <- &network_packet{addr: src, data: p.data}
+}
+
+func new_sim_handshake(network *sim_network, addr string, device nat_device) *handshake {
+
+	h := &handshake{}
+	network.attach(h, addr, device)
+
+	h.create_passive_session = func(addr string, peerid []byte) (*session, error) {
+		s := h.new_session()
+		s.passive_open()
+		return s, nil
+	}
+
+	h.open()
+
+	return h
+}
+
+func TestNATMapping(t *testing.T) {
+
+	for _, c := range []struct {
+		mapping        int
+		same_ip, other bool //reuse the mapping for another port / another ip of the remote
+	}{
+		{nat_endpoint_independent, true, true},
+		{nat_address_dependent, true, false},
+		{nat_address_port_dependent, false, false},
+	} {
+		n := new_nat(c.mapping, nat_endpoint_independent, "1.1.1.1")
+
+		first := n.outbound("10.0.0.1:1935", "9.9.9.9:1935")
+
+		if (n.outbound("10.0.0.1:1935", "9.9.9.9:1936") == first) != c.same_ip {
+			t.Fatal("unexpected mapping for another port.", c.mapping)
+		}
+
+		if (n.outbound("10.0.0.1:1935", "8.8.8.8:1935") == first) != c.other {
+			t.Fatal("unexpected mapping for another ip.", c.mapping)
+		}
+
+		if n.outbound("10.0.0.2:1935", "9.9.9.9:1935") == first {
+			t.Fatal("different hosts share one mapping.")
+		}
+	}
+}
+
+func TestNATFiltering(t *testing.T) {
+
+	for _, c := range []struct {
+		filtering         int
+		other_port, other bool //accept packet from another port / another ip
+	}{
+		{nat_endpoint_independent, true, true},
+		{nat_address_dependent, true, false},
+		{nat_address_port_dependent, false, false},
+	} {
+		n := new_nat(nat_endpoint_independent, c.filtering, "1.1.1.1")
+
+		public := n.outbound("10.0.0.1:1935", "9.9.9.9:1935")
+
+		if private, ok := n.inbound("9.9.9.9:1935", public); !ok || private != "10.0.0.1:1935" {
+			t.Fatal("reply filtered.", c.filtering)
+		}
+
+		if _, ok := n.inbound("9.9.9.9:1936", public); ok != c.other_port {
+			t.Fatal("unexpected filtering for another port.", c.filtering)
+		}
+
+		if _, ok := n.inbound("8.8.8.8:1935", public); ok != c.other {
+			t.Fatal("unexpected filtering for another ip.", c.filtering)
+		}
+
+		if _, ok := n.inbound("9.9.9.9:1935", "1.1.1.1:1"); ok {
+			t.Fatal("packet to unknown port accepted.")
+		}
+	}
+}
+
+func TestNATTimeout(t *testing.T) {
+
+	n := new_nat(nat_endpoint_independent, nat_address_dependent, "1.1.1.1")
+	n.timeout = 50 * time.Millisecond
+
+	public := n.outbound("10.0.0.1:1935", "9.9.9.9:1935")
+
+	time.Sleep(30 * time.Millisecond)
+
+	//inbound don't refresh binding by default.
+	if _, ok := n.inbound("9.9.9.9:1935", public); !ok {
+		t.Fatal("binding expired too early.")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+
+	if _, ok := n.inbound("9.9.9.9:1935", public); ok {
+		t.Fatal("binding not expired.")
+	}
+
+	//rebinding
+	if n.outbound("10.0.0.1:1935", "9.9.9.9:1935") == public {
+		t.Fatal("expired binding reused.")
+	}
+
+	n.inbound_refresh = true
+	public = n.outbound("10.0.0.1:1935", "9.9.9.9:1935")
+
+	for i := 0; i < 3; i++ {
+		time.Sleep(30 * time.Millisecond)
+		if _, ok := n.inbound("9.9.9.9:1935", public); !ok {
+			t.Fatal("binding not refreshed by inbound traffic.")
+		}
+	}
+}
+
+func TestSimNetwork(t *testing.T) {
+
+	network := new_sim_network()
+
+	a := new_sim_handshake(network, "10.0.0.1:1935", new_nat(nat_endpoint_independent, nat_address_dependent, "1.1.1.1"))
+	defer a.close()
+
+	b := new_sim_handshake(network, "9.9.9.9:1935", nil)
+	defer b.close()
+
+	s, err := a.create_session("9.9.9.9:1935", b.peerid())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var passive *session
+	for _, v := range b.sessions {
+		passive = v
+	}
+
+	//b see the public address of a.
+	if host, _, _ := net.SplitHostPort(passive.other_addr); host != "1.1.1.1" || !s.handshaked() {
+		t.Fatal("address not translated.", passive.other_addr)
+	}
+}
@@ -0,0 +1,589 @@
+//net_connection is the NetConnection of Flash, the control stream of a session.
+//
+//it carry connect, createStream, deleteStream and the calls of NetConnection.call(), a
+//command with a transaction id other than 0 is answered by _result or _error with the
+//same id, so that many calls may wait for their responses at the same time.
+//
+//both ends serve the calls of the other with the functions of their remoting.Registry.
+
+package rtmfp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"rtmfp/amf"
+	"rtmfp/remoting"
+	"sync"
+	"time"
+)
+
+var net_connection_signature = []byte{0x05, 0x00, 0x54, 0x43, 0x04, 0x00}
+
+//how long a call wait for its response.
+var net_connection_call_timeout = 10 * time.Second
+
+//the command object of connect, the properties of the NetConnection of a client.
+type ConnectInfo struct {
+	App            string  `amf:"app"`
+	FlashVer       string  `amf:"flashVer"`
+	TcUrl          string  `amf:"tcUrl,omitempty"`
+	SwfUrl         string  `amf:"swfUrl,omitempty"`
+	PageUrl        string  `amf:"pageUrl,omitempty"`
+	Fpad           bool    `amf:"fpad,omitempty"` //connected through a proxy.
+	Capabilities   float64 `amf:"capabilities,omitempty"`
+	AudioCodecs    float64 `amf:"audioCodecs,omitempty"` //flags of the codecs supported.
+	VideoCodecs    float64 `amf:"videoCodecs,omitempty"`
+	VideoFunction  float64 `amf:"videoFunction,omitempty"`
+	ObjectEncoding float64 `amf:"objectEncoding"`
+
+	Args       []interface{} `amf:"-"` //the arguments of connect after the command object.
+	RemoteAddr string        `amf:"-"`
+}
+
+//accept a NetConnection by returning nil, or reject it with the error as description.
+type ConnectHandler func(nc *NetConnection, info *ConnectInfo) error
+
+//accept a control command of the NetStream id of a client, e.g. play, publish, pause or
+//seek, by returning nil, or reject it with the error as description. closeStream is only
+//notified.
+type StreamCommandHandler func(nc *NetConnection, id float64, cmd string, args []interface{}) error
+
+//the command object of the _result of connect.
+type server_properties struct {
+	FmsVer       string  `amf:"fmsVer"`
+	Capabilities float64 `amf:"capabilities"`
+}
+
+type connect_status struct {
+	net_status
+	ObjectEncoding float64 `amf:"objectEncoding"`
+}
+
+type net_connection struct {
+	session  *session
+	sendFlow *send_flow
+	recvFlow *recv_flow
+	services *remoting.Registry //nil if calls are not served.
+
+	on_connect        func(info *ConnectInfo) error //nil to accept every connect.
+	on_stream_command func(id float64, cmd string, args []interface{}) error
+
+	publications *publications //the streams published and played, on the server.
+
+	send_mutex sync.Mutex
+
+	//held by recv_connect across the handler, so that a connect is accepted only once.
+	connect_mutex sync.Mutex
+
+	mutex          sync.Mutex
+	last_tid       float64
+	pending        map[float64]chan *command //calls waiting for their response.
+	connected      bool
+	app            string
+	last_stream_id float64
+	streams        map[float64]*net_stream //nil until the flow of the stream is opened.
+	closed         bool
+}
+
+//the first flow of a NetConnection, it is not the response of another flow.
+func is_net_connection_flow(options []byte) bool {
+	return bytes.HasPrefix(options, net_connection_signature) && read_vlu_option(options, 0xa, 0) == 0
+}
+
+//the signature of the flow of a NetStream, the id is the one of createStream.
+func net_stream_signature(id float64) []byte {
+	data := bytes.NewBuffer(nil)
+	data.Write([]byte{0x00, 0x54, 0x43, 0x04})
+	encode_vlu(data, uint(id))
+
+	buf := bytes.NewBuffer(nil)
+	encode_vlu_prefix_bytes(buf, data.Bytes())
+	return buf.Bytes()
+}
+
+//the stream id of the signature of a flow, 0 for a NetConnection.
+func stream_id_of_flow(options []byte) (float64, bool) {
+	sig := read_option(options, 0x00)
+	if !bytes.HasPrefix(sig, []byte{0x54, 0x43, 0x04}) {
+		return 0, false
+	}
+	return float64(decode_vlu(bytes.NewBuffer(sig[3:]))), true
+}
+
+func (self *net_connection) init() {
+	self.pending = make(map[float64]chan *command)
+	self.streams = make(map[float64]*net_stream)
+}
+
+func (self *net_connection) active_open() (err error) {
+	self.init()
+
+	self.sendFlow, err = self.session.new_send_flow(0, net_connection_signature)
+	if err != nil {
+		return err
+	}
+
+	//the session may be opened by the far end, after a glare.
+	passive_recv_flow := self.session.create_recv_flow
+
+	//the response flow is opened by the first response.
+	self.session.create_recv_flow = func(options []byte, flowid uint) (*recv_flow, error) {
+
+		rel_flowid := read_vlu_option(options, 0xa, 0)
+
+		if self.recvFlow == nil && rel_flowid == self.sendFlow.flowid {
+			self.recvFlow, _ = self.session.new_recv_flow(flowid)
+			go self.dispatch()
+
+			return self.recvFlow, nil
+		}
+
+		//the response of a stream.
+		self.mutex.Lock()
+		for _, ns := range self.streams {
+			if ns != nil && ns.sendFlow.flowid == rel_flowid && ns.attach_flow(flowid) {
+				self.mutex.Unlock()
+				go self.stream_dispatch(ns)
+				return ns.recvFlow, nil
+			}
+		}
+		self.mutex.Unlock()
+
+		if passive_recv_flow != nil {
+			return passive_recv_flow(options, flowid)
+		}
+
+		fmt.Println("not expect this flow!")
+		return nil, errors.New("not expect this flow!")
+	}
+
+	self.session.recv_close_request = func() {
+		self.close()
+	}
+
+	return nil
+}
+
+func (self *net_connection) passive_open(recv_flowid uint) (*recv_flow, error) {
+	self.init()
+
+	var err error
+	if self.recvFlow, err = self.session.new_recv_flow(recv_flowid); err != nil {
+		return nil, err
+	}
+
+	//response flow
+	if self.sendFlow, err = self.session.new_send_flow(recv_flowid, net_connection_signature); err != nil {
+		return nil, err
+	}
+
+	go self.dispatch()
+
+	return self.recvFlow, nil
+}
+
+//the flow of a NetStream of the far end, after it connected and created the stream.
+func (self *net_connection) accept_stream_flow(options []byte, flowid uint) (*recv_flow, error) {
+
+	id, ok := stream_id_of_flow(options)
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if !self.connected {
+		return nil, errors.New("not connected.")
+	}
+
+	if ns, created := self.streams[id]; !ok || !created || ns != nil {
+		return nil, fmt.Errorf("stream %v not created.", id)
+	}
+
+	ns := &net_stream{session: self.session, publications: self.publications}
+	if h := self.on_stream_command; h != nil {
+		ns.on_command = func(cmd string, args []interface{}) error {
+			return h(id, cmd, args)
+		}
+	}
+	if err := ns.passive_open(flowid); err != nil {
+		return nil, err
+	}
+	self.streams[id] = ns
+
+	if self.publications != nil {
+		ns.on_media = func(m *MediaMessage) {
+			self.publications.relay(ns, m)
+		}
+		ns.on_close = func() {
+			self.publications.remove(ns)
+		}
+	}
+
+	go self.stream_dispatch(ns)
+
+	return ns.recvFlow, nil
+}
+
+//open the flow of ns for a stream created by create_stream(), the response flow is
+//attached when the far end answer, and received by the handlers of ns.
+func (self *net_connection) open_stream(id float64, ns *net_stream) error {
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if s, created := self.streams[id]; !created || s != nil {
+		return fmt.Errorf("stream %v not created.", id)
+	}
+
+	ns.session = self.session
+
+	var err error
+	if ns.sendFlow, err = self.session.new_send_flow(0, net_stream_signature(id)); err != nil {
+		return err
+	}
+	self.streams[id] = ns
+
+	return nil
+}
+
+func (self *net_connection) stream_dispatch(ns *net_stream) {
+	for {
+		//the control commands, e.g. play and publish, are answered by recv().
+		cmd, param, err := ns.recv()
+		if err != nil {
+			break
+		}
+
+		if ns.handler != nil {
+			ns.handler(cmd, param)
+		}
+	}
+
+	if ns.on_close != nil {
+		ns.on_close()
+	}
+}
+
+func (self *net_connection) close() {
+
+	self.abort_pending()
+
+	if !self.session.closed {
+		self.session.close()
+	}
+}
+
+//fail the calls waiting for a response.
+func (self *net_connection) abort_pending() {
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.closed = true
+	for tid, ch := range self.pending {
+		close(ch)
+		delete(self.pending, tid)
+	}
+}
+
+func (self *net_connection) send(c *command) error {
+
+	buf, err := encode_command(c)
+	if err != nil {
+		return err
+	}
+
+	self.send_mutex.Lock()
+	defer self.send_mutex.Unlock()
+
+	_, err = self.sendFlow.send(buf)
+	return err
+}
+
+//send the command with a new transaction id, and wait for its response. an _error is
+//returned as a *remoting.Fault with the info object as Details.
+func (self *net_connection) call(name string, object interface{}, args ...interface{}) (*command, error) {
+
+	ch := make(chan *command, 1)
+
+	self.mutex.Lock()
+	if self.closed {
+		self.mutex.Unlock()
+		return nil, errors.New("connection closed!")
+	}
+	self.last_tid++
+	tid := self.last_tid
+	self.pending[tid] = ch
+	self.mutex.Unlock()
+
+	//fmt.Printf("call %s(%v)\n", name, tid)
+
+	if err := self.send(&command{name: name, tid: tid, object: object, args: args}); err != nil {
+		self.mutex.Lock()
+		delete(self.pending, tid)
+		self.mutex.Unlock()
+		return nil, err
+	}
+
+	var res *command
+	select {
+	case res = <-ch:
+	case <-self.session.clock.After(net_connection_call_timeout):
+		self.mutex.Lock()
+		delete(self.pending, tid)
+		self.mutex.Unlock()
+		return nil, fmt.Errorf("%s: no response in %v.", name, net_connection_call_timeout)
+	}
+
+	if res == nil {
+		return nil, errors.New("connection closed!")
+	}
+
+	if res.name == "_error" {
+		return nil, fault_of_status(res.args)
+	}
+
+	return res, nil
+}
+
+func fault_of_status(args []interface{}) *remoting.Fault {
+
+	f := &remoting.Fault{Code: "NetConnection.Call.Failed"}
+	if len(args) == 0 {
+		return f
+	}
+
+	var status net_status
+	if amf.Convert(args[0], &status) == nil && len(status.Code) > 0 {
+		f.Code, f.Description = status.Code, status.Description
+	}
+	f.Details = args[0]
+
+	return f
+}
+
+//the info object of an _error, a *remoting.Fault keep its code.
+func status_of_error(err error) *net_status {
+	f, ok := err.(*remoting.Fault)
+	if !ok {
+		f = &remoting.Fault{Code: "NetConnection.Call.Failed", Description: err.Error()}
+	}
+	return &net_status{"error", f.Code, f.Description}
+}
+
+func (self *net_connection) connect(app string, args ...interface{}) error {
+	info := &ConnectInfo{App: app, FlashVer: "WIN 10,0,32,18", TcUrl: "rtmfp://" + self.session.remote_addr() + "/" + app}
+	_, err := self.call("connect", info, args...)
+	if err != nil {
+		return err
+	}
+
+	self.mutex.Lock()
+	self.connected = true
+	self.app = app
+	self.mutex.Unlock()
+
+	return nil
+}
+
+func (self *net_connection) create_stream() (float64, error) {
+
+	res, err := self.call("createStream", nil)
+	if err != nil {
+		return 0, err
+	}
+
+	var id float64
+	if len(res.args) == 0 || amf.Convert(res.args[0], &id) != nil {
+		return 0, errors.New("createStream: invalid stream id.")
+	}
+
+	self.mutex.Lock()
+	self.streams[id] = nil
+	self.mutex.Unlock()
+
+	return id, nil
+}
+
+//as Flash, deleteStream has no response.
+func (self *net_connection) delete_stream(id float64) error {
+
+	self.mutex.Lock()
+	delete(self.streams, id)
+	self.mutex.Unlock()
+
+	return self.send(&command{name: "deleteStream", args: []interface{}{id}})
+}
+
+func (self *net_connection) dispatch() {
+	for {
+		buf, err := self.recvFlow.recv()
+		if err != nil {
+			break
+		}
+
+		c, err := decode_command(buf)
+		if err != nil {
+			//fmt.Printf("invalid command: %v\n", err)
+			continue
+		}
+
+		//fmt.Printf("recv %s(%v)\n", c.name, c.tid)
+
+		switch c.name {
+		case "":
+		case "_result", "_error":
+			self.recv_response(c)
+		case "connect":
+			//the handler may call the far end, and wait for the response.
+			go self.recv_connect(c)
+		case "createStream":
+			self.recv_create_stream(c)
+		case "deleteStream":
+			self.recv_delete_stream(c)
+		default:
+			//a call may call the far end in turn, and wait for the response.
+			go self.recv_call(c)
+		}
+	}
+
+	self.abort_pending()
+}
+
+func (self *net_connection) recv_response(c *command) {
+
+	//under the lock, the channel may be closed by abort_pending() otherwise.
+	self.mutex.Lock()
+	ch, ok := self.pending[c.tid]
+	if ok {
+		delete(self.pending, c.tid)
+		ch <- c
+	}
+	self.mutex.Unlock()
+
+	//if !ok {
+	//	fmt.Printf("unexpected %s(%v)\n", c.name, c.tid)
+	//}
+}
+
+//answer the command unless its transaction id is 0.
+func (self *net_connection) reply(c *command, object interface{}, args ...interface{}) {
+	if c.tid != 0 {
+		self.send(&command{name: "_result", tid: c.tid, object: object, args: args})
+	}
+}
+
+func (self *net_connection) reply_error(c *command, status *net_status) {
+	if c.tid != 0 {
+		self.send(&command{name: "_error", tid: c.tid, args: []interface{}{status}})
+	}
+}
+
+func (self *net_connection) is_connected() bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	return self.connected
+}
+
+func (self *net_connection) recv_connect(c *command) {
+
+	info := &ConnectInfo{}
+	if err := amf.Convert(c.object, info); err != nil {
+		self.reply_error(c, &net_status{"error", "NetConnection.Connect.Failed", err.Error()})
+		return
+	}
+	info.Args = c.args
+	info.RemoteAddr = self.session.remote_addr()
+
+	//fmt.Printf("connect(%s) from %s\n", info.App, info.RemoteAddr)
+
+	//not self.mutex, the handler may call the far end and wait for the response.
+	self.connect_mutex.Lock()
+	defer self.connect_mutex.Unlock()
+
+	if self.is_connected() {
+		self.reply_error(c, &net_status{"error", "NetConnection.Connect.Failed", "already connected."})
+		return
+	}
+
+	if self.on_connect != nil {
+		if err := self.on_connect(info); err != nil {
+			status := status_of_error(err)
+			status.Code = "NetConnection.Connect.Rejected"
+			self.reply_error(c, status)
+			return
+		}
+	}
+
+	self.mutex.Lock()
+	self.connected = true
+	self.app = info.App
+	self.mutex.Unlock()
+
+	self.reply(c, &server_properties{"FMS/3,5,5,2004", 31},
+		&connect_status{net_status{"status", "NetConnection.Connect.Success", "Connection succeeded."}, info.ObjectEncoding})
+}
+
+var not_connected_status = &net_status{"error", "NetConnection.Call.Failed", "not connected."}
+
+func (self *net_connection) recv_create_stream(c *command) {
+
+	if !self.is_connected() {
+		self.reply_error(c, not_connected_status)
+		return
+	}
+
+	self.mutex.Lock()
+	self.last_stream_id++
+	id := self.last_stream_id
+	self.streams[id] = nil
+	self.mutex.Unlock()
+
+	self.reply(c, nil, id)
+}
+
+func (self *net_connection) recv_delete_stream(c *command) {
+
+	var id float64
+	if len(c.args) > 0 {
+		amf.Convert(c.args[0], &id)
+	}
+
+	self.mutex.Lock()
+	ns := self.streams[id]
+	delete(self.streams, id)
+	self.mutex.Unlock()
+
+	if ns != nil {
+		if self.publications != nil {
+			self.publications.remove(ns)
+		}
+		ns.close()
+	}
+
+	self.reply(c, nil)
+}
+
+func (self *net_connection) recv_call(c *command) {
+
+	if !self.is_connected() {
+		self.reply_error(c, not_connected_status)
+		return
+	}
+
+	if self.services == nil || !self.services.Has(c.name) {
+		self.reply_error(c, &net_status{"error", "NetConnection.Call.Failed", "Method not found (" + c.name + ")."})
+		return
+	}
+
+	call := &remoting.Call{Name: c.name, Args: c.args, RemoteAddr: self.session.remote_addr()}
+
+	result, err := self.services.Call(call)
+	if err != nil {
+		self.reply_error(c, status_of_error(err))
+		return
+	}
+
+	self.reply(c, nil, result)
+}
@@ -0,0 +1,340 @@
+package rtmfp
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"rtmfp/amf"
+	"rtmfp/remoting"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCommand(t *testing.T) {
+
+	c := &command{
+		name:   "connect",
+		tid:    1,
+		object: &ConnectInfo{App: "live", FlashVer: "WIN 10,0,32,18"},
+		args:   []interface{}{"a", 2},
+	}
+
+	buf, err := encode_command(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := decode_command(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := &command{
+		name:   "connect",
+		tid:    1,
+		object: map[string]interface{}{"app": "live", "flashVer": "WIN 10,0,32,18", "objectEncoding": 0.0},
+		args:   []interface{}{"a", 2.0},
+	}
+	if !reflect.DeepEqual(decoded, expect) {
+		t.Fatalf("not match.\n%#v\n%#v", decoded, expect)
+	}
+
+	//without command object.
+	buf, _ = encode_command(&command{name: "_result", tid: 3})
+	buf = buf[:len(buf)-1]
+	if decoded, err = decode_command(buf); err != nil || decoded.tid != 3 || decoded.object != nil || decoded.args != nil {
+		t.Fatalf("unexpected command.\n%#v %v", decoded, err)
+	}
+
+	//a truncated command is an error, or has less values, never a panic.
+	buf, _ = encode_command(c)
+	for n := 0; n < len(buf); n++ {
+		if decoded, err := decode_command(buf[:n]); err == nil && reflect.DeepEqual(decoded, expect) {
+			t.Fatal("truncated at", n, "decoded.")
+		}
+	}
+}
+
+func TestNetConnection(t *testing.T) {
+
+	services := remoting.NewRegistry()
+	services.RegisterFunc("add", func(a, b float64) float64 { return a + b })
+	services.RegisterFunc("slow", func(d float64) { time.Sleep(time.Duration(d) * time.Millisecond) })
+	services.RegisterFunc("fail", func() error { return &remoting.Fault{Code: "App.Fail", Description: "failed"} })
+
+	server := &Transport{}
+	server.SetServices(services)
+	server.SetStreamHandler(func(*BiStream, string) bool { return true })
+	server.Open("127.0.0.1:0", []byte("server"))
+	defer server.Close()
+
+	c := &Transport{}
+	c.SetStreamHandler(func(*BiStream, string) bool { return false })
+	c.Open("127.0.0.1:0", []byte("client"))
+	defer c.Close()
+
+	nc, err := c.CreateNetConnection(server.LocalAddr(), server.Peerid())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := nc.Call("add", 1, 2); err == nil {
+		t.Fatal("called before connect.")
+	}
+
+	if err := nc.Connect("app"); err != nil {
+		t.Fatal(err)
+	}
+
+	//responses matched by transaction id, the slow call answered last.
+	slow := make(chan error, 1)
+	go func() {
+		_, err := nc.Call("slow", 50)
+		slow <- err
+	}()
+
+	calls := 20
+	done := make(chan error, calls)
+
+	for i := 0; i < calls; i++ {
+		go func(i int) {
+			result, err := nc.Call("add", i, 1000)
+			if err == nil && result != float64(i+1000) {
+				err = fmt.Errorf("add(%d, 1000) = %v", i, result)
+			}
+			done <- err
+		}(i)
+	}
+
+	for i := 0; i < calls; i++ {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-slow:
+			t.Fatal("slow call answered first.")
+		case <-time.After(time.Second):
+			t.Fatal("timeout")
+		}
+	}
+
+	if err := <-slow; err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []float64{1, 2} {
+		if sid, err := nc.CreateStream(); err != nil || sid != id {
+			t.Fatal("unexpected stream id.", sid, err)
+		}
+	}
+	if err := nc.DeleteStream(1); err != nil {
+		t.Fatal(err)
+	}
+
+	faults := map[string]string{"fail": "App.Fail", "unknown": "NetConnection.Call.Failed"}
+	for name, code := range faults {
+		_, err := nc.Call(name)
+		if f, ok := err.(*remoting.Fault); !ok || f.Code != code {
+			t.Fatalf("%s: unexpected error %v.", name, err)
+		}
+	}
+
+	defer func(timeout time.Duration) {
+		net_connection_call_timeout = timeout
+	}(net_connection_call_timeout)
+
+	c.SetCallTimeout(20 * time.Millisecond)
+	if _, err := nc.Call("slow", 200); err == nil {
+		t.Fatal("slow call not timeout.")
+	}
+
+	nc.Close()
+	if _, err := nc.Call("add", 1, 2); err == nil {
+		t.Fatal("called after close.")
+	}
+}
+
+func TestNetConnectionConnect(t *testing.T) {
+
+	accepted := make(chan *ConnectInfo, 1)
+
+	//only Flash clients, without stream handler.
+	server := &Transport{}
+	server.SetConnectHandler(func(nc *NetConnection, info *ConnectInfo) error {
+		if info.App != "live" {
+			return errors.New("unknown application.")
+		}
+		accepted <- info
+		return nil
+	})
+	server.Open("127.0.0.1:0", []byte("server"))
+	defer server.Close()
+
+	c := &Transport{}
+	c.SetStreamHandler(func(*BiStream, string) bool { return false })
+	c.Open("127.0.0.1:0", []byte("client"))
+	defer c.Close()
+
+	nc, err := c.CreateNetConnection(server.LocalAddr(), server.Peerid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+
+	err = nc.Connect("vod")
+	if f, ok := err.(*remoting.Fault); !ok || f.Code != "NetConnection.Connect.Rejected" || f.Description != "unknown application." {
+		t.Fatal("not rejected.", err)
+	}
+	if _, err := nc.CreateStream(); err == nil {
+		t.Fatal("stream created before connect.")
+	}
+
+	if err := nc.Connect("live", "token"); err != nil {
+		t.Fatal(err)
+	}
+
+	info := <-accepted
+	if info.FlashVer == "" || info.TcUrl != "rtmfp://"+server.LocalAddr()+"/live" || len(info.Args) != 1 || info.Args[0] != "token" || info.RemoteAddr != c.LocalAddr() {
+		t.Fatalf("unexpected connect info.\n%#v", info)
+	}
+
+	if err := nc.Connect("live"); err == nil {
+		t.Fatal("connected twice.")
+	}
+
+	//the NetStream flow of a created stream.
+	id, err := nc.CreateStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status := make(chan string, 2)
+	ns := &net_stream{
+		handler: func(cmd string, param interface{}) {
+			if cmd == "onStatus" {
+				status <- param.(map[string]interface{})["code"].(string)
+			}
+		},
+	}
+	if err := nc.conn.open_stream(id, ns); err != nil {
+		t.Fatal(err)
+	}
+	if err := nc.conn.open_stream(id+1, &net_stream{}); err == nil {
+		t.Fatal("stream opened before createStream.")
+	}
+
+	ns.play("cam")
+
+	for _, code := range []string{"NetStream.Play.Reset", "NetStream.Play.Start"} {
+		select {
+		case s := <-status:
+			if s != code {
+				t.Fatal("unexpected status.", s)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timeout")
+		}
+	}
+}
+
+//hex bytes, "#" comments to the end of the line.
+func load_hex(t *testing.T, path string) []byte {
+
+	text, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var digits []string
+	for _, line := range strings.Split(string(text), "\n") {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		digits = append(digits, strings.Fields(line)...)
+	}
+
+	data, err := hex.DecodeString(strings.Join(digits, ""))
+	if err != nil {
+		t.Fatal(path, err)
+	}
+
+	return data
+}
+
+//the connect of Flash Player, with the properties our client does not send.
+func TestNetConnectionFlashConnect(t *testing.T) {
+
+	c, err := decode_command(load_hex(t, "testdata/flash_connect.hex"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.name != "connect" || c.tid != 1 || c.args != nil {
+		t.Fatalf("unexpected command.\n%#v", c)
+	}
+
+	initiator, responder := create_netstream_sessions()
+	defer initiator.close()
+	defer responder.close()
+
+	results := make(chan []byte, 1)
+	initiator.create_recv_flow = func(options []byte, flowid uint) (*recv_flow, error) {
+		flow, err := initiator.new_recv_flow(flowid)
+		go func() {
+			if buf, err := flow.recv(); err == nil {
+				results <- buf
+			}
+		}()
+		return flow, err
+	}
+
+	accepted := make(chan *ConnectInfo, 1)
+	nc := &net_connection{session: responder}
+	nc.init()
+	nc.sendFlow, _ = responder.new_send_flow(0, net_connection_signature)
+	nc.on_connect = func(info *ConnectInfo) error {
+		accepted <- info
+		return nil
+	}
+
+	nc.recv_connect(c)
+
+	info := <-accepted
+	expect := &ConnectInfo{
+		FlashVer:       "WIN 11,7,700,202",
+		TcUrl:          "rtmfp://192.168.137.183/",
+		Capabilities:   235,
+		AudioCodecs:    3575,
+		VideoCodecs:    252,
+		VideoFunction:  1,
+		ObjectEncoding: 3,
+		RemoteAddr:     responder.remote_addr(),
+	}
+	if !reflect.DeepEqual(info, expect) {
+		t.Fatalf("unexpected connect info.\n%#v\n%#v", info, expect)
+	}
+	if !nc.is_connected() {
+		t.Fatal("not connected.")
+	}
+
+	//the object encoding of the client is answered.
+	var buf []byte
+	select {
+	case buf = <-results:
+	case <-time.After(time.Second):
+		t.Fatal("no response.")
+	}
+
+	res, err := decode_command(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var status connect_status
+	if res.name != "_result" || res.tid != 1 || len(res.args) != 1 || amf.Convert(res.args[0], &status) != nil ||
+		status.Code != "NetConnection.Connect.Success" || status.ObjectEncoding != 3 {
+		t.Fatalf("unexpected response.\n%#v", res)
+	}
+}
@@ -1,19 +1,61 @@
 package rtmfp
 
 import (
-	"bytes"
-	"encoding/binary"
 	"fmt"
 	"io"
+	"sync"
 )
 
 var net_stream_req_signature = []byte{0x07, 0x00, 0x54, 0x43, 0x04, 0xFA, 0x89, 0x00}
 var net_stream_res_signature = []byte{0x05, 0x00, 0x54, 0x43, 0x04, 0x00}
 
+//the chunks not yet acked by a player, above which its audio and video frames are
+//dropped until it catch up, and the video is sent again from a keyframe.
+var max_media_queue = 1024
+
+//info object of onStatus.
+type net_status struct {
+	Level       string `amf:"level"`
+	Code        string `amf:"code"`
+	Description string `amf:"description,omitempty"`
+}
+
 type net_stream struct {
 	session  *session
 	sendFlow *send_flow
 	recvFlow *recv_flow
+
+	send_mutex sync.Mutex //the flow is shared with the publisher relaying to us.
+
+	handler  func(cmd string, param interface{}) //the commands received on a NetConnection.
+	on_media func(m *MediaMessage)
+	on_close func() //the flow of the far end is closed.
+
+	publications *publications //nil if play and publish are only answered.
+
+	//accept the control commands before they are answered, or reject them with the error.
+	on_command func(cmd string, args []interface{}) error
+
+	//receiveAudio and receiveVideo, guarded by send_mutex.
+	no_audio      bool
+	no_video      bool
+	wait_keyframe bool //video is sent again from a keyframe.
+}
+
+//the commands answered by net_stream, the code of onStatus when they are rejected.
+var stream_control_failed = map[string]string{
+	"play":         "NetStream.Play.Failed",
+	"publish":      "NetStream.Publish.Denied",
+	"seek":         "NetStream.Seek.Failed",
+	"pause":        "NetStream.Failed",
+	"receiveAudio": "NetStream.Failed",
+	"receiveVideo": "NetStream.Failed",
+	"closeStream":  "NetStream.Failed",
+}
+
+func is_stream_control(cmd string) bool {
+	_, ok := stream_control_failed[cmd]
+	return ok
 }
 
 func (self *net_stream) active_open() (flowid uint, err error) {
@@ -33,8 +75,18 @@ func (self *net_stream) passive_open(recv_flowid uint) (err error) {
 	return err
 }
 
+//stop the flows of the stream, the goroutine receiving it return as recv() fail.
 func (self *net_stream) close() {
 
+	self.send_mutex.Lock()
+	if self.sendFlow != nil {
+		self.sendFlow.close()
+	}
+	self.send_mutex.Unlock()
+
+	if self.recvFlow != nil {
+		self.recvFlow.close()
+	}
 }
 
 func (self *net_stream) attach_flow(flowid uint) bool {
@@ -56,99 +108,147 @@ func (self *net_stream) recv() (cmd string, param interface{}, err error) {
 			return "", nil, err
 		}
 
-		cmd, param, err = self.decode_msg(buf)
-		if err != nil {
-			return
+		if len(buf) > 0 && is_media(buf[0]) {
+			if m, err := decode_media(buf); err == nil && self.on_media != nil {
+				self.on_media(m)
+			}
+			continue
 		}
 
+		var c *command
+		if c, err = decode_command(buf); err != nil {
+			return "", nil, err
+		}
+		cmd, param = c.name, command_param(c)
+
 		//do standard reply before return to caller.
-		switch cmd {
-		case "play":
-			self.recv_play(param)
-		case "publish":
-			self.recv_publish(param)
+		if is_stream_control(cmd) {
+			self.recv_control(cmd, c.args)
 		}
 		return
 	}
 }
 
+func (self *net_stream) recv_control(cmd string, args []interface{}) {
+
+	if self.on_command != nil {
+		//closeStream is not rejected, the far end does not wait for its answer.
+		if err := self.on_command(cmd, args); err != nil && cmd != "closeStream" {
+			self.send("onStatus", &net_status{"error", stream_control_failed[cmd], err.Error()})
+			return
+		}
+	}
+
+	switch cmd {
+	case "play":
+		self.recv_play(args)
+	case "publish":
+		self.recv_publish(args)
+	case "seek":
+		self.recv_seek(args)
+	case "pause":
+		self.recv_pause(args)
+	case "receiveAudio", "receiveVideo":
+		self.recv_receive(cmd, args)
+	case "closeStream":
+		self.recv_close_stream()
+	}
+}
+
 func (self *net_stream) send(cmd string, v interface{}) error {
+	return self.send_command(cmd, v)
+}
+
+func (self *net_stream) send_command(cmd string, args ...interface{}) error {
 
 	//fmt.Printf("send %s()\n", cmd)
 
-	buf, err := self.encode_msg(cmd, v)
+	buf, err := encode_command(&command{name: cmd, args: args})
 	if err != nil {
 		return err
 	}
+
+	self.send_mutex.Lock()
+	defer self.send_mutex.Unlock()
+
 	_, err = self.sendFlow.send(buf)
 
 	return err
 }
 
-func (self *net_stream) decode_msg(buf []byte) (cmd string, param interface{}, err error) {
-
-	r := bytes.NewBuffer(buf)
-
-	var msg_type uint8
-	binary.Read(r, binary.BigEndian, &msg_type)
-
-	//fmt.Printf("msg type:%d\n", msg_type)
+func (self *net_stream) send_media(m *MediaMessage) error {
 
-	switch msg_type {
-	case 0x11: //AMF?
-		r.Next(5)
-		cmd = read_amf0_type_string(r)
-		_ = read_amf0_type_number(r) /*callback*/
+	self.send_mutex.Lock()
+	defer self.send_mutex.Unlock()
 
-		//NOTE: skip the first null
-		//when server response, it write "cmd|callback|null|..."
-		if r.Bytes()[0] == 0x5 {
-			r.Next(1)
+	switch m.Type {
+	case MediaAudio:
+		if self.no_audio {
+			return nil
 		}
-
-		param = decode_amf(r)
-	case 0x14: //AMF_WITH_HANDLER
-		r.Next(4)
-		cmd = read_amf0_type_string(r)
-		_ = read_amf0_type_number(r) /*callback*/
-
-		//NOTE: skip the first null
-		//when server response, it write "cmd|callback|null|..."
-		if r.Bytes()[0] == 0x5 {
-			r.Next(1)
+	case MediaVideo:
+		if self.no_video {
+			return nil
+		}
+		if self.wait_keyframe && !is_video_config(m.Data) {
+			if !is_video_keyframe(m.Data) {
+				return nil
+			}
+			self.wait_keyframe = false
 		}
+	}
 
-		param = decode_amf(r)
-	case 0x0F: //AMF
-		r.Next(5)
-		cmd = read_amf0_type_string(r)
-		param = decode_amf(r)
-	default:
-		fmt.Printf("###############unknown msg type:%d####################\n", msg_type)
-		//panic("unknown msg type")
+	//the codec configs and the data frames are never dropped.
+	if (m.Type == MediaAudio && !is_audio_config(m.Data)) || (m.Type == MediaVideo && !is_video_config(m.Data)) {
+		if self.sendFlow.queued() >= max_media_queue {
+			if m.Type == MediaVideo {
+				self.wait_keyframe = true
+			}
+			return nil
+		}
 	}
 
-	//fmt.Printf("#cmd:%s\n", cmd)
+	_, err := self.sendFlow.send(encode_media(m))
 
-	return
+	return err
 }
 
-func (self *net_stream) encode_msg(cmd string, v interface{}) (buf []byte, err error) {
+//the command and its first argument, the transaction id is ignored as net_stream
+//commands have no response.
+func (self *net_stream) decode_msg(buf []byte) (cmd string, param interface{}, err error) {
 
-	w := bytes.NewBuffer(nil)
+	c, err := decode_command(buf)
+	if err != nil {
+		return "", nil, err
+	}
 
-	//AMF_WITH_HANDLER
+	return c.name, command_param(c), nil
+}
 
-	binary.Write(w, binary.BigEndian, uint8(0x14))
-	binary.Write(w, binary.BigEndian, uint32(0))
+func command_param(c *command) interface{} {
 
-	write_amf0_type_string(w, cmd)
-	write_amf0_type_number(w, 0) //FIXME: ?
-	write_amf0_type_null(w)      //FIXME: should we write this?
+	//NOTE: skip the first null
+	//when server response, it write "cmd|callback|null|..."
+	if c.object != nil {
+		return c.object
+	} else if len(c.args) > 0 {
+		return c.args[0]
+	}
 
-	encode_amf(w, v)
+	return nil
+}
 
-	return w.Bytes(), nil
+//v may be any value amf.Marshal() accept, e.g. a struct with amf tags.
+func (self *net_stream) encode_msg(cmd string, v interface{}) (buf []byte, err error) {
+	return encode_command(&command{name: cmd, args: []interface{}{v}})
+}
+
+//the argument i of a command, nil if missing.
+func command_arg(args []interface{}, i int) interface{} {
+	if i < len(args) {
+		return args[i]
+	}
+	return nil
 }
 
 func (self *net_stream) play(name string) {
@@ -157,22 +257,35 @@ func (self *net_stream) play(name string) {
 	self.send("play", name)
 }
 
-func (self *net_stream) recv_play(param interface{}) {
+//play the recording of name from start milliseconds.
+func (self *net_stream) play_recorded(name string, start float64) {
+	self.send_command("play", name, start)
+}
 
-	name := param.(string)
-	//fmt.Printf("recv_play: %s\n", name)
+//the start of play: -2 for the live stream, or the recording if not published, -1 for
+//the live stream only, and milliseconds of the recording to start from.
+func (self *net_stream) recv_play(args []interface{}) {
 
-	res := make(map[string]interface{})
-	res["level"] = "status"
-	res["code"] = "NetStream.Play.Reset"
-	res["description"] = name + " is reset!"
+	name, _ := command_arg(args, 0).(string)
+	start, ok := command_arg(args, 1).(float64)
+	if !ok {
+		start = -2
+	}
+	//fmt.Printf("recv_play: %s\n", name)
 
-	self.send("onStatus", res)
+	if self.publications == nil {
+		self.send_play_start(name)
+		return
+	}
 
-	res["code"] = "NetStream.Play.Start"
-	res["description"] = name + " is playing!"
+	if err := self.publications.play(name, self, start); err != nil {
+		self.send("onStatus", &net_status{"error", "NetStream.Play.StreamNotFound", err.Error()})
+	}
+}
 
-	self.send("onStatus", res)
+func (self *net_stream) send_play_start(name string) {
+	self.send("onStatus", &net_status{"status", "NetStream.Play.Reset", name + " is reset!"})
+	self.send("onStatus", &net_status{"status", "NetStream.Play.Start", name + " is playing!"})
 }
 
 func (self *net_stream) publish(name string) {
@@ -181,14 +294,104 @@ func (self *net_stream) publish(name string) {
 	self.send("publish", name)
 }
 
-func (self *net_stream) recv_publish(param interface{}) {
+//publish name and record it to a file.
+func (self *net_stream) record(name string) {
+	self.send_command("publish", name, "record")
+}
+
+//the type of publish is "live" by default, or "record" to record the stream to a
+//file of media_dir, which replace the previous recording.
+func (self *net_stream) recv_publish(args []interface{}) {
 
-	res := make(map[string]interface{})
-	res["level"] = "status"
-	res["code"] = "NetStream.Publish.Start"
-	res["description"] = param.(string) + " is now published!"
+	name, _ := command_arg(args, 0).(string)
+	mode, _ := command_arg(args, 1).(string)
 
-	self.send("onStatus", res)
+	if self.publications != nil {
+		if err := self.publications.publish(name, self); err != nil {
+			self.send("onStatus", &net_status{"error", "NetStream.Publish.BadName", err.Error()})
+			return
+		}
+	}
+
+	self.send("onStatus", &net_status{"status", "NetStream.Publish.Start", name + " is now published!"})
+
+	if self.publications != nil && mode == "record" {
+		//published live when the file can not be recorded.
+		if err := self.publications.record(name, self); err != nil {
+			self.send("onStatus", &net_status{"error", "NetStream.Record.NoAccess", err.Error()})
+			return
+		}
+		self.send("onStatus", &net_status{"status", "NetStream.Record.Start", "recording " + name + "."})
+	}
+}
+
+//seek the recording played to the keyframe before the milliseconds of the argument.
+func (self *net_stream) recv_seek(args []interface{}) {
+
+	ms, _ := command_arg(args, 0).(float64)
+
+	if self.publications == nil {
+		self.send("onStatus", &net_status{"status", "NetStream.Seek.Notify", "seeking."})
+		return
+	}
+
+	//notified when the playback is sought.
+	if err := self.publications.seek(self, ms); err != nil {
+		self.send("onStatus", &net_status{"error", "NetStream.Seek.Failed", err.Error()})
+	}
+}
+
+//pause or resume, the first argument is true to pause.
+func (self *net_stream) recv_pause(args []interface{}) {
+
+	paused, _ := command_arg(args, 0).(bool)
+
+	if self.publications != nil {
+		if err := self.publications.pause(self, paused); err != nil {
+			self.send("onStatus", &net_status{"error", "NetStream.Failed", err.Error()})
+			return
+		}
+	}
+
+	if paused {
+		self.send("onStatus", &net_status{"status", "NetStream.Pause.Notify", "paused."})
+	} else {
+		self.send("onStatus", &net_status{"status", "NetStream.Unpause.Notify", "unpaused."})
+	}
+}
+
+//receiveAudio or receiveVideo, the first argument is false to stop receiving it.
+func (self *net_stream) recv_receive(cmd string, args []interface{}) {
+
+	flag, _ := command_arg(args, 0).(bool)
+
+	self.send_mutex.Lock()
+	defer self.send_mutex.Unlock()
+
+	if cmd == "receiveAudio" {
+		self.no_audio = !flag
+	} else {
+		if flag && self.no_video {
+			self.wait_keyframe = true
+		}
+		self.no_video = !flag
+	}
+}
+
+//stop publishing or playing, the stream may publish or play again.
+func (self *net_stream) recv_close_stream() {
+
+	if self.publications == nil {
+		return
+	}
+
+	published, played := self.publications.remove(self)
+	if published {
+		self.send("onStatus", &net_status{"status", "NetStream.Unpublish.Success", "unpublished."})
+	}
+	if played {
+		self.send("onStatus", &net_status{"status", "NetStream.Play.Stop", "stopped."})
+	}
 }
 
 func (self *net_stream) dump_state(w io.Writer) {
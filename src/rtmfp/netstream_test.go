@@ -1,7 +1,9 @@
 package rtmfp
 
 import (
+	"errors"
 	"fmt"
+	"reflect"
 	"testing"
 	"time"
 )
@@ -132,3 +134,132 @@ func TestNetStream(t *testing.T) {
 	initiator.close()
 	responder.close()
 }
+
+func TestNetStreamMsg(t *testing.T) {
+
+	ns := &net_stream{}
+
+	buf, err := ns.encode_msg("onStatus", &net_status{"status", "NetStream.Play.Start", ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd, param, err := ns.decode_msg(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//the empty description is omitted.
+	expect := map[string]interface{}{"level": "status", "code": "NetStream.Play.Start"}
+	if cmd != "onStatus" || !reflect.DeepEqual(param, expect) {
+		t.Fatal("not match.", cmd, param)
+	}
+
+	if _, _, err := ns.decode_msg(buf[:len(buf)-1]); err == nil {
+		t.Fatal("truncated message decoded.")
+	}
+}
+
+func TestNetStreamClose(t *testing.T) {
+
+	initiator, responder := create_netstream_sessions()
+	defer initiator.close()
+	defer responder.close()
+
+	accepted := make(chan *net_stream, 1)
+	responder.create_recv_flow = func(options []byte, flowid uint) (*recv_flow, error) {
+		ns := &net_stream{session: responder}
+		err := ns.passive_open(flowid)
+		accepted <- ns
+		return ns.recvFlow, err
+	}
+
+	send_stream := &net_stream{session: initiator}
+	send_stream.active_open()
+	send_stream.send("foo", "bar")
+
+	var ns *net_stream
+	select {
+	case ns = <-accepted:
+	case <-time.After(time.Second):
+		t.Fatal("stream not opened.")
+	}
+
+	stopped := make(chan bool)
+	ns.on_close = func() { close(stopped) }
+	nc := &net_connection{session: responder}
+	go nc.stream_dispatch(ns)
+
+	ns.close()
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("stream_dispatch not stopped.")
+	}
+
+	if err := ns.send("onStatus", &net_status{"status", "NetStream.Play.Start", ""}); err == nil {
+		t.Fatal("sent on a closed stream.")
+	}
+}
+
+func TestNetStreamMediaQueue(t *testing.T) {
+
+	initiator, responder := create_netstream_sessions()
+	defer initiator.close()
+	defer responder.close()
+
+	//never acked.
+	responder.create_recv_flow = func(options []byte, flowid uint) (*recv_flow, error) {
+		return nil, errors.New("refused.")
+	}
+
+	ns := &net_stream{session: initiator}
+	ns.active_open()
+
+	inter := &MediaMessage{MediaVideo, 40, []byte{0x27, 0x01, 0x01}}
+	for i := 0; i < max_media_queue; i++ {
+		ns.send_media(inter)
+	}
+
+	//dropped above the limit, the video is sent again from a keyframe.
+	ns.send_media(inter)
+	ns.send_media(&MediaMessage{MediaAudio, 40, []byte{0xaf, 0x01, 0x02}})
+	if n := ns.sendFlow.queued(); n != max_media_queue || !ns.wait_keyframe {
+		t.Fatal("not dropped.", n, ns.wait_keyframe)
+	}
+
+	//the codec configs and the data frames are queued.
+	ns.send_media(&MediaMessage{MediaVideo, 80, []byte{0x17, 0x00, 0x03}})
+	ns.send_media(&MediaMessage{MediaAudio, 80, []byte{0xaf, 0x00, 0x04}})
+	ns.send_media(&MediaMessage{MediaData, 80, []byte{0x05}})
+	if n := ns.sendFlow.queued(); n != max_media_queue+3 {
+		t.Fatal("header dropped.", n)
+	}
+}
+
+func TestNetStreamRecvMedia(t *testing.T) {
+
+	s := &NetStream{media: make(chan *MediaMessage, 1)}
+
+	first := &MediaMessage{MediaAudio, 0, []byte{0xaf, 0x01, 0x01}}
+	second := &MediaMessage{MediaAudio, 20, []byte{0xaf, 0x01, 0x02}}
+
+	//a player not calling Recv() never block the session.
+	done := make(chan bool)
+	go func() {
+		s.recv_media(first)
+		s.recv_media(second)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("blocked by the player.")
+	}
+
+	if m, err := s.Recv(); err != nil || m != first {
+		t.Fatal("unexpected media.", m, err)
+	}
+}
@@ -3,36 +3,41 @@ package rtmfp
 import (
 	"container/list"
 	"math/rand"
+	"strings"
 	"sync"
 	"time"
 )
 
 type noisy_chan struct {
-	in, out         chan *network_packet
-	lose_rate       int //0-100
-	delay           time.Duration
-	capacity        int
-	disorder        bool
-	max_packet_size int
-	speed           int // bytes/s
+	in, out chan *network_packet
+	profile ChannelProfile
+	clock   clock //nil for the real clock
 
-	packets *list.List
-
-	send_mutex sync.Mutex
-	send_cond  *sync.Cond
+	rand      *rand.Rand
+	ge_bad    bool      //Gilbert-Elliott state
+	open_time time.Time //start of the rate trace
 
+	packets       *list.List //ordered by send time
 	packets_mutex sync.Mutex
+	wake          chan bool
+	wake_timer    clock_timer
+	done          chan bool
+	last_send     time.Time //send time of the last queued packet, to keep order.
 
-	rx_count, tx_count, drop_count int
+	rx_count, tx_count, drop_count, dup_count, corrupt_count int
 
-	bucket           int // bytes in one second
-	bucket_inc_rate  int // bytes/ms,  us millionsecond to increase precise
+	bucket           int //bytes, at most one second of the current speed.
 	bucket_update_ts time.Time
+
+	//delivery trace
+	opp_next      int64         //next opportunity
+	opp_credit    int           //bytes left of the last used opportunity
+	opp_credit_at time.Duration //time of the last used opportunity
 }
 
 type nosiy_chan_item struct {
-	p           *network_packet
-	queued_time time.Time
+	p         *network_packet
+	send_time time.Time
 }
 
 func (self *noisy_chan) open() {
@@ -41,16 +46,26 @@ func (self *noisy_chan) open() {
 		panic("in chan can't be nil")
 	}
 
+	if self.clock == nil {
+		self.clock = default_clock
+	}
+
+	if self.profile.Seed == 0 {
+		self.rand = rand.New(rand.NewSource(rand.Int63()))
+	} else {
+		self.rand = rand.New(rand.NewSource(self.profile.Seed))
+	}
+
 	self.out = make(chan *network_packet, network_packet_chan_default_buffer_size)
 	self.packets = list.New()
+	self.wake = make(chan bool, 1)
+	self.done = make(chan bool)
+	self.wake_timer = self.clock.AfterFunc(time.Hour, self.notify)
+	self.wake_timer.Stop()
 
-	self.send_cond = sync.NewCond(&self.send_mutex)
-
-	if self.speed > 0 {
-		self.bucket = self.speed
-		self.bucket_inc_rate = self.speed / 1000
-		self.bucket_update_ts = time.Now()
-	}
+	self.open_time = self.clock.Now()
+	self.bucket = self.profile.speed_at(0)
+	self.bucket_update_ts = self.open_time
 
 	go self.recv()
 	go self.send()
@@ -58,79 +73,168 @@ func (self *noisy_chan) open() {
 
 func (self *noisy_chan) recv() {
 	for {
-		p, ok := <-self.in
-		if !ok {
-			break
+		select {
+		case p, ok := <-self.in:
+			if !ok {
+				return
+			}
+			self.recv_packet(p)
+		case <-self.done:
+			return
 		}
-		self.recv_packet(p)
-
 	}
 }
 
 func (self *noisy_chan) send() {
 	for {
+		self.packets_mutex.Lock()
 
-		self.send_cond.L.Lock()
-
-		for self.packets.Len() == 0 {
-			self.send_cond.Wait()
+		if self.packets.Len() == 0 {
+			self.packets_mutex.Unlock()
+			if !self.wait() {
+				return
+			}
+			continue
 		}
 
-		for self.packets.Len() > 0 {
+		front := self.packets.Front()
+		item := front.Value.(*nosiy_chan_item)
 
-			front := self.packets.Front()
-
-			schedule_time := front.Value.(*nosiy_chan_item).queued_time.Add(self.delay)
-
-			if time.Now().Before(schedule_time) {
-				time.Sleep(schedule_time.Sub(time.Now()))
+		//a packet with less delay may be queued before the front while waiting.
+		if now := self.clock.Now(); now.Before(item.send_time) {
+			self.packets_mutex.Unlock()
+			self.wake_timer.Reset(item.send_time.Sub(now))
+			if !self.wait() {
+				return
 			}
+			continue
+		}
 
-			p := front.Value.(*nosiy_chan_item).p
+		var wait_time time.Duration
+		if self.profile.DeliveryTrace != nil {
+			wait_time = self.update_delivery(item.send_time, len(item.p.data))
+		} else {
+			wait_time = self.update_send_bucket(len(item.p.data))
+		}
+		if wait_time > 0 {
+			self.packets_mutex.Unlock()
+			self.clock.Sleep(wait_time)
+			continue
+		}
 
-			wait_time := self.update_send_bucket(len(p.data))
-			if wait_time == 0 {
-				self.send_packet(p)
-				self.packets_mutex.Lock()
-				self.packets.Remove(front)
-				self.packets_mutex.Unlock()
-			} else {
-				time.Sleep(wait_time)
-			}
+		self.packets.Remove(front)
+		self.packets_mutex.Unlock()
+
+		if !self.send_packet(item.p) {
+			return
 		}
+	}
+}
 
-		self.send_cond.L.Unlock()
+//false if closed.
+func (self *noisy_chan) wait() bool {
+	select {
+	case <-self.wake:
+		return true
+	case <-self.done:
+		return false
 	}
 }
 
+//stop receiving and sending, queued packets are dropped.
+func (self *noisy_chan) close() {
+	self.wake_timer.Stop()
+	close(self.done)
+}
+
 func (self *noisy_chan) update_send_bucket(data_len int) time.Duration {
 
+	now := self.clock.Now()
+	speed := self.profile.speed_at(now.Sub(self.open_time))
+
 	//no speed limit
-	if self.bucket_inc_rate == 0 {
+	if speed == 0 {
 		return 0
 	}
 
-	//increase bucket
-	self.bucket += self.bucket_inc_rate * int(time.Since(self.bucket_update_ts)/time.Millisecond)
-	self.bucket_update_ts = time.Now()
-	if self.bucket > self.speed {
-		self.bucket = self.speed
+	//increase bucket, keep the fraction of a byte for the next time.
+	inc := int(int64(speed) * int64(now.Sub(self.bucket_update_ts)) / int64(time.Second))
+	if inc > 0 {
+		self.bucket += inc
+		self.bucket_update_ts = now
+	}
+	if self.bucket > speed {
+		self.bucket = speed
 	}
 
 	if self.bucket >= data_len {
 		self.bucket -= data_len
 		return 0
 	} else {
+		return time.Duration(data_len-self.bucket) * time.Second / time.Duration(speed)
+	}
+}
+
+//wait before a packet ready at ready_time can use a delivery opportunity.
+func (self *noisy_chan) update_delivery(ready_time time.Time, data_len int) time.Duration {
+
+	trace := self.profile.DeliveryTrace
+
+	ready, now := ready_time.Sub(self.open_time), self.clock.Now().Sub(self.open_time)
 
-		//may round to zero
-		wait_time := (data_len - self.bucket) / self.bucket_inc_rate
-		if wait_time == 0 {
-			wait_time = 1 //force to 1 ms
+	//larger packets take a whole opportunity.
+	if data_len > trace.MTU {
+		data_len = trace.MTU
+	}
+
+	//opportunities before the packet is ready are lost.
+	if self.opp_credit_at < ready {
+		self.opp_credit = 0
+		if trace.opportunity(self.opp_next) < ready {
+			self.opp_next = trace.first_at_or_after(ready)
+		}
+	}
+
+	for self.opp_credit < data_len {
+		at := trace.opportunity(self.opp_next)
+		if at > now {
+			return at - now
 		}
+		self.opp_next++
+		self.opp_credit = trace.MTU
+		self.opp_credit_at = at
+	}
 
-		return time.Duration(wait_time) * time.Millisecond
+	self.opp_credit -= data_len
+	return 0
+}
+
+//loss by the profile, the delay trace or Gilbert-Elliott if set, otherwise uniform.
+func (self *noisy_chan) lose(elapsed time.Duration) bool {
+
+	if self.profile.DelayTrace != nil {
+		return self.profile.DelayTrace.record_at(elapsed).Lost
+	}
+
+	ge := self.profile.BurstLoss
+	if ge == nil {
+		return self.rand.Int31n(100) < int32(self.profile.LoseRate)
+	}
+
+	if self.ge_bad {
+		if self.rand.Float64() < ge.R {
+			self.ge_bad = false
+		}
+	} else {
+		if self.rand.Float64() < ge.P {
+			self.ge_bad = true
+		}
 	}
 
+	if self.ge_bad {
+		return self.rand.Float64() < ge.LossBad
+	}
+	return self.rand.Float64() < ge.LossGood
 }
 
 func (self *noisy_chan) recv_packet(p *network_packet) {
@@ -138,40 +242,158 @@ func (self *noisy_chan) recv_packet(p *network_packet) {
 	self.rx_count++
 	self.drop_count++ //pre increase
 
+	elapsed := self.clock.Since(self.open_time)
+
 	//drop by lose rate
-	if rand.Int31n(100) < int32(self.lose_rate) {
+	if self.lose(elapsed) {
 		return
 	}
 
 	//drop by capacity
-	if self.capacity > 0 && self.packets.Len() >= self.capacity {
+	self.packets_mutex.Lock()
+	queued := self.packets.Len()
+	self.packets_mutex.Unlock()
+
+	if self.profile.Capacity > 0 && queued >= self.profile.Capacity {
 		return
 	}
 
 	//drop by packet size
-	if self.max_packet_size > 0 && len(p.data) > self.max_packet_size {
+	if self.profile.MaxPacketSize > 0 && len(p.data) > self.profile.MaxPacketSize {
 		return
 	}
 
 	self.drop_count-- //backoff
 
-	item := &nosiy_chan_item{p: p, queued_time: time.Now()}
+	if self.profile.CorruptRate > 0 && len(p.data) > 0 && self.rand.Int31n(100) < int32(self.profile.CorruptRate) {
+		data := make([]byte, len(p.data))
+		copy(data, p.data)
+		bit := self.rand.Intn(len(data) * 8)
+		data[bit/8] ^= 1 << uint(bit%8)
 
+		p = &network_packet{data: data, addr: p.addr}
+		self.corrupt_count++
+	}
+
+	self.queue_packet(p, elapsed)
+
+	if self.profile.DuplicateRate > 0 && self.rand.Int31n(100) < int32(self.profile.DuplicateRate) {
+		self.queue_packet(p, elapsed)
+		self.dup_count++
+	}
+}
+
+func (self *noisy_chan) queue_packet(p *network_packet, elapsed time.Duration) {
+
+	send_time := self.open_time.Add(elapsed + self.profile.packet_delay(self.rand, elapsed))
+
+	if self.profile.KeepOrder && send_time.Before(self.last_send) {
+		send_time = self.last_send
+	}
+	if send_time.After(self.last_send) {
+		self.last_send = send_time
+	}
+
+	item := &nosiy_chan_item{p: p, send_time: send_time}
 
-	//50% change of disorder
 	self.packets_mutex.Lock()
-	if self.disorder && rand.Int31n(100) < 50 && self.packets.Len() > 0 {
-		self.packets.InsertBefore(item, self.packets.Back())
+
+	//insert by send time, after packets with the same send time.
+	mark := self.packets.Back()
+	for mark != nil && mark.Value.(*nosiy_chan_item).send_time.After(send_time) {
+		mark = mark.Prev()
+	}
+
+	//50% change of disorder
+	if self.profile.Disorder && mark != nil && self.rand.Int31n(100) < 50 {
+		item.send_time = mark.Value.(*nosiy_chan_item).send_time
+		self.packets.InsertBefore(item, mark)
+	} else if mark != nil {
+		self.packets.InsertAfter(item, mark)
 	} else {
-		self.packets.PushBack(item)
+		self.packets.PushFront(item)
 	}
+
 	self.packets_mutex.Unlock()
 
-	self.send_cond.Signal()
+	self.notify()
+}
+
+func (self *noisy_chan) notify() {
+	select {
+	case self.wake <- true:
+	default:
+	}
 }
 
-func (self *noisy_chan) send_packet(p *network_packet) {
+func (self *noisy_chan) send_packet(p *network_packet) bool {
 	self.tx_count++
 
-	self.out <- p
+	select {
+	case self.out <- p:
+		return true
+	case <-self.done:
+		return false
+	}
+}
+
+func (self *noisy_chan) queued() int {
+	self.packets_mutex.Lock()
+	defer self.packets_mutex.Unlock()
+
+	return self.packets.Len()
+}
+
+//ChannelLink impair the packets between two hosts of a virtual network by a ChannelProfile,
+//as the channels of a Transport do, e.g. the links of a vnet.Switch.
+type ChannelLink struct {
+	nc      *noisy_chan
+	in      chan *network_packet
+	deliver func(src, dst string, data []byte)
+}
+
+//the packets got through are passed to deliver.
+func NewChannelLink(profile ChannelProfile, deliver func(src, dst string, data []byte)) *ChannelLink {
+	return new_channel_link(profile, nil, deliver)
+}
+
+//the link is timed by clock, nil for the real clock, as the transports on the same network.
+func new_channel_link(profile ChannelProfile, clock clock, deliver func(src, dst string, data []byte)) *ChannelLink {
+
+	l := &ChannelLink{
+		in:      make(chan *network_packet, network_packet_chan_default_buffer_size),
+		deliver: deliver,
+	}
+
+	l.nc = &noisy_chan{in: l.in, profile: profile, clock: clock}
+	l.nc.open()
+
+	go l.run()
+
+	return l
+}
+
+//the addresses of the packet are kept in addr, "src dst".
+func (self *ChannelLink) Send(src, dst string, data []byte) {
+	select {
+	case self.in <- &network_packet{data: data, addr: src + " " + dst}:
+	case <-self.nc.done:
+	}
+}
+
+func (self *ChannelLink) run() {
+	for {
+		select {
+		case p := <-self.nc.out:
+			src, dst, _ := strings.Cut(p.addr, " ")
+			self.deliver(src, dst, p.data)
+		case <-self.nc.done:
+			return
+		}
+	}
+}
+
+//queued packets are dropped.
+func (self *ChannelLink) Close() {
+	self.nc.close()
 }
@@ -1,7 +1,10 @@
 package rtmfp
 
 import (
+	"encoding/binary"
 	"fmt"
+	"rtmfp/vnet"
+	"sync"
 	"testing"
 	"time"
 )
@@ -9,19 +12,26 @@ import (
 func test_noisy_chan(send_packet_count, lose_rate int, delay time.Duration, capacity int) (int, time.Duration) {
 	in := make(chan *network_packet, network_packet_chan_default_buffer_size)
 
+	clock := new_sim_clock(time.Unix(1000000000, 0))
+	defer clock.stop()
+
 	nc := &noisy_chan{
-		in:              in,
-		lose_rate:       lose_rate,
-		delay:           delay,
-		capacity:        capacity,
-		disorder:        true,
-		max_packet_size: 1500,
+		in:    in,
+		clock: clock,
+		profile: ChannelProfile{
+			LoseRate:      lose_rate,
+			Delay:         delay,
+			Capacity:      capacity,
+			Disorder:      true,
+			MaxPacketSize: 1500,
+			Seed:          1,
+		},
 	}
 	nc.open()
 
 	out := nc.out
 
-	start_time := time.Now()
+	start_time := clock.Now()
 
 	go func() {
 		for i := 0; i < send_packet_count; i++ {
@@ -37,12 +47,12 @@ func test_noisy_chan(send_packet_count, lose_rate int, delay time.Duration, capa
 			<-out
 			recv_packet_cout++
 			if send_packet_count == recv_packet_cout {
-				total_delay = time.Since(start_time)
+				total_delay = clock.Since(start_time)
 			}
 		}
 	}()
 
-	time.Sleep(100 * time.Millisecond)
+	clock.Sleep(100 * time.Millisecond)
 
 	actual_lose_rate := (send_packet_count - recv_packet_cout) * 100 / send_packet_count
 
@@ -68,3 +78,291 @@ func TestNoisyChan(t *testing.T) {
 		t.Fatal("delay not correct.")
 	}
 }
+
+type noisy_chan_arrival struct {
+	seq  int
+	data []byte
+	at   time.Duration //since sent
+}
+
+//send count packets of size bytes one per interval through a channel with the profile on a sim_clock,
+//return the packets arrived in wait after the last one sent. arrival time is since the packet sent.
+func run_noisy_chan(profile ChannelProfile, count, size int, interval, wait time.Duration) []noisy_chan_arrival {
+
+	clock := new_sim_clock(time.Unix(1000000000, 0))
+	defer clock.stop()
+
+	nc := &noisy_chan{
+		in:      make(chan *network_packet, network_packet_chan_default_buffer_size),
+		clock:   clock,
+		profile: profile,
+	}
+	nc.open()
+
+	start := clock.Now()
+
+	var mutex sync.Mutex
+	var arrivals []noisy_chan_arrival
+
+	go func() {
+		for p := range nc.out {
+			seq := int(binary.BigEndian.Uint32(p.data))
+			at := clock.Since(start) - time.Duration(seq)*interval
+			mutex.Lock()
+			arrivals = append(arrivals, noisy_chan_arrival{seq, p.data, at})
+			mutex.Unlock()
+		}
+	}()
+
+	for i := 0; i < count; i++ {
+		data := make([]byte, size)
+		binary.BigEndian.PutUint32(data, uint32(i))
+		nc.in <- &network_packet{data: data}
+		if interval > 0 {
+			clock.Sleep(interval)
+		}
+	}
+
+	clock.Sleep(wait)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	return arrivals
+}
+
+func count_reordered(arrivals []noisy_chan_arrival) int {
+	n := 0
+	for i := 1; i < len(arrivals); i++ {
+		if arrivals[i].seq < arrivals[i-1].seq {
+			n++
+		}
+	}
+	return n
+}
+
+func mean_delay(arrivals []noisy_chan_arrival) time.Duration {
+	var total time.Duration
+	for _, a := range arrivals {
+		total += a.at
+	}
+	return total / time.Duration(len(arrivals))
+}
+
+func TestNoisyChanJitter(t *testing.T) {
+
+	profile := ChannelProfile{Delay: 50 * time.Millisecond, Jitter: 10 * time.Millisecond, JitterDistribution: JitterNormal, Seed: 1}
+
+	arrivals := run_noisy_chan(profile, 1000, 100, 0, time.Second)
+	if len(arrivals) != 1000 {
+		t.Fatal("packets lost.", len(arrivals))
+	}
+
+	if mean := mean_delay(arrivals); mean < 48*time.Millisecond || mean > 52*time.Millisecond {
+		t.Fatal("mean delay not correct.", mean)
+	}
+
+	if count_reordered(arrivals) == 0 {
+		t.Fatal("jitter should reorder packets.")
+	}
+
+	profile.KeepOrder = true
+	if n := count_reordered(run_noisy_chan(profile, 1000, 100, 0, time.Second)); n != 0 {
+		t.Fatal("packets reordered.", n)
+	}
+
+	//mean of Pareto II with shape 3 is scale/2, with a long tail.
+	profile = ChannelProfile{Delay: 50 * time.Millisecond, Jitter: 20 * time.Millisecond, JitterDistribution: JitterPareto, Seed: 1}
+
+	arrivals = run_noisy_chan(profile, 1000, 100, 0, 10*time.Second)
+	if mean := mean_delay(arrivals); mean < 55*time.Millisecond || mean > 65*time.Millisecond {
+		t.Fatal("mean delay not correct.", mean)
+	}
+
+	var max_delay time.Duration
+	for _, a := range arrivals {
+		if a.at < profile.Delay {
+			t.Fatal("delay less than base delay.", a.at)
+		}
+		if a.at > max_delay {
+			max_delay = a.at
+		}
+	}
+
+	if max_delay < profile.Delay+3*profile.Jitter {
+		t.Fatal("pareto jitter should have a long tail.", max_delay)
+	}
+}
+
+func TestNoisyChanBurstLoss(t *testing.T) {
+
+	ge := &GilbertElliott{P: 0.01, R: 0.2, LossGood: 0, LossBad: 1}
+	arrivals := run_noisy_chan(ChannelProfile{BurstLoss: ge, Seed: 1}, 10000, 100, 0, time.Second)
+
+	//stationary loss rate P/(P+R), mean burst 1/R
+	lost, bursts := 10000-len(arrivals), 0
+	next := 0
+	for _, a := range arrivals {
+		if a.seq != next {
+			bursts++
+		}
+		next = a.seq + 1
+	}
+
+	if lost < 350 || lost > 600 {
+		t.Fatal("loss rate not correct.", lost)
+	}
+
+	if mean_burst := float64(lost) / float64(bursts); mean_burst < 3.5 || mean_burst > 6.5 {
+		t.Fatal("mean burst length not correct.", mean_burst)
+	}
+}
+
+func TestNoisyChanDuplicateCorrupt(t *testing.T) {
+
+	arrivals := run_noisy_chan(ChannelProfile{DuplicateRate: 20, Seed: 1}, 1000, 100, 0, time.Second)
+	if n := len(arrivals); n < 1150 || n > 1250 {
+		t.Fatal("duplicate rate not correct.", n)
+	}
+
+	arrivals = run_noisy_chan(ChannelProfile{CorruptRate: 100, Seed: 1}, 100, 100, 0, time.Second)
+	if len(arrivals) != 100 {
+		t.Fatal("packets lost.", len(arrivals))
+	}
+
+	corrupted := 0
+	for _, a := range arrivals {
+		original := make([]byte, len(a.data))
+		binary.BigEndian.PutUint32(original, uint32(a.seq))
+
+		bits := 0
+		for i := range original {
+			for x := original[i] ^ a.data[i]; x != 0; x &= x - 1 {
+				bits++
+			}
+		}
+
+		//a flipped bit in the sequence number make the packet look like another one.
+		if bits > 1 {
+			t.Fatal("more than one bit flipped.", bits)
+		}
+		corrupted += bits
+	}
+
+	if corrupted < 90 {
+		t.Fatal("packets not corrupted.", corrupted)
+	}
+}
+
+func TestNoisyChanRateTrace(t *testing.T) {
+
+	//10 packets pass with the initial bucket, 10 in the first second, the rest at 100k bytes/s.
+	profile := ChannelProfile{Speed: 10 * 1000, RateTrace: []RatePoint{{At: time.Second, Speed: 100 * 1000}}}
+
+	arrivals := run_noisy_chan(profile, 40, 1000, 0, 10*time.Second)
+	if len(arrivals) != 40 {
+		t.Fatal("packets lost.", len(arrivals))
+	}
+
+	if last := arrivals[39].at; last < 1100*time.Millisecond || last > 1300*time.Millisecond {
+		t.Fatal("rate trace not applied.", last)
+	}
+
+	profile.RateTrace = nil
+
+	arrivals = run_noisy_chan(profile, 40, 1000, 0, 10*time.Second)
+	if last := arrivals[39].at; last < 2900*time.Millisecond || last > 3100*time.Millisecond {
+		t.Fatal("speed not limited.", last)
+	}
+}
+
+//packets from a to b received in wait.
+func vnet_recv_count(sw *vnet.Switch, a, b string, count int, wait time.Duration) int {
+
+	ca, _ := sw.Listen(a)
+	defer ca.Close()
+	cb, _ := sw.Listen(b)
+	defer cb.Close()
+
+	for i := 0; i < count; i++ {
+		ca.WriteTo([]byte("hello"), cb.LocalAddr())
+	}
+
+	n := 0
+	buf := make([]byte, 100)
+	for {
+		cb.SetReadDeadline(time.Now().Add(wait))
+		if _, _, err := cb.ReadFrom(buf); err != nil {
+			return n
+		}
+		n++
+	}
+}
+
+func TestChannelLink(t *testing.T) {
+
+	sw := vnet.NewSwitch()
+	defer sw.Close()
+
+	//a lossy link to 10.0.0.3, the others are delayed.
+	sw.SetLinkFunc(func(src_ip, dst_ip string, deliver func(src, dst string, data []byte)) vnet.Link {
+		if dst_ip == "10.0.0.3" {
+			return NewChannelLink(ChannelProfile{LoseRate: 30, Seed: 1}, deliver)
+		}
+		return NewChannelLink(ChannelProfile{Delay: 50 * time.Millisecond}, deliver)
+	})
+
+	start := time.Now()
+	if n := vnet_recv_count(sw, "10.0.0.1:1935", "10.0.0.2:1935", 1, 100*time.Millisecond); n != 1 {
+		t.Fatal("packet lost.", n)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatal("packet not delayed.", elapsed)
+	}
+
+	n := vnet_recv_count(sw, "10.0.0.1:1935", "10.0.0.3:1935", 1000, 20*time.Millisecond)
+	if n < 650 || n > 750 {
+		t.Fatal("loss rate not correct.", n)
+	}
+
+	//a new link with the same seed drop the same packets.
+	sw.SetLinkFunc(func(src_ip, dst_ip string, deliver func(src, dst string, data []byte)) vnet.Link {
+		return NewChannelLink(ChannelProfile{LoseRate: 30, Seed: 1}, deliver)
+	})
+
+	if vnet_recv_count(sw, "10.0.0.1:1935", "10.0.0.3:1935", 1000, 20*time.Millisecond) != n {
+		t.Fatal("same seed should drop the same packets.")
+	}
+}
+
+func TestChannelLinkClock(t *testing.T) {
+
+	clock := new_sim_clock(time.Unix(1000000000, 0))
+	defer clock.stop()
+
+	sw := vnet.NewSwitch()
+	defer sw.Close()
+
+	//delayed in virtual time only.
+	sw.SetLinkFunc(func(src_ip, dst_ip string, deliver func(src, dst string, data []byte)) vnet.Link {
+		return new_channel_link(ChannelProfile{Delay: time.Minute}, clock, deliver)
+	})
+
+	ca, _ := sw.Listen("10.0.0.1:1935")
+	defer ca.Close()
+	cb, _ := sw.Listen("10.0.0.2:1935")
+	defer cb.Close()
+
+	start, real_start := clock.Now(), time.Now()
+	ca.WriteTo([]byte("hello"), cb.LocalAddr())
+	cb.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, _, err := cb.ReadFrom(make([]byte, 100)); err != nil {
+		t.Fatal("packet lost.", err)
+	}
+	if elapsed := clock.Since(start); elapsed < time.Minute {
+		t.Fatal("packet not delayed.", elapsed)
+	}
+	if elapsed := time.Since(real_start); elapsed > 2*time.Second {
+		t.Fatal("delayed in real time.", elapsed)
+	}
+}
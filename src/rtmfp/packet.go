@@ -2,18 +2,15 @@ package rtmfp
 
 import (
 	"bytes"
-	"crypto/aes"
-	"crypto/cipher"
 	"encoding/binary"
 	"fmt"
-	"io"
+	"hash/fnv"
 )
 
-var default_crypto_key = []byte("Adobe Systems 02")
-
 type packet_handler interface {
+	//called once the packet is authenticated, before its chunks. false drop the packet.
 	recv_packet_info(srcAddr *string, sid uint32, timeCritical, timeCriticalReverse bool,
-		mode uint8, timestamp, timestampEcho uint16)
+		mode uint8, timestamp, timestampEcho uint16) bool
 }
 
 func calc_check_sum(buf []byte) uint16 {
@@ -42,10 +39,16 @@ type packet_context struct {
 	last_flowid, last_seqnum, last_fsnOffset uint
 }
 
-func decode_packet(src_addr *string, buf, crypt_key []byte, packet_handler packet_handler, chunk_handler chunk_handler) {
+//return the number of chunks decoded, ok is false if the packet can't be authenticated or
+//is dropped by the packet handler.
+func decode_packet(src_addr *string, buf, crypt_key []byte, profile CryptoProfile, packet_handler packet_handler, chunk_handler chunk_handler) (chunks int, ok bool) {
 
 	cxt := &packet_context{}
 
+	if len(buf) < 12 {
+		return 0, false
+	}
+
 	r := bytes.NewBuffer(buf)
 
 	var scrambleSessionId uint32
@@ -61,47 +64,28 @@ func decode_packet(src_addr *string, buf, crypt_key []byte, packet_handler packe
 
 	//fmt.Printf("SessionID: %d\n", sessionId)
 
-	aes_key := crypt_key
-	if aes_key == nil || sessionId == 0 {
-		aes_key = default_crypto_key
+	if sessionId == 0 {
+		crypt_key = nil //default key
 	}
 
-	if len(aes_key) != 16 {
-		panic("invalid aes key")
-	}
-
-	c, err := aes.NewCipher([]byte(aes_key))
-	if err != nil {
-		fmt.Println(err)
-		return
+	if profile == nil {
+		profile = default_crypto_profile
 	}
-	iv := make([]byte, 16)
-	decrypt := cipher.NewCBCDecrypter(c, iv)
-
-	packet := buf[4:]
 
 	//fmt.Println("encrypted packet:")
-	//fmt.Println(packet)
+	//fmt.Println(buf[4:])
 
-	decrypt.CryptBlocks(packet, packet)
+	packet, err := profile.DecryptPacket(crypt_key, buf[4:])
+	if err != nil {
+		//fmt.Println(err)
+		return 0, false
+	}
 
 	//fmt.Println("decrypted packet:")
 	//fmt.Println(packet)
 
 	r = bytes.NewBuffer(packet)
 
-	var check_sum uint16
-	binary.Read(r, binary.BigEndian, &check_sum)
-	//fmt.Printf("0x%x\n", check_sum)
-
-	calc_check_sum := calc_check_sum(r.Bytes())
-
-	if check_sum != calc_check_sum {
-		fmt.Println("###########check sum don't match!##########")
-		//panic("check sum don't match!")
-		return
-	}
-
 	var flags uint8
 	binary.Read(r, binary.BigEndian, &flags)
 	//fmt.Printf("Flag:%d\n", flags)
@@ -128,8 +112,10 @@ func decode_packet(src_addr *string, buf, crypt_key []byte, packet_handler packe
 	}
 
 	if packet_handler != nil {
-		packet_handler.recv_packet_info(src_addr,
-			sessionId, time_critical, time_critical_reverse, mode, time_stamp, time_stamp_echo)
+		if !packet_handler.recv_packet_info(src_addr,
+			sessionId, time_critical, time_critical_reverse, mode, time_stamp, time_stamp_echo) {
+			return 0, false
+		}
 	}
 
 	for r.Len() > 2 {
@@ -146,28 +132,12 @@ func decode_packet(src_addr *string, buf, crypt_key []byte, packet_handler packe
 
 		//fmt.Printf("chunk(type:0x%x length:%d)\n", chunk_type, chunk_length)
 		decode_chunk(src_addr, chunk_type, r.Bytes()[:chunk_length], cxt, chunk_handler)
+		chunks++
 
 		r.Next(int(chunk_length))
 	}
 
-}
-
-type overwrite_buffer struct {
-	buf []byte
-}
-
-func (self *overwrite_buffer) Write(p []byte) (n int, err error) {
-
-	copy(self.buf, p)
-
-	return len(p), nil
-}
-
-func new_overwrite_buffer(buf []byte) io.Writer {
-
-	return &overwrite_buffer{
-		buf: buf,
-	}
+	return chunks, true
 }
 
 type packet struct {
@@ -180,10 +150,6 @@ type packet struct {
 func (self *packet) init() {
 	self.buf = bytes.NewBuffer(nil)
 
-	binary.Write(self.buf, binary.BigEndian, uint32(0)) //session id
-
-	binary.Write(self.buf, binary.BigEndian, uint16(0)) //checksum
-
 	flags := uint8(0)
 
 	if self.time_critical {
@@ -221,46 +187,70 @@ func (self *packet) add_chunk(chunk_type uint8, data []byte) {
 	self.buf.Write(data)
 }
 
-func (self *packet) pack(session_id uint32, crypt_key []byte) []byte {
-
-	encrypted_len := (self.buf.Len() - 4) //exclude session id
-	padding_len := ((encrypted_len-1)/16+1)*16 - encrypted_len
+//nil crypt_key means the default key.
+func (self *packet) pack(session_id uint32, crypt_key []byte, profile CryptoProfile) []byte {
 
-	for i := 0; i < padding_len; i++ {
-		binary.Write(self.buf, binary.BigEndian, uint8(0xff))
+	if session_id == 0 {
+		crypt_key = nil
 	}
 
-	raw_data := self.buf.Bytes()
-
-	check_sum := calc_check_sum(raw_data[6:])
-
-	binary.Write(new_overwrite_buffer(raw_data[4:]), binary.BigEndian, check_sum)
-
-	packet := raw_data[4:]
-
-	aes_key := crypt_key
-	if aes_key == nil || session_id == 0 {
-		aes_key = default_crypto_key
+	if profile == nil {
+		profile = default_crypto_profile
 	}
 
-	c, err := aes.NewCipher(aes_key)
+	encrypted, err := profile.EncryptPacket(crypt_key, self.buf.Bytes())
 	if err != nil {
 		fmt.Println(err)
 		return nil
 	}
 
-	iv := make([]byte, 16)
-	decrypt := cipher.NewCBCEncrypter(c, iv)
-	decrypt.CryptBlocks(packet, packet)
+	raw_data := make([]byte, 4+len(encrypted))
+	copy(raw_data[4:], encrypted)
 
-	var first32 [2]uint32
-	read_buf := bytes.NewBuffer(raw_data[4:])
-	binary.Read(read_buf, binary.BigEndian, &first32[0])
-	binary.Read(read_buf, binary.BigEndian, &first32[1])
+	first32 := [2]uint32{
+		binary.BigEndian.Uint32(raw_data[4:]),
+		binary.BigEndian.Uint32(raw_data[8:]),
+	}
 
 	scrambled_session_id := session_id ^ first32[0] ^ first32[1]
 
-	binary.Write(new_overwrite_buffer(raw_data), binary.BigEndian, scrambled_session_id)
+	binary.BigEndian.PutUint32(raw_data, scrambled_session_id)
 
 	return raw_data
 }
+
+//digests of the last packets received, the oldest is forgotten first.
+type packet_history struct {
+	seen map[uint64]bool
+	ring []uint64
+	next int
+}
+
+func new_packet_history(size int) *packet_history {
+	return &packet_history{seen: make(map[uint64]bool), ring: make([]uint64, 0, size)}
+}
+
+func packet_digest(data []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(data)
+	return h.Sum64()
+}
+
+//false if the packet of the digest is received before.
+func (self *packet_history) add(digest uint64) bool {
+
+	if self.seen[digest] {
+		return false
+	}
+
+	if len(self.ring) < cap(self.ring) {
+		self.ring = append(self.ring, digest)
+	} else if len(self.ring) > 0 {
+		delete(self.seen, self.ring[self.next])
+		self.ring[self.next] = digest
+		self.next = (self.next + 1) % len(self.ring)
+	}
+	self.seen[digest] = true
+
+	return true
+}
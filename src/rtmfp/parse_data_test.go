@@ -35,7 +35,7 @@ func my_decode_packet(file_name string, crypt_key []byte, handler chunk_handler)
 	//fmt.Printf("read %d bytes\n", read_bytes)
 
 	buf = buf[0:read_bytes]
-	decode_packet(nil, buf, crypt_key, nil, handler)
+	decode_packet(nil, buf, crypt_key, nil, nil, handler)
 }
 
 func responderComputeKeys(other_dh_pub_num, initNonce []byte) (dkey, ekey []byte) {
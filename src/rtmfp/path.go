@@ -0,0 +1,273 @@
+package rtmfp
+
+import (
+	"bytes"
+	"sort"
+	"time"
+)
+
+//the far end may be reachable at several addresses, e.g. its LAN and public address,
+//or its IPv4 and IPv6 address. a session keep all addresses it learned as paths,
+//validate each by a ping challenge and measure its RTT, and fail over to another
+//validated path when the one in use stop delivering acks.
+
+var path_probe_interval = 5 * time.Second //standby paths are pinged at most once in the interval
+var path_failover_timeouts = 3            //consecutive retransmit timeouts without ack before fail over
+var max_session_paths = 8
+
+type session_path struct {
+	addr      string
+	validated bool          //echoed a ping challenge
+	failed    bool          //stop delivering acks while in use, until it echo a ping again
+	srtt      time.Duration //smooth rtt of pings
+	challenge []byte        //outstanding ping
+	ping_ts   time.Time     //outstanding ping sent
+}
+
+//PathInfo is the state of one address of the far end.
+type PathInfo struct {
+	Addr      string
+	Active    bool          //packets of the session are sent to it
+	Validated bool          //echoed a ping challenge
+	Failed    bool          //stop delivering acks while active
+	RTT       time.Duration //smoothed ping round trip, 0 before validated
+}
+
+//learn an address of the far end, return true if it is new. the address the session
+//open with is added as validated, the others should be probed.
+func (self *session) add_path(addr string, validated bool) bool {
+
+	self.paths_mutex.Lock()
+	defer self.paths_mutex.Unlock()
+
+	if self.paths == nil {
+		self.paths = make(map[string]*session_path)
+	}
+
+	path, ok := self.paths[addr]
+	if !ok {
+		if len(self.paths) >= max_session_paths {
+			return false
+		}
+		path = &session_path{addr: addr}
+		self.paths[addr] = path
+	}
+
+	path.validated = path.validated || validated
+
+	return !ok
+}
+
+//ping the address, a matching reply validate it and give a rtt sample.
+func (self *session) probe_path(addr string) []byte {
+
+	challenge := self.send_ping(addr)
+
+	self.paths_mutex.Lock()
+	if path, ok := self.paths[addr]; ok {
+		path.challenge = challenge
+		path.ping_ts = self.clock.Now()
+	}
+	self.paths_mutex.Unlock()
+
+	return challenge
+}
+
+//ping standby paths to keep their state fresh, at most once in path_probe_interval.
+func (self *session) probe_paths() {
+
+	self.paths_mutex.Lock()
+
+	if len(self.paths) < 2 || self.clock.Since(self.paths_probe_ts) < path_probe_interval {
+		self.paths_mutex.Unlock()
+		return
+	}
+	self.paths_probe_ts = self.clock.Now()
+
+	addrs := self.standby_paths()
+
+	self.paths_mutex.Unlock()
+
+	for _, addr := range addrs {
+		self.probe_path(addr)
+	}
+}
+
+//addresses of paths other than the one in use, sorted. paths_mutex should be held.
+func (self *session) standby_paths() []string {
+	addrs := make([]string, 0, len(self.paths))
+	for addr := range self.paths {
+		if addr != self.other_addr {
+			addrs = append(addrs, addr)
+		}
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+//ping reply from a path, return true if it echo the outstanding challenge.
+func (self *session) recv_path_reply(addr string, msgEcho []byte) bool {
+
+	self.paths_mutex.Lock()
+
+	path, ok := self.paths[addr]
+	if !ok || path.challenge == nil || !bytes.Equal(msgEcho, path.challenge) {
+		self.paths_mutex.Unlock()
+		return false
+	}
+
+	rtt := self.clock.Since(path.ping_ts)
+	if path.srtt == 0 {
+		path.srtt = rtt
+	} else {
+		path.srtt = (7*path.srtt + rtt) / 8
+	}
+
+	path.challenge = nil
+	path.validated = true
+	path.failed = false
+
+	//the path in use failed with no validated path to go, take the first one answer.
+	switch_to := self.failover_pending && addr != self.other_addr
+
+	self.paths_mutex.Unlock()
+
+	if switch_to {
+		self.switch_path(addr)
+	}
+
+	return true
+}
+
+//a retransmit timeout of a flow, fail over after path_failover_timeouts in a row.
+func (self *session) path_timeout() {
+
+	self.paths_mutex.Lock()
+
+	self.rtx_timeouts++
+	if self.rtx_timeouts < path_failover_timeouts || len(self.paths) < 2 {
+		self.paths_mutex.Unlock()
+		return
+	}
+
+	if current, ok := self.paths[self.other_addr]; ok {
+		current.failed = true
+	}
+
+	//the validated path with the least rtt.
+	var best *session_path
+	for _, addr := range self.standby_paths() {
+		path := self.paths[addr]
+		if path.validated && !path.failed && (best == nil || path.srtt < best.srtt) {
+			best = path
+		}
+	}
+
+	var addrs []string
+	if best == nil {
+		self.failover_pending = true
+		addrs = self.standby_paths()
+	}
+
+	self.paths_mutex.Unlock()
+
+	if best != nil {
+		//fmt.Printf("path %v failed, fail over to %v\n", self.other_addr, best.addr)
+		self.switch_path(best.addr)
+		return
+	}
+
+	//nowhere to go yet, probe them all.
+	for _, addr := range addrs {
+		self.probe_path(addr)
+	}
+}
+
+//an ack arrived, the path in use is working.
+func (self *session) path_acked() {
+
+	self.paths_mutex.Lock()
+
+	self.rtx_timeouts = 0
+	self.failover_pending = false
+
+	if current, ok := self.paths[self.other_addr]; ok {
+		current.failed = false
+	}
+
+	self.paths_mutex.Unlock()
+}
+
+//send to the path from now on, restart the retransmit timer from its rtt.
+func (self *session) switch_path(addr string) {
+
+	self.paths_mutex.Lock()
+
+	path, ok := self.paths[addr]
+	if !ok {
+		self.paths_mutex.Unlock()
+		return
+	}
+
+	self.rtx_timeouts = 0
+	self.failover_pending = false
+
+	if path.srtt > 0 {
+		self.tx_mutex.Lock()
+		self.srtt = path.srtt
+		self.rttvar = path.srtt / 2
+		self.mrto = self.srtt + 4*self.rttvar + 200*time.Millisecond
+		self.erto = max_duration(self.mrto, 250*time.Millisecond)
+		self.tx_mutex.Unlock()
+	}
+
+	self.paths_mutex.Unlock()
+
+	self.set_other_addr(addr)
+}
+
+func (self *session) path_infos() []PathInfo {
+
+	self.paths_mutex.Lock()
+	defer self.paths_mutex.Unlock()
+
+	infos := make([]PathInfo, 0, len(self.paths))
+	for _, path := range self.paths {
+		infos = append(infos, PathInfo{
+			Addr:      path.addr,
+			Active:    path.addr == self.other_addr,
+			Validated: path.validated,
+			Failed:    path.failed,
+			RTT:       path.srtt,
+		})
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Addr < infos[j].Addr })
+
+	return infos
+}
+
+func (self *session) has_path(addr string) bool {
+	self.paths_mutex.Lock()
+	defer self.paths_mutex.Unlock()
+
+	_, ok := self.paths[addr]
+	return ok
+}
+
+//where the far end can be reached, the address in use first, then the validated
+//paths, e.g. the other IP family of a dual stack peer.
+func (self *session) reachable_addrs() []string {
+
+	self.paths_mutex.Lock()
+	defer self.paths_mutex.Unlock()
+
+	addrs := []string{self.other_addr}
+	for _, addr := range self.standby_paths() {
+		if path := self.paths[addr]; path.validated && !path.failed {
+			addrs = append(addrs, addr)
+		}
+	}
+
+	return addrs
+}
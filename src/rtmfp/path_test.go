@@ -0,0 +1,184 @@
+package rtmfp
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//a dual stack link between an initiator at 10.0.0.1/[fd00::1] and a responder at
+//10.0.0.2/[fd00::2], each IP family is a path with its own delay and can be cut.
+type dual_stack_link struct {
+	clock clock
+	mutex sync.Mutex
+	down  map[bool]bool //by ipv6
+}
+
+var dual_stack_initiator = map[bool]string{false: "10.0.0.1:1935", true: "[fd00::1]:1935"}
+var dual_stack_responder = map[bool]string{false: "10.0.0.2:1935", true: "[fd00::2]:1935"}
+
+func (self *dual_stack_link) set_down(ipv6, down bool) {
+	self.mutex.Lock()
+	self.down[ipv6] = down
+	self.mutex.Unlock()
+}
+
+//forward packets sent to dst addresses in out to in, with the source address of the same family.
+func (self *dual_stack_link) relay(out, in chan *network_packet, src map[bool]string) {
+	for p := range out {
+
+		ipv6 := strings.HasPrefix(p.addr, "[")
+
+		self.mutex.Lock()
+		down := self.down[ipv6]
+		self.mutex.Unlock()
+
+		if down {
+			continue
+		}
+
+		delay := 10 * time.Millisecond
+		if ipv6 {
+			delay = 30 * time.Millisecond
+		}
+
+		p := &network_packet{addr: src[ipv6], data: p.data}
+		self.clock.AfterFunc(delay, func() { in <- p })
+	}
+}
+
+func create_dual_stack_sessions(c clock) (link *dual_stack_link, initiator, responder *session, err error) {
+
+	link = &dual_stack_link{clock: c, down: make(map[bool]bool)}
+
+	chan_a := make(chan *network_packet, network_packet_chan_default_buffer_size)
+	chan_b := make(chan *network_packet, network_packet_chan_default_buffer_size)
+
+	initiator = &session{
+		in:        make(chan *network_packet, network_packet_chan_default_buffer_size),
+		out:       chan_a,
+		sessionid: 1,
+		clock:     c,
+	}
+
+	responder = &session{
+		in:        make(chan *network_packet, network_packet_chan_default_buffer_size),
+		out:       chan_b,
+		sessionid: 2,
+		clock:     c,
+	}
+
+	go link.relay(chan_a, responder.in, dual_stack_initiator)
+	go link.relay(chan_b, initiator.in, dual_stack_responder)
+
+	responder.passive_open()
+	err = initiator.active_open(dual_stack_responder[false], nil, nil)
+
+	return
+}
+
+//send a message on the flow and wait the responder get it.
+func send_and_wait(c clock, flow *send_flow, msgs chan []byte, msg string) bool {
+	flow.send([]byte(msg))
+
+	select {
+	case data := <-msgs:
+		return bytes.Equal(data, []byte(msg))
+	case <-c.After(30 * time.Second):
+		return false
+	}
+}
+
+func TestPathFailover(t *testing.T) {
+
+	clock := new_sim_clock(time.Unix(1000000000, 0))
+	defer clock.stop()
+
+	link, initiator, responder, err := create_dual_stack_sessions(clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := make(chan []byte, 10)
+	responder.create_recv_flow = func(signature []byte, flowid uint) (*recv_flow, error) {
+		flow, err := responder.new_recv_flow(flowid)
+		if err == nil {
+			go func() {
+				for {
+					buf, err := flow.recv()
+					if err != nil {
+						return
+					}
+					msgs <- buf
+				}
+			}()
+		}
+		return flow, err
+	}
+
+	v4, v6 := dual_stack_responder[false], dual_stack_responder[true]
+
+	if !initiator.add_path(v6, false) {
+		t.Fatal("path not added.")
+	}
+	initiator.probe_path(v6)
+
+	clock.Sleep(time.Second)
+
+	paths := initiator.path_infos()
+	if len(paths) != 2 || paths[0].Addr != v4 || paths[1].Addr != v6 {
+		t.Fatal("unexpected paths.", paths)
+	}
+	if !paths[0].Active || !paths[0].Validated || paths[1].Active || !paths[1].Validated {
+		t.Fatal("paths should be validated.", paths)
+	}
+	if paths[1].RTT != 60*time.Millisecond {
+		t.Fatal("unexpected path rtt.", paths[1].RTT)
+	}
+
+	flow, _ := initiator.new_send_flow(0, nil)
+
+	if !send_and_wait(clock, flow, msgs, "v4") {
+		t.Fatal("not delivered on ipv4.")
+	}
+
+	//ipv4 break, the initiator should fail over to ipv6 and the responder follow it.
+	link.set_down(false, true)
+
+	if !send_and_wait(clock, flow, msgs, "v6") {
+		t.Fatal("not delivered after ipv4 break.")
+	}
+
+	if initiator.other_addr != v6 {
+		t.Fatal("not fail over.", initiator.other_addr)
+	}
+
+	paths = initiator.path_infos()
+	if !paths[0].Failed || paths[0].Active || !paths[1].Active {
+		t.Fatal("unexpected paths after fail over.", paths)
+	}
+
+	clock.Sleep(time.Second)
+
+	if responder.other_addr != dual_stack_initiator[true] {
+		t.Fatal("responder not follow.", responder.other_addr)
+	}
+
+	//ipv6 break too while ipv4 is back, no validated path to go, the first one
+	//answer the probes is taken.
+	link.set_down(false, false)
+	link.set_down(true, true)
+
+	if !send_and_wait(clock, flow, msgs, "v4 again") {
+		t.Fatal("not delivered after ipv6 break.")
+	}
+
+	if initiator.other_addr != v4 {
+		t.Fatal("not fail back.", initiator.other_addr)
+	}
+
+	initiator.close()
+	responder.close()
+}
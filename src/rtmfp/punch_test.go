@@ -0,0 +1,144 @@
+package rtmfp
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+//the NAT types of the hole punching cases, {mapping, filtering}.
+var nat_full_cone = []int{nat_endpoint_independent, nat_endpoint_independent}
+var nat_restricted = []int{nat_endpoint_independent, nat_address_dependent}
+var nat_port_restricted = []int{nat_endpoint_independent, nat_address_port_dependent}
+var nat_symmetric = []int{nat_address_port_dependent, nat_address_port_dependent}
+
+func test_punch(t *testing.T, initiator_nat, target_nat []int) error {
+
+	network := new_sim_network()
+
+	server := &handshake{rendezvous: true}
+	network.attach(server, "9.9.9.9:1935", nil)
+	server.create_passive_session = func(addr string, peerid []byte) (*session, error) {
+		s := server.new_session()
+		s.passive_open()
+		return s, nil
+	}
+	server.open()
+	defer server.close()
+
+	target := new_sim_handshake(network, "10.0.1.1:1935", new_nat(target_nat[0], target_nat[1], "1.1.1.1"))
+	defer target.close()
+
+	initiator := new_sim_handshake(network, "10.0.2.1:1935", new_nat(initiator_nat[0], initiator_nat[1], "2.2.2.2"))
+	defer initiator.close()
+
+	//register to the rendezvous service.
+	if _, err := target.create_session("9.9.9.9:1935", server.peerid()); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := initiator.create_session("9.9.9.9:1935", target.peerid())
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(s.far_peerid, target.peerid()) {
+		t.Fatal("not connected to the target.")
+	}
+
+	return nil
+}
+
+func TestHolePunching(t *testing.T) {
+
+	saved_retry, saved_timeout := ihello_retry, ihello_timeout
+	ihello_retry, ihello_timeout = 3, 50*time.Millisecond
+	defer func() {
+		ihello_retry, ihello_timeout = saved_retry, saved_timeout
+	}()
+
+	cases := []struct {
+		initiator, target []int
+		ok                bool
+	}{
+		{nat_full_cone, nat_full_cone, true},
+		{nat_restricted, nat_restricted, true},
+		{nat_restricted, nat_full_cone, true},
+		{nat_symmetric, nat_full_cone, true},
+		{nat_full_cone, nat_symmetric, true},
+		{nat_symmetric, nat_restricted, true},
+		{nat_port_restricted, nat_port_restricted, true},
+		{nat_symmetric, nat_port_restricted, false},
+		{nat_symmetric, nat_symmetric, false},
+	}
+
+	for _, c := range cases {
+		err := test_punch(t, c.initiator, c.target)
+		if (err == nil) != c.ok {
+			t.Fatal("unexpected result.", c.initiator, c.target, err)
+		}
+	}
+}
+
+func TestGlare(t *testing.T) {
+
+	saved_retry, saved_timeout := ihello_retry, ihello_timeout
+	ihello_retry, ihello_timeout = 3, 50*time.Millisecond
+	defer func() {
+		ihello_retry, ihello_timeout = saved_retry, saved_timeout
+	}()
+
+	network := new_sim_network()
+
+	//both iikeying are on the way when the other one arrives.
+	network.delay = 10 * time.Millisecond
+
+	a := new_sim_handshake(network, "10.0.0.1:1935", nil)
+	defer a.close()
+
+	b := new_sim_handshake(network, "10.0.0.2:1935", nil)
+	defer b.close()
+
+	type result struct {
+		s   *session
+		err error
+	}
+
+	a_result := make(chan result, 1)
+	b_result := make(chan result, 1)
+
+	go func() {
+		s, err := a.create_session("10.0.0.2:1935", b.peerid())
+		a_result <- result{s, err}
+	}()
+
+	go func() {
+		s, err := b.create_session("10.0.0.1:1935", a.peerid())
+		b_result <- result{s, err}
+	}()
+
+	ra, rb := <-a_result, <-b_result
+
+	if ra.err != nil || rb.err != nil {
+		t.Fatal("create session fail.", ra.err, rb.err)
+	}
+
+	//both ends use the session kept.
+	if ra.s.other_sessionid != rb.s.sessionid || rb.s.other_sessionid != ra.s.sessionid {
+		t.Fatal("not the same session.", ra.s.sessionid, ra.s.other_sessionid, rb.s.sessionid, rb.s.other_sessionid)
+	}
+
+	if !ra.s.handshaked() || !rb.s.handshaked() {
+		t.Fatal("session not established.")
+	}
+
+	//the session of the end yielding is forgotten.
+	for _, h := range []*handshake{a, b} {
+		h.mutex.Lock()
+		n := len(h.sessions)
+		h.mutex.Unlock()
+		if n != 1 {
+			t.Fatal("aborted session not removed.", n)
+		}
+	}
+}
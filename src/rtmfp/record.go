@@ -0,0 +1,367 @@
+//recording of published streams to FLV files, and the playback of them with the pacing
+//of their timestamps.
+
+package rtmfp
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"rtmfp/flv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//the directory of the recordings, "" if streams are not recorded.
+var media_dir = ""
+
+//the file of the recording of a stream name, in media_dir.
+func media_path(name string) (string, error) {
+
+	if media_dir == "" {
+		return "", errors.New("recording is disabled.")
+	}
+
+	//a file of media_dir, never of another directory, and names of different files differ.
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return "", errors.New("invalid stream name " + name + ".")
+	}
+
+	return filepath.Join(media_dir, name+".flv"), nil
+}
+
+//write the messages of a publisher to a file, the timestamps are from the first message.
+//the file is written aside and replace the recording of the name when closed, so the
+//playbacks of the previous recording are not disturbed.
+type recorder struct {
+	mutex   sync.Mutex //written by the publisher, closed when unpublished or recorded again.
+	path    string
+	file    *os.File //the temporary file written.
+	w       *flv.Writer
+	started bool
+	base    uint32
+	closed  bool
+}
+
+func new_recorder(name string) (*recorder, error) {
+
+	path, err := media_path(name)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return nil, err
+	}
+
+	return &recorder{path: path, file: file, w: flv.NewWriter(file, flv.HasAudio|flv.HasVideo)}, nil
+}
+
+//m is the message relayed, the data frame without @setDataFrame. dropped after closed.
+func (self *recorder) write(m *MediaMessage) error {
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.closed {
+		return nil
+	}
+
+	if !self.started {
+		self.started = true
+		self.base = m.Timestamp
+	}
+
+	ts := uint32(0)
+	if m.Timestamp > self.base {
+		ts = m.Timestamp - self.base
+	}
+
+	return self.w.WriteTag(&flv.Tag{Type: m.Type, Timestamp: ts, Data: m.Data})
+}
+
+//the recording replace the previous one of the name.
+func (self *recorder) close() {
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if !self.closed {
+		self.closed = true
+		self.file.Close()
+
+		if os.Rename(self.file.Name(), self.path) != nil {
+			os.Remove(self.file.Name())
+		}
+	}
+}
+
+//close without recording anything, the previous recording is kept.
+func (self *recorder) discard() {
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if !self.closed {
+		self.closed = true
+		self.file.Close()
+		os.Remove(self.file.Name())
+	}
+}
+
+//the tags at the start of a recording looked for the headers of a playback.
+const max_playback_headers = 16
+
+//play a recording to a net_stream, until it is closed.
+type playback struct {
+	name   string
+	ns     *net_stream
+	clock  clock
+	file   *os.File
+	reader *flv.Reader
+	index  []flv.IndexEntry
+	first  int64 //the offset of the first tag.
+
+	//the data frame and the codec configs, sent before the keyframe sought.
+	headers []*MediaMessage
+
+	//the pacing of the messages, the timestamp base_ts is sent at base_time.
+	base_ts   uint32
+	base_time time.Time
+
+	paused   bool
+	seek_to  chan uint32
+	pause_to chan bool
+	closed   chan bool
+}
+
+//the timeout of a message to send now.
+var ready_to_send = func() <-chan time.Time {
+	c := make(chan time.Time)
+	close(c)
+	return c
+}()
+
+func open_playback(name string, ns *net_stream) (*playback, error) {
+
+	path, err := media_path(name)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errors.New(name + " is not found.")
+		}
+		return nil, err
+	}
+
+	reader, err := flv.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	first := reader.Offset()
+	index, err := reader.Index()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	var headers []*MediaMessage
+	for i := 0; i < max_playback_headers; i++ {
+		tag, err := reader.ReadTag()
+		if err != nil {
+			break
+		}
+		if tag.Type == flv.TagData || is_video_config(tag.Data) || is_audio_config(tag.Data) {
+			headers = append(headers, &MediaMessage{tag.Type, tag.Timestamp, tag.Data})
+		}
+	}
+
+	clk := ns.session.clock
+	if clk == nil {
+		clk = default_clock
+	}
+
+	return &playback{
+		name:     name,
+		ns:       ns,
+		clock:    clk,
+		file:     file,
+		reader:   reader,
+		index:    index,
+		first:    first,
+		headers:  headers,
+		seek_to:  make(chan uint32, 1),
+		pause_to: make(chan bool, 1),
+		closed:   make(chan bool),
+	}, nil
+}
+
+//move to the keyframe before ms, the messages from it are sent from now on. the first
+//keyframes are played from the start of the recording, the others after the headers.
+func (self *playback) position(ms uint32) error {
+
+	i := -1
+	for j, e := range self.index {
+		if e.Timestamp > ms {
+			break
+		}
+		if i < 0 || e.Timestamp != self.index[i].Timestamp {
+			i = j
+		}
+	}
+
+	offset, ts := self.first, uint32(0)
+	if i > 0 {
+		offset, ts = self.index[i].Offset, self.index[i].Timestamp
+	}
+
+	if err := self.reader.SeekTag(offset); err != nil {
+		return err
+	}
+
+	if offset != self.first {
+		for _, m := range self.headers {
+			self.ns.send_media(m)
+		}
+	}
+
+	self.base_ts = ts
+	self.base_time = self.clock.Now()
+
+	return nil
+}
+
+func (self *playback) sought(ms uint32) {
+
+	if err := self.position(ms); err != nil {
+		self.ns.send("onStatus", &net_status{"error", "NetStream.Seek.Failed", err.Error()})
+		return
+	}
+
+	self.ns.send("onStatus", &net_status{"status", "NetStream.Seek.Notify", fmt.Sprintf("seeking %d.", ms)})
+}
+
+//send the messages from start milliseconds, at the time of their timestamps.
+//NetStream.Play.Stop is sent at the end, the recording may be sought after it.
+func (self *playback) run(start uint32) {
+
+	defer self.file.Close()
+
+	if err := self.position(start); err != nil {
+		self.ns.send("onStatus", &net_status{"error", "NetStream.Play.Failed", err.Error()})
+		return
+	}
+
+	for {
+		tag, err := self.reader.ReadTag()
+		if err != nil {
+			//the end, or the rest of the file can not be read.
+			self.ns.send("onStatus", &net_status{"status", "NetStream.Play.Stop", self.name + " is stopped."})
+
+			if !self.wait_seek() {
+				return
+			}
+			continue
+		}
+
+		send, open := self.wait_tag(tag)
+		if !open {
+			return
+		}
+		if !send {
+			//sought.
+			continue
+		}
+
+		if err := self.ns.send_media(&MediaMessage{tag.Type, tag.Timestamp, tag.Data}); err != nil {
+			//the stream is closed.
+			return
+		}
+	}
+}
+
+//wait for the time of tag, false to send it if the playback is sought.
+func (self *playback) wait_tag(tag *flv.Tag) (send bool, open bool) {
+	for {
+		timeout := ready_to_send
+		if self.paused {
+			timeout = nil
+		} else if delay := time.Duration(int64(tag.Timestamp)-int64(self.base_ts))*time.Millisecond - self.clock.Since(self.base_time); delay > 0 {
+			timeout = self.clock.After(delay)
+		}
+
+		select {
+		case <-timeout:
+			return true, true
+		case ms := <-self.seek_to:
+			self.sought(ms)
+			return false, true
+		case paused := <-self.pause_to:
+			if self.paused && !paused {
+				//resume from tag.
+				self.base_ts, self.base_time = tag.Timestamp, self.clock.Now()
+			}
+			self.paused = paused
+		case <-self.closed:
+			return false, false
+		}
+	}
+}
+
+//at the end, false if closed.
+func (self *playback) wait_seek() bool {
+	for {
+		select {
+		case ms := <-self.seek_to:
+			self.sought(ms)
+			return true
+		case paused := <-self.pause_to:
+			self.paused = paused
+		case <-self.closed:
+			return false
+		}
+	}
+}
+
+//the last seek replace the one not yet done.
+func (self *playback) seek(ms uint32) {
+	for {
+		select {
+		case self.seek_to <- ms:
+			return
+		default:
+			select {
+			case <-self.seek_to:
+			default:
+			}
+		}
+	}
+}
+
+//the last pause or resume replace the one not yet done.
+func (self *playback) pause(paused bool) {
+	for {
+		select {
+		case self.pause_to <- paused:
+			return
+		default:
+			select {
+			case <-self.pause_to:
+			default:
+			}
+		}
+	}
+}
+
+func (self *playback) close() {
+	close(self.closed)
+}
@@ -0,0 +1,242 @@
+package rtmfp
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"rtmfp/flv"
+	"rtmfp/remoting"
+	"testing"
+	"time"
+)
+
+func read_recording(path string) ([]*flv.Tag, error) {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	r, err := flv.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var tags []*flv.Tag
+	for {
+		tag, err := r.ReadTag()
+		if err != nil {
+			return tags, nil
+		}
+		tags = append(tags, tag)
+	}
+}
+
+func TestRecord(t *testing.T) {
+
+	if _, err := media_path("cam"); err == nil {
+		t.Fatal("recorded without media_dir.")
+	}
+
+	dir := t.TempDir()
+
+	server := &Transport{}
+	server.SetConnectHandler(func(*NetConnection, *ConnectInfo) error { return nil })
+	server.SetMediaDir(dir)
+	defer server.SetMediaDir("")
+	server.Open("127.0.0.1:0", []byte("server"))
+	defer server.Close()
+
+	if path, err := media_path("cam"); err != nil || path != filepath.Join(dir, "cam.flv") {
+		t.Fatal("unexpected path.", path, err)
+	}
+	for _, name := range []string{"", "..", "../cam", "a/cam", `a\cam`} {
+		if _, err := media_path(name); err == nil {
+			t.Fatal("accepted stream name", name)
+		}
+	}
+
+	publisher := connect_test_client(t, server, "publisher")
+	defer publisher.Close()
+	client := connect_test_client(t, server, "player")
+	defer client.Close()
+
+	//not recorded.
+	s, _ := client.CreateNetStream()
+	if err := s.PlayRecorded("cam", 0); err == nil || err.(*remoting.Fault).Code != "NetStream.Play.StreamNotFound" {
+		t.Fatal("played without recording.", err)
+	}
+
+	//a previous recording, kept until the new one is closed.
+	if err := ioutil.WriteFile(filepath.Join(dir, "cam.flv"), []byte("previous"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	pub, _ := publisher.CreateNetStream()
+	if err := pub.Record("cam"); err != nil {
+		t.Fatal(err)
+	}
+	server.publications.mutex.Lock()
+	recording := server.publications.streams["cam"].recorder.file.Name()
+	server.publications.mutex.Unlock()
+
+	metadata := []byte{0x02, 0x00, 0x0a, 'o', 'n', 'M', 'e', 't', 'a', 'D', 'a', 't', 'a', 0x05}
+	messages := []*MediaMessage{
+		{MediaData, 1000, append(append([]byte{}, set_data_frame...), metadata...)},
+		{MediaVideo, 1000, []byte{0x17, 0x00, 0x01}},
+		{MediaVideo, 1000, []byte{0x17, 0x01, 0x02}},
+		{MediaAudio, 1050, []byte{0xaf, 0x01, 0x03}},
+		{MediaVideo, 1100, []byte{0x27, 0x01, 0x04}},
+		{MediaVideo, 1200, []byte{0x17, 0x01, 0x05}},
+		{MediaVideo, 1300, []byte{0x27, 0x01, 0x06}},
+	}
+	for _, m := range messages {
+		pub.Send(m)
+	}
+
+	//the timestamps from the first message, the data frame without @setDataFrame.
+	recorded := []*MediaMessage{{MediaData, 0, metadata}}
+	for _, m := range messages[1:] {
+		recorded = append(recorded, &MediaMessage{m.Type, m.Timestamp - 1000, m.Data})
+	}
+
+	var tags []*flv.Tag
+	for deadline := time.Now().Add(time.Second); len(tags) < len(recorded) && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		tags, _ = read_recording(recording)
+	}
+	if len(tags) != len(recorded) {
+		t.Fatal("not recorded.", len(tags))
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, "cam.flv")); string(data) != "previous" {
+		t.Fatal("previous recording replaced while recording.")
+	}
+	for i, tag := range tags {
+		if m := recorded[i]; tag.Type != m.Type || tag.Timestamp != m.Timestamp || !reflect.DeepEqual(tag.Data, m.Data) {
+			t.Fatalf("unexpected tag %d.\n%#v\n%#v", i, tag, m)
+		}
+	}
+
+	//the publisher is notified when the file can not be written, and published live.
+	server.publications.mutex.Lock()
+	server.publications.streams["cam"].recorder.file.Close()
+	server.publications.mutex.Unlock()
+	pub.Send(messages[len(messages)-1])
+	if err := pub.wait_status("NetStream.Record.Failed"); err != nil {
+		t.Fatal(err)
+	}
+
+	pub.Close()
+
+	//played with the pacing of the timestamps.
+	start := time.Now()
+	if err := s.PlayRecorded("cam", 0); err != nil {
+		t.Fatal(err)
+	}
+	recv_media(t, s, recorded...)
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+		t.Fatal("played too fast.", elapsed)
+	}
+	if err := s.wait_status("NetStream.Play.Stop"); err != nil {
+		t.Fatal(err)
+	}
+
+	//from the keyframe before, after the data frame and the codec config.
+	if err := s.Seek(250 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	recv_media(t, s, append(recorded[:2:2], recorded[5:]...)...)
+	if err := s.wait_status("NetStream.Play.Stop"); err != nil {
+		t.Fatal(err)
+	}
+
+	//resumed where it is paused.
+	if err := s.PlayRecorded("cam", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Pause(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(400 * time.Millisecond)
+	if len(s.media) == len(recorded) {
+		t.Fatal("played while paused.")
+	}
+	if err := s.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	recv_media(t, s, recorded...)
+	if err := s.wait_status("NetStream.Play.Stop"); err != nil {
+		t.Fatal(err)
+	}
+
+	//the recording is played when not published.
+	rec, _ := client.CreateNetStream()
+	if err := rec.Play("cam"); err != nil {
+		t.Fatal(err)
+	}
+	recv_media(t, rec, recorded[0])
+
+	//live streams are not sought.
+	live, _ := client.CreateNetStream()
+	if err := live.Play("other"); err != nil {
+		t.Fatal(err)
+	}
+	if err := live.Seek(0); err == nil || err.(*remoting.Fault).Code != "NetStream.Seek.Failed" {
+		t.Fatal("live stream sought.", err)
+	}
+}
+
+func TestPlaybackFailed(t *testing.T) {
+
+	media_dir = t.TempDir()
+	defer func() { media_dir = "" }()
+
+	r, err := new_recorder("cam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.write(&MediaMessage{MediaVideo, 0, []byte{0x17, 0x01, 0x01}})
+	r.close()
+
+	initiator, responder := create_netstream_sessions()
+	defer initiator.close()
+	defer responder.close()
+
+	status := make(chan string, 1)
+	initiator.create_recv_flow = func(options []byte, flowid uint) (*recv_flow, error) {
+		flow, err := initiator.new_recv_flow(flowid)
+		go func() {
+			if buf, err := flow.recv(); err == nil {
+				if c, err := decode_command(buf); err == nil && c.name == "onStatus" {
+					code, _ := command_arg(c.args, 0).(map[string]interface{})["code"].(string)
+					status <- code
+				}
+			}
+		}()
+		return flow, err
+	}
+
+	ns := &net_stream{session: responder}
+	ns.sendFlow, _ = responder.new_send_flow(0, nil)
+
+	pb, err := open_playback("cam", ns)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//the recording can not be read.
+	pb.file.Close()
+	go pb.run(0)
+	defer pb.close()
+
+	select {
+	case code := <-status:
+		if code != "NetStream.Play.Failed" {
+			t.Fatal("unexpected status.", code)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout")
+	}
+}
@@ -0,0 +1,184 @@
+package remoting
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"rtmfp/amf"
+)
+
+//the body of a request, or of a response to the body with Response as its Target.
+type Body struct {
+	Target   string //the call, e.g. "echo.hello", or "/1/onResult" in a response.
+	Response string //the target of the response, e.g. "/1".
+	Value    interface{}
+}
+
+type Header struct {
+	Name           string
+	MustUnderstand bool
+	Value          interface{}
+}
+
+//an AMF remoting packet, the HTTP body of a request or a response.
+//
+//Version is 0 for AMF0 and 3 for AMF3, the values of a version 3 envelope are encoded
+//as AMF3 values after avmplus markers.
+type Envelope struct {
+	Version uint16
+	Headers []Header
+	Bodies  []Body
+}
+
+var ErrInvalidEnvelope = errors.New("remoting: invalid envelope.")
+
+func read_u16(r io.Reader) (v uint16, err error) {
+	err = binary.Read(r, binary.BigEndian, &v)
+	return
+}
+
+func read_utf8(r io.Reader) (string, error) {
+	n, err := read_u16(r)
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+//the value after its u32 length, ignored as it is unknown in many clients.
+//each value have its own reference tables.
+func read_value(r *bufio.Reader) (v interface{}, err error) {
+	var n uint32
+	if err = binary.Read(r, binary.BigEndian, &n); err != nil {
+		return nil, ErrInvalidEnvelope
+	}
+	if err = amf.NewDecoder(r).Decode(&v); err == io.EOF {
+		err = ErrInvalidEnvelope
+	}
+	return
+}
+
+func DecodeEnvelope(r io.Reader) (env *Envelope, err error) {
+
+	br := bufio.NewReader(r)
+
+	env = &Envelope{}
+	if env.Version, err = read_u16(br); err != nil {
+		return nil, ErrInvalidEnvelope
+	}
+
+	//fmt.Printf("envelope version:%d\n", env.Version)
+
+	count, err := read_u16(br)
+	if err != nil {
+		return nil, ErrInvalidEnvelope
+	}
+
+	for i := 0; i < int(count); i++ {
+		var h Header
+		if h.Name, err = read_utf8(br); err != nil {
+			return nil, ErrInvalidEnvelope
+		}
+		must, err := br.ReadByte()
+		if err != nil {
+			return nil, ErrInvalidEnvelope
+		}
+		h.MustUnderstand = must != 0
+		if h.Value, err = read_value(br); err != nil {
+			return nil, err
+		}
+		env.Headers = append(env.Headers, h)
+	}
+
+	if count, err = read_u16(br); err != nil {
+		return nil, ErrInvalidEnvelope
+	}
+
+	for i := 0; i < int(count); i++ {
+		var b Body
+		if b.Target, err = read_utf8(br); err != nil {
+			return nil, ErrInvalidEnvelope
+		}
+		if b.Response, err = read_utf8(br); err != nil {
+			return nil, ErrInvalidEnvelope
+		}
+		if b.Value, err = read_value(br); err != nil {
+			return nil, err
+		}
+		env.Bodies = append(env.Bodies, b)
+	}
+
+	return env, nil
+}
+
+func write_utf8(w *bytes.Buffer, s string) error {
+	if len(s) > 0xFFFF {
+		return errors.New("remoting: string too long.")
+	}
+	binary.Write(w, binary.BigEndian, uint16(len(s)))
+	w.WriteString(s)
+	return nil
+}
+
+func write_value(w *bytes.Buffer, version uint16, v interface{}) error {
+
+	buf := bytes.NewBuffer(nil)
+	e := amf.NewEncoder(buf)
+	if version == 3 {
+		e.SetObjectEncoding(amf.AMF3)
+	}
+	if err := e.Encode(v); err != nil {
+		return err
+	}
+
+	binary.Write(w, binary.BigEndian, uint32(buf.Len()))
+	w.Write(buf.Bytes())
+	return nil
+}
+
+func EncodeEnvelope(w io.Writer, env *Envelope) error {
+
+	if len(env.Headers) > 0xFFFF || len(env.Bodies) > 0xFFFF {
+		return errors.New("remoting: too many headers or bodies.")
+	}
+
+	buf := bytes.NewBuffer(nil)
+	binary.Write(buf, binary.BigEndian, env.Version)
+
+	binary.Write(buf, binary.BigEndian, uint16(len(env.Headers)))
+	for _, h := range env.Headers {
+		if err := write_utf8(buf, h.Name); err != nil {
+			return err
+		}
+		if h.MustUnderstand {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+		if err := write_value(buf, env.Version, h.Value); err != nil {
+			return err
+		}
+	}
+
+	binary.Write(buf, binary.BigEndian, uint16(len(env.Bodies)))
+	for _, b := range env.Bodies {
+		if err := write_utf8(buf, b.Target); err != nil {
+			return err
+		}
+		if err := write_utf8(buf, b.Response); err != nil {
+			return err
+		}
+		if err := write_value(buf, env.Version, b.Value); err != nil {
+			return err
+		}
+	}
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
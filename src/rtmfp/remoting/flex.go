@@ -0,0 +1,105 @@
+package remoting
+
+import (
+	"crypto/rand"
+	"fmt"
+	"rtmfp/amf"
+	"time"
+)
+
+//the messages of Flex RemoteObject, sent as the only argument of a body with a "null"
+//target.
+
+type AbstractMessage struct {
+	Body        interface{}            `amf:"body"`
+	ClientID    interface{}            `amf:"clientId"`
+	Destination string                 `amf:"destination"`
+	Headers     map[string]interface{} `amf:"headers"`
+	MessageID   string                 `amf:"messageId"`
+	Timestamp   float64                `amf:"timestamp"`
+	TimeToLive  float64                `amf:"timeToLive"`
+}
+
+//a call of Operation of the Destination service, with the arguments in Body.
+type RemotingMessage struct {
+	AbstractMessage
+	Operation string `amf:"operation"`
+	Source    string `amf:"source"`
+}
+
+//Operation of CommandMessage
+const (
+	SubscribeOperation      = 0
+	UnsubscribeOperation    = 1
+	PollOperation           = 2
+	ClientSyncOperation     = 4
+	ClientPingOperation     = 5
+	ClusterRequestOperation = 7
+	LoginOperation          = 8
+	LogoutOperation         = 9
+	DisconnectOperation     = 12
+	TriggerConnectOperation = 13
+	UnknownOperation        = 10000
+)
+
+type CommandMessage struct {
+	AbstractMessage
+	Operation     int    `amf:"operation"`
+	CorrelationID string `amf:"correlationId"`
+}
+
+//the result of a message, in Body.
+type AcknowledgeMessage struct {
+	AbstractMessage
+	CorrelationID string `amf:"correlationId"`
+}
+
+type ErrorMessage struct {
+	AcknowledgeMessage
+	FaultCode    string      `amf:"faultCode"`
+	FaultString  string      `amf:"faultString"`
+	FaultDetail  string      `amf:"faultDetail"`
+	RootCause    interface{} `amf:"rootCause"`
+	ExtendedData interface{} `amf:"extendedData"`
+}
+
+func init() {
+	amf.RegisterClass("flex.messaging.messages.RemotingMessage", RemotingMessage{})
+	amf.RegisterClass("flex.messaging.messages.CommandMessage", CommandMessage{})
+	amf.RegisterClass("flex.messaging.messages.AcknowledgeMessage", AcknowledgeMessage{})
+	amf.RegisterClass("flex.messaging.messages.ErrorMessage", ErrorMessage{})
+}
+
+//random UUID, the format of Flex ids.
+func new_uuid() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%X-%X-%X-%X-%X", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func new_ack(msg *AbstractMessage) *AcknowledgeMessage {
+	return &AcknowledgeMessage{
+		AbstractMessage: AbstractMessage{
+			ClientID:  msg.ClientID,
+			MessageID: new_uuid(),
+			Timestamp: float64(time.Now().UnixNano() / int64(time.Millisecond)),
+			Headers:   map[string]interface{}{},
+		},
+		CorrelationID: msg.MessageID,
+	}
+}
+
+func new_error_message(msg *AbstractMessage, f *Fault) *ErrorMessage {
+	m := &ErrorMessage{
+		AcknowledgeMessage: *new_ack(msg),
+		FaultCode:          f.Code,
+		FaultString:        f.Description,
+		ExtendedData:       f.Details,
+	}
+	if f.Details != nil {
+		m.FaultDetail = fmt.Sprint(f.Details)
+	}
+	return m
+}
@@ -0,0 +1,144 @@
+package remoting
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+)
+
+//requests larger than it are rejected.
+var MaxRequestSize int64 = 1 << 20
+
+const content_type = "application/x-amf"
+
+//Gateway is an http.Handler of AMF remoting requests, the NetConnection.call()s of
+//Flash with an http:// url, and the RemoteObjects of Flex with an AMFChannel, calling
+//the functions of its Registry.
+type Gateway struct {
+	registry *Registry
+}
+
+func NewGateway(registry *Registry) *Gateway {
+	return &Gateway{registry: registry}
+}
+
+//info object of onStatus, the error of an AMF0 call.
+type fault_status struct {
+	Level       string      `amf:"level"`
+	Code        string      `amf:"code"`
+	Description string      `amf:"description"`
+	Details     interface{} `amf:"details,omitempty"`
+}
+
+func (self *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req, err := DecodeEnvelope(http.MaxBytesReader(w, r.Body, MaxRequestSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	headers := make(map[string]interface{})
+	for _, h := range req.Headers {
+		headers[h.Name] = h.Value
+	}
+
+	res := &Envelope{Version: req.Version}
+
+	for _, b := range req.Bodies {
+		//the headers of a Flex message are added for its body only.
+		call := &Call{Headers: make(map[string]interface{}, len(headers)), RemoteAddr: r.RemoteAddr}
+		for k, v := range headers {
+			call.Headers[k] = v
+		}
+		res.Bodies = append(res.Bodies, self.serve_body(call, &b))
+	}
+
+	buf := bytes.NewBuffer(nil)
+	if err := EncodeEnvelope(buf, res); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", content_type)
+	w.Write(buf.Bytes())
+}
+
+func (self *Gateway) serve_body(call *Call, b *Body) Body {
+
+	args, _ := b.Value.([]interface{})
+
+	//fmt.Printf("remoting call %s\n", b.Target)
+
+	if len(args) == 1 {
+		switch msg := args[0].(type) {
+		case *RemotingMessage:
+			return Body{Target: b.Response + "/onResult", Response: "null", Value: self.serve_remoting(call, msg)}
+		case *CommandMessage:
+			return Body{Target: b.Response + "/onResult", Response: "null", Value: serve_command(msg)}
+		}
+	}
+
+	if b.Value != nil && args == nil {
+		args = []interface{}{b.Value}
+	}
+
+	call.Name = b.Target
+	call.Args = args
+
+	result, err := self.registry.Call(call)
+	if err != nil {
+		f := fault_of(err)
+		status := &fault_status{Level: "error", Code: f.Code, Description: f.Description, Details: f.Details}
+		return Body{Target: b.Response + "/onStatus", Response: "null", Value: status}
+	}
+
+	return Body{Target: b.Response + "/onResult", Response: "null", Value: result}
+}
+
+func (self *Gateway) serve_remoting(call *Call, msg *RemotingMessage) interface{} {
+
+	service := msg.Destination
+	if len(msg.Source) > 0 {
+		service = msg.Source
+	}
+
+	call.Name = service + "." + msg.Operation
+	call.Args, _ = msg.Body.([]interface{})
+	for k, v := range msg.Headers {
+		call.Headers[k] = v
+	}
+
+	result, err := self.registry.Call(call)
+	if err != nil {
+		return new_error_message(&msg.AbstractMessage, fault_of(err))
+	}
+
+	ack := new_ack(&msg.AbstractMessage)
+	ack.Body = result
+	return ack
+}
+
+func serve_command(msg *CommandMessage) interface{} {
+
+	switch msg.Operation {
+	case ClientPingOperation, DisconnectOperation:
+		ack := new_ack(&msg.AbstractMessage)
+		//the id of the client for its next messages.
+		if id, _ := msg.Headers["DSId"].(string); len(id) > 0 && id != "nil" {
+			ack.Headers["DSId"] = id
+		} else {
+			ack.Headers["DSId"] = new_uuid()
+		}
+		return ack
+	}
+
+	f := &Fault{Code: "Server.Command.Unsupported", Description: fmt.Sprintf("operation %d not supported.", msg.Operation)}
+	return new_error_message(&msg.AbstractMessage, f)
+}
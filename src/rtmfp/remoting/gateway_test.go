@@ -0,0 +1,194 @@
+package remoting
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestEnvelope(t *testing.T) {
+
+	for _, version := range []uint16{0, 3} {
+
+		env := &Envelope{
+			Version: version,
+			Headers: []Header{{"Credentials", true, map[string]interface{}{"userid": "a"}}},
+			Bodies: []Body{
+				{"test.hello", "/1", []interface{}{"world"}},
+				{"test.add", "/2", []interface{}{1.0, 2.0}},
+			},
+		}
+
+		buf := bytes.NewBuffer(nil)
+		if err := EncodeEnvelope(buf, env); err != nil {
+			t.Fatal(err)
+		}
+		data := buf.Bytes()
+
+		decoded, err := DecodeEnvelope(buf)
+		if err != nil {
+			t.Fatal(version, err)
+		}
+		if !reflect.DeepEqual(decoded, env) {
+			t.Fatalf("version %d not match.\n%#v\n%#v", version, decoded, env)
+		}
+
+		for n := 0; n < len(data); n++ {
+			if _, err := DecodeEnvelope(bytes.NewReader(data[:n])); err == nil {
+				t.Fatal("truncated at", n, "decoded.")
+			}
+		}
+	}
+}
+
+func post(t *testing.T, url string, req *Envelope) *Envelope {
+
+	buf := bytes.NewBuffer(nil)
+	if err := EncodeEnvelope(buf, req); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.Post(url, content_type, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != content_type {
+		t.Fatal("unexpected response.", resp.Status)
+	}
+
+	res, err := DecodeEnvelope(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Version != req.Version || len(res.Bodies) != len(req.Bodies) {
+		t.Fatalf("unexpected response.\n%#v", res)
+	}
+	return res
+}
+
+func TestGatewayAMF0(t *testing.T) {
+
+	server := httptest.NewServer(NewGateway(test_registry(t)))
+	defer server.Close()
+
+	res := post(t, server.URL, &Envelope{
+		Bodies: []Body{
+			{"test.hello", "/1", []interface{}{"world"}},
+			{"test.fail", "/2", []interface{}{}},
+			{"unknown", "/3", []interface{}{}},
+		},
+	})
+
+	if b := res.Bodies[0]; b.Target != "/1/onResult" || b.Response != "null" || b.Value != "hello world" {
+		t.Fatalf("unexpected result.\n%#v", b)
+	}
+
+	expect := map[string]interface{}{"level": "error", "code": "App.Fail", "description": "failed", "details": 42.0}
+	if b := res.Bodies[1]; b.Target != "/2/onStatus" || !reflect.DeepEqual(b.Value, expect) {
+		t.Fatalf("unexpected fault.\n%#v", b)
+	}
+
+	if b := res.Bodies[2]; b.Target != "/3/onStatus" || b.Value.(map[string]interface{})["code"] != "Server.ResourceUnavailable" {
+		t.Fatalf("unexpected fault.\n%#v", b)
+	}
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatal("GET not rejected.", resp.Status)
+	}
+
+	resp, err = http.Post(server.URL, content_type, bytes.NewReader([]byte{0, 3, 0}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatal("invalid envelope not rejected.", resp.Status)
+	}
+}
+
+func TestGatewayFlex(t *testing.T) {
+
+	server := httptest.NewServer(NewGateway(test_registry(t)))
+	defer server.Close()
+
+	ping := &CommandMessage{Operation: ClientPingOperation}
+	ping.MessageID = "ping-id"
+	ping.Headers = map[string]interface{}{"DSId": "nil"}
+
+	call := &RemotingMessage{Operation: "add"}
+	call.Destination = "test"
+	call.MessageID = "call-id"
+	call.Body = []interface{}{1, 2}
+
+	fail := &RemotingMessage{Operation: "fail"}
+	fail.Destination = "test"
+	fail.MessageID = "fail-id"
+
+	res := post(t, server.URL, &Envelope{
+		Version: 3,
+		Bodies: []Body{
+			{"null", "/1", []interface{}{ping}},
+			{"null", "/2", []interface{}{call}},
+			{"null", "/3", []interface{}{fail}},
+		},
+	})
+
+	ack, ok := res.Bodies[0].Value.(*AcknowledgeMessage)
+	if !ok || res.Bodies[0].Target != "/1/onResult" || ack.CorrelationID != "ping-id" || len(ack.Headers["DSId"].(string)) != 36 {
+		t.Fatalf("unexpected ping response.\n%#v", res.Bodies[0])
+	}
+
+	ack, ok = res.Bodies[1].Value.(*AcknowledgeMessage)
+	if !ok || ack.CorrelationID != "call-id" || ack.Body != 3 || len(ack.MessageID) != 36 {
+		t.Fatalf("unexpected result.\n%#v", res.Bodies[1].Value)
+	}
+
+	e, ok := res.Bodies[2].Value.(*ErrorMessage)
+	if !ok || e.CorrelationID != "fail-id" || e.FaultCode != "App.Fail" || e.FaultString != "failed" || e.FaultDetail != "42" {
+		t.Fatalf("unexpected fault.\n%#v", res.Bodies[2].Value)
+	}
+}
+
+func TestGatewayHeaders(t *testing.T) {
+
+	r := NewRegistry()
+	r.RegisterFunc("test.headers", func(call *Call) string {
+		return fmt.Sprintf("%v %v", call.Headers["Credentials"], call.Headers["DSEndpoint"])
+	})
+
+	server := httptest.NewServer(NewGateway(r))
+	defer server.Close()
+
+	first := &RemotingMessage{Operation: "headers"}
+	first.Destination = "test"
+	first.Headers = map[string]interface{}{"DSEndpoint": "amf"}
+
+	second := &RemotingMessage{Operation: "headers"}
+	second.Destination = "test"
+
+	res := post(t, server.URL, &Envelope{
+		Version: 3,
+		Headers: []Header{{"Credentials", false, "a"}},
+		Bodies: []Body{
+			{"null", "/1", []interface{}{first}},
+			{"null", "/2", []interface{}{second}},
+		},
+	})
+
+	for i, expect := range []string{"a amf", "a <nil>"} {
+		ack, ok := res.Bodies[i].Value.(*AcknowledgeMessage)
+		if !ok || ack.Body != expect {
+			t.Fatalf("unexpected headers of body %d.\n%#v", i, res.Bodies[i].Value)
+		}
+	}
+}
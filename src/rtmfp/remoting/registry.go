@@ -0,0 +1,209 @@
+//Package remoting dispatch Flash NetConnection.call()s to Go functions, over HTTP with
+//the Gateway, the AMF remoting of Flash and Flex, and over RTMFP with rtmfp.Transport's
+//SetServices(), so that both share one Registry of services.
+package remoting
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"rtmfp/amf"
+	"strings"
+	"sync"
+)
+
+//one call to a registered function.
+type Call struct {
+	Name       string
+	Args       []interface{} //decoded AMF values
+	Headers    map[string]interface{}
+	RemoteAddr string
+}
+
+//an error with the code sent to the caller, e.g. the faultCode of a Flex ErrorMessage.
+//other errors are sent as Server.Processing faults.
+type Fault struct {
+	Code        string
+	Description string
+	Details     interface{}
+}
+
+func (self *Fault) Error() string {
+	return self.Code + ": " + self.Description
+}
+
+func fault_of(err error) *Fault {
+	if f, ok := err.(*Fault); ok {
+		return f
+	}
+	return &Fault{Code: "Server.Processing", Description: err.Error()}
+}
+
+var ErrNotFound = errors.New("remoting: no such function.")
+
+var call_type = reflect.TypeOf((*Call)(nil))
+var error_type = reflect.TypeOf((*error)(nil)).Elem()
+
+//Registry map the names of calls to Go functions.
+//
+//A function take any number of arguments, each converted from the AMF value of the
+//caller as amf.Unmarshal() does, and the *Call as the first one if it want. it return
+//nothing, a result, an error, or both.
+type Registry struct {
+	mutex sync.RWMutex
+	funcs map[string]reflect.Value
+}
+
+func NewRegistry() *Registry {
+	return &Registry{funcs: make(map[string]reflect.Value)}
+}
+
+func check_func(t reflect.Type) error {
+
+	if t.Kind() != reflect.Func {
+		return fmt.Errorf("remoting: %v is not a function.", t)
+	}
+
+	if t.IsVariadic() {
+		return fmt.Errorf("remoting: %v is variadic.", t)
+	}
+
+	switch t.NumOut() {
+	case 0:
+	case 1:
+	case 2:
+		if t.Out(1) != error_type {
+			return fmt.Errorf("remoting: the second result of %v is not an error.", t)
+		}
+	default:
+		return fmt.Errorf("remoting: %v return more than 2 results.", t)
+	}
+
+	return nil
+}
+
+//register fn under name, e.g. "echo" for NetConnection.call("echo", ...).
+func (self *Registry) RegisterFunc(name string, fn interface{}) error {
+
+	v := reflect.ValueOf(fn)
+	if !v.IsValid() {
+		return errors.New("remoting: nil function.")
+	}
+	if err := check_func(v.Type()); err != nil {
+		return err
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.funcs[name] = v
+
+	return nil
+}
+
+//register the exported methods of rcvr as "service.Method", and with the first letter
+//of Method in lower case as Flash methods are, e.g. "echo.hello" for Hello().
+func (self *Registry) Register(service string, rcvr interface{}) error {
+
+	v := reflect.ValueOf(rcvr)
+	if !v.IsValid() || v.NumMethod() == 0 {
+		return fmt.Errorf("remoting: %T has no exported methods.", rcvr)
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	for i := 0; i < v.NumMethod(); i++ {
+		m := v.Method(i)
+		name := v.Type().Method(i).Name
+
+		if check_func(m.Type()) != nil {
+			continue
+		}
+
+		self.funcs[service+"."+name] = m
+		self.funcs[service+"."+strings.ToLower(name[:1])+name[1:]] = m
+	}
+
+	return nil
+}
+
+func (self *Registry) Unregister(name string) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	prefix := name + "."
+	for k := range self.funcs {
+		if k == name || strings.HasPrefix(k, prefix) {
+			delete(self.funcs, k)
+		}
+	}
+}
+
+func (self *Registry) Has(name string) bool {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+
+	_, ok := self.funcs[name]
+	return ok
+}
+
+//call the function registered as call.Name. a panic of the function is returned as
+//an error.
+func (self *Registry) Call(call *Call) (result interface{}, err error) {
+
+	self.mutex.RLock()
+	fn, ok := self.funcs[call.Name]
+	self.mutex.RUnlock()
+
+	if !ok {
+		return nil, &Fault{Code: "Server.ResourceUnavailable", Description: ErrNotFound.Error(), Details: call.Name}
+	}
+
+	t := fn.Type()
+
+	args := call.Args
+	in := make([]reflect.Value, t.NumIn())
+
+	for i := range in {
+		if i == 0 && t.In(0) == call_type {
+			in[0] = reflect.ValueOf(call)
+			continue
+		}
+
+		p := reflect.New(t.In(i))
+		if len(args) > 0 {
+			if err := amf.Convert(args[0], p.Interface()); err != nil {
+				return nil, &Fault{Code: "Server.Call.BadArguments", Description: err.Error()}
+			}
+			args = args[1:]
+		}
+		in[i] = p.Elem()
+	}
+
+	if len(args) > 0 {
+		return nil, &Fault{Code: "Server.Call.BadArguments", Description: fmt.Sprintf("%d arguments too many.", len(args))}
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			result, err = nil, fmt.Errorf("remoting: %s panic: %v", call.Name, r)
+		}
+	}()
+
+	out := fn.Call(in)
+
+	switch len(out) {
+	case 1:
+		if t.Out(0) == error_type {
+			err, _ = out[0].Interface().(error)
+		} else {
+			result = out[0].Interface()
+		}
+	case 2:
+		result = out[0].Interface()
+		err, _ = out[1].Interface().(error)
+	}
+
+	return result, err
+}
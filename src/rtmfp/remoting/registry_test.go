@@ -0,0 +1,119 @@
+package remoting
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+type test_point struct {
+	X, Y float64
+}
+
+type test_service struct{}
+
+func (self *test_service) Hello(name string) string {
+	return "hello " + name
+}
+
+func (self *test_service) Add(a, b int) (int, error) {
+	return a + b, nil
+}
+
+func (self *test_service) Move(p test_point, dx float64) test_point {
+	return test_point{p.X + dx, p.Y}
+}
+
+func (self *test_service) Fail() error {
+	return &Fault{Code: "App.Fail", Description: "failed", Details: 42}
+}
+
+func (self *test_service) Panic() {
+	panic("boom")
+}
+
+func (self *test_service) Addr(call *Call, n int) string {
+	return call.RemoteAddr + strings.Repeat("!", n)
+}
+
+//not registered, more than 2 results.
+func (self *test_service) Invalid() (int, int, int) {
+	return 1, 2, 3
+}
+
+func test_registry(t *testing.T) *Registry {
+	r := NewRegistry()
+	if err := r.Register("test", &test_service{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.RegisterFunc("echo", func(v interface{}) interface{} { return v }); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestRegistry(t *testing.T) {
+
+	r := test_registry(t)
+
+	if !r.Has("test.hello") || !r.Has("test.Hello") || r.Has("test.invalid") || r.Has("test.unknown") {
+		t.Fatal("unexpected registered names.")
+	}
+
+	cases := []struct {
+		name   string
+		args   []interface{}
+		result interface{}
+	}{
+		{"test.hello", []interface{}{"world"}, "hello world"},
+		{"test.add", []interface{}{1.0, 2.0}, 3},
+		{"test.add", []interface{}{1.0}, 1}, //missing arguments are zero
+		{"test.move", []interface{}{map[string]interface{}{"x": 1.0, "y": 2.0}, 0.5}, test_point{1.5, 2}},
+		{"test.addr", []interface{}{2.0}, "1.2.3.4:5!!"},
+		{"test.panic", nil, nil},
+		{"echo", []interface{}{"abc"}, "abc"},
+	}
+
+	for _, c := range cases {
+		result, err := r.Call(&Call{Name: c.name, Args: c.args, RemoteAddr: "1.2.3.4:5"})
+		if c.name == "test.panic" {
+			if err == nil || !strings.Contains(err.Error(), "boom") {
+				t.Fatal("panic not returned.", err)
+			}
+			continue
+		}
+		if err != nil || result != c.result {
+			t.Fatalf("%s: %#v %v", c.name, result, err)
+		}
+	}
+
+	_, err := r.Call(&Call{Name: "test.fail"})
+	if f, ok := err.(*Fault); !ok || f.Code != "App.Fail" || f.Details != 42 {
+		t.Fatal("fault not returned.", err)
+	}
+
+	invalid := []*Call{
+		{Name: "unknown"},
+		{Name: "test.add", Args: []interface{}{"a"}},
+		{Name: "test.add", Args: []interface{}{1.0, 2.0, 3.0}},
+	}
+
+	for _, call := range invalid {
+		if _, err := r.Call(call); err == nil {
+			t.Fatalf("%#v called.", call)
+		}
+	}
+
+	if fault_of(errors.New("x")).Code != "Server.Processing" {
+		t.Fatal("unexpected code of an error.")
+	}
+
+	if r.RegisterFunc("x", 1) == nil || r.RegisterFunc("x", func() (int, int) { return 0, 0 }) == nil {
+		t.Fatal("invalid function registered.")
+	}
+
+	r.Unregister("test")
+	if r.Has("test.hello") || !r.Has("echo") {
+		t.Fatal("not unregistered.")
+	}
+}
@@ -4,16 +4,13 @@ import (
 	"bytes"
 	"crypto/rand"
 	"encoding/binary"
-	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
-	"math/big"
+	"sync"
 	"time"
 )
 
-var dh1024p = "FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7EDEE386BFB5A899FA5AE9F24117C4B1FE649286651ECE65381FFFFFFFFFFFFFFFF"
-
 var mode_startup = uint8(3)
 var mode_initiator = uint8(1)
 var mode_responder = uint8(2)
@@ -21,29 +18,95 @@ var mode_responder = uint8(2)
 var iikeying_retry_count = 5 //not exceed 64
 var iikeying_timeout = 1 * time.Second
 
+//how a session follow the far end to a new address, see AddressValidation.
+var address_validation = AddressValidationPing
+var address_probe_interval = 1 * time.Second  //at most one probe in the interval
+var address_probe_timeout = 120 * time.Second //probe reply later than it is ignored
+var address_probe_challenge_size = 8
+
+//number of packets remembered to drop the replays of them.
+var recent_packets_size = 1024
+
+//the keys of a closed session are released after the close chunks are gone.
+var session_key_release_delay = 1 * time.Second
+
+//the socket a closed session migrated to is closed after the close request is gone.
+var session_socket_close_delay = 1 * time.Second
+
 type session struct {
 	in  chan *network_packet
 	out chan *network_packet
 
+	tasks chan func() //run on the session goroutine, between packets
+
+	out_mutex sync.Mutex  //out change when the session migrate, other_addr when the far end move
+	socket    *socket_bin //socket of the session after migration, nil for the transport socket.
+
 	sessionid, other_sessionid uint32
-	dh_private, dh_public      *big.Int
+	dh_group                   dh_group //nil for the default 1024-bit group
+	dh_private, dh_public      []byte
 	other_dh_public            []byte
 	nonce                      []byte
 	mode                       uint8
+	profile                    CryptoProfile
 	dkey, ekey                 []byte
 
 	other_addr  string
+	far_peerid  []byte //verified peerid of the responder, only for active opened session.
+	certificate []byte //endpoint certificate presented in IIKeying, so that rendezvous can identify us.
+	cookie_echo []byte
 	last_flowid uint
 
+	cookie_mutex sync.Mutex //cookie_echo change by RHello cookie change during active_open.
+
+	closed bool //guarded by out_mutex, Migrate() read it.
+
+	//closed, guarded by the peers lock of the handshake, see register_peer().
+	unregistered bool
+	on_close     func()
+
+	clock clock //nil for the real clock
+
 	send_flows map[uint]*send_flow
 	recv_flows map[uint]*recv_flow
 
-	create_recv_flow   func(options []byte, flowid uint) (*recv_flow, error)
-	recv_close_request func()
+	create_recv_flow      func(options []byte, flowid uint) (*recv_flow, error)
+	recv_close_request    func()
+	recv_forwarded_ihello func(edpData []byte, replyAddress string, tag []byte)
 
 	active_open_chan chan bool
-
-	mobile_tx_ts time.Time
+	open_abort       chan bool
+
+	//address change of the far end.
+	mobile_tx_ts    time.Time //last probe sent
+	probe_addr      string
+	probe_challenge []byte
+	address_changed func(oldAddr, newAddr string)
+
+	//addresses of the far end, see path.go
+	paths            map[string]*session_path
+	paths_mutex      sync.Mutex
+	paths_probe_ts   time.Time //last standby paths probe
+	rtx_timeouts     int       //consecutive retransmit timeouts without ack
+	failover_pending bool      //the path in use failed, move to the first path answer a probe
+
+	//user data chunks in the packet being decoded, a packet which carry duplicate user
+	//data and nothing new of it may be a replay and should not move the session.
+	rx_packet_userdata, rx_packet_dup_userdata int
+
+	//the packets received recently, a packet received again is a replay. the AEAD profile
+	//reject replays by their sequence number before. rx_digest is of the packet being
+	//decoded, which is added once it is authenticated.
+	recent_packets *packet_history
+	rx_digest      uint64
+
+	//pings and ping replies in the packet being decoded, probes of a standby path
+	//should not move the session either.
+	rx_packet_probe int
+
+	//the timestamps, the rtt and the statistics of the packets sent, which are sent by
+	//the flows from the goroutines of their owners too.
+	tx_mutex sync.Mutex
 
 	//RTT related
 	ts_rx      uint16        //last timestamp received from far end
@@ -67,53 +130,53 @@ type session struct {
 
 func (self *session) init_dh() {
 
-	//g,p
-	var p big.Int
-	p.SetString(dh1024p, 16)
-	g := big.NewInt(2)
-
-	//x
-	dh_private := make([]byte, 128)
-	rand.Read(dh_private)
-	self.dh_private = new(big.Int)
-	self.dh_private.SetString(hex.EncodeToString(dh_private), 16)
+	if self.dh_group == nil {
+		self.dh_group = find_dh_group(dh_group_modp1024)
+	}
 
-	//y = g^x mod p
-	self.dh_public = g.Exp(g, self.dh_private, &p)
+	self.dh_private, self.dh_public = self.dh_group.generate_key()
 
 	//generate nonce
-	self.nonce = make([]byte, 139) //11 + 128
-	copy(self.nonce, []byte("\x03\x1A\x00\x00\x02\x1E\x00\x81\x02\x0D\x02"))
-	pad_len := 128 - len(self.dh_public.Bytes())
-	copy(self.nonce[11+pad_len:], self.dh_public.Bytes())
-}
+	nonce_buf := bytes.NewBuffer(nil)
+	nonce_buf.Write([]byte("\x03\x1A\x00\x00\x02\x1E\x00"))
 
-func (self *session) end_dh(other_dh_pub []byte) *big.Int {
+	//OPTION(x0D, group + DH)
+	encode_vlu(nonce_buf, uint(2+len(self.dh_public)))
+	nonce_buf.WriteByte(0x0D)
+	nonce_buf.WriteByte(self.dh_group.id())
+	nonce_buf.Write(self.dh_public)
 
-	//p
-	var p big.Int
-	p.SetString(dh1024p, 16)
+	self.nonce = nonce_buf.Bytes()
+}
 
-	y := new(big.Int)
-	y.SetString(hex.EncodeToString(other_dh_pub), 16)
+func (self *session) generate_aes_keys(other_dh_pub, myNonce, otherNonce []byte) error {
 
-	//share_secret = y^x mode p
-	share_secret := y.Exp(y, self.dh_private, &p)
+	share_secret, err := self.dh_group.compute_secret(self.dh_private, other_dh_pub)
+	if err != nil {
+		return err
+	}
 
 	//fmt.Printf("share_secret:%v\n", share_secret)
 
-	return share_secret
-}
+	self.dkey, self.ekey = self.profile.DeriveSessionKeys(share_secret, myNonce, otherNonce)
 
-func (self *session) generate_aes_keys(other_dh_pub, myNonce, otherNonce []byte) {
-
-	self.dkey, self.ekey = GenCryptoKeys(self.end_dh(other_dh_pub), myNonce, otherNonce)
+	return nil
 }
 
 func (self *session) init() {
 	self.send_flows = make(map[uint]*send_flow)
 	self.recv_flows = make(map[uint]*recv_flow)
+	self.tasks = make(chan func(), 8)
 	self.mode = mode_startup
+
+	if self.profile == nil {
+		self.profile = default_crypto_profile
+	}
+
+	if self.clock == nil {
+		self.clock = default_clock
+	}
+
 	self.init_dh()
 
 	//rtt related
@@ -131,17 +194,20 @@ func (self *session) active_open(dstAddr string, cookie, other_dh_public []byte)
 	self.init()
 
 	self.other_dh_public = other_dh_public
+	self.set_cookie_echo(cookie)
 
 	self.active_open_chan = make(chan bool, 1)
 forloop:
 	for i := 0; i < iikeying_retry_count; i++ {
 
-		self.send_iikeying(dstAddr, cookie)
+		self.send_iikeying(dstAddr, self.get_cookie_echo())
 
 		select {
 		case <-self.active_open_chan:
 			break forloop
-		case <-time.After((1 << uint(i)) * iikeying_timeout):
+		case <-self.open_abort:
+			break forloop
+		case <-self.clock.After((1 << uint(i)) * iikeying_timeout):
 		}
 	}
 
@@ -154,14 +220,37 @@ forloop:
 	}
 }
 
+//give up active open, non-blocking.
+func (self *session) abort_open() {
+	select {
+	case self.open_abort <- true:
+	default:
+	}
+}
+
 func (self *session) passive_open() {
 	self.init()
 }
 
 func (self *session) close() {
 
+	self.out_mutex.Lock()
+	self.closed = true
+	self.out_mutex.Unlock()
+
+	if self.on_close != nil {
+		self.on_close()
+	}
+
 	self.send_session_close_request()
 
+	//give the close request a while to go out.
+	self.out_mutex.Lock()
+	if self.socket != nil {
+		self.clock.AfterFunc(session_socket_close_delay, self.socket.close)
+	}
+	self.out_mutex.Unlock()
+
 	for _, flow := range self.recv_flows {
 		flow.close()
 	}
@@ -169,31 +258,97 @@ func (self *session) close() {
 	for _, flow := range self.send_flows {
 		flow.close()
 	}
+
+	self.release_keys()
+}
+
+//tell the profile the keys of the session are no longer used.
+func (self *session) release_keys() {
+
+	r, ok := self.profile.(SessionKeyReleaser)
+	if !ok || !self.handshaked() {
+		return
+	}
+
+	dkey, ekey := self.dkey, self.ekey
+	self.clock.AfterFunc(session_key_release_delay, func() {
+		r.ReleaseSessionKeys(dkey, ekey)
+	})
 }
 
 func (self *session) dispatch() {
 
 	for {
-		packet, ok := <-self.in
-		if !ok {
-			break
+		select {
+		case packet, ok := <-self.in:
+			if !ok {
+				return
+			}
+			self.recv_packet(packet)
+		case task := <-self.tasks:
+			task()
 		}
-		self.recv_packet(packet)
 	}
 }
 
 //should not be called
 func (self *session) recv_ihello(srcAddr *string, edpType uint8, edpData, tag []byte) {}
+
+//rendezvous forward an IHello for us, answer the initiator directly.
 func (self *session) recv_fihello(srcAddr *string, edpType uint8, edpData []byte, replyAddress string, tag []byte) {
+	//fmt.Printf("recv_fihello(replyAddress:%s)\n", replyAddress)
+
+	if edpType != 0x0f || self.recv_forwarded_ihello == nil {
+		return
+	}
+
+	self.recv_forwarded_ihello(edpData, replyAddress, tag)
+}
+
+func (self *session) send_fihello(edp []byte, replyAddress string, tag []byte) {
+
+	chunk_buf := bytes.NewBuffer(nil)
+
+	encode_endpoint_discriminator(chunk_buf, 0x0f, edp)
+	encode_address(chunk_buf, replyAddress, address_origin_observed)
+	chunk_buf.Write(tag)
+
+	self.send_chunk(self.other_addr, 0x0f, chunk_buf.Bytes())
 }
 
 func (self *session) recv_rhello(srcAddr *string, tagEcho, cookie, respCert []byte) {}
 func (self *session) recv_redirect(srcAddr *string, tagEcho []byte, redirectDestination []string) {
 }
 
+func (self *session) get_cookie_echo() []byte {
+	self.cookie_mutex.Lock()
+	defer self.cookie_mutex.Unlock()
+	return self.cookie_echo
+}
+
+func (self *session) set_cookie_echo(cookie []byte) {
+	self.cookie_mutex.Lock()
+	defer self.cookie_mutex.Unlock()
+	self.cookie_echo = cookie
+}
+
 func (self *session) recv_rhello_cookie_change(srcAddr *string, oldCookie, newCookie []byte) {
-	//naive implementation
-	self.send_iikeying(*srcAddr, newCookie)
+
+	if self.handshaked() {
+		return
+	}
+
+	//later retries should use the new cookie too.
+	self.cookie_mutex.Lock()
+	if !bytes.Equal(oldCookie, self.cookie_echo) {
+		self.cookie_mutex.Unlock()
+		return
+	}
+	self.cookie_echo = append([]byte(nil), newCookie...)
+	cookie := self.cookie_echo
+	self.cookie_mutex.Unlock()
+
+	self.send_iikeying(*srcAddr, cookie)
 }
 
 func (self *session) send_iikeying(dstAddr string, cookieEcho []byte) {
@@ -208,16 +363,15 @@ func (self *session) send_iikeying(dstAddr string, cookieEcho []byte) {
 	//cookie echo
 	encode_vlu_prefix_bytes(chunk_buf, cookieEcho)
 
-	//initiator certificate
-	encode_vlu(chunk_buf, 132) //4 + 128
-	chunk_buf.Write([]byte("\x81\x02\x1D\x02"))
+	//initiator certificate, CERT = endpoint certificate + OPTION(x1D, group + DH)
+	cert_buf := bytes.NewBuffer(nil)
+	cert_buf.Write(self.certificate)
+	encode_vlu(cert_buf, uint(2+len(self.dh_public)))
+	cert_buf.WriteByte(0x1D)
+	cert_buf.WriteByte(self.dh_group.id())
+	cert_buf.Write(self.dh_public)
 
-	pad_len := 128 - len(self.dh_public.Bytes())
-	for i := 0; i < pad_len; i++ {
-		chunk_buf.WriteByte(0x0)
-	}
-
-	chunk_buf.Write(self.dh_public.Bytes())
+	encode_vlu_prefix_bytes(chunk_buf, cert_buf.Bytes())
 
 	//session key initiator component
 	encode_vlu_prefix_bytes(chunk_buf, self.nonce)
@@ -237,15 +391,33 @@ func (self *session) recv_iikeying(srcAddr *string, initSid uint32, cookieEcho,
 		return
 	}*/
 
-	//CERT = OPTION(x1D, \x02 + DH)
-	other_dh_pub := read_option(initCert, 0x1D)[1:]
+	//CERT = OPTION(x1D, group + DH)
+	option_1d := read_option(initCert, 0x1D)
+	if len(option_1d) < 2 {
+		return
+	}
+
+	//answer in the group the initiator choose.
+	if group := find_dh_group(option_1d[0]); group == nil {
+		return
+	} else if group.id() != self.dh_group.id() {
+		self.dh_group = group
+		self.init_dh()
+	}
 
-	self.generate_aes_keys(other_dh_pub, self.nonce, initNonce)
+	err := self.generate_aes_keys(option_1d[1:], self.nonce, initNonce)
+	if err != nil {
+		//fmt.Println(err)
+		return
+	}
 
 	//session established for responder
 	self.mode = mode_responder
 	self.other_sessionid = initSid
+	self.out_mutex.Lock()
 	self.other_addr = *srcAddr
+	self.out_mutex.Unlock()
+	self.add_path(*srcAddr, true)
 
 	self.send_rikeying(*srcAddr)
 }
@@ -274,34 +446,50 @@ func (self *session) recv_rikeying(srcAddr *string, respSid uint32, respNonce []
 		return
 	}
 
-	//CERT = OPTION(x0D, \x02 + DH)
+	//NONCE = OPTION(x0D, group + DH)
 	option_0d := read_option(respNonce, 0x0D)
 	if self.other_dh_public == nil && len(option_0d) > 1 {
+		if option_0d[0] != self.dh_group.id() {
+			//fmt.Println("responder answer in another dh group!")
+			return
+		}
 		self.other_dh_public = option_0d[1:]
 	}
 
-	self.generate_aes_keys(self.other_dh_public, self.nonce, respNonce)
+	err := self.generate_aes_keys(self.other_dh_public, self.nonce, respNonce)
+	if err != nil {
+		//fmt.Println(err)
+		return
+	}
 
 	//session established for both side!
 	self.mode = mode_initiator
 	self.other_sessionid = respSid
+	self.out_mutex.Lock()
 	self.other_addr = *srcAddr
+	self.out_mutex.Unlock()
+	self.add_path(*srcAddr, true)
 
 	if self.active_open_chan != nil {
 		self.active_open_chan <- true
 	}
 }
 
-func (self *session) send_ping(dstAddr string) {
-	chunk_buf := bytes.NewBuffer(nil)
-	chunk_buf.Write([]byte("hello"))
+//ping with a random challenge, only the one receive it can echo it.
+func (self *session) send_ping(dstAddr string) []byte {
+	challenge := make([]byte, address_probe_challenge_size)
+	rand.Read(challenge)
 
-	self.send_chunk(dstAddr, 0x01, chunk_buf.Bytes())
+	self.send_chunk(dstAddr, 0x01, challenge)
+
+	return challenge
 }
 
 func (self *session) recv_ping(srcAddr *string, msg []byte) {
 	//fmt.Printf("recv_ping(%v)\n", msg)
 
+	self.rx_packet_probe++
+
 	self.send_ping_reply(*srcAddr, msg)
 }
 
@@ -315,15 +503,96 @@ func (self *session) send_ping_reply(dstAddr string, msgEcho []byte) {
 func (self *session) recv_ping_reply(srcAddr *string, msgEcho []byte) {
 	//fmt.Printf("recv_ping_reply(%v)\n", msgEcho)
 
-	//address change confirm
-	if *srcAddr != self.other_addr && time.Since(self.mobile_tx_ts) < 120*time.Second {
-		fmt.Printf("new remote address confirmed! %v -> %v\n", self.other_addr, *srcAddr)
-		self.other_addr = *srcAddr
+	self.rx_packet_probe++
+
+	self.recv_path_reply(*srcAddr, msgEcho)
+
+	//address change confirm, the reply should come from the probed address and echo its challenge.
+	if self.probe_challenge == nil || *srcAddr != self.probe_addr || !bytes.Equal(msgEcho, self.probe_challenge) {
+		return
+	}
+
+	self.probe_challenge = nil
+
+	if *srcAddr != self.other_addr && self.clock.Since(self.mobile_tx_ts) < address_probe_timeout {
+		//fmt.Printf("new remote address confirmed! %v -> %v\n", self.other_addr, *srcAddr)
+		self.set_other_addr(*srcAddr)
 	}
 }
 
+//authenticated packet from an address other than the far end's.
+func (self *session) recv_from_new_addr(addr string) {
+
+	switch address_validation {
+	case AddressValidationNone:
+		self.set_other_addr(addr)
+
+	case AddressValidationPing:
+		if self.clock.Since(self.mobile_tx_ts) > address_probe_interval {
+			//fmt.Printf("detect remote address changed. new address: %v\n", addr)
+			self.mobile_tx_ts = self.clock.Now()
+			self.probe_addr = addr
+			self.add_path(addr, false)
+			self.probe_challenge = self.probe_path(addr)
+		}
+	}
+}
+
+func (self *session) set_other_addr(addr string) {
+
+	old := self.other_addr
+	self.add_path(addr, false)
+	self.out_mutex.Lock()
+	self.other_addr = addr
+	self.out_mutex.Unlock()
+
+	if self.address_changed != nil {
+		self.address_changed(old, addr)
+	}
+}
+
+//other_addr for the goroutines other than the session's, which change it.
+func (self *session) remote_addr() string {
+	self.out_mutex.Lock()
+	defer self.out_mutex.Unlock()
+
+	return self.other_addr
+}
+
+//send packets of this session through the socket from now on, the previous socket
+//of the session is closed, the transport socket is kept for other sessions.
+func (self *session) migrate(socket *socket_bin) error {
+
+	self.out_mutex.Lock()
+	if self.closed {
+		self.out_mutex.Unlock()
+		return errors.New("session closed.")
+	}
+	if self.socket != nil {
+		self.socket.close()
+	}
+	self.socket = socket
+	self.out = socket.in
+	self.out_mutex.Unlock()
+
+	//let the far end see the new address, it will probe and move to it. a packet of
+	//pings alone look like a probe of a standby path and don't move it, see recv_packet(),
+	//so the flows are acked as well. without flows it move on the next data.
+	self.tasks <- func() {
+		self.probe_path(self.other_addr)
+
+		for _, flow := range self.recv_flows {
+			flow.send_ack()
+		}
+	}
+
+	return nil
+}
+
 func (self *session) send_userdata(fragmentControl uint8, flowid, sequnceNumber, fsnOffset uint, data, options []byte, abandon, final bool) {
+	self.tx_mutex.Lock()
 	self.c_user_data_tx++
+	self.tx_mutex.Unlock()
 
 	//fmt.Printf("send_userdata(flowid: %d sequnceNumber: %d)\n", flowid, sequnceNumber)
 
@@ -356,7 +625,7 @@ func (self *session) send_userdata(fragmentControl uint8, flowid, sequnceNumber,
 
 	chunk_buf.Write(data)
 
-	self.send_chunk(self.other_addr, 0x10, chunk_buf.Bytes())
+	self.send_chunk(self.remote_addr(), 0x10, chunk_buf.Bytes())
 }
 
 func (self *session) recv_userdata(srcAddr *string, fragmentControl uint8, flowid, sequenceNumber, fsnOffset uint, data, options []byte, abandon, final bool) {
@@ -382,15 +651,20 @@ func (self *session) recv_userdata(srcAddr *string, fragmentControl uint8, flowi
 	}
 
 	if flow != nil {
-		flow.on_userdata(fragmentControl, sequenceNumber, fsnOffset, data, options, abandon, final)
+		self.rx_packet_userdata++
+		if !flow.on_userdata(fragmentControl, sequenceNumber, fsnOffset, data, options, abandon, final) {
+			self.rx_packet_dup_userdata++
+		}
 	} else {
+		//refused by the owner of the session, e.g. a NetStream not created.
 		self.send_flow_exception_report(flowid, 0)
-		panic("unknown flow.")
 	}
 }
 
 func (self *session) send_range_ack(flowid, bufAvail, cumAck uint, recvRanges []Range) {
+	self.tx_mutex.Lock()
 	self.c_ack_tx++
+	self.tx_mutex.Unlock()
 
 	chunk_buf := bytes.NewBuffer(nil)
 
@@ -407,7 +681,7 @@ func (self *session) send_range_ack(flowid, bufAvail, cumAck uint, recvRanges []
 		ackCursor = rr.End()
 	}
 
-	self.send_chunk(self.other_addr, 0x51, chunk_buf.Bytes())
+	self.send_chunk(self.remote_addr(), 0x51, chunk_buf.Bytes())
 }
 
 func (self *session) recv_range_ack(srcAddr *string, flowid, bufAvail, cumAck uint, recvRanges []Range) {
@@ -429,7 +703,7 @@ func (self *session) send_buffer_probe(flowid uint) {
 
 	encode_vlu(chunk_buf, flowid)
 
-	self.send_chunk(self.other_addr, 0x18, chunk_buf.Bytes())
+	self.send_chunk(self.remote_addr(), 0x18, chunk_buf.Bytes())
 }
 
 func (self *session) recv_buffer_probe(srcAddr *string, flowid uint) {
@@ -468,11 +742,20 @@ func (self *session) send_session_close_request() {
 func (self *session) recv_session_close_request() {
 	fmt.Println("recv_session_close_request")
 
+	self.out_mutex.Lock()
+	self.closed = true
+	self.out_mutex.Unlock()
+	if self.on_close != nil {
+		self.on_close()
+	}
+
 	if self.recv_close_request != nil {
 		self.recv_close_request()
 	}
 
 	self.send_session_close_ack()
+
+	self.release_keys()
 }
 
 func (self *session) send_session_close_ack() {
@@ -488,15 +771,17 @@ func (self *session) send_chunk(dstAddr string, chunk_type uint8, chunk_data []b
 		mode: self.mode,
 	}
 
+	self.tx_mutex.Lock()
+
 	//include timestamp only when changed from last timestamp()
-	cur_ts := timestamp()
+	cur_ts := timestamp(self.clock.Now())
 	if self.ts_tx != cur_ts {
 		self.ts_tx = cur_ts
 		p.time_stamp = cur_ts
 	}
 
 	//include timestam echo within 128s after last recv timestamp.
-	ts_rx_elapsed := time.Since(self.ts_rx_time)
+	ts_rx_elapsed := self.clock.Since(self.ts_rx_time)
 	if ts_rx_elapsed > 128*time.Second {
 		self.ts_rx = 0
 		self.ts_rx_time = time.Time{}
@@ -513,6 +798,8 @@ func (self *session) send_chunk(dstAddr string, chunk_type uint8, chunk_data []b
 
 	}
 
+	self.tx_mutex.Unlock()
+
 	//RIKeying is special, other_sessionid != 0 and use default crypt key, shoule be in startup mode
 	crypt_key := self.ekey
 	if chunk_type == 0x78 { //RIKeying is special
@@ -523,38 +810,83 @@ func (self *session) send_chunk(dstAddr string, chunk_type uint8, chunk_data []b
 	p.init()
 	p.add_chunk(chunk_type, chunk_data)
 
-	self.send_packet(dstAddr, p.pack(self.other_sessionid, crypt_key))
+	self.send_packet(dstAddr, p.pack(self.other_sessionid, crypt_key, self.profile))
 }
 
 func (self *session) send_packet(dstAddr string, data []byte) {
+	self.tx_mutex.Lock()
 	self.c_packet_tx++
-	self.out <- &network_packet{addr: dstAddr, data: data}
+	self.tx_mutex.Unlock()
+
+	self.out_mutex.Lock()
+	out := self.out
+	self.out_mutex.Unlock()
+
+	out <- &network_packet{addr: dstAddr, data: data}
 }
 
 func (self *session) recv_packet(p *network_packet) {
 	self.c_packet_rx++
-	decode_packet(&p.addr, p.data, self.dkey, self, self)
+
+	self.rx_packet_userdata = 0
+	self.rx_packet_dup_userdata = 0
+	self.rx_packet_probe = 0
+
+	//before the packet is decrypted in place.
+	self.rx_digest = packet_digest(p.data)
+
+	chunks, ok := decode_packet(&p.addr, p.data, self.dkey, self.profile, self, self)
+	if !ok {
+		return
+	}
+
+	//no new data in it, may be a replayed packet.
+	if self.rx_packet_userdata > 0 && self.rx_packet_userdata == self.rx_packet_dup_userdata {
+		return
+	}
 
 	//destaddr changed?
-	if p.addr != self.other_addr && time.Since(self.mobile_tx_ts) > 1*time.Second {
-		fmt.Printf("detect remote address changed. new address: %v\n", p.addr)
-		self.mobile_tx_ts = time.Now()
-		self.send_ping(p.addr)
+	if p.addr != self.other_addr {
+
+		//a probe of another path of the far end, learn the address only. a far end moving
+		//to the address send more than pings from it, e.g. the acks of migrate().
+		if chunks > 0 && chunks == self.rx_packet_probe {
+			if self.add_path(p.addr, false) {
+				self.probe_path(p.addr)
+			}
+			return
+		}
+
+		self.recv_from_new_addr(p.addr)
 	}
+
+	self.probe_paths()
 }
 
 func (self *session) recv_packet_info(srcAddr *string, sid uint32, timeCritical, timeCriticalReverse bool,
-	mode uint8, ts, timestampEcho uint16) {
+	mode uint8, ts, timestampEcho uint16) bool {
+
+	//forged packets never fill the history.
+	if self.recent_packets == nil {
+		self.recent_packets = new_packet_history(recent_packets_size)
+	}
+	if self.handshaked() && !self.recent_packets.add(self.rx_digest) {
+		//replayed.
+		return false
+	}
+
+	self.tx_mutex.Lock()
+	defer self.tx_mutex.Unlock()
 
 	if ts != 0 && ts != self.ts_rx {
 		self.ts_rx = ts
-		self.ts_rx_time = time.Now()
+		self.ts_rx_time = self.clock.Now()
 	}
 
 	if timestampEcho != 0 && timestampEcho != self.ts_echo_rx {
 		self.ts_echo_rx = timestampEcho
 
-		rtt_ticks := (timestamp() - timestampEcho) /*% 65536*/
+		rtt_ticks := (timestamp(self.clock.Now()) - timestampEcho) /*% 65536*/
 		if rtt_ticks <= 32767 {
 			rtt := time.Duration(rtt_ticks) * 4 * time.Millisecond
 
@@ -580,6 +912,16 @@ func (self *session) recv_packet_info(srcAddr *string, sid uint32, timeCritical,
 	}
 
 	//fmt.Printf("MRTO: %v ERTO: %v SRTT: %v\n", self.mrto, self.erto, self.srtt)
+
+	return true
+}
+
+//the retransmit timeout of the flows.
+func (self *session) rto() time.Duration {
+	self.tx_mutex.Lock()
+	defer self.tx_mutex.Unlock()
+
+	return self.erto
 }
 
 func (self *session) new_flowid() uint {
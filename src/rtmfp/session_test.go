@@ -1,6 +1,7 @@
 package rtmfp
 
 import (
+	"bytes"
 	"testing"
 	"time"
 )
@@ -29,3 +30,259 @@ func TestSession(t *testing.T) {
 
 	time.Sleep(100 * time.Millisecond) //100ms is enough to run the logic.
 }
+
+//sessions connected by channels, with a flow from the initiator.
+func create_session_pair() (initiator, responder *session, flow *send_flow) {
+
+	chan_a := make(chan *network_packet, network_packet_chan_default_buffer_size)
+	chan_b := make(chan *network_packet, network_packet_chan_default_buffer_size)
+
+	initiator = &session{
+		in:        chan_a,
+		out:       chan_b,
+		sessionid: 1,
+	}
+
+	responder = &session{
+		in:        chan_b,
+		out:       chan_a,
+		sessionid: 2,
+	}
+
+	responder.passive_open()
+	initiator.active_open("", nil, nil)
+
+	responder.create_recv_flow = func(options []byte, flowid uint) (*recv_flow, error) {
+		return responder.new_recv_flow(flowid)
+	}
+
+	flow, _ = initiator.new_send_flow(0, nil)
+	flow.send([]byte("hello"))
+
+	time.Sleep(50 * time.Millisecond)
+
+	return
+}
+
+//a packet of the initiator carrying the user data seq of the flow.
+func userdata_packet(initiator, responder *session, flow *send_flow, seq uint) []byte {
+	chunk_buf := bytes.NewBuffer(nil)
+	chunk_buf.WriteByte(fc_whole << 4)
+	encode_vlu(chunk_buf, flow.flowid)
+	encode_vlu(chunk_buf, seq)
+	encode_vlu(chunk_buf, 0)
+	chunk_buf.Write([]byte("hello"))
+
+	p := &packet{mode: mode_initiator}
+	p.init()
+	p.add_chunk(0x10, chunk_buf.Bytes())
+
+	return p.pack(responder.sessionid, initiator.ekey, nil)
+}
+
+//run f on the session goroutine, where the packets from the network are received.
+func run_in_session(s *session, f func()) {
+	done := make(chan bool)
+	s.tasks <- func() {
+		f()
+		close(done)
+	}
+	<-done
+}
+
+//receive p on the session goroutine, and tell the time the session last saw the far end move.
+func recv_in_session(s *session, p *network_packet) (mobile_tx_ts time.Time) {
+	run_in_session(s, func() {
+		s.recv_packet(p)
+		mobile_tx_ts = s.mobile_tx_ts
+	})
+	return
+}
+
+func TestReplayedDataNoMobility(t *testing.T) {
+
+	initiator, responder, flow := create_session_pair()
+
+	userdata := func(seq uint) []byte {
+		return userdata_packet(initiator, responder, flow, seq)
+	}
+
+	//replay the first message from another address.
+	if !recv_in_session(responder, &network_packet{addr: "10.0.0.1:1935", data: userdata(1)}).IsZero() {
+		t.Fatal("replayed packet trigger address change.")
+	}
+
+	//forged packet
+	if !recv_in_session(responder, &network_packet{addr: "10.0.0.1:1935", data: []byte("0123456789abcdef0123456789abcdef")}).IsZero() {
+		t.Fatal("forged packet trigger address change.")
+	}
+
+	if recv_in_session(responder, &network_packet{addr: "10.0.0.1:1935", data: userdata(2)}).IsZero() {
+		t.Fatal("new data should trigger address change.")
+	}
+}
+
+func TestAddressValidation(t *testing.T) {
+
+	defer func(policy AddressValidation) { address_validation = policy }(address_validation)
+
+	new_addr := "10.0.0.1:1935"
+
+	//ping: move only after the probed address echo the challenge.
+	address_validation = AddressValidationPing
+
+	initiator, responder, flow := create_session_pair()
+	old_addr := responder.remote_addr()
+
+	var changed []string
+	var probe_addr string
+	var challenge []byte
+
+	run_in_session(responder, func() {
+		responder.address_changed = func(oldAddr, newAddr string) {
+			changed = append(changed, oldAddr, newAddr)
+		}
+
+		responder.recv_packet(&network_packet{addr: new_addr, data: userdata_packet(initiator, responder, flow, 2)})
+		probe_addr, challenge = responder.probe_addr, responder.probe_challenge
+	})
+
+	if responder.remote_addr() != old_addr || probe_addr != new_addr || challenge == nil {
+		t.Fatal("new address should be probed.")
+	}
+
+	other := "10.0.0.2:1935"
+	run_in_session(responder, func() {
+		responder.recv_ping_reply(&other, challenge)
+		responder.recv_ping_reply(&new_addr, []byte("hello"))
+	})
+
+	if responder.remote_addr() != old_addr || len(changed) != 0 {
+		t.Fatal("moved without a valid probe reply.")
+	}
+
+	run_in_session(responder, func() {
+		responder.recv_ping_reply(&new_addr, challenge)
+	})
+
+	if responder.remote_addr() != new_addr || len(changed) != 2 || changed[0] != old_addr || changed[1] != new_addr {
+		t.Fatal("not moved to the validated address.", responder.remote_addr(), changed)
+	}
+
+	//a probe reply is accepted only once.
+	run_in_session(responder, func() {
+		responder.set_other_addr(old_addr)
+		responder.recv_ping_reply(&new_addr, challenge)
+	})
+
+	if responder.remote_addr() != old_addr {
+		t.Fatal("probe reply accepted twice.")
+	}
+
+	//none: move on the first authenticated packet.
+	address_validation = AddressValidationNone
+
+	initiator, responder, flow = create_session_pair()
+	old_addr = responder.remote_addr()
+
+	recv_in_session(responder, &network_packet{addr: new_addr, data: []byte("0123456789abcdef0123456789abcdef")})
+
+	if responder.remote_addr() != old_addr {
+		t.Fatal("forged packet move the session.")
+	}
+
+	recv_in_session(responder, &network_packet{addr: new_addr, data: userdata_packet(initiator, responder, flow, 2)})
+
+	if responder.remote_addr() != new_addr {
+		t.Fatal("not moved to the new address.")
+	}
+
+	//disabled: never move, never probe.
+	address_validation = AddressValidationDisabled
+
+	initiator, responder, flow = create_session_pair()
+	old_addr = responder.remote_addr()
+
+	mobile_tx_ts := recv_in_session(responder, &network_packet{addr: new_addr, data: userdata_packet(initiator, responder, flow, 2)})
+
+	if responder.remote_addr() != old_addr || !mobile_tx_ts.IsZero() {
+		t.Fatal("address change should be ignored.")
+	}
+}
+
+func TestReplayedPacketNoMobility(t *testing.T) {
+
+	initiator, responder, flow := create_session_pair()
+
+	//new data and an ack, received once from the address of the initiator.
+	chunk_buf := bytes.NewBuffer(nil)
+	chunk_buf.WriteByte(fc_whole << 4)
+	encode_vlu(chunk_buf, flow.flowid)
+	encode_vlu(chunk_buf, 2)
+	encode_vlu(chunk_buf, 0)
+	chunk_buf.Write([]byte("hello"))
+
+	ack_buf := bytes.NewBuffer(nil)
+	encode_vlu(ack_buf, 1)
+	encode_vlu(ack_buf, 0x7f)
+	encode_vlu(ack_buf, 0)
+
+	p := &packet{mode: mode_initiator}
+	p.init()
+	p.add_chunk(0x10, chunk_buf.Bytes())
+	p.add_chunk(0x51, ack_buf.Bytes())
+	data := p.pack(responder.sessionid, initiator.ekey, nil)
+
+	other_addr := responder.remote_addr()
+
+	recv_in_session(responder, &network_packet{addr: other_addr, data: append([]byte(nil), data...)})
+
+	//replayed from another address.
+	if !recv_in_session(responder, &network_packet{addr: "10.0.0.1:1935", data: append([]byte(nil), data...)}).IsZero() {
+		t.Fatal("replayed packet trigger address change.")
+	}
+
+	//nothing but an ack.
+	p = &packet{mode: mode_initiator}
+	p.init()
+	p.add_chunk(0x51, ack_buf.Bytes())
+	data = p.pack(responder.sessionid, initiator.ekey, nil)
+
+	recv_in_session(responder, &network_packet{addr: other_addr, data: append([]byte(nil), data...)})
+	if !recv_in_session(responder, &network_packet{addr: "10.0.0.1:1935", data: append([]byte(nil), data...)}).IsZero() {
+		t.Fatal("replayed ack trigger address change.")
+	}
+
+	//forged packets do not push the packets received out of the history.
+	ack_buf = bytes.NewBuffer(nil)
+	encode_vlu(ack_buf, 1)
+	encode_vlu(ack_buf, 0x7e)
+	encode_vlu(ack_buf, 0)
+
+	p = &packet{mode: mode_initiator}
+	p.init()
+	p.add_chunk(0x51, ack_buf.Bytes())
+	data = p.pack(responder.sessionid, initiator.ekey, nil)
+
+	recv_in_session(responder, &network_packet{addr: other_addr, data: append([]byte(nil), data...)})
+
+	for i := 0; i < recent_packets_size; i++ {
+		forged := append(append([]byte(nil), data...), byte(i), byte(i>>8))
+		recv_in_session(responder, &network_packet{addr: "10.0.0.1:1935", data: forged})
+	}
+
+	if !recv_in_session(responder, &network_packet{addr: "10.0.0.1:1935", data: append([]byte(nil), data...)}).IsZero() {
+		t.Fatal("replayed packet accepted after forged packets.")
+	}
+}
+
+func TestPacketHistory(t *testing.T) {
+
+	//the oldest is forgotten.
+	h := new_packet_history(2)
+	for i, expect := range []bool{true, true, false, true, true, false} {
+		if h.add(packet_digest([]byte{"abacac"[i]})) != expect {
+			t.Fatal("unexpected history at", i)
+		}
+	}
+}
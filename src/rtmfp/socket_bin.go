@@ -1,8 +1,10 @@
 package rtmfp
 
 import (
+	"errors"
 	//	"fmt"
 	"net"
+	"sync"
 )
 
 var max_udp_packet_size = 2 * 1024
@@ -16,21 +18,41 @@ type network_packet struct {
 
 type socket_bin struct {
 	in, out chan *network_packet
-	conn    net.PacketConn
+	conns   []net.PacketConn //one for each IP family when listen dual stack
 	closed  bool
+
+	closed_mutex sync.Mutex //closed by the owner, read by the receiving goroutines.
 }
 
 func (self *socket_bin) open(local string) (err error) {
 
-	self.conn, err = net.ListenPacket("udp", local)
+	conn, err := net.ListenPacket("udp", local)
 	if err != nil {
 		return
 	}
 
+	return self.open_conn(conn)
+}
+
+//run on connections opened by others, e.g. a virtual network in tests. with more than one
+//connection, packets are sent from the one of the destination's IP family.
+//out may be set before, to share the received packets with other sockets.
+func (self *socket_bin) open_conn(conns ...net.PacketConn) error {
+
+	if len(conns) == 0 {
+		return errors.New("no connection.")
+	}
+
+	self.conns = conns
+
 	self.in = make(chan *network_packet, network_packet_chan_default_buffer_size)
-	self.out = make(chan *network_packet, network_packet_chan_default_buffer_size)
+	if self.out == nil {
+		self.out = make(chan *network_packet, network_packet_chan_default_buffer_size)
+	}
 
-	go self.recv()
+	for _, conn := range conns {
+		go self.recv(conn)
+	}
 	go self.dispatch()
 
 	return nil
@@ -38,8 +60,20 @@ func (self *socket_bin) open(local string) (err error) {
 
 func (self *socket_bin) close() {
 
+	self.closed_mutex.Lock()
 	self.closed = true
-	self.conn.Close()
+	self.closed_mutex.Unlock()
+
+	for _, conn := range self.conns {
+		conn.Close()
+	}
+}
+
+func (self *socket_bin) is_closed() bool {
+	self.closed_mutex.Lock()
+	defer self.closed_mutex.Unlock()
+
+	return self.closed
 }
 
 func (self *socket_bin) dispatch() {
@@ -52,19 +86,23 @@ func (self *socket_bin) dispatch() {
 	}
 }
 
-func (self *socket_bin) recv() {
+func (self *socket_bin) recv(conn net.PacketConn) {
 
 	err_count := 0
 
-	for !self.closed {
+	for !self.is_closed() {
 
 		buf := make([]byte, max_udp_packet_size)
 
-		readed_size, raddr, err := self.conn.ReadFrom(buf)
+		readed_size, raddr, err := conn.ReadFrom(buf)
 
 		//NOTE:ReadFrom may mistake fail on windows platform, we should ignore and retry.
 		//https://code.google.com/p/go/issues/detail?id=5834
 
+		if errors.Is(err, net.ErrClosed) {
+			break
+		}
+
 		if err != nil {
 			err_count++
 			if err_count > 1000 {
@@ -85,13 +123,40 @@ func (self *socket_bin) recv() {
 
 func (self *socket_bin) send_packet(p *network_packet) {
 
-	udp_addr, _ := net.ResolveUDPAddr("udp", p.addr)
+	udp_addr, err := net.ResolveUDPAddr("udp", p.addr)
+	if err != nil {
+		return
+	}
 
 	//fmt.Printf("send_packet:%v\n", p.addr)
 
-	self.conn.WriteTo(p.data, udp_addr)
+	self.conn_for(udp_addr).WriteTo(p.data, udp_addr)
+}
+
+//the connection bound to the destination's IP family, the first one if none.
+func (self *socket_bin) conn_for(dst *net.UDPAddr) net.PacketConn {
+
+	if len(self.conns) > 1 {
+		ipv4 := dst.IP.To4() != nil
+
+		for _, conn := range self.conns {
+			if local, ok := conn.LocalAddr().(*net.UDPAddr); ok && (local.IP.To4() != nil) == ipv4 {
+				return conn
+			}
+		}
+	}
+
+	return self.conns[0]
 }
 
 func (self *socket_bin) local_addr() net.Addr {
-	return self.conn.LocalAddr()
+	return self.conns[0].LocalAddr()
+}
+
+func (self *socket_bin) local_addrs() []string {
+	addrs := make([]string, len(self.conns))
+	for i, conn := range self.conns {
+		addrs[i] = conn.LocalAddr().String()
+	}
+	return addrs
 }
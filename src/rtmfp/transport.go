@@ -3,6 +3,10 @@ package rtmfp
 import (
 	"errors"
 	"io"
+	"net"
+	"rtmfp/amf"
+	"rtmfp/remoting"
+	"strings"
 	"time"
 
 	//	"encoding/hex"
@@ -15,7 +19,15 @@ type Transport struct {
 	socket    *socket_bin
 	handshake *handshake
 
-	stream_handler StreamHandler
+	stream_handler         StreamHandler
+	connect_handler        ConnectHandler
+	stream_command_handler StreamCommandHandler
+	crypto_profile         CryptoProfile
+	rendezvous             bool
+	clock                  clock //nil for the real clock, tests may run transports on a sim_clock.
+	listen_func            func(localAddr string) (net.PacketConn, error)
+	services               *remoting.Registry
+	publications           *publications //of the NetStreams of Flash clients.
 
 	in_chan, out_chan *noisy_chan
 }
@@ -24,32 +36,104 @@ func (self *Transport) SetStreamHandler(h StreamHandler) {
 	self.stream_handler = h
 }
 
-func (self *Transport) SetInChannelParam(delay time.Duration, capacity, lose_rate, speed int) {
+//accept or reject the connect of the NetConnection of a Flash client, every connect is
+//accepted without it. the NetStream flows of the client are accepted after it connected.
+func (self *Transport) SetConnectHandler(h ConnectHandler) {
+	self.connect_handler = h
+}
+
+//accept or reject the control commands of the NetStreams of Flash clients before they
+//are answered, every command is accepted without it.
+func (self *Transport) SetStreamCommandHandler(h StreamCommandHandler) {
+	self.stream_command_handler = h
+}
+
+//answer the calls of the far end to the functions of r, as the remoting.Gateway does
+//over HTTP: a call received on a NetConnection is called with its arguments, and answered
+//with "_result" and the result, or "_error" and the fault, by its transaction id. should
+//be called before Open().
+func (self *Transport) SetServices(r *remoting.Registry) {
+	self.services = r
+}
+
+//should be called before Open(), both ends should use the same profile. default is FlashCryptoProfile.
+func (self *Transport) SetCryptoProfile(profile CryptoProfile) {
+	self.crypto_profile = profile
+}
+
+//act as a rendezvous service, peers connected to us can be reached by their peerid:
+//an IHello for a connected peer is answered with a Redirect to the peer's address,
+//and forwarded to the peer as FIHello. should be called before Open().
+func (self *Transport) SetRendezvous(enable bool) {
+	self.rendezvous = enable
+}
+
+//impair packets received from the network, for tests. should be called after Open().
+func (self *Transport) SetInChannelProfile(profile ChannelProfile) {
 	nc := &noisy_chan{
-		in:        self.socket.out,
-		lose_rate: lose_rate,
-		delay:     delay,
-		capacity:  capacity,
-		speed:     speed,
+		in:      self.socket.out,
+		clock:   self.clock,
+		profile: profile,
 	}
 	nc.open()
 	self.handshake.in = nc.out
 	self.in_chan = nc
 }
 
-func (self *Transport) SetOutChannelParam(delay time.Duration, capacity, lose_rate, speed int) {
+//impair packets sent to the network, independent of the in channel. should be called after Open().
+func (self *Transport) SetOutChannelProfile(profile ChannelProfile) {
 	nc := &noisy_chan{
-		in:        self.handshake.out,
-		lose_rate: lose_rate,
-		delay:     delay,
-		capacity:  capacity,
-		speed:     speed,
+		in:      self.handshake.out,
+		clock:   self.clock,
+		profile: profile,
 	}
 	nc.open()
 	self.socket.in = nc.out
 	self.out_chan = nc
 }
 
+func (self *Transport) SetInChannelParam(delay time.Duration, capacity, lose_rate, speed int) {
+	self.SetInChannelProfile(ChannelProfile{Delay: delay, Capacity: capacity, LoseRate: lose_rate, Speed: speed})
+}
+
+func (self *Transport) SetOutChannelParam(delay time.Duration, capacity, lose_rate, speed int) {
+	self.SetOutChannelProfile(ChannelProfile{Delay: delay, Capacity: capacity, LoseRate: lose_rate, Speed: speed})
+}
+
+//open sockets for Open() and Session.Migrate(), default is udp of the os.
+func (self *Transport) SetListenFunc(fn func(localAddr string) (net.PacketConn, error)) {
+	self.listen_func = fn
+}
+
+func (self *Transport) listen(localAddr string) (net.PacketConn, error) {
+	if self.listen_func != nil {
+		return self.listen_func(localAddr)
+	}
+	return net.ListenPacket("udp", localAddr)
+}
+
+//how sessions follow the far end to a new address. default is AddressValidationPing.
+func (self *Transport) SetAddressValidation(policy AddressValidation) {
+	address_validation = policy
+}
+
+//number of packets the AEAD profile remember to reject replayed packets, 0 disable replay protection.
+//should be called before Open().
+func (self *Transport) SetReplayWindowSize(size int) {
+	aead_replay_window_size = size
+}
+
+//how long NetConnection calls wait for their response. default is 10s.
+func (self *Transport) SetCallTimeout(timeout time.Duration) {
+	net_connection_call_timeout = timeout
+}
+
+//record the streams published with the "record" type to dir, as name.flv, and play
+//them back. streams are not recorded by default.
+func (self *Transport) SetMediaDir(dir string) {
+	media_dir = dir
+}
+
 func (self *Transport) SetFlowRecvBufSize(size int) {
 	max_recv_buf_size = uint(size)
 }
@@ -62,16 +146,56 @@ func (self *Transport) SetFastGrow(fg bool) {
 	fastgrow_allowed = fg
 }
 
+//when dial by peerid, only accept the responder whose certificate match the peerid. default is true.
+func (self *Transport) SetStrictPeeridCheck(strict bool) {
+	strict_peerid_check = strict
+}
+
 func (self *Transport) Open(localAddr string, pseudoId []byte) (err error) {
+
+	conn, err := self.listen(localAddr)
+	if err != nil {
+		return err
+	}
+
+	return self.OpenConn(conn, pseudoId)
+}
+
+//listen on an IPv4 and an IPv6 address, e.g. "0.0.0.0:1935" and "[::]:1935", packets
+//to a far end are sent from the socket of its IP family.
+func (self *Transport) OpenDualStack(localAddr4, localAddr6 string, pseudoId []byte) (err error) {
+
+	conn4, err := self.listen(localAddr4)
+	if err != nil {
+		return err
+	}
+
+	conn6, err := self.listen(localAddr6)
+	if err != nil {
+		conn4.Close()
+		return err
+	}
+
+	return self.OpenConn(conn4, pseudoId, conn6)
+}
+
+//same as Open(), but run on the given connection, the transport take the ownership of it.
+//more connections of other IP families may follow.
+func (self *Transport) OpenConn(conn net.PacketConn, pseudoId []byte, more ...net.PacketConn) (err error) {
 	self.socket = &socket_bin{}
-	err = self.socket.open(localAddr)
+	err = self.socket.open_conn(append([]net.PacketConn{conn}, more...)...)
 	if err != nil {
 		return err
 	}
 
+	self.publications = new_publications()
+
 	self.handshake = &handshake{
-		in:  self.socket.out,
-		out: self.socket.in,
+		in:         self.socket.out,
+		out:        self.socket.in,
+		profile:    self.crypto_profile,
+		rendezvous: self.rendezvous,
+		clock:      self.clock,
 	}
 
 	if len(pseudoId) < len(self.handshake.pseudo_id) {
@@ -80,25 +204,52 @@ func (self *Transport) Open(localAddr string, pseudoId []byte) (err error) {
 		copy(self.handshake.pseudo_id[0:len(self.handshake.pseudo_id)], pseudoId)
 	}
 
-	self.handshake.create_passive_session = func(addr string, nearid []byte) (s *session, err error) {
+	self.handshake.create_passive_session = func(addr string, peerid []byte) (s *session, err error) {
 
 		s = self.handshake.new_session()
 		s.passive_open()
 
-		//NOTE: nearid is not the same as peerid.
-
-		stream := &bi_stream{ /*name: hex.EncodeToString(nearid)*/}
+		stream := &bi_stream{ /*name: hex.EncodeToString(peerid)*/ }
 		err = stream.passive_open(s /*hex.EncodeToString(self.Peerid())*/, "WHATEVER")
 		if err != nil {
 			return nil, err
 		}
 
+		//the NetConnection of the far end, if it open one, share the session with the stream.
+		nc := &net_connection{session: s, services: self.services, publications: self.publications}
+		conn := &NetConnection{conn: nc, transport: self}
+		if h := self.connect_handler; h != nil {
+			nc.on_connect = func(info *ConnectInfo) error {
+				return h(conn, info)
+			}
+		}
+		if h := self.stream_command_handler; h != nil {
+			nc.on_stream_command = func(id float64, cmd string, args []interface{}) error {
+				return h(conn, id, cmd, args)
+			}
+		}
+
+		stream_recv_flow := s.create_recv_flow
+		s.create_recv_flow = func(options []byte, flowid uint) (*recv_flow, error) {
+			if nc.recvFlow == nil && is_net_connection_flow(options) {
+				return nc.passive_open(flowid)
+			}
+			if nc.recvFlow != nil {
+				return nc.accept_stream_flow(options, flowid)
+			}
+			return stream_recv_flow(options, flowid)
+		}
+
 		if self.stream_handler == nil {
+			if self.connect_handler != nil {
+				//only Flash clients.
+				return s, nil
+			}
 			panic("SetStreamHandler() before Open()!")
 			return nil, errors.New("StreamHandler not set.")
 		}
 
-		if self.stream_handler(&BiStream{stream: stream}, addr) {
+		if self.stream_handler(&BiStream{stream: stream, transport: self}, addr) {
 			return s, nil
 		} else {
 			return nil, errors.New("stream handler return false.")
@@ -120,13 +271,30 @@ func (self *Transport) CreateBiStream(dstAddr string, dstPeerid []byte) (*BiStre
 		return nil, err
 	}
 
-	stream := &bi_stream{ /*name: hex.EncodeToString(dstPeerid)*/}
+	stream := &bi_stream{ /*name: hex.EncodeToString(dstPeerid)*/ }
 	err = stream.active_open(s /*hex.EncodeToString(self.Peerid())*/, "WHATEVER")
 	if err != nil {
 		return nil, err
 	}
 
-	return &BiStream{stream: stream}, nil
+	return &BiStream{stream: stream, transport: self}, nil
+}
+
+//open the NetConnection of a new session, Connect() before other calls.
+func (self *Transport) CreateNetConnection(dstAddr string, dstPeerid []byte) (*NetConnection, error) {
+
+	s, err := self.handshake.create_session(dstAddr, dstPeerid)
+	if err != nil {
+		return nil, err
+	}
+
+	nc := &net_connection{session: s, services: self.services}
+	if err := nc.active_open(); err != nil {
+		s.close()
+		return nil, err
+	}
+
+	return &NetConnection{conn: nc, transport: self}, nil
 }
 
 func (self *Transport) Peerid() []byte {
@@ -137,6 +305,11 @@ func (self *Transport) LocalAddr() string {
 	return self.socket.local_addr().String()
 }
 
+//addresses of all sockets, see OpenDualStack().
+func (self *Transport) LocalAddrs() []string {
+	return self.socket.local_addrs()
+}
+
 func (self *Transport) DumpState(w io.Writer) {
 	fmt.Fprintln(w, "[IN_QUEUE]")
 	dump_queue_state(self.in_chan, w)
@@ -148,9 +321,11 @@ func (self *Transport) DumpState(w io.Writer) {
 func dump_queue_state(nc *noisy_chan, w io.Writer) {
 	if nc != nil {
 
+		queued := nc.queued()
+
 		load := 0
-		if nc.capacity != 0 {
-			load = nc.packets.Len() * 100 / nc.capacity
+		if nc.profile.Capacity != 0 {
+			load = queued * 100 / nc.profile.Capacity
 		}
 
 		drop := 0
@@ -158,16 +333,19 @@ func dump_queue_state(nc *noisy_chan, w io.Writer) {
 			drop = nc.drop_count * 100 / nc.rx_count
 		}
 
-		fmt.Fprintf(w, "speed: %d\tdelay: %v\tcap: %d\tqueued: %d\tload: %d%%\trx: %d\tdrop: %d%%\ttx: %d\n",
-			nc.speed, nc.delay, nc.capacity, nc.packets.Len(),
-			load, nc.rx_count, drop, nc.tx_count)
+		speed := nc.profile.speed_at(nc.clock.Since(nc.open_time))
+
+		fmt.Fprintf(w, "speed: %d\tdelay: %v\tjitter: %v\tcap: %d\tqueued: %d\tload: %d%%\trx: %d\tdrop: %d%%\tdup: %d\tcorrupt: %d\ttx: %d\n",
+			speed, nc.profile.Delay, nc.profile.Jitter, nc.profile.Capacity, queued,
+			load, nc.rx_count, drop, nc.dup_count, nc.corrupt_count, nc.tx_count)
 	} else {
 		fmt.Fprintf(w, "n/a")
 	}
 }
 
 type BiStream struct {
-	stream *bi_stream
+	stream    *bi_stream
+	transport *Transport
 }
 
 func (self *BiStream) Close() {
@@ -182,6 +360,227 @@ func (self *BiStream) Recv() ([]byte, error) {
 	return self.stream.recv()
 }
 
+//peerid of the remote end verified during handshake, nil for passive opened stream.
+func (self *BiStream) FarPeerid() []byte {
+	return self.stream.ns.session.far_peerid
+}
+
+func (self *BiStream) Session() *Session {
+	return &Session{session: self.stream.session, transport: self.transport}
+}
+
 func (self *BiStream) DumpState(w io.Writer) {
 	self.stream.dump_state(w)
 }
+
+type NetConnection struct {
+	conn      *net_connection
+	transport *Transport
+}
+
+//connect to the application app of the far end, args are the arguments of the
+//connect command after its command object.
+func (self *NetConnection) Connect(app string, args ...interface{}) error {
+	return self.conn.connect(app, args...)
+}
+
+//the id of a new NetStream.
+func (self *NetConnection) CreateStream() (float64, error) {
+	return self.conn.create_stream()
+}
+
+func (self *NetConnection) DeleteStream(id float64) error {
+	return self.conn.delete_stream(id)
+}
+
+//call the function name of the far end, and wait for its result. an _error response
+//is returned as a *remoting.Fault, with the info object as Details.
+func (self *NetConnection) Call(name string, args ...interface{}) (interface{}, error) {
+
+	res, err := self.conn.call(name, nil, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(res.args) == 0 {
+		return nil, nil
+	}
+	return res.args[0], nil
+}
+
+//close the session of the NetConnection.
+func (self *NetConnection) Close() {
+	self.conn.close()
+}
+
+func (self *NetConnection) Session() *Session {
+	return &Session{session: self.conn.session, transport: self.transport}
+}
+
+//a NetStream of a NetConnection, publishing or playing media.
+type NetStream struct {
+	stream *net_stream
+	conn   *NetConnection
+	id     float64
+
+	status chan *net_status
+	media  chan *MediaMessage
+}
+
+//create a NetStream after Connect().
+func (self *NetConnection) CreateNetStream() (*NetStream, error) {
+
+	id, err := self.conn.create_stream()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &NetStream{
+		conn:   self,
+		id:     id,
+		status: make(chan *net_status, 16),
+		media:  make(chan *MediaMessage, 1000),
+	}
+
+	s.stream = &net_stream{
+		handler:  s.recv_command,
+		on_media: s.recv_media,
+		on_close: func() {
+			close(s.media)
+		},
+	}
+
+	if err := self.conn.open_stream(id, s.stream); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (self *NetStream) recv_command(cmd string, param interface{}) {
+
+	if cmd != "onStatus" {
+		return
+	}
+
+	status := &net_status{}
+	if amf.Convert(param, status) != nil {
+		return
+	}
+
+	//fmt.Printf("onStatus:%s\n", status.Code)
+
+	select {
+	case self.status <- status:
+	default:
+	}
+}
+
+//received on the session goroutine, which never wait for a player not calling Recv().
+func (self *NetStream) recv_media(m *MediaMessage) {
+	select {
+	case self.media <- m:
+	default:
+		//dropped, the player is too far behind.
+	}
+}
+
+//wait for the status code, or an error status with the prefix of its code, or NetStream.Failed.
+func (self *NetStream) wait_status(code string) error {
+
+	prefix := code[:strings.LastIndex(code, ".")+1]
+	timeout := self.stream.session.clock.After(net_connection_call_timeout)
+
+	for {
+		select {
+		case status := <-self.status:
+			if status.Code == code {
+				return nil
+			}
+			if status.Level == "error" && (strings.HasPrefix(status.Code, prefix) || status.Code == "NetStream.Failed") {
+				return &remoting.Fault{Code: status.Code, Description: status.Description}
+			}
+		case <-timeout:
+			return errors.New("no " + code + " in " + net_connection_call_timeout.String() + ".")
+		}
+	}
+}
+
+//publish the stream name, an error if it is already published.
+func (self *NetStream) Publish(name string) error {
+	self.stream.publish(name)
+	return self.wait_status("NetStream.Publish.Start")
+}
+
+//play the stream name, the media is received when it is published.
+func (self *NetStream) Play(name string) error {
+	self.stream.play(name)
+	return self.wait_status("NetStream.Play.Start")
+}
+
+//publish the stream name and record it, the recording replace the previous one.
+//the stream is published when the error is a NetStream.Record fault.
+func (self *NetStream) Record(name string) error {
+	self.stream.record(name)
+	if err := self.wait_status("NetStream.Publish.Start"); err != nil {
+		return err
+	}
+	return self.wait_status("NetStream.Record.Start")
+}
+
+//play the recording of name from start, NetStream.Play.Stop is sent at its end.
+func (self *NetStream) PlayRecorded(name string, start time.Duration) error {
+	self.stream.play_recorded(name, float64(start/time.Millisecond))
+	return self.wait_status("NetStream.Play.Start")
+}
+
+//seek the recording played to the keyframe before offset.
+func (self *NetStream) Seek(offset time.Duration) error {
+	self.stream.send("seek", float64(offset/time.Millisecond))
+	return self.wait_status("NetStream.Seek.Notify")
+}
+
+//pause the stream played, the live stream is resumed from its next keyframe, and the
+//recording from where it is paused.
+func (self *NetStream) Pause() error {
+	self.stream.send_command("pause", true, 0.0)
+	return self.wait_status("NetStream.Pause.Notify")
+}
+
+func (self *NetStream) Resume() error {
+	self.stream.send_command("pause", false, 0.0)
+	return self.wait_status("NetStream.Unpause.Notify")
+}
+
+//receive the audio of the stream played or not, it is received by default.
+func (self *NetStream) ReceiveAudio(flag bool) error {
+	return self.stream.send("receiveAudio", flag)
+}
+
+//receive the video of the stream played or not, it is received again from a keyframe.
+func (self *NetStream) ReceiveVideo(flag bool) error {
+	return self.stream.send("receiveVideo", flag)
+}
+
+//send audio, video or data of a published stream.
+func (self *NetStream) Send(m *MediaMessage) error {
+	return self.stream.send_media(m)
+}
+
+//the next media played, an error when the stream is closed. the media received while 1000
+//messages are not read yet are dropped.
+func (self *NetStream) Recv() (*MediaMessage, error) {
+
+	m, ok := <-self.media
+	if !ok {
+		return nil, errors.New("stream closed.")
+	}
+
+	return m, nil
+}
+
+//stop publishing or playing, and delete the stream.
+func (self *NetStream) Close() error {
+	self.stream.send("closeStream", nil)
+	return self.conn.conn.delete_stream(self.id)
+}
@@ -1,10 +1,13 @@
 package rtmfp
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"rtmfp/remoting"
+	"rtmfp/vnet"
 	"testing"
 	"time"
-
-//	"fmt"
 )
 
 func TestTransport(t *testing.T) {
@@ -50,3 +53,183 @@ func TestTransport(t *testing.T) {
 		t.Fatal("timeout")
 	}
 }
+
+func TestRendezvous(t *testing.T) {
+
+	server := &Transport{}
+	server.SetRendezvous(true)
+	server.SetStreamHandler(func(*BiStream, string) bool { return true })
+	server.Open("127.0.0.1:0", []byte("server"))
+	defer server.Close()
+
+	done := make(chan string, 1)
+
+	target := &Transport{}
+	target.SetStreamHandler(func(stream *BiStream, addr string) bool {
+		go func() {
+			data, _ := stream.Recv()
+			done <- string(data)
+		}()
+		return true
+	})
+	target.Open("127.0.0.1:0", []byte("target"))
+	defer target.Close()
+
+	//register to the rendezvous service.
+	_, err := target.CreateBiStream(server.LocalAddr(), server.Peerid())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	initiator := &Transport{}
+	initiator.SetStreamHandler(func(*BiStream, string) bool { return false })
+	initiator.Open("127.0.0.1:0", []byte("initiator"))
+	defer initiator.Close()
+
+	//ask the server for the target.
+	stream, err := initiator.CreateBiStream(server.LocalAddr(), target.Peerid())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(stream.FarPeerid(), target.Peerid()) {
+		t.Fatal("not connected to the target.")
+	}
+
+	stream.Send([]byte("hello"))
+
+	select {
+	case msg := <-done:
+		if msg != "hello" {
+			t.Fatal("msg not match.")
+		}
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("timeout")
+	}
+}
+
+func TestTransportVnet(t *testing.T) {
+
+	sw := vnet.NewSwitch()
+	defer sw.Close()
+
+	sw.SetLinkFunc(vnet_link_func(ChannelProfile{Delay: 5 * time.Millisecond}))
+
+	conn, _ := sw.Listen("10.0.0.1:1935")
+
+	server := &Transport{}
+	server.SetStreamHandler(func(stream *BiStream, addr string) bool {
+		go func() {
+			for {
+				data, err := stream.Recv()
+				if err != nil {
+					return
+				}
+				stream.Send(data)
+			}
+		}()
+		return true
+	})
+	server.OpenConn(conn, []byte("server"))
+	defer server.Close()
+
+	if server.LocalAddr() != "10.0.0.1:1935" {
+		t.Fatal("unexpected local address.", server.LocalAddr())
+	}
+
+	clients := 30
+	done := make(chan error, clients)
+
+	for i := 0; i < clients; i++ {
+
+		conn, _ := sw.Listen(fmt.Sprintf("10.0.1.%d:1935", i+1))
+
+		c := &Transport{}
+		c.SetStreamHandler(func(*BiStream, string) bool { return false })
+		c.OpenConn(conn, []byte(fmt.Sprintf("client%d", i)))
+		defer c.Close()
+
+		go func(i int) {
+			stream, err := c.CreateBiStream("10.0.0.1:1935", server.Peerid())
+			if err != nil {
+				done <- err
+				return
+			}
+
+			msg := fmt.Sprintf("hello %d", i)
+			stream.Send([]byte(msg))
+
+			data, err := stream.Recv()
+			if err == nil && string(data) != msg {
+				err = errors.New("echo msg not match!")
+			}
+			done <- err
+		}(i)
+	}
+
+	for i := 0; i < clients; i++ {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("timeout")
+		}
+	}
+}
+
+func TestTransportServices(t *testing.T) {
+
+	services := remoting.NewRegistry()
+	services.RegisterFunc("square", func(x float64) float64 { return x * x })
+	services.RegisterFunc("peer", func(call *remoting.Call) string { return call.RemoteAddr })
+	services.RegisterFunc("fail", func() error { return &remoting.Fault{Code: "App.Fail", Description: "failed"} })
+
+	server := &Transport{}
+	server.SetServices(services)
+	server.SetStreamHandler(func(*BiStream, string) bool { return true })
+	server.Open("127.0.0.1:0", []byte("server"))
+	defer server.Close()
+
+	//the replies are never served as calls.
+	served := make(chan string, 2)
+	callbacks := remoting.NewRegistry()
+	callbacks.RegisterFunc("_result", func() { served <- "_result" })
+	callbacks.RegisterFunc("_error", func() { served <- "_error" })
+
+	c := &Transport{}
+	c.SetServices(callbacks)
+	c.SetStreamHandler(func(*BiStream, string) bool { return false })
+	c.Open("127.0.0.1:0", []byte("client"))
+	defer c.Close()
+
+	nc, err := c.CreateNetConnection(server.LocalAddr(), server.Peerid())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := nc.Connect("app"); err != nil {
+		t.Fatal(err)
+	}
+
+	if result, err := nc.Call("square", 3); err != nil || result != 9.0 {
+		t.Fatal("square(3) =", result, err)
+	}
+
+	if result, err := nc.Call("peer"); err != nil || result != c.LocalAddr() {
+		t.Fatal("peer() =", result, err)
+	}
+
+	if _, err := nc.Call("fail"); err == nil {
+		t.Fatal("fail() succeed.")
+	} else if f, ok := err.(*remoting.Fault); !ok || f.Code != "App.Fail" {
+		t.Fatal("fail() =", err)
+	}
+
+	select {
+	case name := <-served:
+		t.Fatal("reply served as a call:", name)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,11 @@
+package vnet
+
+//Link carry the packets from one ip to another, it may delay, drop, reorder or corrupt them,
+//e.g. a rtmfp.ChannelLink impairing them by a ChannelProfile. src and dst are "ip:port".
+type Link interface {
+	Send(src, dst string, data []byte)
+	Close()
+}
+
+//create the link from src ip to dst ip, the packets got through it are passed to deliver.
+type LinkFunc func(src_ip, dst_ip string, deliver func(src, dst string, data []byte)) Link
@@ -0,0 +1,309 @@
+//Package vnet is an in-memory udp network for tests. Conns attached to a Switch implement
+//net.PacketConn, packets between them go through links which may delay, drop, reorder and
+//rate limit them, so many transports can run in one process without real sockets.
+//without a LinkFunc the links are perfect.
+package vnet
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+var conn_recv_buffer_size = 4096 //packets, overflowed packets are dropped as udp does.
+
+var ErrClosed = fmt.Errorf("vnet: %w", net.ErrClosed)
+
+type timeout_error struct{}
+
+func (self *timeout_error) Error() string   { return "vnet: i/o timeout" }
+func (self *timeout_error) Timeout() bool   { return true }
+func (self *timeout_error) Temporary() bool { return true }
+
+//rewrite or drop a packet before it is routed, return ok false to drop it.
+//src and dst are "ip:port".
+type RewriteFunc func(src, dst string) (new_src, new_dst string, ok bool)
+
+type Switch struct {
+	mutex sync.Mutex
+
+	conns map[string]*Conn //by local address
+
+	link_func LinkFunc
+	links     map[string]Link //by "src ip>dst ip"
+
+	rewrite RewriteFunc
+
+	last_port int
+}
+
+func NewSwitch() *Switch {
+	return &Switch{
+		conns:     make(map[string]*Conn),
+		links:     make(map[string]Link),
+		last_port: 10000,
+	}
+}
+
+//create the link of each pair of ips when the first packet goes through it, links created
+//before are closed with their queued packets. nil for perfect links.
+func (self *Switch) SetLinkFunc(fn LinkFunc) {
+
+	self.mutex.Lock()
+	links := self.links
+	self.links = make(map[string]Link)
+	self.link_func = fn
+	self.mutex.Unlock()
+
+	for _, l := range links {
+		l.Close()
+	}
+}
+
+func (self *Switch) SetRewriteFunc(fn RewriteFunc) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.rewrite = fn
+}
+
+//attach a new conn to the switch, port 0 choose a free port.
+func (self *Switch) Listen(addr string) (*Conn, error) {
+
+	udp_addr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if udp_addr.IP == nil {
+		return nil, errors.New("vnet: ip address required.")
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if udp_addr.Port == 0 {
+		for {
+			self.last_port++
+			udp_addr.Port = self.last_port
+			if _, ok := self.conns[udp_addr.String()]; !ok {
+				break
+			}
+		}
+	}
+
+	if _, ok := self.conns[udp_addr.String()]; ok {
+		return nil, errors.New("vnet: address already in use.")
+	}
+
+	c := &Conn{
+		sw:    self,
+		addr:  udp_addr,
+		queue: make(chan *packet, conn_recv_buffer_size),
+		done:  make(chan bool),
+	}
+
+	self.conns[udp_addr.String()] = c
+
+	return c, nil
+}
+
+//close all conns and stop all links.
+func (self *Switch) Close() {
+
+	self.mutex.Lock()
+	conns := self.conns
+	links := self.links
+	self.conns = make(map[string]*Conn)
+	self.links = make(map[string]Link)
+	self.mutex.Unlock()
+
+	for _, c := range conns {
+		c.Close()
+	}
+
+	for _, l := range links {
+		l.Close()
+	}
+}
+
+func (self *Switch) detach(c *Conn) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.conns[c.addr.String()] == c {
+		delete(self.conns, c.addr.String())
+	}
+}
+
+//nil for a perfect link.
+func (self *Switch) find_link(src, dst string) Link {
+
+	if self.link_func == nil {
+		return nil
+	}
+
+	src_ip, _, _ := net.SplitHostPort(src)
+	dst_ip, _, _ := net.SplitHostPort(dst)
+
+	key := src_ip + ">" + dst_ip
+
+	l, ok := self.links[key]
+	if !ok {
+		l = self.link_func(src_ip, dst_ip, self.deliver)
+		self.links[key] = l
+	}
+
+	return l
+}
+
+func (self *Switch) send(src, dst string, data []byte) {
+
+	self.mutex.Lock()
+
+	if self.rewrite != nil {
+		var ok bool
+		src, dst, ok = self.rewrite(src, dst)
+		if !ok {
+			self.mutex.Unlock()
+			return
+		}
+	}
+
+	l := self.find_link(src, dst)
+
+	self.mutex.Unlock()
+
+	if l == nil {
+		self.deliver(src, dst, data)
+		return
+	}
+
+	l.Send(src, dst, data)
+}
+
+func (self *Switch) deliver(src, dst string, data []byte) {
+
+	self.mutex.Lock()
+	c, ok := self.conns[dst]
+	self.mutex.Unlock()
+
+	if ok {
+		c.recv(&packet{src: src, data: data})
+	}
+}
+
+type packet struct {
+	src  string
+	data []byte
+}
+
+//Conn is a net.PacketConn attached to a Switch.
+type Conn struct {
+	sw   *Switch
+	addr *net.UDPAddr
+
+	queue chan *packet
+
+	mutex         sync.Mutex
+	closed        bool
+	done          chan bool
+	read_deadline time.Time
+}
+
+func (self *Conn) recv(p *packet) {
+	select {
+	case self.queue <- p:
+	default:
+		//buffer overflow
+	}
+}
+
+func (self *Conn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+
+	self.mutex.Lock()
+	deadline := self.read_deadline
+	self.mutex.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case p := <-self.queue:
+		udp_addr, err := net.ResolveUDPAddr("udp", p.src)
+		if err != nil {
+			return 0, nil, err
+		}
+		return copy(b, p.data), udp_addr, nil
+	case <-self.done:
+		return 0, nil, ErrClosed
+	case <-timeout:
+		return 0, nil, &timeout_error{}
+	}
+}
+
+func (self *Conn) WriteTo(b []byte, addr net.Addr) (n int, err error) {
+
+	self.mutex.Lock()
+	closed := self.closed
+	self.mutex.Unlock()
+
+	if closed {
+		return 0, ErrClosed
+	}
+
+	dst, err := net.ResolveUDPAddr("udp", addr.String())
+	if err != nil {
+		return 0, err
+	}
+
+	data := make([]byte, len(b))
+	copy(data, b)
+
+	self.sw.send(self.addr.String(), dst.String(), data)
+
+	return len(b), nil
+}
+
+func (self *Conn) Close() error {
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.closed {
+		return ErrClosed
+	}
+
+	self.closed = true
+	close(self.done)
+	self.sw.detach(self)
+
+	return nil
+}
+
+func (self *Conn) LocalAddr() net.Addr {
+	return self.addr
+}
+
+func (self *Conn) SetDeadline(t time.Time) error {
+	return self.SetReadDeadline(t)
+}
+
+func (self *Conn) SetReadDeadline(t time.Time) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.read_deadline = t
+	return nil
+}
+
+//writes never block.
+func (self *Conn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,194 @@
+package vnet
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func listen(t *testing.T, sw *Switch, addr string) *Conn {
+	c, err := sw.Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestConn(t *testing.T) {
+
+	sw := NewSwitch()
+	defer sw.Close()
+
+	a := listen(t, sw, "10.0.0.1:1935")
+	b := listen(t, sw, "10.0.0.2:0")
+
+	var _ net.PacketConn = a
+
+	if _, err := sw.Listen("10.0.0.1:1935"); err == nil {
+		t.Fatal("address reused.")
+	}
+
+	a.WriteTo([]byte("hello"), b.LocalAddr())
+
+	buf := make([]byte, 100)
+	n, addr, err := b.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(buf[:n]) != "hello" || addr.String() != "10.0.0.1:1935" {
+		t.Fatal("packet not match.", string(buf[:n]), addr)
+	}
+
+	b.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, _, err := b.ReadFrom(buf); err == nil || !err.(net.Error).Timeout() {
+		t.Fatal("should timeout.", err)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		b.Close()
+	}()
+
+	b.SetReadDeadline(time.Time{})
+	if _, _, err := b.ReadFrom(buf); err != ErrClosed || !errors.Is(err, net.ErrClosed) {
+		t.Fatal("should be closed.", err)
+	}
+
+	//no one listen now.
+	if _, err := a.WriteTo([]byte("hello"), b.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func recv_count(c *Conn, wait time.Duration) int {
+
+	count := 0
+	buf := make([]byte, 2048)
+
+	for {
+		c.SetReadDeadline(time.Now().Add(wait))
+		if _, _, err := c.ReadFrom(buf); err != nil {
+			return count
+		}
+		count++
+	}
+}
+
+//deliver after delay, keep the packets of the link in flight.
+type delay_link struct {
+	delay   time.Duration
+	deliver func(src, dst string, data []byte)
+
+	mutex  sync.Mutex
+	timers []*time.Timer
+}
+
+func (self *delay_link) Send(src, dst string, data []byte) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.timers = append(self.timers, time.AfterFunc(self.delay, func() {
+		self.deliver(src, dst, data)
+	}))
+}
+
+func (self *delay_link) Close() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	for _, timer := range self.timers {
+		timer.Stop()
+	}
+}
+
+func TestLinkFunc(t *testing.T) {
+
+	sw := NewSwitch()
+	defer sw.Close()
+
+	var mutex sync.Mutex
+	var created []string
+
+	//only the link from 10.0.0.1 to 10.0.0.2 is delayed.
+	sw.SetLinkFunc(func(src_ip, dst_ip string, deliver func(src, dst string, data []byte)) Link {
+		mutex.Lock()
+		created = append(created, src_ip+">"+dst_ip)
+		mutex.Unlock()
+
+		delay := time.Duration(0)
+		if src_ip == "10.0.0.1" && dst_ip == "10.0.0.2" {
+			delay = 50 * time.Millisecond
+		}
+		return &delay_link{delay: delay, deliver: deliver}
+	})
+
+	a := listen(t, sw, "10.0.0.1:1935")
+	b := listen(t, sw, "10.0.0.2:1935")
+	b2 := listen(t, sw, "10.0.0.2:1936")
+
+	start := time.Now()
+	a.WriteTo([]byte("hello"), b.LocalAddr())
+	a.WriteTo([]byte("hello"), b2.LocalAddr())
+
+	buf := make([]byte, 100)
+	if _, addr, err := b.ReadFrom(buf); err != nil || addr.String() != "10.0.0.1:1935" {
+		t.Fatal("packet not delivered.", addr, err)
+	}
+
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatal("packet not delayed.", elapsed)
+	}
+
+	if recv_count(b2, 20*time.Millisecond) != 1 {
+		t.Fatal("packet to another port lost.")
+	}
+
+	//the reverse link is another one.
+	start = time.Now()
+	b.WriteTo([]byte("hello"), a.LocalAddr())
+	a.ReadFrom(buf)
+
+	if elapsed := time.Since(start); elapsed > 40*time.Millisecond {
+		t.Fatal("reverse link delayed.", elapsed)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if len(created) != 2 || created[0] != "10.0.0.1>10.0.0.2" || created[1] != "10.0.0.2>10.0.0.1" {
+		t.Fatal("one link for each direction of a pair of ips.", created)
+	}
+}
+
+func TestRewrite(t *testing.T) {
+
+	sw := NewSwitch()
+	defer sw.Close()
+
+	a := listen(t, sw, "10.0.0.1:1935")
+	b := listen(t, sw, "10.0.0.2:1935")
+
+	//only b can send to a, and it is seen as 1.1.1.1
+	sw.SetRewriteFunc(func(src, dst string) (string, string, bool) {
+		if src == "10.0.0.2:1935" {
+			return "1.1.1.1:1935", dst, true
+		}
+		return src, dst, false
+	})
+
+	a.WriteTo([]byte("hello"), b.LocalAddr())
+	b.WriteTo([]byte("hello"), a.LocalAddr())
+
+	if recv_count(b, 20*time.Millisecond) != 0 {
+		t.Fatal("packet should be dropped.")
+	}
+
+	buf := make([]byte, 100)
+	a.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, addr, err := a.ReadFrom(buf); err != nil || addr.String() != "1.1.1.1:1935" {
+		t.Fatal("source not rewritten.", addr, err)
+	}
+}